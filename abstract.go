@@ -1,84 +1,189 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
+	"path"
 	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	cloudwatchSemaphore chan struct{}
 	tagSemaphore        chan struct{}
+	// Limits the number of regions scraped at the same time, nil means unlimited
+	regionSemaphore chan struct{}
 )
 
-func scrapeAwsData(config conf) ([]*tagsData, []*cloudwatchData) {
+// Runs fn concurrently for every region not excluded, tracked by wg and limited by regionSemaphore
+func forEachRegion(wg *sync.WaitGroup, regions []string, excludeRegions []string, fn func(region string)) {
+	for _, region := range regions {
+		if stringInSlice(region, excludeRegions) {
+			log.Debugf("Skipping excluded region %s", region)
+			continue
+		}
+		wg.Add(1)
+
+		go func(region string) {
+			defer wg.Done()
+			if regionSemaphore != nil {
+				regionSemaphore <- struct{}{}
+				defer func() {
+					<-regionSemaphore
+				}()
+			}
+			fn(region)
+		}(region)
+	}
+}
+
+// Regions which are not enabled (opt-in regions) fail with these error codes instead of returning no resources.
+// AuthFailure isn't one of them, it is also returned for invalid credentials which must fail the discovery.
+var regionUnavailableErrorCodes = map[string]string{
+	"OptInRequired":               "opt_in_required",
+	"UnrecognizedClientException": "unrecognized_client",
+}
+
+// Get the reason of the error when it was caused by a region not enabled for the account
+func regionUnavailableReason(err error) (string, bool) {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return "", false
+	}
+	reason, ok := regionUnavailableErrorCodes[awsErr.Code()]
+	return reason, ok
+}
+
+// Label the resources and metrics of a job scraping several roles with their account, taken from the ARN of the
+// resource or else from the role, e.g. for the resources identified by their IDs
+func setAccountIDs(roleArn string, resources []*tagsData, metrics []*cloudwatchData) {
+	accountID := func(id string) string {
+		if resourceArn, err := arn.Parse(id); err == nil && resourceArn.AccountID != "" {
+			return resourceArn.AccountID
+		}
+		if role, err := arn.Parse(roleArn); err == nil {
+			return role.AccountID
+		}
+		return ""
+	}
+	for _, resource := range resources {
+		resource.AccountID = accountID(*resource.ID)
+	}
+	for _, metric := range metrics {
+		metric.AccountID = accountID(*metric.ID)
+	}
+}
+
+// Run fn concurrently for every role and region of the discovery jobs
+func forEachDiscoveryRun(wg *sync.WaitGroup, jobs []job, fn func(discoveryJob job, roleArn string, region string)) {
+	for _, discoveryJob := range jobs {
+		for _, roleArn := range discoveryJob.RoleArns {
+			discoveryJob, roleArn := discoveryJob, roleArn
+			forEachRegion(wg, discoveryJob.Regions, discoveryJob.ExcludeRegions, func(region string) {
+				fn(discoveryJob, roleArn, region)
+			})
+		}
+	}
+}
+
+// Label the resources and metrics of a job run with the alias of the account of the role, and with the account itself
+// when the job scrapes several roles
+func (c *conf) setAccounts(discoveryJob job, roleArn string, resources []*tagsData, metrics []*cloudwatchData) {
+	if alias := c.accountAlias(roleArn, createIAMSession); alias != "" {
+		for _, resource := range resources {
+			resource.AccountAlias = alias
+		}
+	}
+	if len(discoveryJob.RoleArns) > 1 {
+		setAccountIDs(roleArn, resources, metrics)
+	}
+}
+
+// Returns the error of a failed discovery job run alongside the data of the other runs
+func scrapeAwsData(config conf) ([]*tagsData, []*cloudwatchData, error) {
 	mux := &sync.Mutex{}
 
 	cwData := make([]*cloudwatchData, 0)
 	awsInfoData := make([]*tagsData, 0)
 
 	var wg sync.WaitGroup
+	var jobErrors []error
 
+	// Every configured service is reported, so a job which stops discovering anything shows up as 0
+	jobsSucceeded := make(map[string]int)
 	for _, discoveryJob := range config.Discovery.Jobs {
-		for _, roleArn := range discoveryJob.RoleArns {
-			for _, region := range discoveryJob.Regions {
-				wg.Add(1)
+		jobsSucceeded[discoveryJob.Type] = 0
+	}
 
-				go func(discoveryJob job, region string, roleArn string) {
-					defer wg.Done()
-					clientCloudwatch := cloudwatchInterface{
-						client: createCloudwatchSession(&region, roleArn),
-					}
+	forEachDiscoveryRun(&wg, config.Discovery.Jobs, func(discoveryJob job, roleArn string, region string) {
+		clientCloudwatch := cloudwatchInterface{
+			client: createCloudwatchSession(&region, roleArn),
+		}
 
-					clientTag := tagsInterface{
-						client:           createTagSession(&region, roleArn),
-						apiGatewayClient: createAPIGatewaySession(&region, roleArn),
-						asgClient:        createASGSession(&region, roleArn),
-						ec2Client:        createEC2Session(&region, roleArn),
-					}
-					var resources []*tagsData
-					var metrics []*cloudwatchData
-					resources, metrics = scrapeDiscoveryJobUsingMetricData(discoveryJob, region, config.Discovery.ExportedTagsOnMetrics, clientTag, clientCloudwatch)
-					mux.Lock()
-					awsInfoData = append(awsInfoData, resources...)
-					cwData = append(cwData, metrics...)
-					mux.Unlock()
-				}(discoveryJob, region, roleArn)
-			}
+		clientTag := createTagsInterface(discoveryJob, region, roleArn)
+		resources, metrics, err := scrapeDiscoveryJobUsingMetricData(discoveryJob, region, config.Discovery.ExportedTagsOnMetrics, clientTag, clientCloudwatch)
+		config.setAccounts(discoveryJob, roleArn, resources, metrics)
+		mux.Lock()
+		if err != nil {
+			jobErrors = append(jobErrors, err)
 		}
-	}
+		awsInfoData = append(awsInfoData, resources...)
+		cwData = append(cwData, metrics...)
+		if len(resources) > 0 {
+			jobsSucceeded[discoveryJob.Type]++
+		}
+		mux.Unlock()
+	})
 
 	for _, staticJob := range config.Static {
 		for _, roleArn := range staticJob.RoleArns {
-			for _, region := range staticJob.Regions {
-				wg.Add(1)
+			staticJob, roleArn := staticJob, roleArn
+			forEachRegion(&wg, staticJob.Regions, staticJob.ExcludeRegions, func(region string) {
+				clientCloudwatch := cloudwatchInterface{
+					client: createCloudwatchSession(&region, roleArn),
+				}
 
-				go func(staticJob static, region string, roleArn string) {
-					clientCloudwatch := cloudwatchInterface{
-						client: createCloudwatchSession(&region, roleArn),
+				metrics, err := scrapeStaticJob(staticJob, region, clientCloudwatch)
+				// Static jobs have no info metrics, their metrics carry the alias instead
+				if alias := config.accountAlias(roleArn, createIAMSession); alias != "" {
+					for _, metric := range metrics {
+						metric.AccountAlias = alias
 					}
+				}
 
-					metrics := scrapeStaticJob(staticJob, region, clientCloudwatch)
-
-					mux.Lock()
-					cwData = append(cwData, metrics...)
-					mux.Unlock()
-
-					wg.Done()
-				}(staticJob, region, roleArn)
-			}
+				mux.Lock()
+				if err != nil {
+					jobErrors = append(jobErrors, err)
+				}
+				cwData = append(cwData, metrics...)
+				mux.Unlock()
+			})
 		}
 	}
 	wg.Wait()
-	return awsInfoData, cwData
+
+	jobsConfiguredGauge.Set(float64(len(config.Discovery.Jobs)))
+	jobsSucceededGauge.Reset()
+	for service, count := range jobsSucceeded {
+		jobsSucceededGauge.WithLabelValues(service).Set(float64(count))
+	}
+	publishResourceAges()
+
+	if len(jobErrors) > 0 {
+		return awsInfoData, cwData, fmt.Errorf("%d job runs failed, first: %w", len(jobErrors), jobErrors[0])
+	}
+	return awsInfoData, cwData, nil
 }
 
-func scrapeStaticJob(resource static, region string, clientCloudwatch cloudwatchInterface) (cw []*cloudwatchData) {
+// Returns the metrics which could be scraped and the first error of CloudWatch
+func scrapeStaticJob(resource static, region string, clientCloudwatch cloudwatchInterface) (cw []*cloudwatchData, err error) {
 	mux := &sync.Mutex{}
 	var wg sync.WaitGroup
 
@@ -113,17 +218,21 @@ func scrapeStaticJob(resource static, region string, clientCloudwatch cloudwatch
 				metric,
 			)
 
-			data.Points = clientCloudwatch.get(filter)
+			points, errGet := clientCloudwatch.get(filter)
+			data.Points = points
 
+			mux.Lock()
+			if errGet != nil && err == nil {
+				err = fmt.Errorf("static job %s: GetMetricStatistics: %w", resource.Name, errGet)
+			}
 			if data.Points != nil {
-				mux.Lock()
 				cw = append(cw, &data)
-				mux.Unlock()
 			}
+			mux.Unlock()
 		}()
 	}
 	wg.Wait()
-	return cw
+	return cw, err
 }
 
 func getMetricDataInputLength(job job) int {
@@ -178,6 +287,12 @@ func getMetricDataForQueries(
 		for _, resource := range resources {
 			// Creates the dimensions with values for the resource depending on the namespace of the job (p.e. InstanceId=XXXXXXX)
 			dimensionsWithValue := detectDimensionsByService(resource, fullMetricsList)
+			dimensionsWithValue = applyDimensionOverrides(*resource.ID, dimensionsWithValue, discoveryJob.DimensionOverrides)
+			if len(dimensionsWithValue) == 0 {
+				// Nothing identifies the resource, it would match the account wide metrics
+				resourcesDroppedCounter.WithLabelValues(discoveryJob.Type, "no_dimensions").Inc()
+				continue
+			}
 
 			// Adds the dimensions with values of that specific metric of the job
 			dimensionsWithValue = addAdditionalDimensions(dimensionsWithValue, metric.AdditionalDimensions)
@@ -205,7 +320,7 @@ func getMetricDataForQueries(
 							Tags:                   metricTags,
 							CustomTags:             discoveryJob.CustomTags,
 							Dimensions:             fetchedMetrics.Dimensions,
-							Region:                 &region,
+							Region:                 resource.Region,
 							Period:                 getMetricPeriod(discoveryJob, metric),
 						})
 					}
@@ -216,24 +331,45 @@ func getMetricDataForQueries(
 	return getMetricDatas
 }
 
+// Discover the resources of a job in a region, shared by the scrapes and the dumps. A region which isn't enabled for the
+// account is skipped without error.
+func discoverJobResources(job job, region string, clientTag tagsInterface) ([]*tagsData, error) {
+	tagSemaphore <- struct{}{}
+	resources, err := clientTag.get(job, region)
+	<-tagSemaphore
+	if reason, ok := regionUnavailableReason(err); ok {
+		log.Warningf("Skipping region %s, it is not enabled for the account: %v", region, err)
+		regionSkippedCounter.WithLabelValues(region, reason).Inc()
+		return nil, nil
+	}
+	if job.RegionTag != "" {
+		for _, resource := range resources {
+			resource.inferRegion(job.RegionTag)
+		}
+	}
+	return resources, err
+}
+
 func scrapeDiscoveryJobUsingMetricData(
 	job job,
 	region string,
 	tagsOnMetrics exportedTagsOnMetrics,
 	clientTag tagsInterface,
-	clientCloudwatch cloudwatchInterface) (resources []*tagsData, cw []*cloudwatchData) {
+	clientCloudwatch cloudwatchInterface) (resources []*tagsData, cw []*cloudwatchData, err error) {
 
 	namespace, err := getNamespace(job.Type)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 	// Add the info tags of all the resources
-	tagSemaphore <- struct{}{}
-	resources, err = clientTag.get(job, region)
-	<-tagSemaphore
+	resources, err = discoverJobResources(job, region, clientTag)
 	if err != nil {
-		log.Printf("Couldn't describe resources for region %s: %s\n", region, err.Error())
-		return
+		var partial *partialResultsError
+		if !errors.As(err, &partial) {
+			log.Printf("Couldn't describe resources: %s\n", err.Error())
+			return resources, cw, err
+		}
+		log.Warningf("Using partial resources: %v", err)
 	}
 
 	getMetricDatas := getMetricDataForQueries(job, region, tagsOnMetrics, clientCloudwatch, resources)
@@ -253,7 +389,14 @@ func scrapeDiscoveryJobUsingMetricData(
 				end = metricDataLength
 			}
 			filter := createGetMetricDataInput(getMetricDatas[i:end], &namespace, length, job.Delay)
-			data := clientCloudwatch.getMetricData(filter)
+			data, errGet := clientCloudwatch.getMetricData(filter)
+			if errGet != nil {
+				mux.Lock()
+				if err == nil {
+					err = fmt.Errorf("GetMetricData: %w", errGet)
+				}
+				mux.Unlock()
+			}
 			if data != nil {
 				for _, MetricDataResult := range data.MetricDataResults {
 					getMetricData, err := findGetMetricDataById(getMetricDatas[i:end], *MetricDataResult.Id)
@@ -271,24 +414,110 @@ func scrapeDiscoveryJobUsingMetricData(
 		}(i)
 	}
 	wg.Wait()
-	return resources, cw
+	return resources, cw, err
 }
 
 func (r tagsData) filterThroughTags(filterTags []tag) bool {
-	tagMatches := 0
+	return r.filterThroughTagsWithMode(filterTags, searchTagsModeRegex)
+}
 
+// Filter with the values of the search tags as regular expressions (default) or glob patterns. Every search tag has
+// to match a tag of the resource, so a resource without tags only passes a job without search tags.
+func (r tagsData) filterThroughTagsWithMode(filterTags []tag, mode string) bool {
+	for _, filterTag := range filterTags {
+		if !r.hasMatchingTag(filterTag, mode) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a tag of the resource has the key of the search tag and a value matching it, several tags with the same
+// key (e.g. returned by a describe API) count once
+func (r tagsData) hasMatchingTag(filterTag tag, mode string) bool {
 	for _, resourceTag := range r.Tags {
-		for _, filterTag := range filterTags {
-			if resourceTag.Key == filterTag.Key {
-				r, _ := regexp.Compile(filterTag.Value)
-				if r.MatchString(resourceTag.Value) {
-					tagMatches++
-				}
+		if resourceTag == nil || resourceTag.Key != filterTag.Key {
+			continue
+		}
+		if mode == searchTagsModeGlob {
+			// A malformed pattern is rejected when the configuration is loaded
+			if matched, _ := path.Match(filterTag.Value, resourceTag.Value); matched {
+				return true
 			}
+			continue
+		}
+		if filterTag.regex.MatchString(resourceTag.Value) {
+			return true
 		}
 	}
+	return false
+}
 
-	return tagMatches == len(filterTags)
+// How a tag of the resource matched the search tag for the debug counter: exact when its value is the literal value
+// of the search tag, otherwise through the regular expression or glob pattern of the mode
+func (r tagsData) matchSearchTag(filterTag tag, mode string) string {
+	match := searchTagMatchNone
+	for _, resourceTag := range r.Tags {
+		if resourceTag == nil || resourceTag.Key != filterTag.Key {
+			continue
+		}
+		if resourceTag.Value == filterTag.Value {
+			return searchTagMatchExact
+		}
+		if mode == searchTagsModeGlob {
+			// A malformed pattern is rejected when the configuration is loaded
+			if matched, _ := path.Match(filterTag.Value, resourceTag.Value); matched {
+				match = searchTagsModeGlob
+			}
+			continue
+		}
+		if filterTag.regex.MatchString(resourceTag.Value) {
+			match = searchTagsModeRegex
+		}
+	}
+	return match
+}
+
+// Count how every search tag of the job matched the resource, the rule is the search tag as key=value
+func (r tagsData) recordMatchRules(job job) {
+	for _, filterTag := range job.SearchTags {
+		matchRuleCounter.WithLabelValues(job.Type, filterTag.Key+"="+filterTag.Value, r.matchSearchTag(filterTag, job.SearchTagsMode)).Inc()
+	}
+}
+
+// Filter the resource through the ARN filter and the search tags of the job, counting the resources scanned and matched per service
+func (r tagsData) filterThroughJobTags(job job) bool {
+	resourcesScannedCounter.WithLabelValues(job.Type).Inc()
+	if !r.filterThroughArn(job.arnFilterRegex, job.ArnFilterMode) {
+		return false
+	}
+	if *debugMatchRules {
+		r.recordMatchRules(job)
+	}
+	if !r.filterThroughTagsWithMode(job.SearchTags, job.SearchTagsMode) {
+		return false
+	}
+	resourcesMatchedCounter.WithLabelValues(job.Type).Inc()
+	return true
+}
+
+// Include (default) or exclude the resource when its ARN matches the filter, an empty filter keeps every resource
+func (r tagsData) filterThroughArn(filter *regexp.Regexp, mode string) bool {
+	if filter == nil {
+		return true
+	}
+	return filter.MatchString(*r.ID) != (mode == arnFilterModeExclude)
+}
+
+// Override the region of the resource with the value of the given tag, when present
+func (r *tagsData) inferRegion(regionTag string) {
+	for _, resourceTag := range r.Tags {
+		if resourceTag.Key == regionTag && resourceTag.Value != "" {
+			region := resourceTag.Value
+			r.Region = &region
+			return
+		}
+	}
 }
 
 func (r tagsData) metricTags(tagsOnMetrics exportedTagsOnMetrics) []tag {
@@ -1,7 +1,17 @@
 package main
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestFilterThroughTags(t *testing.T) {
@@ -20,3 +30,469 @@ func TestFilterThroughTags(t *testing.T) {
 		t.Fatalf("\nexpected: %t\nactual:  %t", expected, actual)
 	}
 }
+
+func TestFilterThroughTagsEmptyTags(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		tags       []*tag
+		searchTags []tag
+		expected   bool
+	}{
+		{"nil tags, nil search tags", nil, nil, true},
+		{"nil tags, empty search tags", nil, []tag{}, true},
+		{"empty tags, nil search tags", []*tag{}, nil, true},
+		{"tags, no search tags", []*tag{{Key: "env", Value: "prod"}}, nil, true},
+		{"nil tags, search tags", nil, []tag{{Key: "env", Value: "prod"}}, false},
+		{"empty tags, search tags", []*tag{}, []tag{{Key: "env", Value: "prod"}}, false},
+		// A search tag matching any value still requires the tag
+		{"nil tags, match anything search tag", nil, []tag{{Key: "env", Value: ".*"}}, false},
+		{"nil tag, search tags", []*tag{nil}, []tag{{Key: "env", Value: "prod"}}, false},
+		{"matching tag", []*tag{{Key: "env", Value: "prod"}}, []tag{{Key: "env", Value: "prod"}}, true},
+		{"empty tag value, match anything search tag", []*tag{{Key: "env", Value: ""}}, []tag{{Key: "env", Value: ".*"}}, true},
+		{"duplicated tag", []*tag{{Key: "env", Value: "prod"}, {Key: "env", Value: "prod"}}, []tag{{Key: "env", Value: "prod"}}, true},
+		{"one of two search tags", []*tag{{Key: "env", Value: "prod"}}, []tag{{Key: "env", Value: "prod"}, {Key: "team", Value: "payments"}}, false},
+	} {
+		for _, mode := range []string{searchTagsModeRegex, searchTagsModeGlob} {
+			// Arrange
+			resource := tagsData{Tags: tc.tags}
+			searchTags := tc.searchTags
+			if mode == searchTagsModeRegex {
+				compileTagRegexes(searchTags)
+			}
+			if mode == searchTagsModeGlob {
+				searchTags = nil
+				for _, searchTag := range tc.searchTags {
+					if searchTag.Value == ".*" {
+						searchTag.Value = "*"
+					}
+					searchTags = append(searchTags, searchTag)
+				}
+			}
+
+			// Act
+			actual := resource.filterThroughTagsWithMode(searchTags, mode)
+
+			// Assert
+			if actual != tc.expected {
+				t.Errorf("%s (%s)\nexpected: %t\nactual:  %t", tc.name, mode, tc.expected, actual)
+			}
+		}
+	}
+}
+
+func TestFilterThroughJobTagsCountsResources(t *testing.T) {
+	// Setup Test
+	j := job{Type: "test-filter", SearchTags: []tag{{Key: "env", Value: "^prod$"}}}
+	j.compileRegexes()
+	resources := []tagsData{
+		{Tags: []*tag{{Key: "env", Value: "prod"}}},
+		{Tags: []*tag{{Key: "env", Value: "dev"}}},
+		{},
+	}
+
+	// Act
+	for _, resource := range resources {
+		resource.filterThroughJobTags(j)
+	}
+
+	// Assert
+	if scanned := testutil.ToFloat64(resourcesScannedCounter.WithLabelValues(j.Type)); scanned != 3 {
+		t.Fatalf("\nexpected: 3 scanned\nactual:  %f", scanned)
+	}
+	if matched := testutil.ToFloat64(resourcesMatchedCounter.WithLabelValues(j.Type)); matched != 1 {
+		t.Fatalf("\nexpected: 1 matched\nactual:  %f", matched)
+	}
+}
+
+func TestFilterThroughJobTagsRecordsMatchRules(t *testing.T) {
+	// Setup Test
+	*debugMatchRules = true
+	defer func() { *debugMatchRules = false }()
+	j := job{Type: "test-match-rules", SearchTags: []tag{{Key: "env", Value: "prod"}, {Key: "team", Value: "pay.*"}}}
+	j.compileRegexes()
+	resources := []tagsData{
+		{Tags: []*tag{{Key: "env", Value: "prod"}, {Key: "team", Value: "payments"}}},
+		{Tags: []*tag{{Key: "env", Value: "production"}, {Key: "team", Value: "pay.*"}}},
+		{Tags: []*tag{{Key: "env", Value: "dev"}}},
+	}
+
+	// Act
+	for _, resource := range resources {
+		resource.filterThroughJobTags(j)
+	}
+	// Only counted with the debug flag
+	*debugMatchRules = false
+	resources[0].filterThroughJobTags(j)
+
+	// Assert
+	for _, tc := range []struct {
+		rule     string
+		match    string
+		expected float64
+	}{
+		{"env=prod", "exact", 1},
+		{"env=prod", "regex", 1},
+		{"env=prod", "none", 1},
+		{"team=pay.*", "exact", 1},
+		{"team=pay.*", "regex", 1},
+		{"team=pay.*", "none", 1},
+	} {
+		if actual := testutil.ToFloat64(matchRuleCounter.WithLabelValues(j.Type, tc.rule, tc.match)); actual != tc.expected {
+			t.Errorf("%s %s\nexpected: %f\nactual:  %f", tc.rule, tc.match, tc.expected, actual)
+		}
+	}
+}
+
+func TestForEachRegionLimitsConcurrency(t *testing.T) {
+	// Setup Test
+	regionSemaphore = make(chan struct{}, 2)
+	defer func() {
+		regionSemaphore = nil
+	}()
+	regions := []string{"eu-west-1", "eu-west-2", "eu-west-3", "eu-central-1", "us-east-1", "us-west-2"}
+
+	// Arrange
+	var mux sync.Mutex
+	var running, maxRunning, scraped int
+	var wg sync.WaitGroup
+
+	// Act
+	forEachRegion(&wg, regions, nil, func(region string) {
+		mux.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mux.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mux.Lock()
+		running--
+		scraped++
+		mux.Unlock()
+	})
+	wg.Wait()
+
+	// Assert
+	if scraped != len(regions) {
+		t.Fatalf("\nexpected: %d regions scraped\nactual:  %d", len(regions), scraped)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("\nexpected: at most 2 concurrent regions\nactual:  %d", maxRunning)
+	}
+}
+
+func TestForEachRegionSkipsExcludedRegions(t *testing.T) {
+	// Arrange
+	regions := []string{"eu-west-1", "eu-south-1", "us-east-1", "af-south-1"}
+	excludeRegions := []string{"eu-south-1", "af-south-1"}
+
+	var mux sync.Mutex
+	var scraped []string
+	var wg sync.WaitGroup
+
+	// Act
+	forEachRegion(&wg, regions, excludeRegions, func(region string) {
+		mux.Lock()
+		scraped = append(scraped, region)
+		mux.Unlock()
+	})
+	wg.Wait()
+
+	// Assert
+	if len(scraped) != 2 || !stringInSlice("eu-west-1", scraped) || !stringInSlice("us-east-1", scraped) {
+		t.Fatalf("\nexpected: [eu-west-1 us-east-1]\nactual:  %v", scraped)
+	}
+}
+
+func TestInferRegion(t *testing.T) {
+	for _, tc := range []struct {
+		tags     []*tag
+		expected string
+	}{
+		{[]*tag{{Key: "region", Value: "global"}}, "global"},
+		{[]*tag{{Key: "Name", Value: "web"}}, "eu-west-1"},
+		{[]*tag{{Key: "region", Value: ""}}, "eu-west-1"},
+		{nil, "eu-west-1"},
+	} {
+		// Arrange
+		region := "eu-west-1"
+		resource := tagsData{Tags: tc.tags, Region: &region}
+
+		// Act
+		resource.inferRegion("region")
+
+		// Assert
+		if *resource.Region != tc.expected {
+			t.Fatalf("tags %v\nexpected: %s\nactual:  %s", tc.tags, tc.expected, *resource.Region)
+		}
+	}
+}
+
+func TestFilterThroughTagsGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		value    string
+		expected bool
+	}{
+		{"payments-*", "payments-api", true},
+		{"payments-*", "payments-", true},
+		{"payments-*", "billing-payments-api", false},
+		{"payments-?", "payments-a", true},
+		{"payments-?", "payments-ab", false},
+		{"payments-[ab]", "payments-b", true},
+		{"team/*", "team/payments", true},
+		{"*", "team/payments", false},
+		{`payments-\*`, "payments-*", true},
+		{`payments-\*`, "payments-api", false},
+		{"payments.api", "paymentsXapi", false},
+	} {
+		// Arrange
+		resource := tagsData{Tags: []*tag{{Key: "team", Value: tc.value}}}
+
+		// Act
+		actual := resource.filterThroughTagsWithMode([]tag{{Key: "team", Value: tc.pattern}}, searchTagsModeGlob)
+
+		// Assert
+		if actual != tc.expected {
+			t.Errorf("pattern %q value %q\nexpected: %t\nactual:  %t", tc.pattern, tc.value, tc.expected, actual)
+		}
+	}
+}
+
+func TestScrapeDiscoveryJobReturnsDiscoveryError(t *testing.T) {
+	// Arrange
+	tagSemaphore = make(chan struct{}, 1)
+	discoveryErr := errors.New("AccessDenied")
+	clientTag := tagsInterface{client: &mockTaggingClient{
+		pages:      []*resourcegroupstaggingapi.GetResourcesOutput{{}},
+		failOnPage: 1,
+		err:        discoveryErr,
+	}}
+
+	// Act
+	resources, cw, err := scrapeDiscoveryJobUsingMetricData(job{Type: "sqs"}, "eu-west-1", nil, clientTag, cloudwatchInterface{})
+
+	// Assert
+	if !errors.Is(err, discoveryErr) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", discoveryErr, err)
+	}
+	if len(resources) != 0 || len(cw) != 0 {
+		t.Errorf("\nexpected: no data\nactual:  %d resources, %d metrics", len(resources), len(cw))
+	}
+}
+
+type mockCloudwatchClient struct {
+	cloudwatchiface.CloudWatchAPI
+	metrics []*cloudwatch.Metric
+	err     error
+}
+
+func (m mockCloudwatchClient) ListMetricsPages(input *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool) error {
+	fn(&cloudwatch.ListMetricsOutput{Metrics: m.metrics}, true)
+	return nil
+}
+
+func (m mockCloudwatchClient) GetMetricStatistics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return nil, m.err
+}
+
+func (m mockCloudwatchClient) GetMetricDataPages(input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool) error {
+	return m.err
+}
+
+func TestScrapeDiscoveryJobReturnsCloudwatchError(t *testing.T) {
+	// Arrange
+	tagSemaphore = make(chan struct{}, 1)
+	cloudwatchErr := errors.New("Throttling")
+	clientTag := tagsInterface{client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:queue")},
+		},
+	}}}}
+	j := job{Type: "sqs", Metrics: []metric{{Name: "NumberOfMessagesSent", Statistics: []string{"Sum"}, Period: 300, Length: 300}}}
+	clientCloudwatch := cloudwatchInterface{client: mockCloudwatchClient{
+		metrics: []*cloudwatch.Metric{{
+			MetricName: aws.String("NumberOfMessagesSent"),
+			Dimensions: []*cloudwatch.Dimension{{Name: aws.String("QueueName"), Value: aws.String("queue")}},
+		}},
+		err: cloudwatchErr,
+	}}
+
+	// Act
+	resources, _, err := scrapeDiscoveryJobUsingMetricData(j, "eu-west-1", nil, clientTag, clientCloudwatch)
+
+	// Assert
+	// The resources are still exported, but the scrape fails in strict mode
+	if !errors.Is(err, cloudwatchErr) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", cloudwatchErr, err)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("\nexpected: 1 resource\nactual:  %d", len(resources))
+	}
+}
+
+func TestScrapeStaticJobReturnsCloudwatchError(t *testing.T) {
+	// Arrange
+	cloudwatchSemaphore = make(chan struct{}, 1)
+	cloudwatchErr := errors.New("AccessDenied")
+	staticJob := static{Name: "importer", Namespace: "AWS/EC2", Metrics: []metric{{Name: "CPUUtilization", Statistics: []string{"Average"}, Period: 300, Length: 300}}}
+
+	// Act
+	cw, err := scrapeStaticJob(staticJob, "eu-west-1", cloudwatchInterface{client: mockCloudwatchClient{err: cloudwatchErr}})
+
+	// Assert
+	if !errors.Is(err, cloudwatchErr) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", cloudwatchErr, err)
+	}
+	if len(cw) != 0 {
+		t.Fatalf("\nexpected: no metrics\nactual:  %d", len(cw))
+	}
+}
+
+func TestScrapeDiscoveryJobSkipsOptInRegion(t *testing.T) {
+	// Arrange
+	tagSemaphore = make(chan struct{}, 1)
+	clientTag := tagsInterface{client: &mockTaggingClient{
+		pages:      []*resourcegroupstaggingapi.GetResourcesOutput{{}},
+		failOnPage: 1,
+		err:        awserr.New("OptInRequired", "You are not subscribed to this service.", nil),
+	}}
+
+	// Act
+	resources, cw, err := scrapeDiscoveryJobUsingMetricData(job{Type: "sqs"}, "ap-east-1", nil, clientTag, cloudwatchInterface{})
+
+	// Assert
+	if err != nil || len(resources) != 0 || len(cw) != 0 {
+		t.Fatalf("\nexpected: the region to be skipped without error\nactual:  %v, %d resources, %d metrics", err, len(resources), len(cw))
+	}
+	if skipped := testutil.ToFloat64(regionSkippedCounter.WithLabelValues("ap-east-1", "opt_in_required")); skipped != 1 {
+		t.Fatalf("\nexpected: 1 skipped\nactual:  %f", skipped)
+	}
+}
+
+func TestDiscoverJobResourcesInfersRegion(t *testing.T) {
+	// Arrange
+	tagSemaphore = make(chan struct{}, 1)
+	clientTag := tagsInterface{client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{
+			ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:jobs"),
+			Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("region"), Value: aws.String("global")}},
+		}},
+	}}}}
+
+	// Act
+	// The dumps discover the resources like the scrapes
+	resources, err := discoverJobResources(job{Type: "sqs", RegionTag: "region"}, "eu-west-1", clientTag)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].Region != "global" {
+		t.Fatalf("\nexpected: the region of the tag\nactual:  %v", resources)
+	}
+}
+
+func TestScrapeDiscoveryJobWithoutMetrics(t *testing.T) {
+	// Arrange
+	tagSemaphore = make(chan struct{}, 1)
+	clientTag := tagsInterface{client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:subnet/subnet-0123")},
+		},
+	}}}}
+
+	// Act
+	// CloudWatch isn't requested for the info metric only
+	resources, cw, err := scrapeDiscoveryJobUsingMetricData(job{Type: "subnet"}, "eu-west-1", nil, clientTag, cloudwatchInterface{})
+
+	// Assert
+	if err != nil || len(resources) != 1 || len(cw) != 0 {
+		t.Fatalf("\nexpected: 1 subnet without metrics\nactual:  %v, %d resources, %d metrics", err, len(resources), len(cw))
+	}
+}
+
+func TestRegionUnavailableReason(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		reason string
+		ok     bool
+	}{
+		{awserr.New("OptInRequired", "", nil), "opt_in_required", true},
+		{&DiscoveryError{Service: "sqs", Region: "me-south-1", Err: awserr.New("UnrecognizedClientException", "", nil)}, "unrecognized_client", true},
+		{&DiscoveryError{Service: "ec2", Region: "me-south-1", Err: awserr.New("AuthFailure", "", nil)}, "", false},
+		{awserr.New("AccessDenied", "", nil), "", false},
+		{errors.New("OptInRequired"), "", false},
+		{nil, "", false},
+	} {
+		if reason, ok := regionUnavailableReason(tc.err); reason != tc.reason || ok != tc.ok {
+			t.Errorf("%v\nexpected: %q %t\nactual:  %q %t", tc.err, tc.reason, tc.ok, reason, ok)
+		}
+	}
+}
+
+func TestSetAccountIDsOfSeveralRoles(t *testing.T) {
+	// Setup Test
+	config = conf{NameLabel: nameLabel{ResourceID: true}}
+	defer func() { config = conf{} }()
+	accounts := map[string]tagsInterface{}
+	for _, account := range []string{"111111111111", "222222222222"} {
+		accounts["arn:aws:iam::"+account+":role/prometheus"] = tagsInterface{client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:" + account + ":orders")},
+			},
+		}}}}
+	}
+
+	// Act
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	var resources []*tagsData
+	for roleArn, iface := range accounts {
+		wg.Add(1)
+		go func(roleArn string, iface tagsInterface) {
+			defer wg.Done()
+			discovered, err := iface.get(job{Type: "sqs"}, "eu-west-1")
+			if err != nil {
+				t.Error(err)
+			}
+			setAccountIDs(roleArn, discovered, nil)
+			mux.Lock()
+			resources = append(resources, discovered...)
+			mux.Unlock()
+		}(roleArn, iface)
+	}
+	wg.Wait()
+	collector := NewPrometheusCollector(migrateTagsToPrometheus(resources))
+
+	// Assert
+	if len(collector.metrics) != 2 {
+		t.Fatalf("\nexpected: an orders queue per account\nactual:  %d", len(collector.metrics))
+	}
+	accountIDs := map[string]bool{}
+	for _, metric := range collector.metrics {
+		if metric.labels["name"] != "orders" {
+			t.Fatalf("\nexpected: orders\nactual:  %s", metric.labels["name"])
+		}
+		accountIDs[metric.labels["account_id"]] = true
+	}
+	if !accountIDs["111111111111"] || !accountIDs["222222222222"] {
+		t.Fatalf("\nexpected: both accounts\nactual:  %v", accountIDs)
+	}
+}
+
+func TestSetAccountIDsFallsBackToRole(t *testing.T) {
+	// Arrange
+	resources := []*tagsData{{ID: aws.String("tgw-0123/tgw-attach-4567")}}
+	metrics := []*cloudwatchData{{ID: aws.String("tgw-0123/tgw-attach-4567")}}
+
+	// Act
+	setAccountIDs("arn:aws:iam::333333333333:role/prometheus", resources, metrics)
+
+	// Assert
+	if resources[0].AccountID != "333333333333" || metrics[0].AccountID != "333333333333" {
+		t.Fatalf("\nexpected: 333333333333\nactual:  %s and %s", resources[0].AccountID, metrics[0].AccountID)
+	}
+}
@@ -11,7 +11,6 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
@@ -21,6 +20,9 @@ import (
 
 var percentile = regexp.MustCompile(`^p(\d{1,2}(\.\d{0,2})?|100)$`)
 
+// Secrets Manager appends a hyphen and six random characters to the secret name in its ARN
+var secretSuffix = regexp.MustCompile(`-[a-zA-Z0-9]{6}$`)
+
 type cloudwatchInterface struct {
 	client cloudwatchiface.CloudWatchAPI
 }
@@ -41,14 +43,17 @@ type cloudwatchData struct {
 	Dimensions              []*cloudwatch.Dimension
 	Region                  *string
 	Period                  int64
+	AccountID               string
+	AccountAlias            string
 }
 
 var labelMap = make(map[string][]string)
 
 func createCloudwatchSession(region *string, roleArn string) *cloudwatch.CloudWatch {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+	options := sessionOptions()
+	options.SharedConfigState = session.SharedConfigEnable
+	sess := session.Must(session.NewSessionWithOptions(options))
+	addUserAgent(sess)
 
 	maxCloudwatchRetries := 5
 
@@ -59,7 +64,7 @@ func createCloudwatchSession(region *string, roleArn string) *cloudwatch.CloudWa
 	}
 
 	if roleArn != "" {
-		config.Credentials = stscreds.NewCredentials(sess, roleArn)
+		config.Credentials = newRoleCredentials(sess, roleArn)
 	}
 
 	return cloudwatch.New(sess, config)
@@ -175,7 +180,7 @@ func dimensionsToCliString(dimensions []*cloudwatch.Dimension) (output string) {
 	return output
 }
 
-func (iface cloudwatchInterface) get(filter *cloudwatch.GetMetricStatisticsInput) []*cloudwatch.Datapoint {
+func (iface cloudwatchInterface) get(filter *cloudwatch.GetMetricStatisticsInput) ([]*cloudwatch.Datapoint, error) {
 	c := iface.client
 
 	log.Debug(filter)
@@ -189,13 +194,13 @@ func (iface cloudwatchInterface) get(filter *cloudwatch.GetMetricStatisticsInput
 
 	if err != nil {
 		log.Warningf("Unable to get metric statistics due to %v", err)
-		return nil
+		return nil, err
 	}
 
-	return resp.Datapoints
+	return resp.Datapoints, nil
 }
 
-func (iface cloudwatchInterface) getMetricData(filter *cloudwatch.GetMetricDataInput) *cloudwatch.GetMetricDataOutput {
+func (iface cloudwatchInterface) getMetricData(filter *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
 	c := iface.client
 
 	var resp cloudwatch.GetMetricDataOutput
@@ -219,9 +224,9 @@ func (iface cloudwatchInterface) getMetricData(filter *cloudwatch.GetMetricDataI
 
 	if err != nil {
 		log.Warningf("Unable to get metric data due to %v", err)
-		return nil
+		return nil, err
 	}
-	return &resp
+	return &resp, nil
 }
 
 // https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/aws-services-cloudwatch-metrics.html
@@ -232,36 +237,67 @@ func getNamespace(service string) (string, error) {
 	namespaces := map[string]string{
 		"alb":                   "AWS/ApplicationELB",
 		"apigateway":            "AWS/ApiGateway",
+		"apprunner":             "AWS/AppRunner",
 		"appsync":               "AWS/AppSync",
 		"asg":                   "AWS/AutoScaling",
+		"athena":                "AWS/Athena",
+		"bedrock":               "AWS/Bedrock",
 		"cf":                    "AWS/CloudFront",
+		"comprehend":            "AWS/Comprehend",
+		"dax":                   "AWS/DAX",
+		"drs":                   "AWS/DRS",
 		"dynamodb":              "AWS/DynamoDB",
 		"ebs":                   "AWS/EBS",
 		"ec":                    "AWS/ElastiCache",
 		"ec2":                   "AWS/EC2",
+		"ecr":                   "AWS/ECR",
 		"ecs-svc":               "AWS/ECS",
 		"ecs-containerinsights": "ECS/ContainerInsights",
 		"efs":                   "AWS/EFS",
+		"efs-ap":                "AWS/EFS",
 		"elb":                   "AWS/ELB",
 		"emr":                   "AWS/ElasticMapReduce",
 		"es":                    "AWS/ES",
 		"firehose":              "AWS/Firehose",
 		"fsx":                   "AWS/FSx",
+		"fsx-lustre":            "AWS/FSx",
+		"fsx-ontap":             "AWS/FSx",
+		"fsx-openzfs":           "AWS/FSx",
+		"fsx-windows":           "AWS/FSx",
+		"grafana":               "AWS/Grafana",
+		"guardduty":             "AWS/GuardDuty",
+		"gwlb":                  "AWS/GatewayELB",
+		"iot":                   "AWS/IoT",
 		"kafka":                 "AWS/Kafka",
 		"kinesis":               "AWS/Kinesis",
 		"lambda":                "AWS/Lambda",
+		"memorydb":              "AWS/MemoryDB",
 		"ngw":                   "AWS/NATGateway",
 		"nlb":                   "AWS/NetworkELB",
+		"osis":                  "AWS/OSIS",
 		"rds":                   "AWS/RDS",
+		"rds-proxy":             "AWS/RDS",
 		"redshift":              "AWS/Redshift",
 		"r53r":                  "AWS/Route53Resolver",
+		"r53r-endpoint":         "AWS/Route53Resolver",
+		"r53r-rule":             "AWS/Route53Resolver",
 		"s3":                    "AWS/S3",
+		"secretsmanager":        "AWS/SecretsManager",
 		"sfn":                   "AWS/States",
+		"sfn-activity":          "AWS/States",
+		"sfn-statemachine":      "AWS/States",
+		"shield":                "AWS/DDoSProtection",
 		"sns":                   "AWS/SNS",
+		"spot-fleet":            "AWS/EC2Spot",
 		"sqs":                   "AWS/SQS",
+		"synthetics":            "CloudWatchSynthetics",
+		"subnet":                "AWS/EC2",
 		"tgw":                   "AWS/TransitGateway",
 		"tgwa":                  "AWS/TransitGateway",
+		"tgw-rt":                "AWS/TransitGateway",
+		"vpce-service":          "AWS/PrivateLinkServices",
 		"vpn":                   "AWS/VPN",
+		"waf":                   "AWS/WAF",
 	}
 	if ns, ok = namespaces[service]; !ok {
 		return "", errors.New("Not implemented namespace for cloudwatch metric: " + service)
@@ -395,7 +431,8 @@ func detectDimensionsByService(resource *tagsData, fullMetricsList *cloudwatch.L
 	service := *resource.Service
 	arnParsed, err := arn.Parse(resourceArn)
 
-	if err != nil && service != "tgwa" {
+	// Services discovered through their describe API can be identified by IDs instead of ARNs
+	if err != nil && !stringInSlice(service, []string{"spot-fleet", "tgwa", "tgw-rt"}) {
 		log.Warningf("Unable to parse ARN (%s) on %s due to %v", resourceArn, service, err)
 		return dimensions
 	}
@@ -405,29 +442,32 @@ func detectDimensionsByService(resource *tagsData, fullMetricsList *cloudwatch.L
 		Prefix string
 	}
 	baseDimension := map[string]baseParams{
-		"appsync":  {Key: "GraphQLAPIId", Prefix: "apis/"},
-		"asg":      {Key: "AutoScalingGroupName", Prefix: "autoScalingGroupName/"},
+		"athena":   {Key: "WorkGroup", Prefix: "workgroup/"},
+		"dax":      {Key: "ClusterId", Prefix: "cache/"},
+		"drs":      {Key: "SourceServerID", Prefix: "source-server/"},
 		"dynamodb": {Key: "TableName", Prefix: "table/"},
 		"ebs":      {Key: "VolumeId", Prefix: "volume/"},
-		"ec":       {Key: "CacheClusterId", Prefix: "cluster:"},
 		"ec2":      {Key: "InstanceId", Prefix: "instance/"},
+		"ecr":      {Key: "RepositoryName", Prefix: "repository/"},
 		"efs":      {Key: "FileSystemId", Prefix: "file-system/"},
 		"elb":      {Key: "LoadBalancerName", Prefix: "loadbalancer/"},
 		"emr":      {Key: "JobFlowId", Prefix: "cluster/"},
 		"firehose": {Key: "DeliveryStreamName", Prefix: "deliverystream/"},
 		"fsx":      {Key: "FileSystemId", Prefix: "file-system/"},
+		"grafana":  {Key: "WorkspaceId", Prefix: "/workspaces/"},
+		"gwlb":     {Key: "LoadBalancer", Prefix: "loadbalancer/"},
 		"kinesis":  {Key: "StreamName", Prefix: "stream/"},
-		"lambda":   {Key: "FunctionName", Prefix: "function:"},
+		"memorydb": {Key: "ClusterName", Prefix: "cluster/"},
 		"ngw":      {Key: "NatGatewayId", Prefix: "natgateway/"},
 		"nlb":      {Key: "LoadBalancer", Prefix: "loadbalancer/"},
+		"osis":     {Key: "PipelineName", Prefix: "pipeline/"},
 		"rds":      {Key: "DBInstanceIdentifier", Prefix: "db:"},
 		"redshift": {Key: "ClusterIdentifier", Prefix: "cluster:"},
-		"r53r":     {Key: "EndpointId", Prefix: "resolver-endpoint/"},
 		"s3":       {Key: "BucketName", Prefix: ""},
 		"sns":      {Key: "TopicName", Prefix: ""},
 		"sqs":      {Key: "QueueName", Prefix: ""},
+		"subnet":   {Key: "SubnetId", Prefix: "subnet/"},
 		"tgw":      {Key: "TransitGateway", Prefix: "transit-gateway/"},
-		"vpn":      {Key: "VpnId", Prefix: "vpn-connection/"},
 	}
 	if params, ok := baseDimension[service]; ok {
 		return buildBaseDimension(arnParsed.Resource, params.Key, params.Prefix)
@@ -436,6 +476,10 @@ func detectDimensionsByService(resource *tagsData, fullMetricsList *cloudwatch.L
 	case "alb":
 		namespace, _ := getNamespace(service)
 		dimensions = queryAvailableDimensions(arnParsed.Resource, &namespace, fullMetricsList)
+	case "asg":
+		// Both the original ARN (autoScalingGroup:uuid:autoScalingGroupName/name) and the transformed one end with the name
+		groupName := arnParsed.Resource[strings.LastIndex(arnParsed.Resource, ":")+1:]
+		dimensions = buildBaseDimension(groupName, "AutoScalingGroupName", "autoScalingGroupName/")
 	case "apigateway":
 		// https://docs.aws.amazon.com/apigateway/latest/developerguide/arn-format-reference.html
 		dimensions = buildBaseDimension(*resource.Matcher, "ApiName", "")
@@ -464,6 +508,86 @@ func detectDimensionsByService(resource *tagsData, fullMetricsList *cloudwatch.L
 				}
 			}
 		}
+	case "appsync":
+		// apis/api-id or apis/api-id/types/type-name/resolvers/field-name
+		parsedResource := strings.Split(arnParsed.Resource, "/")
+		if len(parsedResource) < 2 {
+			break
+		}
+		dimensions = append(dimensions, buildDimension("GraphQLAPIId", parsedResource[1]))
+		if resource.Matcher != nil {
+			// Resolver discovered through its GraphQL API
+			dimensions = append(dimensions, buildDimension("Resolver", *resource.Matcher))
+		}
+	case "apprunner":
+		// service/service-name/service-id
+		parsedResource := strings.Split(arnParsed.Resource, "/")
+		if len(parsedResource) == 3 {
+			dimensions = append(dimensions, buildDimension("ServiceName", parsedResource[1]), buildDimension("ServiceID", parsedResource[2]))
+		}
+	case "bedrock":
+		// The invocations of custom and provisioned models are reported with their ARN as ModelId
+		dimensions = append(dimensions, buildDimension("ModelId", resourceArn))
+	case "comprehend":
+		dimensions = append(dimensions, buildDimension("EndpointArn", resourceArn))
+	case "lambda":
+		// function:function-name or function:function-name:alias
+		functionName := strings.Split(strings.TrimPrefix(arnParsed.Resource, "function:"), ":")[0]
+		dimensions = append(dimensions, buildDimension("FunctionName", functionName))
+		if resource.Matcher != nil {
+			// Alias discovered through its function
+			dimensions = append(dimensions, buildDimension("Resource", *resource.Matcher))
+		}
+	case "shield":
+		// The protected resource, e.g. a CloudFront distribution or a load balancer
+		dimensions = append(dimensions, buildDimension("ResourceArn", resourceArn))
+	case "synthetics":
+		dimensions = buildBaseDimension(arnParsed.Resource, "CanaryName", "canary:")
+	case "guardduty":
+		dimensions = buildBaseDimension(arnParsed.Resource, "DetectorId", "detector/")
+	case "waf":
+		// The web ACL is reported under its metric name, the rule ALL covers every rule of the web ACL
+		if resource.Matcher == nil {
+			break
+		}
+		dimensions = append(dimensions, buildDimension("WebACL", *resource.Matcher), buildDimension("Rule", "ALL"))
+		if arnParsed.Service == "waf-regional" {
+			dimensions = append(dimensions, buildDimension("Region", arnParsed.Region))
+		}
+	case "r53r", "r53r-endpoint", "r53r-rule":
+		// r53r discovers the endpoints and the rules together
+		if strings.HasPrefix(arnParsed.Resource, "resolver-rule/") {
+			dimensions = buildBaseDimension(arnParsed.Resource, "RuleId", "resolver-rule/")
+		} else {
+			dimensions = buildBaseDimension(arnParsed.Resource, "EndpointId", "resolver-endpoint/")
+		}
+	case "vpce-service":
+		// The dimension name of AWS/PrivateLinkServices contains a space
+		dimensions = buildBaseDimension(arnParsed.Resource, "Service Id", "vpc-endpoint-service/")
+	case "vpn":
+		if resource.Matcher != nil {
+			// Tunnel discovered through its VPN connection
+			dimensions = append(dimensions, buildDimension("TunnelIpAddress", *resource.Matcher))
+		} else {
+			dimensions = buildBaseDimension(arnParsed.Resource, "VpnId", "vpn-connection/")
+		}
+	case "secretsmanager":
+		// secret:secret-name-AbCdEf
+		name := strings.TrimPrefix(arnParsed.Resource, "secret:")
+		dimensions = append(dimensions, buildDimension("SecretName", secretSuffix.ReplaceAllString(name, "")))
+	case "ec":
+		// cluster:cluster-id or cluster:cluster-id/node-id
+		clusterID := strings.Split(strings.TrimPrefix(arnParsed.Resource, "cluster:"), "/")[0]
+		dimensions = append(dimensions, buildDimension("CacheClusterId", clusterID))
+		if resource.Matcher != nil {
+			// Node discovered through its cache cluster
+			dimensions = append(dimensions, buildDimension("CacheNodeId", *resource.Matcher))
+		}
+	case "efs-ap":
+		// The access point was matched to its file system during discovery
+		if resource.Matcher != nil {
+			dimensions = append(dimensions, buildDimension("FileSystemId", *resource.Matcher))
+		}
 	case "cf":
 		dimensions = buildBaseDimension(arnParsed.Resource, "DistributionId", "distribution/")
 		dimensions = append(dimensions, buildDimension("Region", "Global"))
@@ -478,15 +602,32 @@ func detectDimensionsByService(resource *tagsData, fullMetricsList *cloudwatch.L
 	case "es":
 		dimensions = buildBaseDimension(arnParsed.Resource, "DomainName", "domain/")
 		dimensions = append(dimensions, buildDimension("ClientId", arnParsed.AccountID))
-	case "sfn":
-		// The value of StateMachineArn returned is the Name, not the ARN
+	case "sfn", "sfn-activity", "sfn-statemachine":
+		// The value of StateMachineArn/ActivityArn returned is the Name, not the ARN
 		// We are setting the value to the ARN in order to correlate dimensions with metric values
-		// (StateMachineArn will be set back to the name later, once all the filtering is complete)
+		// (StateMachineArn/ActivityArn will be set back to the name later, once all the filtering is complete)
 		// https://docs.aws.amazon.com/step-functions/latest/dg/procedure-cw-metrics.html
-		dimensions = append(dimensions, buildDimension("StateMachineArn", resourceArn))
+		dimensions = append(dimensions, buildDimension(getStepFunctionsDimensionName(arnParsed), resourceArn))
 	case "tgwa":
 		parsedResource := strings.Split(resourceArn, "/")
 		dimensions = append(dimensions, buildDimension("TransitGateway", parsedResource[0]), buildDimension("TransitGatewayAttachment", parsedResource[1]))
+	case "spot-fleet":
+		dimensions = append(dimensions, buildDimension("FleetRequestId", resourceArn))
+	case "tgw-rt":
+		parsedResource := strings.Split(resourceArn, "/")
+		dimensions = append(dimensions, buildDimension("TransitGateway", parsedResource[0]), buildDimension("TransitGatewayRouteTable", parsedResource[1]))
+	case "fsx-lustre", "fsx-ontap", "fsx-openzfs", "fsx-windows":
+		dimensions = buildBaseDimension(arnParsed.Resource, "FileSystemId", "file-system/")
+	case "rds-proxy":
+		// The proxy was matched to its name during discovery
+		if resource.Matcher != nil {
+			dimensions = buildBaseDimension(*resource.Matcher, "ProxyName", "")
+		}
+	case "iot":
+		// AWS/IoT has no per thing metrics, things are only exported through the info metric
+		if strings.HasPrefix(arnParsed.Resource, "rule/") {
+			dimensions = buildBaseDimension(arnParsed.Resource, "RuleName", "rule/")
+		}
 	case "kafka":
 		cluster := strings.Split(arnParsed.Resource, "/")[1]
 		dimensions = append(dimensions, buildDimension("Cluster Name", cluster))
@@ -506,6 +647,35 @@ func addAdditionalDimensions(startingDimensions []*cloudwatch.Dimension, additio
 	return dimensions
 }
 
+// Replace (or add) the dimensions whose value is extracted from the resource ID by the overrides of the job.
+// The template defaults to the first capture group, resources not matching the regex keep their default dimensions.
+func applyDimensionOverrides(resourceID string, startingDimensions []*cloudwatch.Dimension, overrides []dimensionOverride) (dimensions []*cloudwatch.Dimension) {
+	dimensions = append(dimensions, startingDimensions...)
+	for _, override := range overrides {
+		match := override.regex.FindStringSubmatchIndex(resourceID)
+		if match == nil {
+			continue
+		}
+		template := override.Template
+		if template == "" {
+			template = "$1"
+		}
+		value := string(override.regex.ExpandString(nil, template, resourceID, match))
+
+		replaced := false
+		for i, dimension := range dimensions {
+			if *dimension.Name == override.Name {
+				dimensions[i] = buildDimension(override.Name, value)
+				replaced = true
+			}
+		}
+		if !replaced {
+			dimensions = append(dimensions, buildDimension(override.Name, value))
+		}
+	}
+	return dimensions
+}
+
 func buildBaseDimension(identifier string, dimensionKey string, prefix string) (dimensions []*cloudwatch.Dimension) {
 	helper := strings.TrimPrefix(identifier, prefix)
 	dimensions = append(dimensions, buildDimension(dimensionKey, helper))
@@ -557,6 +727,14 @@ func fixServiceName(serviceName *string, dimensions []*cloudwatch.Dimension) str
 	return promString(*serviceName) + suffixName
 }
 
+// Activities and state machines share the AWS/States namespace but use different dimensions
+func getStepFunctionsDimensionName(arnParsed arn.ARN) string {
+	if strings.HasPrefix(arnParsed.Resource, "activity:") {
+		return "ActivityArn"
+	}
+	return "StateMachineArn"
+}
+
 func getStateMachineNameFromArn(resourceArn string) string {
 	arnParsed, err := arn.Parse(resourceArn)
 	if err != nil {
@@ -569,13 +747,21 @@ func getStateMachineNameFromArn(resourceArn string) string {
 
 func createPrometheusLabels(cwd *cloudwatchData) map[string]string {
 	labels := make(map[string]string)
-	labels["name"] = *cwd.ID
+	config.NameLabel.apply(labels, *cwd.ID)
 	labels["region"] = *cwd.Region
+	if cwd.AccountID != "" {
+		labels["account_id"] = cwd.AccountID
+	}
+	if cwd.AccountAlias != "" {
+		labels["account_alias"] = cwd.AccountAlias
+	}
 
 	// Inject the sfn name back as a label
 	switch *cwd.Service {
-	case "sfn":
-		labels["dimension_"+promStringTag("StateMachineArn")] = getStateMachineNameFromArn(*cwd.ID)
+	case "sfn", "sfn-activity", "sfn-statemachine":
+		if arnParsed, err := arn.Parse(*cwd.ID); err == nil {
+			labels["dimension_"+promStringTag(getStepFunctionsDimensionName(arnParsed))] = getStateMachineNameFromArn(*cwd.ID)
+		}
 	}
 
 	for _, dimension := range cwd.Dimensions {
@@ -588,15 +774,15 @@ func createPrometheusLabels(cwd *cloudwatchData) map[string]string {
 	for _, tag := range cwd.Tags {
 		labels["tag_"+promStringTag(tag.Key)] = tag.Value
 	}
+	addStaticLabels(labels, config.StaticLabels)
 
 	return labels
 }
 
+// Record the label names of the metric, the union of the labels of all its series is kept, e.g. the target groups
+// and the load balancers of the same info metric
 func recordLabelsForMetric(metricName string, promLabels map[string]string) {
-	var workingLabelsCopy []string
-	if _, ok := labelMap[metricName]; ok {
-		copy(labelMap[metricName], workingLabelsCopy)
-	}
+	workingLabelsCopy := append([]string(nil), labelMap[metricName]...)
 
 	for k, _ := range promLabels {
 		workingLabelsCopy = append(workingLabelsCopy, k)
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestDimensionsToCliString(t *testing.T) {
@@ -41,3 +43,444 @@ func TestGetNamespace(t *testing.T) {
 		t.Fatalf("jobType foobar should have returned empty string")
 	}
 }
+
+func TestDetectDimensionsByServiceOpenSearchIngestion(t *testing.T) {
+	// Arrange
+	id := "arn:aws:osis:eu-west-1:123456789012:pipeline/logs"
+	service := "osis"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "PipelineName" || *dimensions[0].Value != "logs" {
+		t.Fatalf("\nexpected: PipelineName=logs\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceStepFunctions(t *testing.T) {
+	stateMachine := "arn:aws:states:eu-west-1:123456789012:stateMachine:orders"
+	activity := "arn:aws:states:eu-west-1:123456789012:activity:approve"
+	for _, tc := range []struct {
+		service   string
+		id        string
+		dimension string
+	}{
+		{"sfn", stateMachine, "StateMachineArn"},
+		{"sfn", activity, "ActivityArn"},
+		{"sfn-statemachine", stateMachine, "StateMachineArn"},
+		{"sfn-activity", activity, "ActivityArn"},
+	} {
+		// Arrange
+		id := tc.id
+		service := tc.service
+		resource := tagsData{ID: &id, Service: &service}
+
+		// Act
+		dimensions := detectDimensionsByService(&resource, nil)
+
+		// Assert
+		if len(dimensions) != 1 || *dimensions[0].Name != tc.dimension || *dimensions[0].Value != tc.id {
+			t.Fatalf("%s %s\nexpected: %s=%s\nactual:  %v", tc.service, tc.id, tc.dimension, tc.id, dimensions)
+		}
+	}
+}
+
+func TestDetectDimensionsByServiceMemoryDB(t *testing.T) {
+	// Arrange
+	id := "arn:aws:memorydb:eu-west-1:123456789012:cluster/sessions"
+	service := "memorydb"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "ClusterName" || *dimensions[0].Value != "sessions" {
+		t.Fatalf("\nexpected: ClusterName=sessions\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceAppRunner(t *testing.T) {
+	// Arrange
+	id := "arn:aws:apprunner:eu-west-1:123456789012:service/python-app/8fe1e10304f84fd2b0df550fe98a71fa"
+	service := "apprunner"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 2 ||
+		*dimensions[0].Name != "ServiceName" || *dimensions[0].Value != "python-app" ||
+		*dimensions[1].Name != "ServiceID" || *dimensions[1].Value != "8fe1e10304f84fd2b0df550fe98a71fa" {
+		t.Fatalf("\nexpected: ServiceName=python-app ServiceID=8fe1e10304f84fd2b0df550fe98a71fa\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceCloudFront(t *testing.T) {
+	// Arrange
+	id := "arn:aws:cloudfront::123456789012:distribution/E2QWRUHAPOMQZL"
+	service := "cf"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 2 ||
+		*dimensions[0].Name != "DistributionId" || *dimensions[0].Value != "E2QWRUHAPOMQZL" ||
+		*dimensions[1].Name != "Region" || *dimensions[1].Value != "Global" {
+		t.Fatalf("\nexpected: DistributionId=E2QWRUHAPOMQZL Region=Global\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceSecretsManager(t *testing.T) {
+	for _, tc := range []struct {
+		id       string
+		expected string
+	}{
+		{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:db-password-AbC123", "db-password"},
+		{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:prod/api/token-x9Y8z7", "prod/api/token"},
+	} {
+		// Arrange
+		id := tc.id
+		service := "secretsmanager"
+		resource := tagsData{ID: &id, Service: &service}
+
+		// Act
+		dimensions := detectDimensionsByService(&resource, nil)
+
+		// Assert
+		if len(dimensions) != 1 || *dimensions[0].Name != "SecretName" || *dimensions[0].Value != tc.expected {
+			t.Fatalf("\nexpected: SecretName=%s\nactual:  %v", tc.expected, dimensions)
+		}
+	}
+}
+
+func TestGatewayLoadBalancerIsDistinct(t *testing.T) {
+	// Arrange
+	id := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/gwy/inspection/0123456789abcdef"
+	service := "gwlb"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "LoadBalancer" || *dimensions[0].Value != "gwy/inspection/0123456789abcdef" {
+		t.Fatalf("\nexpected: LoadBalancer=gwy/inspection/0123456789abcdef\nactual:  %v", dimensions)
+	}
+	namespace, _ := getNamespace("gwlb")
+	for _, other := range []string{"alb", "elb", "nlb"} {
+		if ns, _ := getNamespace(other); ns == namespace {
+			t.Fatalf("gwlb shares the namespace %s with %s", namespace, other)
+		}
+		for _, filter := range allResourceTypesFilters[other] {
+			if stringInSlice(filter, allResourceTypesFilters["gwlb"]) {
+				t.Fatalf("gwlb filter %s is also used by %s", filter, other)
+			}
+		}
+	}
+}
+
+func TestApplyDimensionOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		id        string
+		service   string
+		overrides []dimensionOverride
+		expected  map[string]string
+	}{
+		{
+			name:      "asg group name from rebuilt arn",
+			id:        "arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroupName/my-group",
+			service:   "asg",
+			overrides: []dimensionOverride{{Name: "AutoScalingGroupName", Regex: `autoScalingGroupName/(?P<group>[^/]+)$`, Template: "${group}"}},
+			expected:  map[string]string{"AutoScalingGroupName": "my-group"},
+		},
+		{
+			name:      "tgwa attachment from id",
+			id:        "tgw-0123/tgw-attach-4567",
+			service:   "tgwa",
+			overrides: []dimensionOverride{{Name: "TransitGatewayAttachment", Regex: `/(tgw-attach-\w+)$`}},
+			expected:  map[string]string{"TransitGateway": "tgw-0123", "TransitGatewayAttachment": "tgw-attach-4567"},
+		},
+		{
+			name:      "added dimension",
+			id:        "arn:aws:dynamodb:eu-west-1:123456789012:table/orders",
+			service:   "dynamodb",
+			overrides: []dimensionOverride{{Name: "Operation", Regex: `table/`, Template: "GetItem"}},
+			expected:  map[string]string{"TableName": "orders", "Operation": "GetItem"},
+		},
+		{
+			name:      "no match keeps default",
+			id:        "arn:aws:dynamodb:eu-west-1:123456789012:table/orders",
+			service:   "dynamodb",
+			overrides: []dimensionOverride{{Name: "TableName", Regex: `^nomatch/(.+)$`}},
+			expected:  map[string]string{"TableName": "orders"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Arrange
+			resource := tagsData{ID: &tc.id, Service: &tc.service}
+			j := job{DimensionOverrides: tc.overrides}
+			j.compileRegexes()
+
+			// Act
+			dimensions := applyDimensionOverrides(tc.id, detectDimensionsByService(&resource, nil), j.DimensionOverrides)
+
+			// Assert
+			actual := map[string]string{}
+			for _, dimension := range dimensions {
+				actual[*dimension.Name] = *dimension.Value
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("\nexpected: %v\nactual:  %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDetectDimensionsByServiceDAX(t *testing.T) {
+	// Arrange
+	id := "arn:aws:dax:eu-west-1:123456789012:cache/sessions"
+	service := "dax"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "ClusterId" || *dimensions[0].Value != "sessions" {
+		t.Fatalf("\nexpected: ClusterId=sessions\nactual:  %v", dimensions)
+	}
+}
+
+func TestCreatePrometheusLabelsStaticLabels(t *testing.T) {
+	defer func(staticLabels map[string]string) {
+		config.StaticLabels = staticLabels
+	}(config.StaticLabels)
+	config.StaticLabels = map[string]string{"environment": "prod", "region": "static"}
+
+	// Arrange
+	id := "arn:aws:dynamodb:eu-west-1:123456789012:table/orders"
+	service := "dynamodb"
+	region := "eu-west-1"
+	cwd := cloudwatchData{ID: &id, Service: &service, Region: &region, Dimensions: []*cloudwatch.Dimension{buildDimension("TableName", "orders")}}
+	expected := map[string]string{"environment": "prod", "name": id, "region": region, "dimension_TableName": "orders"}
+
+	// Act
+	labels := createPrometheusLabels(&cwd)
+
+	// Assert
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, labels)
+	}
+}
+
+func TestDetectDimensionsByServiceECR(t *testing.T) {
+	for id, expected := range map[string]string{
+		"arn:aws:ecr:eu-west-1:123456789012:repository/api":          "api",
+		"arn:aws:ecr:eu-west-1:123456789012:repository/payments/api": "payments/api",
+	} {
+		// Arrange
+		id := id
+		service := "ecr"
+		resource := tagsData{ID: &id, Service: &service}
+
+		// Act
+		dimensions := detectDimensionsByService(&resource, nil)
+
+		// Assert
+		if len(dimensions) != 1 || *dimensions[0].Name != "RepositoryName" || *dimensions[0].Value != expected {
+			t.Fatalf("\nexpected: RepositoryName=%s\nactual:  %v", expected, dimensions)
+		}
+	}
+}
+
+func TestDetectDimensionsByServiceBedrock(t *testing.T) {
+	// Arrange
+	id := "arn:aws:bedrock:us-east-1:123456789012:provisioned-model/a1b2c3d4e5f6"
+	service := "bedrock"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "ModelId" || *dimensions[0].Value != id {
+		t.Fatalf("\nexpected: ModelId=%s\nactual:  %v", id, dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceDRS(t *testing.T) {
+	// Arrange
+	id := "arn:aws:drs:eu-west-1:123456789012:source-server/s-0123456789abcdef0"
+	service := "drs"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "SourceServerID" || *dimensions[0].Value != "s-0123456789abcdef0" {
+		t.Fatalf("\nexpected: SourceServerID=s-0123456789abcdef0\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceVpcEndpointService(t *testing.T) {
+	// Arrange
+	id := "arn:aws:ec2:eu-west-1:123456789012:vpc-endpoint-service/vpce-svc-0123456789abcdef0"
+	service := "vpce-service"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+	namespace, err := getNamespace(service)
+
+	// Assert
+	if err != nil || namespace != "AWS/PrivateLinkServices" {
+		t.Fatalf("\nexpected: AWS/PrivateLinkServices\nactual:  %s %v", namespace, err)
+	}
+	if len(dimensions) != 1 || *dimensions[0].Name != "Service Id" || *dimensions[0].Value != "vpce-svc-0123456789abcdef0" {
+		t.Fatalf("\nexpected: Service Id=vpce-svc-0123456789abcdef0\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceSubnet(t *testing.T) {
+	// Arrange
+	id := "arn:aws:ec2:eu-west-1:123456789012:subnet/subnet-0123456789abcdef0"
+	service := "subnet"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "SubnetId" || *dimensions[0].Value != "subnet-0123456789abcdef0" {
+		t.Fatalf("\nexpected: SubnetId=subnet-0123456789abcdef0\nactual:  %v", dimensions)
+	}
+	if resourceTypes := allResourceTypesFilters[service]; len(resourceTypes) != 1 || resourceTypes[0] != "ec2:subnet" {
+		t.Fatalf("\nexpected: ec2:subnet\nactual:  %v", resourceTypes)
+	}
+}
+
+func TestDetectDimensionsByServiceGrafana(t *testing.T) {
+	// Arrange
+	id := "arn:aws:grafana:eu-west-1:123456789012:/workspaces/g-0123456789"
+	service := "grafana"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "WorkspaceId" || *dimensions[0].Value != "g-0123456789" {
+		t.Fatalf("\nexpected: WorkspaceId=g-0123456789\nactual:  %v", dimensions)
+	}
+}
+
+func TestDetectDimensionsByServiceRoute53Resolver(t *testing.T) {
+	endpoint := "arn:aws:route53resolver:eu-west-1:123456789012:resolver-endpoint/rslvr-in-0123456789abcdef0"
+	rule := "arn:aws:route53resolver:eu-west-1:123456789012:resolver-rule/rslvr-rr-0123456789abcdef0"
+	for _, tc := range []struct {
+		service       string
+		id            string
+		expectedName  string
+		expectedValue string
+	}{
+		{"r53r-endpoint", endpoint, "EndpointId", "rslvr-in-0123456789abcdef0"},
+		{"r53r-rule", rule, "RuleId", "rslvr-rr-0123456789abcdef0"},
+		{"r53r", endpoint, "EndpointId", "rslvr-in-0123456789abcdef0"},
+		{"r53r", rule, "RuleId", "rslvr-rr-0123456789abcdef0"},
+	} {
+		// Arrange
+		resource := tagsData{ID: &tc.id, Service: &tc.service}
+
+		// Act
+		dimensions := detectDimensionsByService(&resource, nil)
+
+		// Assert
+		if len(dimensions) != 1 || *dimensions[0].Name != tc.expectedName || *dimensions[0].Value != tc.expectedValue {
+			t.Fatalf("%s\nexpected: %s=%s\nactual:  %v", tc.service, tc.expectedName, tc.expectedValue, dimensions)
+		}
+	}
+}
+
+func TestDetectDimensionsByServiceAthena(t *testing.T) {
+	// Arrange
+	id := "arn:aws:athena:eu-west-1:123456789012:workgroup/analytics"
+	service := "athena"
+	resource := tagsData{ID: &id, Service: &service}
+
+	// Act
+	dimensions := detectDimensionsByService(&resource, nil)
+
+	// Assert
+	if len(dimensions) != 1 || *dimensions[0].Name != "WorkGroup" || *dimensions[0].Value != "analytics" {
+		t.Fatalf("\nexpected: WorkGroup=analytics\nactual:  %v", dimensions)
+	}
+}
+
+func TestPrometheusMetricsKeepLabelsOfEveryResource(t *testing.T) {
+	for _, tc := range []struct {
+		service string
+		labeled string
+		labels  map[string]string
+		other   string
+	}{
+		// A load balancer after the target group
+		{"alb", "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/api/0123456789abcdef", map[string]string{"load_balancer": "app/api"}, "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/api/0123456789abcdef"},
+		// A function without aliases after the alias
+		{"lambda", "arn:aws:lambda:eu-west-1:123456789012:function:checkout:live", map[string]string{"alias": "live"}, "arn:aws:lambda:eu-west-1:123456789012:function:search"},
+		// A cluster after its node
+		{"ec", "arn:aws:elasticache:eu-west-1:123456789012:cluster:sessions-001/0001", map[string]string{"node_id": "0001"}, "arn:aws:elasticache:eu-west-1:123456789012:cluster:sessions-001"},
+		// A detached volume after the attached one
+		{"ebs", "arn:aws:ec2:eu-west-1:123456789012:volume/vol-attached", map[string]string{"instance_id": "i-0123456789abcdef0"}, "arn:aws:ec2:eu-west-1:123456789012:volume/vol-detached"},
+		// A gateway whose placement is unknown after the placed one
+		{"ngw", "arn:aws:ec2:eu-west-1:123456789012:natgateway/nat-placed", map[string]string{"subnet_id": "subnet-a", "availability_zone": "eu-west-1a"}, "arn:aws:ec2:eu-west-1:123456789012:natgateway/nat-unknown"},
+		// An instance whose engine version is unknown after the known one
+		{"rds", "arn:aws:rds:eu-west-1:123456789012:db:orders", map[string]string{"engine": "postgres", "engine_version": "15.4"}, "arn:aws:rds:eu-west-1:123456789012:db:unknown"},
+		// A distribution which could not be read after the read one
+		{"cf", "arn:aws:cloudfront::123456789012:distribution/EDFDVBD6EXAMPLE", map[string]string{"domain_name": "d111111abcdef8.cloudfront.net", "aliases": "www.example.com"}, "arn:aws:cloudfront::123456789012:distribution/EUNREADABLE"},
+		// An instance of another job without details after the detailed one
+		{"ec2", "arn:aws:ec2:eu-west-1:123456789012:instance/i-detailed", map[string]string{"instance_type": "t3.micro", "platform": "linux"}, "arn:aws:ec2:eu-west-1:123456789012:instance/i-plain"},
+	} {
+		// Arrange
+		service := tc.service
+		labeled, other := tc.labeled, tc.other
+		tagsData := []*tagsData{
+			{ID: &labeled, Service: &service, Labels: tc.labels},
+			{ID: &other, Service: &service},
+		}
+
+		// Act
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewPrometheusCollector(prometheusMetrics(tagsData, nil)))
+		families, err := registry.Gather()
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != 1 || len(families[0].Metric) != 2 {
+			t.Fatalf("%s\nexpected: 2 info metrics\nactual:  %v", tc.service, families)
+		}
+		for _, metric := range families[0].Metric {
+			labels := make(map[string]string)
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			for name, value := range tc.labels {
+				if labels["name"] != labeled {
+					value = ""
+				}
+				if actual, ok := labels[name]; !ok || actual != value {
+					t.Fatalf("%s %s\nexpected: %s=%q\nactual:  %v", tc.service, labels["name"], name, value, labels)
+				}
+			}
+		}
+	}
+}
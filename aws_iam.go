@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	log "github.com/sirupsen/logrus"
+)
+
+func createIAMSession(roleArn string) iamiface.IAMAPI {
+	// IAM is a global service served out of us-east-1
+	config := &aws.Config{Region: aws.String("us-east-1")}
+	return iam.New(createSession(roleArn, config), config)
+}
+
+// The alias of an account rarely changes, it is resolved once per role until the exporter restarts
+var accountAliasCache = struct {
+	sync.Mutex
+	aliases map[string]string
+}{aliases: make(map[string]string)}
+
+// Get the alias of the account of the role, the configured one or else the one resolved through IAM when enabled
+func (c *conf) accountAlias(roleArn string, newClient func(roleArn string) iamiface.IAMAPI) string {
+	if alias, ok := c.AccountAliases[roleArn]; ok {
+		return alias
+	}
+	if !c.ResolveAccountAliases {
+		return ""
+	}
+
+	accountAliasCache.Lock()
+	alias, ok := accountAliasCache.aliases[roleArn]
+	accountAliasCache.Unlock()
+	if ok {
+		return alias
+	}
+	// Resolved without holding the cache, so the jobs of the other roles don't wait for IAM. Concurrent jobs of a new
+	// role may both resolve its alias.
+	iamAPICounter.Inc()
+	output, err := newClient(roleArn).ListAccountAliasesWithContext(discoveryCtx, &iam.ListAccountAliasesInput{})
+	if err != nil {
+		// Not cached, the next scrape tries again
+		log.Warningf("Couldn't resolve the account alias of role %q: %v", roleArn, err)
+		return ""
+	}
+	// An account has at most one alias, an account without alias is cached as such
+	if len(output.AccountAliases) > 0 {
+		alias = *output.AccountAliases[0]
+	}
+	accountAliasCache.Lock()
+	accountAliasCache.aliases[roleArn] = alias
+	accountAliasCache.Unlock()
+	return alias
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+)
+
+type mockIAMClient struct {
+	iamiface.IAMAPI
+	aliases []*string
+	err     error
+	calls   int
+	// Called during the request, e.g. to resolve the alias of another role meanwhile
+	during func()
+}
+
+func (m *mockIAMClient) ListAccountAliasesWithContext(ctx aws.Context, input *iam.ListAccountAliasesInput, opts ...request.Option) (*iam.ListAccountAliasesOutput, error) {
+	m.calls++
+	if m.during != nil {
+		m.during()
+	}
+	return &iam.ListAccountAliasesOutput{AccountAliases: m.aliases}, m.err
+}
+
+func TestAccountAliasConfigured(t *testing.T) {
+	// Setup Test
+	client := &mockIAMClient{aliases: []*string{aws.String("resolved")}}
+	c := conf{
+		AccountAliases:        map[string]string{"arn:aws:iam::111111111111:role/prometheus": "prod"},
+		ResolveAccountAliases: true,
+	}
+
+	// Act
+	alias := c.accountAlias("arn:aws:iam::111111111111:role/prometheus", func(string) iamiface.IAMAPI { return client })
+
+	// Assert
+	if alias != "prod" {
+		t.Fatalf("\nexpected: prod\nactual:  %s", alias)
+	}
+	if client.calls != 0 {
+		t.Fatalf("expected a configured alias not to be resolved, got %d calls", client.calls)
+	}
+	id, service := "arn:aws:ec2:eu-west-1:111111111111:instance/i-0123", "ec2"
+	labels := migrateTagsToPrometheus([]*tagsData{{ID: &id, Service: &service, AccountAlias: alias}})[0].labels
+	if labels["account_alias"] != "prod" {
+		t.Fatalf("\nexpected: account_alias=prod\nactual:  %v", labels)
+	}
+}
+
+func TestAccountAliasResolved(t *testing.T) {
+	// Setup Test
+	roleArn := "arn:aws:iam::222222222222:role/prometheus"
+	defer delete(accountAliasCache.aliases, roleArn)
+	client := &mockIAMClient{aliases: []*string{aws.String("staging")}}
+	c := conf{ResolveAccountAliases: true}
+	newClient := func(string) iamiface.IAMAPI { return client }
+
+	// Act
+	first := c.accountAlias(roleArn, newClient)
+	second := c.accountAlias(roleArn, newClient)
+
+	// Assert
+	if first != "staging" || second != "staging" {
+		t.Fatalf("\nexpected: staging\nactual:  %s and %s", first, second)
+	}
+	if client.calls != 1 {
+		t.Fatalf("expected the alias to be resolved once per role, got %d calls", client.calls)
+	}
+}
+
+func TestAccountAliasNotCachedOnError(t *testing.T) {
+	// Setup Test
+	roleArn := "arn:aws:iam::333333333333:role/prometheus"
+	defer delete(accountAliasCache.aliases, roleArn)
+	client := &mockIAMClient{err: errors.New("AccessDenied")}
+	c := conf{ResolveAccountAliases: true}
+	newClient := func(string) iamiface.IAMAPI { return client }
+
+	// Act
+	c.accountAlias(roleArn, newClient)
+	alias := c.accountAlias(roleArn, newClient)
+
+	// Assert
+	if alias != "" || client.calls != 2 {
+		t.Fatalf("\nexpected: no alias and a retry\nactual:  %q after %d calls", alias, client.calls)
+	}
+}
+
+func TestAccountAliasResolvedConcurrently(t *testing.T) {
+	// Setup Test
+	roleArn := "arn:aws:iam::444444444444:role/prometheus"
+	otherRoleArn := "arn:aws:iam::555555555555:role/prometheus"
+	defer delete(accountAliasCache.aliases, roleArn)
+	defer delete(accountAliasCache.aliases, otherRoleArn)
+	c := conf{ResolveAccountAliases: true}
+	other := &mockIAMClient{aliases: []*string{aws.String("dev")}}
+	var otherAlias string
+	client := &mockIAMClient{aliases: []*string{aws.String("qa")}, during: func() {
+		otherAlias = c.accountAlias(otherRoleArn, func(string) iamiface.IAMAPI { return other })
+	}}
+
+	// Act
+	alias := c.accountAlias(roleArn, func(string) iamiface.IAMAPI { return client })
+
+	// Assert
+	if alias != "qa" || otherAlias != "dev" {
+		t.Fatalf("\nexpected: qa and dev\nactual:  %s and %s", alias, otherAlias)
+	}
+}
+
+func TestAccountAliasLabelsStaticMetrics(t *testing.T) {
+	// Setup Test
+	id, service, region := "mq", "AmazonMQ", "eu-west-1"
+	data := cloudwatchData{ID: &id, Service: &service, Region: &region, AccountAlias: "prod"}
+
+	// Act
+	labels := createPrometheusLabels(&data)
+
+	// Assert
+	if labels["account_alias"] != "prod" {
+		t.Fatalf("\nexpected: account_alias=prod\nactual:  %v", labels)
+	}
+}
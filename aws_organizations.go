@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	log "github.com/sirupsen/logrus"
+)
+
+func createOrganizationsSession(roleArn string) organizationsiface.OrganizationsAPI {
+	maxOrganizationsAPIRetries := 5
+	// Organizations is a global service served out of us-east-1
+	config := &aws.Config{Region: aws.String("us-east-1"), MaxRetries: &maxOrganizationsAPIRetries}
+	return organizations.New(createSession(roleArn, config), config)
+}
+
+// The accounts and child units of an organizational unit
+type organizationalUnit struct {
+	accountIDs []string
+	childIDs   []string
+}
+
+// Get the IDs of the accounts in the organizational unit and in all the units nested in it. The units already listed
+// for the other excluded units are taken from units.
+func getOrganizationalUnitAccounts(client organizationsiface.OrganizationsAPI, units map[string]organizationalUnit, unitID string) ([]string, error) {
+	unit, ok := units[unitID]
+	if !ok {
+		ctx := context.Background()
+		err := client.ListAccountsForParentPagesWithContext(ctx, &organizations.ListAccountsForParentInput{ParentId: aws.String(unitID)}, func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+			organizationsAPICounter.Inc()
+			for _, account := range page.Accounts {
+				unit.accountIDs = append(unit.accountIDs, *account.Id)
+			}
+			return !lastPage
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = client.ListOrganizationalUnitsForParentPagesWithContext(ctx, &organizations.ListOrganizationalUnitsForParentInput{ParentId: aws.String(unitID)}, func(page *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+			organizationsAPICounter.Inc()
+			for _, child := range page.OrganizationalUnits {
+				unit.childIDs = append(unit.childIDs, *child.Id)
+			}
+			return !lastPage
+		})
+		if err != nil {
+			return nil, err
+		}
+		units[unitID] = unit
+	}
+
+	accountIDs := unit.accountIDs
+	for _, childID := range unit.childIDs {
+		childAccountIDs, err := getOrganizationalUnitAccounts(client, units, childID)
+		if err != nil {
+			return nil, err
+		}
+		accountIDs = append(accountIDs, childAccountIDs...)
+	}
+	return accountIDs, nil
+}
+
+// List the member accounts of the organization once and build the role to assume in every active account which isn't
+// in an excluded organizational unit
+func getOrganizationRoleArns(client organizationsiface.OrganizationsAPI, org organization) ([]string, error) {
+	ctx := context.Background()
+	excluded := make(map[string]bool)
+	// Accounts move between units, the units are listed again by every bootstrap, e.g. on a reload
+	units := make(map[string]organizationalUnit)
+	for _, unitID := range org.ExcludeOrganizationalUnits {
+		accountIDs, err := getOrganizationalUnitAccounts(client, units, unitID)
+		if err != nil {
+			return nil, fmt.Errorf("organizational unit %s: %w", unitID, err)
+		}
+		for _, accountID := range accountIDs {
+			excluded[accountID] = true
+		}
+	}
+	var roleArns []string
+	err := client.ListAccountsPagesWithContext(ctx, &organizations.ListAccountsInput{}, func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+		organizationsAPICounter.Inc()
+		for _, account := range page.Accounts {
+			// Suspended accounts can't be assumed into
+			if *account.Status != organizations.AccountStatusActive {
+				log.Debugf("Skipping organization account %s with status %s", *account.Id, *account.Status)
+				continue
+			}
+			if excluded[*account.Id] {
+				log.Debugf("Skipping organization account %s of an excluded organizational unit", *account.Id)
+				continue
+			}
+			partition := "aws"
+			if accountArn, err := arn.Parse(*account.Arn); err == nil {
+				partition = accountArn.Partition
+			}
+			roleArns = append(roleArns, fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, *account.Id, org.MemberRoleName))
+		}
+		return !lastPage
+	})
+	return roleArns, err
+}
+
+// Assign the organization member roles to every discovery job without explicit roleArns
+func (c *conf) bootstrapOrganization(client organizationsiface.OrganizationsAPI) error {
+	roleArns, err := getOrganizationRoleArns(client, c.Discovery.Organization)
+	if err != nil {
+		return err
+	}
+	log.Infof("Discovered %d active accounts in organization", len(roleArns))
+	for n, job := range c.Discovery.Jobs {
+		if len(job.RoleArns) == 0 {
+			c.Discovery.Jobs[n].RoleArns = roleArns
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+type mockOrganizationsClient struct {
+	organizationsiface.OrganizationsAPI
+	accounts []*organizations.Account
+	calls    int
+	// The accounts and the child units of the organizational units by parent ID
+	parentAccounts map[string][]*organizations.Account
+	parentUnits    map[string][]*organizations.OrganizationalUnit
+	parentCalls    int
+}
+
+func (m *mockOrganizationsClient) ListAccountsForParentPagesWithContext(ctx aws.Context, input *organizations.ListAccountsForParentInput, fn func(*organizations.ListAccountsForParentOutput, bool) bool, opts ...request.Option) error {
+	m.parentCalls++
+	fn(&organizations.ListAccountsForParentOutput{Accounts: m.parentAccounts[*input.ParentId]}, true)
+	return nil
+}
+
+func (m *mockOrganizationsClient) ListOrganizationalUnitsForParentPagesWithContext(ctx aws.Context, input *organizations.ListOrganizationalUnitsForParentInput, fn func(*organizations.ListOrganizationalUnitsForParentOutput, bool) bool, opts ...request.Option) error {
+	m.parentCalls++
+	fn(&organizations.ListOrganizationalUnitsForParentOutput{OrganizationalUnits: m.parentUnits[*input.ParentId]}, true)
+	return nil
+}
+
+func (m *mockOrganizationsClient) ListAccountsPagesWithContext(ctx aws.Context, input *organizations.ListAccountsInput, fn func(*organizations.ListAccountsOutput, bool) bool, opts ...request.Option) error {
+	m.calls++
+	fn(&organizations.ListAccountsOutput{Accounts: m.accounts}, true)
+	return nil
+}
+
+func TestBootstrapOrganization(t *testing.T) {
+	// Setup Test
+	client := &mockOrganizationsClient{accounts: []*organizations.Account{
+		{Id: aws.String("111111111111"), Arn: aws.String("arn:aws:organizations::000000000000:account/o-abc/111111111111"), Status: aws.String("ACTIVE")},
+		{Id: aws.String("222222222222"), Arn: aws.String("arn:aws:organizations::000000000000:account/o-abc/222222222222"), Status: aws.String("SUSPENDED")},
+		{Id: aws.String("333333333333"), Arn: aws.String("arn:aws-us-gov:organizations::000000000000:account/o-abc/333333333333"), Status: aws.String("ACTIVE")},
+	}}
+	c := conf{Discovery: discovery{
+		Organization: organization{MemberRoleName: "prometheus"},
+		Jobs: []job{
+			{Type: "ec2"},
+			{Type: "rds", RoleArns: []string{"arn:aws:iam::444444444444:role/explicit"}},
+		},
+	}}
+
+	// Act
+	err := c.bootstrapOrganization(client)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.calls != 1 {
+		t.Fatalf("expected accounts to be listed once, got %d calls", client.calls)
+	}
+	expected := []string{"arn:aws:iam::111111111111:role/prometheus", "arn:aws-us-gov:iam::333333333333:role/prometheus"}
+	actual := c.Discovery.Jobs[0].RoleArns
+	if len(actual) != len(expected) || actual[0] != expected[0] || actual[1] != expected[1] {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, actual)
+	}
+	if roleArns := c.Discovery.Jobs[1].RoleArns; len(roleArns) != 1 || roleArns[0] != "arn:aws:iam::444444444444:role/explicit" {
+		t.Fatalf("explicit roleArns should be kept, got %v", roleArns)
+	}
+}
+
+func TestBootstrapOrganizationExcludedUnits(t *testing.T) {
+	// Setup Test
+	account := func(id string) *organizations.Account {
+		return &organizations.Account{Id: aws.String(id), Arn: aws.String("arn:aws:organizations::000000000000:account/o-abc/" + id), Status: aws.String("ACTIVE")}
+	}
+	client := &mockOrganizationsClient{
+		accounts: []*organizations.Account{account("111111111111"), account("222222222222"), account("333333333333"), account("444444444444")},
+		parentAccounts: map[string][]*organizations.Account{
+			"ou-abc-sandbox":  {account("222222222222")},
+			"ou-abc-personal": {account("333333333333")},
+			"ou-abc-prod":     {account("444444444444")},
+		},
+		parentUnits: map[string][]*organizations.OrganizationalUnit{
+			"ou-abc-sandbox": {{Id: aws.String("ou-abc-personal")}},
+		},
+	}
+	newConf := func() conf {
+		return conf{Discovery: discovery{
+			Organization: organization{MemberRoleName: "prometheus", ExcludeOrganizationalUnits: []string{"ou-abc-sandbox", "ou-abc-personal"}},
+			Jobs:         []job{{Type: "ec2"}},
+		}}
+	}
+	c := newConf()
+
+	// Act
+	err := c.bootstrapOrganization(client)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The accounts of the excluded unit and of the unit nested in it are not scraped
+	expected := []string{"arn:aws:iam::111111111111:role/prometheus", "arn:aws:iam::444444444444:role/prometheus"}
+	if actual := c.Discovery.Jobs[0].RoleArns; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, actual)
+	}
+	// The excluded unit nested in the other one is listed once
+	if client.parentCalls != 4 {
+		t.Fatalf("\nexpected: 4 calls for the 2 organizational units\nactual:  %d", client.parentCalls)
+	}
+
+	// An account moved out of the excluded units is scraped after a reload of the configuration
+	client.parentAccounts["ou-abc-personal"] = nil
+	c = newConf()
+	if err := c.bootstrapOrganization(client); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"arn:aws:iam::111111111111:role/prometheus", "arn:aws:iam::333333333333:role/prometheus", "arn:aws:iam::444444444444:role/prometheus"}
+	if actual := c.Discovery.Jobs[0].RoleArns; !reflect.DeepEqual(actual, expected) || client.parentCalls != 8 {
+		t.Fatalf("\nexpected: %v listed again\nactual:  %v after %d calls", expected, actual, client.parentCalls)
+	}
+}
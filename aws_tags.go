@@ -2,30 +2,141 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/apigateway"
 	"github.com/aws/aws-sdk-go/service/apigateway/apigatewayiface"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/appsync"
+	"github.com/aws/aws-sdk-go/service/appsync/appsynciface"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/bedrock"
+	"github.com/aws/aws-sdk-go/service/bedrock/bedrockiface"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/aws/aws-sdk-go/service/comprehend/comprehendiface"
+	"github.com/aws/aws-sdk-go/service/drs"
+	"github.com/aws/aws-sdk-go/service/drs/drsiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/fsx"
+	"github.com/aws/aws-sdk-go/service/fsx/fsxiface"
+	"github.com/aws/aws-sdk-go/service/guardduty"
+	"github.com/aws/aws-sdk-go/service/guardduty/guarddutyiface"
+	"github.com/aws/aws-sdk-go/service/iot"
+	"github.com/aws/aws-sdk-go/service/iot/iotiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/managedgrafana"
+	"github.com/aws/aws-sdk-go/service/managedgrafana/managedgrafanaiface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroups"
+	"github.com/aws/aws-sdk-go/service/resourcegroups/resourcegroupsiface"
 	r "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/shield"
+	"github.com/aws/aws-sdk-go/service/shield/shieldiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/synthetics"
+	"github.com/aws/aws-sdk-go/service/synthetics/syntheticsiface"
+	"github.com/aws/aws-sdk-go/service/waf"
+	"github.com/aws/aws-sdk-go/service/waf/wafiface"
+	"github.com/aws/aws-sdk-go/service/wafregional"
+	"github.com/aws/aws-sdk-go/service/wafregional/wafregionaliface"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+// Returned when paging through resources failed after some of them were already discovered.
+// The resources returned alongside it are incomplete but valid.
+type partialResultsError struct {
+	pages     int
+	resources int
+	err       error
+}
+
+func (e *partialResultsError) Error() string {
+	return fmt.Sprintf("discovery failed after %d pages with %d resources: %v", e.pages, e.resources, e.err)
+}
+
+func (e *partialResultsError) Unwrap() error {
+	return e.err
+}
+
+func wrapPartialResults(err error, pages int, resources int) error {
+	if err == nil || resources == 0 {
+		return err
+	}
+	return &partialResultsError{pages: pages, resources: resources, err: err}
+}
+
+// Returned by the discovery of a job, tells apart the accounts and regions the error occurred in
+type DiscoveryError struct {
+	Service string
+	Region  string
+	RoleArn string
+	Err     error
+}
+
+func (e *DiscoveryError) Error() string {
+	if e.RoleArn == "" {
+		return fmt.Sprintf("discovery of %s in %s failed: %v", e.Service, e.Region, e.Err)
+	}
+	return fmt.Sprintf("discovery of %s in %s with role %s failed: %v", e.Service, e.Region, e.RoleArn, e.Err)
+}
+
+func (e *DiscoveryError) Unwrap() error {
+	return e.Err
+}
+
+func (iface tagsInterface) wrapDiscoveryError(err error, service string, region string) error {
+	var discoveryErr *DiscoveryError
+	if err == nil || errors.As(err, &discoveryErr) {
+		return err
+	}
+	return &DiscoveryError{Service: service, Region: region, RoleArn: iface.roleArn, Err: err}
+}
+
 type tagsData struct {
 	ID      *string
 	Matcher *string
 	Tags    []*tag
 	Service *string
 	Region  *string
+	// Only set when the job exports the creation time as value of the info metric
+	CreatedAt *time.Time
+	// Additional labels of the info metric, e.g. the destination of a firehose delivery stream
+	Labels map[string]string
+	// Human readable name of the account the resource was discovered in, empty when unknown
+	AccountAlias string
+	// Only set when the job scrapes several roles, so the resources of different accounts can't collide
+	AccountID string
 }
 
 // https://docs.aws.amazon.com/sdk-for-go/api/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface/
@@ -34,15 +145,84 @@ type tagsInterface struct {
 	asgClient        autoscalingiface.AutoScalingAPI
 	apiGatewayClient apigatewayiface.APIGatewayAPI
 	ec2Client        ec2iface.EC2API
+	efsClient        efsiface.EFSAPI
+	appSyncClient    appsynciface.AppSyncAPI
+	iotClient        iotiface.IoTAPI
+	rdsClient        rdsiface.RDSAPI
+	fsxClient        fsxiface.FSxAPI
+	firehoseClient   firehoseiface.FirehoseAPI
+	ecClient         elasticacheiface.ElastiCacheAPI
+	wafClient        wafiface.WAFAPI
+	wafRegClient     wafregionaliface.WAFRegionalAPI
+	cfClient         cloudfrontiface.CloudFrontAPI
+	elbv2Client      elbv2iface.ELBV2API
+	comprehendClient comprehendiface.ComprehendAPI
+	guardDutyClient  guarddutyiface.GuardDutyAPI
+	resGroupsClient  resourcegroupsiface.ResourceGroupsAPI
+	syntheticsClient syntheticsiface.SyntheticsAPI
+	lambdaClient     lambdaiface.LambdaAPI
+	shieldClient     shieldiface.ShieldAPI
+	bedrockClient    bedrockiface.BedrockAPI
+	drsClient        drsiface.DrsAPI
+	grafanaClient    managedgrafanaiface.ManagedGrafanaAPI
+	// Role the clients were created with, empty for the default credentials
+	roleArn string
+}
+
+// The credentials of a role are shared by all its clients, so the role is assumed once per expiry instead of once per
+// client, and the tracked expiry is the one of the credentials in use
+var roleCredentials = struct {
+	sync.Mutex
+	credentials map[string]*credentials.Credentials
+}{credentials: make(map[string]*credentials.Credentials)}
+
+// Assume the role and track the expiry of its credentials
+func newRoleCredentials(sess *session.Session, roleArn string) *credentials.Credentials {
+	roleCredentials.Lock()
+	defer roleCredentials.Unlock()
+	if creds, ok := roleCredentials.credentials[roleArn]; ok {
+		return creds
+	}
+	creds := stscreds.NewCredentialsWithClient(newSTSClient(sess), roleArn)
+	roleCredentials.credentials[roleArn] = creds
+	credentialsExpiry.track(roleArn, creds)
+	return creds
+}
+
+// The roles are assumed through the STS endpoint of the session, unless it is overridden, e.g. by an interface VPC
+// endpoint in a VPC without internet access
+func newSTSClient(sess *session.Session) *sts.STS {
+	if *stsEndpoint == "" {
+		return sts.New(sess)
+	}
+	return sts.New(sess, &aws.Config{Endpoint: stsEndpoint})
+}
+
+// Select the profile of the shared config, so its source_profile role chaining is honored on local runs
+func sessionOptions() session.Options {
+	if *awsProfile == "" {
+		return session.Options{}
+	}
+	return session.Options{Profile: *awsProfile, SharedConfigState: session.SharedConfigEnable}
+}
+
+// Identify the exporter in the user agent of every request, e.g. for AWS support cases and CloudTrail
+func addUserAgent(sess *session.Session) {
+	var extra []string
+	if *userAgentSuffix != "" {
+		extra = append(extra, *userAgentSuffix)
+	}
+	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentHandler("yace", version, extra...))
 }
 
 func createSession(roleArn string, config *aws.Config) *session.Session {
-	sess, err := session.NewSession()
+	sess, err := session.NewSessionWithOptions(sessionOptions())
 	if err != nil {
 		log.Fatalf("Failed to create session due to %v", err)
 	}
+	addUserAgent(sess)
 	if roleArn != "" {
-		config.Credentials = stscreds.NewCredentials(sess, roleArn)
+		config.Credentials = newRoleCredentials(sess, roleArn)
 	}
 	return sess
 }
@@ -65,100 +245,795 @@ func createEC2Session(region *string, roleArn string) ec2iface.EC2API {
 	return ec2.New(createSession(roleArn, config), config)
 }
 
+func createEFSSession(region *string, roleArn string) efsiface.EFSAPI {
+	maxEFSAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxEFSAPIRetries}
+	return efs.New(createSession(roleArn, config), config)
+}
+
+func createAppSyncSession(region *string, roleArn string) appsynciface.AppSyncAPI {
+	maxAppSyncAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxAppSyncAPIRetries}
+	return appsync.New(createSession(roleArn, config), config)
+}
+
+func createIoTSession(region *string, roleArn string) iotiface.IoTAPI {
+	maxIoTAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxIoTAPIRetries}
+	return iot.New(createSession(roleArn, config), config)
+}
+
+func createRDSSession(region *string, roleArn string) rdsiface.RDSAPI {
+	maxRDSAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxRDSAPIRetries}
+	return rds.New(createSession(roleArn, config), config)
+}
+
+func createElastiCacheSession(region *string, roleArn string) elasticacheiface.ElastiCacheAPI {
+	maxElastiCacheAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxElastiCacheAPIRetries}
+	return elasticache.New(createSession(roleArn, config), config)
+}
+
+func createFSxSession(region *string, roleArn string) fsxiface.FSxAPI {
+	maxFSxAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxFSxAPIRetries}
+	return fsx.New(createSession(roleArn, config), config)
+}
+
+func createFirehoseSession(region *string, roleArn string) firehoseiface.FirehoseAPI {
+	maxFirehoseAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxFirehoseAPIRetries}
+	return firehose.New(createSession(roleArn, config), config)
+}
+
+func createELBv2Session(region *string, roleArn string) elbv2iface.ELBV2API {
+	maxELBv2APIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxELBv2APIRetries}
+	return elbv2.New(createSession(roleArn, config), config)
+}
+
+func createCloudFrontSession(roleArn string) cloudfrontiface.CloudFrontAPI {
+	maxCloudFrontAPIRetries := 5
+	// CloudFront is a global service served out of us-east-1
+	config := &aws.Config{Region: aws.String("us-east-1"), MaxRetries: &maxCloudFrontAPIRetries}
+	return cloudfront.New(createSession(roleArn, config), config)
+}
+
+func createWAFSession(roleArn string) wafiface.WAFAPI {
+	maxWAFAPIRetries := 5
+	// The WAF Classic web ACLs of CloudFront are global, served out of us-east-1
+	config := &aws.Config{Region: aws.String("us-east-1"), MaxRetries: &maxWAFAPIRetries}
+	return waf.New(createSession(roleArn, config), config)
+}
+
+func createWAFRegionalSession(region *string, roleArn string) wafregionaliface.WAFRegionalAPI {
+	maxWAFAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxWAFAPIRetries}
+	return wafregional.New(createSession(roleArn, config), config)
+}
+
+func createComprehendSession(region *string, roleArn string) comprehendiface.ComprehendAPI {
+	maxComprehendAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxComprehendAPIRetries}
+	return comprehend.New(createSession(roleArn, config), config)
+}
+
+func createGuardDutySession(region *string, roleArn string) guarddutyiface.GuardDutyAPI {
+	maxGuardDutyAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxGuardDutyAPIRetries}
+	return guardduty.New(createSession(roleArn, config), config)
+}
+
+func createResourceGroupsSession(region *string, roleArn string) resourcegroupsiface.ResourceGroupsAPI {
+	maxResourceGroupsAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxResourceGroupsAPIRetries}
+	return resourcegroups.New(createSession(roleArn, config), config)
+}
+
+func createSyntheticsSession(region *string, roleArn string) syntheticsiface.SyntheticsAPI {
+	maxSyntheticsAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxSyntheticsAPIRetries}
+	return synthetics.New(createSession(roleArn, config), config)
+}
+
+func createBedrockSession(region *string, roleArn string) bedrockiface.BedrockAPI {
+	maxBedrockAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxBedrockAPIRetries}
+	return bedrock.New(createSession(roleArn, config), config)
+}
+
+func createDRSSession(region *string, roleArn string) drsiface.DrsAPI {
+	maxDRSAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxDRSAPIRetries}
+	return drs.New(createSession(roleArn, config), config)
+}
+
+func createGrafanaSession(region *string, roleArn string) managedgrafanaiface.ManagedGrafanaAPI {
+	maxGrafanaAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxGrafanaAPIRetries}
+	return managedgrafana.New(createSession(roleArn, config), config)
+}
+
+func createShieldSession(roleArn string) shieldiface.ShieldAPI {
+	maxShieldAPIRetries := 5
+	// Shield is a global service served out of us-east-1
+	config := &aws.Config{Region: aws.String("us-east-1"), MaxRetries: &maxShieldAPIRetries}
+	return shield.New(createSession(roleArn, config), config)
+}
+
+func createLambdaSession(region *string, roleArn string) lambdaiface.LambdaAPI {
+	maxLambdaAPIRetries := 5
+	config := &aws.Config{Region: region, MaxRetries: &maxLambdaAPIRetries}
+	return lambda.New(createSession(roleArn, config), config)
+}
+
 func createAPIGatewaySession(region *string, roleArn string) apigatewayiface.APIGatewayAPI {
-	sess, err := session.NewSession()
+	sess, err := session.NewSessionWithOptions(sessionOptions())
 	if err != nil {
 		log.Fatal(err)
 	}
+	addUserAgent(sess)
 	maxApiGatewaygAPIRetries := 5
 	config := &aws.Config{Region: region, MaxRetries: &maxApiGatewaygAPIRetries}
 	if roleArn != "" {
-		config.Credentials = stscreds.NewCredentials(sess, roleArn)
+		config.Credentials = newRoleCredentials(sess, roleArn)
 	}
 
 	return apigateway.New(sess, config)
 }
 
-func (iface tagsInterface) get(job job, region string) (resources []*tagsData, err error) {
+func createTagsInterface(job job, region string, roleArn string) tagsInterface {
+	// CloudFront is a global service, its distributions can only be listed through us-east-1.
+	// The resources keep the region of the job.
+	tagRegion := region
+	if job.Type == "cf" {
+		tagRegion = "us-east-1"
+	}
+	iface := tagsInterface{
+		client:  createTagSession(&tagRegion, roleArn),
+		roleArn: roleArn,
+	}
+	// Only the clients of the APIs the job type is discovered or enriched through are created
 	switch job.Type {
+	case "ec2":
+		iface.ec2Client = createEC2Session(&region, roleArn)
+		iface.asgClient = createASGSession(&region, roleArn)
 	case "asg":
-		return iface.getTaggedAutoscalingGroups(job, region)
-	case "tgwa":
-		return iface.getTaggedTransitGatewayAttachments(job, region)
-	}
-
-	allResourceTypesFilters := map[string][]string{
-		"alb":                   {"elasticloadbalancing:loadbalancer/app", "elasticloadbalancing:targetgroup"},
-		"apigateway":            {"apigateway"},
-		"appsync":               {"appsync"},
-		"cf":                    {"cloudfront"},
-		"dynamodb":              {"dynamodb:table"},
-		"ebs":                   {"ec2:volume"},
-		"ec":                    {"elasticache:cluster"},
-		"ec2":                   {"ec2:instance"},
-		"ecs-svc":               {"ecs:cluster", "ecs:service"},
-		"ecs-containerinsights": {"ecs:cluster", "ecs:service"},
-		"efs":                   {"elasticfilesystem:file-system"},
-		"elb":                   {"elasticloadbalancing:loadbalancer"},
-		"emr":                   {"elasticmapreduce:cluster"},
-		"es":                    {"es:domain"},
-		"firehose":              {"firehose"},
-		"fsx":                   {"fsx:file-system"},
-		"kinesis":               {"kinesis:stream"},
-		"lambda":                {"lambda:function"},
-		"ngw":                   {"ec2:natgateway"},
-		"nlb":                   {"elasticloadbalancing:loadbalancer/net"},
-		"rds":                   {"rds:db"},
-		"redshift":              {"redshift:cluster"},
-		"r53r":                  {"route53resolver"},
-		"s3":                    {"s3"},
-		"sfn":                   {"states"},
-		"sns":                   {"sns"},
-		"sqs":                   {"sqs"},
-		"tgw":                   {"ec2:transit-gateway"},
-		"vpn":                   {"ec2:vpn-connection"},
-		"kafka":                 {"kafka:cluster"},
+		iface.asgClient = createASGSession(&region, roleArn)
+	case "ebs", "ngw", "spot-fleet", "tgwa", "tgw-rt", "vpn":
+		iface.ec2Client = createEC2Session(&region, roleArn)
+	case "alb", "gwlb", "nlb":
+		iface.elbv2Client = createELBv2Session(&region, roleArn)
+	case "apigateway":
+		iface.apiGatewayClient = createAPIGatewaySession(&region, roleArn)
+	case "appsync":
+		iface.appSyncClient = createAppSyncSession(&region, roleArn)
+	case "bedrock":
+		iface.bedrockClient = createBedrockSession(&region, roleArn)
+	case "cf":
+		iface.cfClient = createCloudFrontSession(roleArn)
+	case "comprehend":
+		iface.comprehendClient = createComprehendSession(&region, roleArn)
+	case "drs":
+		iface.drsClient = createDRSSession(&region, roleArn)
+	case "ec":
+		iface.ecClient = createElastiCacheSession(&region, roleArn)
+	case "efs-ap":
+		iface.efsClient = createEFSSession(&region, roleArn)
+	case "firehose":
+		iface.firehoseClient = createFirehoseSession(&region, roleArn)
+	case "fsx-lustre", "fsx-ontap", "fsx-openzfs", "fsx-windows":
+		iface.fsxClient = createFSxSession(&region, roleArn)
+	case "grafana":
+		iface.grafanaClient = createGrafanaSession(&region, roleArn)
+	case "guardduty":
+		iface.guardDutyClient = createGuardDutySession(&region, roleArn)
+	case "iot":
+		iface.iotClient = createIoTSession(&region, roleArn)
+	case "lambda":
+		iface.lambdaClient = createLambdaSession(&region, roleArn)
+	case "rds", "rds-proxy":
+		iface.rdsClient = createRDSSession(&region, roleArn)
+	case "shield":
+		iface.shieldClient = createShieldSession(roleArn)
+	case "synthetics":
+		iface.syntheticsClient = createSyntheticsSession(&region, roleArn)
+	case "waf":
+		iface.wafClient = createWAFSession(roleArn)
+		iface.wafRegClient = createWAFRegionalSession(&region, roleArn)
+	}
+	if job.ResourceGroup != "" {
+		iface.resGroupsClient = createResourceGroupsSession(&region, roleArn)
+	}
+	return iface
+}
+
+// A call to the tagging API failing after the SDK retries resumes from the page it failed on this many times, so the
+// pages already read aren't requested again
+const maxPageResumes = 3
+
+// Resource types of the services discovered through the Resource Groups Tagging API
+var allResourceTypesFilters = map[string][]string{
+	"alb":                   {"elasticloadbalancing:loadbalancer/app", "elasticloadbalancing:targetgroup"},
+	"apigateway":            {"apigateway"},
+	"apprunner":             {"apprunner:service"},
+	"appsync":               {"appsync"},
+	"athena":                {"athena:workgroup"},
+	"cf":                    {"cloudfront"},
+	"dax":                   {"dax:cache"},
+	"dynamodb":              {"dynamodb:table"},
+	"ebs":                   {"ec2:volume"},
+	"ec":                    {"elasticache:cluster"},
+	"ec2":                   {"ec2:instance"},
+	"ecr":                   {"ecr:repository"},
+	"ecs-svc":               {"ecs:cluster", "ecs:service"},
+	"ecs-containerinsights": {"ecs:cluster", "ecs:service"},
+	"efs":                   {"elasticfilesystem:file-system"},
+	"efs-ap":                {"elasticfilesystem:access-point"},
+	"elb":                   {"elasticloadbalancing:loadbalancer"},
+	"emr":                   {"elasticmapreduce:cluster"},
+	"es":                    {"es:domain"},
+	"firehose":              {"firehose"},
+	"fsx":                   {"fsx:file-system"},
+	"fsx-lustre":            {"fsx:file-system"},
+	"fsx-ontap":             {"fsx:file-system"},
+	"fsx-openzfs":           {"fsx:file-system"},
+	"fsx-windows":           {"fsx:file-system"},
+	"gwlb":                  {"elasticloadbalancing:loadbalancer/gwy"},
+	"kinesis":               {"kinesis:stream"},
+	"lambda":                {"lambda:function"},
+	"memorydb":              {"memorydb:cluster"},
+	"ngw":                   {"ec2:natgateway"},
+	"nlb":                   {"elasticloadbalancing:loadbalancer/net"},
+	"osis":                  {"osis:pipeline"},
+	"rds":                   {"rds:db"},
+	"rds-proxy":             {"rds:db-proxy"},
+	"redshift":              {"redshift:cluster"},
+	"r53r":                  {"route53resolver"},
+	"r53r-endpoint":         {"route53resolver:resolver-endpoint"},
+	"r53r-rule":             {"route53resolver:resolver-rule"},
+	"s3":                    {"s3"},
+	"secretsmanager":        {"secretsmanager:secret"},
+	"sfn":                   {"states"},
+	"sfn-activity":          {"states:activity"},
+	"sfn-statemachine":      {"states:stateMachine"},
+	"sns":                   {"sns"},
+	"sqs":                   {"sqs"},
+	"subnet":                {"ec2:subnet"},
+	"tgw":                   {"ec2:transit-gateway"},
+	"vpn":                   {"ec2:vpn-connection"},
+	"vpce-service":          {"ec2:vpc-endpoint-service"},
+	"kafka":                 {"kafka:cluster"},
+}
+
+// The FSx file system types publish different metrics, their jobs only keep the file systems of their type
+var fsxFileSystemTypes = map[string]string{
+	"fsx-lustre":  "LUSTRE",
+	"fsx-ontap":   "ONTAP",
+	"fsx-openzfs": "OPENZFS",
+	"fsx-windows": "WINDOWS",
+}
+
+// Converts the pages of a describe paginator on a bounded number of goroutines while the next page is fetched.
+// Page tokens can't be prefetched, but the conversion and tag filtering of a page no longer delay the next request.
+type describePagePool struct {
+	wg        sync.WaitGroup
+	mux       sync.Mutex
+	semaphore chan struct{}
+	pages     [][]*tagsData
+}
+
+func newDescribePagePool(concurrency int) *describePagePool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &describePagePool{semaphore: make(chan struct{}, concurrency)}
+}
+
+func (p *describePagePool) process(convert func() []*tagsData) {
+	p.mux.Lock()
+	idx := len(p.pages)
+	p.pages = append(p.pages, nil)
+	p.mux.Unlock()
+
+	p.semaphore <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			<-p.semaphore
+		}()
+		pageResources := convert()
+		p.mux.Lock()
+		p.pages[idx] = pageResources
+		p.mux.Unlock()
+	}()
+}
+
+// Wait for all pages and return their resources in page order
+func (p *describePagePool) wait() (resources []*tagsData) {
+	p.wg.Wait()
+	for _, pageResources := range p.pages {
+		resources = append(resources, pageResources...)
+	}
+	return resources
+}
+
+// Discovers the resources of a job type through the describe API of its service
+type describeDiscoverer func(iface tagsInterface, job job, region string) ([]*tagsData, error)
+
+// Services missing from the Resource Groups Tagging API register their describe based workaround here
+var describeDiscoverers = map[string]describeDiscoverer{
+	"asg":        tagsInterface.getTaggedAutoscalingGroups,
+	"iot":        tagsInterface.getTaggedIoT,
+	"tgwa":       tagsInterface.getTaggedTransitGatewayAttachments,
+	"tgw-rt":     tagsInterface.getTaggedTransitGatewayRouteTables,
+	"spot-fleet": tagsInterface.getTaggedSpotFleet,
+	"waf":        tagsInterface.getTaggedWAFClassic,
+	"comprehend": tagsInterface.getTaggedComprehend,
+	"guardduty":  tagsInterface.getTaggedGuardDuty,
+	"synthetics": tagsInterface.getTaggedSynthetics,
+	"shield":     tagsInterface.getTaggedShield,
+	"bedrock":    tagsInterface.getTaggedBedrock,
+	"drs":        tagsInterface.getTaggedDRS,
+	"grafana":    tagsInterface.getTaggedGrafana,
+}
+
+// Map the search tags to the tag filters of the tagging API, which ANDs the keys and ORs the values of a key. The
+// values are only sent when the search tag matches exactly these values, otherwise only the key is, and the search
+// tags are matched again by the exporter anyway.
+func searchTagFilters(job job) []*r.TagFilter {
+	var keys []string
+	searchTags := make(map[string][]tag)
+	for _, searchTag := range job.SearchTags {
+		if _, ok := searchTags[searchTag.Key]; !ok {
+			keys = append(keys, searchTag.Key)
+		}
+		searchTags[searchTag.Key] = append(searchTags[searchTag.Key], searchTag)
+	}
+
+	var tagFilters []*r.TagFilter
+	for _, key := range keys {
+		tagFilter := r.TagFilter{Key: aws.String(key)}
+		// Several search tags of a key must all match, which the values of a tag filter can't express. The tagging API
+		// compares the values before their normalization.
+		if len(searchTags[key]) == 1 && !job.NormalizeTagValues.Trim && !job.NormalizeTagValues.Lowercase {
+			if values, ok := exactValues(searchTags[key][0].Value, job.SearchTagsMode); ok {
+				tagFilter.Values = aws.StringSlice(values)
+			}
+		}
+		tagFilters = append(tagFilters, &tagFilter)
+	}
+	return tagFilters
+}
+
+// Get the values a search tag value matches, when it only matches a fixed set of values, e.g. ^(web|api)$ or a glob
+// pattern without wildcards
+func exactValues(value string, mode string) ([]string, bool) {
+	if mode == searchTagsModeGlob {
+		if strings.ContainsAny(value, `*?[\`) {
+			return nil, false
+		}
+		return []string{value}, true
+	}
+
+	re, err := syntax.Parse(value, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) != 3 || re.Sub[0].Op != syntax.OpBeginText || re.Sub[2].Op != syntax.OpEndText {
+		return nil, false
+	}
+	alternatives := []*syntax.Regexp{re.Sub[1]}
+	if re.Sub[1].Op == syntax.OpCapture {
+		alternatives = re.Sub[1].Sub
+	}
+	if alternatives[0].Op == syntax.OpAlternate {
+		alternatives = alternatives[0].Sub
 	}
+	var values []string
+	for _, alternative := range alternatives {
+		if alternative.Op != syntax.OpLiteral || alternative.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		values = append(values, string(alternative.Rune))
+	}
+	return values, true
+}
+
+func (iface tagsInterface) get(job job, region string) (resources []*tagsData, err error) {
+	// Covers the describe based workarounds and the post processing, like the apigateway name swap
+	timer := prometheus.NewTimer(discoveryDurationHistogram.WithLabelValues(job.Type, region))
+	defer timer.ObserveDuration()
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	// Partial results are a failure, a staleness alert then tells which service stopped being discovered
+	defer func() {
+		if err == nil {
+			serviceLastSuccessGauge.WithLabelValues(job.Type, region).SetToCurrentTime()
+		}
+	}()
+	// Set when the tagging API pages are no longer read because the limit is reached
+	limitExceeded := false
+	defer func() {
+		if job.MaxResources == 0 || !limitExceeded && len(resources) <= job.MaxResources {
+			return
+		}
+		if len(resources) > job.MaxResources {
+			resources = resources[:job.MaxResources]
+		}
+		log.Errorf("tagsInterface.get: %s: more than %d resources in %s, the others are left out", job.Type, job.MaxResources, region)
+		resourceLimitExceededCounter.WithLabelValues(job.Type).Inc()
+	}()
+
+	resourceTypeFilters, ok := allResourceTypesFilters[job.Type]
+	if !ok {
+		if discover, ok := describeDiscoverers[job.Type]; ok {
+			return discover(iface, job, region)
+		}
+		log.Fatal("Not implemented resources:" + job.Type)
+	}
+
 	var inputparams r.GetResourcesInput
-	if resourceTypeFilters, ok := allResourceTypesFilters[job.Type]; ok {
-		var filters []*string
+	if job.ResourcesPerPage != 0 {
+		inputparams.ResourcesPerPage = aws.Int64(job.ResourcesPerPage)
+	}
+	// A call per resource type filter gives each filter its own 100 pages
+	filterGroups := [][]*string{aws.StringSlice(resourceTypeFilters)}
+	if job.SplitResourceTypes {
+		filterGroups = nil
 		for _, filter := range resourceTypeFilters {
-			filters = append(filters, aws.String(filter))
+			filterGroups = append(filterGroups, []*string{aws.String(filter)})
 		}
-		inputparams.ResourceTypeFilters = filters
-	} else {
-		log.Fatal("Not implemented resources:" + job.Type)
+	}
+	// The ASG tags merged into the instances aren't known to the tagging API
+	if config.Discovery.serverSideTagFilters(job.Type) && !(job.Type == "ec2" && job.AutoScalingGroupTags) {
+		inputparams.TagFilters = searchTagFilters(job)
 	}
 	c := iface.client
-	ctx := context.Background()
+	ctx := discoveryCtx
+
+	// Instances launched by an ASG often only carry the tags of the ASG through its tag name
+	var groupTags map[string][]*tag
+	if job.Type == "ec2" && job.AutoScalingGroupTags {
+		var errGet error
+		groupTags, errGet = iface.getAutoScalingGroupTags(job)
+		if errGet != nil {
+			log.Errorf("tagsInterface.get: ec2: getAutoScalingGroupTags: %v", errGet)
+		}
+	}
+
+	// The members of a resource group replace the resources of the tagging API, which only provides their tags
+	var members []string
+	var memberTags map[string][]*tag
+	if job.ResourceGroup != "" {
+		var errGet error
+		members, errGet = iface.getResourceGroupMembers(job.ResourceGroup, resourceTypeFilters)
+		if errGet != nil {
+			return nil, errGet
+		}
+		memberTags = make(map[string][]*tag, len(members))
+	}
+	// The resources of a job with arns are known, the tagging API is at most asked for their tags. Every region of the
+	// job is scraped with its own clients, so it only gets the arns of that region.
+	if len(job.Arns) > 0 {
+		job.Arns = arnsInRegion(job, region)
+		members = job.Arns
+		filterGroups = nil
+		if job.ArnTags && len(job.Arns) > 0 {
+			var errGet error
+			memberTags, errGet = iface.getArnTags(job)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: %s: getArnTags: %v", job.Type, errGet)
+			}
+		}
+	}
+
 	pageNum := 0
-	resourcePages := c.GetResourcesPagesWithContext(ctx, &inputparams, func(page *r.GetResourcesOutput, lastPage bool) bool {
-		pageNum++
-		resourceGroupTaggingAPICounter.Inc()
-		for _, resourceTagMapping := range page.ResourceTagMappingList {
-			resource := tagsData{}
+	for _, filterGroup := range filterGroups {
+		input := inputparams
+		input.ResourceTypeFilters = filterGroup
+		callPageNum := 0
+		// The token of the page after the last one read, a failed call resumes from it instead of the first page
+		nextToken := ""
+		handlePage := func(page *r.GetResourcesOutput, lastPage bool) bool {
+			pageNum++
+			callPageNum++
+			resourceGroupTaggingAPICounter.Inc()
+			for _, resourceTagMapping := range page.ResourceTagMappingList {
+				resource := tagsData{}
+
+				resource.ID = resourceTagMapping.ResourceARN
 
-			resource.ID = resourceTagMapping.ResourceARN
+				resource.Service = &job.Type
+				resource.Region = &region
 
-			resource.Service = &job.Type
-			resource.Region = &region
+				for _, t := range resourceTagMapping.Tags {
+					resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+				}
+				if groupTags != nil {
+					resource.mergeAutoScalingGroupTags(groupTags)
+				}
+				if memberTags != nil {
+					memberTags[*resource.ID] = resource.Tags
+					continue
+				}
 
-			for _, t := range resourceTagMapping.Tags {
-				resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: *t.Value})
+				if resource.filterThroughJobTags(job) {
+					// Stop before a misconfigured job holds every resource of the account in memory
+					if job.MaxResources > 0 && len(resources) >= job.MaxResources {
+						limitExceeded = true
+						return false
+					}
+					resources = append(resources, &resource)
+				}
 			}
-
-			if resource.filterThroughTags(job.SearchTags) {
-				resources = append(resources, &resource)
+			nextToken = aws.StringValue(page.PaginationToken)
+			return callPageNum < 100
+		}
+		for resumes := 0; ; resumes++ {
+			err = c.GetResourcesPagesWithContext(ctx, &input, handlePage, withRateLimit("resourcegroupstaggingapi"))
+			if err == nil || limitExceeded || nextToken == "" || resumes == maxPageResumes || ctx.Err() != nil {
+				break
 			}
+			log.Warningf("tagsInterface.get: %s: resuming after page %d in %s: %v", job.Type, callPageNum, region, err)
+			input.PaginationToken = aws.String(nextToken)
 		}
-		return pageNum < 100
-	})
+		if err != nil || limitExceeded {
+			break
+		}
+	}
+	// Untagged members are unknown to the tagging API, they are kept without tags
+	for _, member := range members {
+		resource := tagsData{ID: aws.String(member), Service: &job.Type, Region: &region, Tags: memberTags[member]}
+		if resource.filterThroughJobTags(job) {
+			resources = append(resources, &resource)
+		}
+	}
+	err = wrapPartialResults(err, pageNum, len(resources))
 
 	switch job.Type {
-	case "apigateway":
-		// Get all the api gateways from aws
-		apiGateways, errGet := iface.getTaggedApiGateway()
+	case "ec2":
+		if job.InfoCreationTime || job.MaxAge > 0 || job.InstanceDetails || len(job.InstanceFilters) > 0 {
+			// A single sweep serves the launch times and the details of the instances
+			instanceIDs := make([]string, 0, len(resources))
+			for _, r := range resources {
+				instanceIDs = append(instanceIDs, resourceIDFromArn(*r.ID))
+			}
+			instances, errGet := iface.getInstances(instanceIDs)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: ec2: getInstances: %v", errGet)
+				return resources, errGet
+			}
+			var filteredResources []*tagsData
+			for _, r := range resources {
+				instance, ok := instances[resourceIDFromArn(*r.ID)]
+				var launchTime *time.Time
+				if ok {
+					launchTime = instance.LaunchTime
+				}
+				if job.exceedsMaxAge(launchTime) {
+					resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+					continue
+				}
+				details := instanceDetails(instance)
+				if len(job.InstanceFilters) > 0 && !(tagsData{Tags: details}).filterThroughTagsWithMode(job.InstanceFilters, job.SearchTagsMode) {
+					resourcesDroppedCounter.WithLabelValues(job.Type, "instance_filters").Inc()
+					continue
+				}
+				if ok && job.InfoCreationTime {
+					r.CreatedAt = launchTime
+				}
+				if ok && job.InstanceDetails {
+					if r.Labels == nil {
+						r.Labels = make(map[string]string)
+					}
+					for _, detail := range details {
+						r.Labels[detail.Key] = detail.Value
+					}
+				}
+				observeResourceAge(job.Type, launchTime)
+				filteredResources = append(filteredResources, r)
+			}
+			resources = filteredResources
+		}
+		if job.IgnoreTerminated {
+			terminated, errGet := iface.getTerminatedInstances()
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: ec2: getTerminatedInstances: %v", errGet)
+				return resources, errGet
+			}
+			var filteredResources []*tagsData
+			for _, r := range resources {
+				if terminated[resourceIDFromArn(*r.ID)] {
+					resourcesDroppedCounter.WithLabelValues(job.Type, "terminated").Inc()
+					continue
+				}
+				filteredResources = append(filteredResources, r)
+			}
+			resources = filteredResources
+		}
+	case "ebs":
+		if !job.VolumeAttachments {
+			break
+		}
+		attachments, errGet := iface.getVolumeAttachments(resources)
+		if errGet != nil {
+			log.Errorf("tagsInterface.get: ebs: getVolumeAttachments: %v", errGet)
+		}
+		for _, r := range resources {
+			if instanceIDs, ok := attachments[resourceIDFromArn(*r.ID)]; ok && len(instanceIDs) > 0 {
+				r.Labels = map[string]string{"instance_id": strings.Join(instanceIDs, ",")}
+			}
+		}
+	case "ngw":
+		if !job.NatGatewayPlacement {
+			break
+		}
+		placements, errGet := iface.getNatGatewayPlacements(resources)
+		if errGet != nil {
+			log.Errorf("tagsInterface.get: ngw: getNatGatewayPlacements: %v", errGet)
+		}
+		for _, r := range resources {
+			if placement, ok := placements[resourceIDFromArn(*r.ID)]; ok && placement.subnetID != "" {
+				r.Labels = map[string]string{"subnet_id": placement.subnetID, "availability_zone": placement.availabilityZone}
+			}
+		}
+	case "vpn":
+		if job.VpnTunnels {
+			// Tunnel metrics are only dimensioned by the outside IP address of the tunnel
+			tunnels, errGet := iface.getVpnTunnels(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: vpn: getVpnTunnels: %v", errGet)
+			}
+			resources = append(resources, tunnels...)
+		}
+	case "appsync":
+		if job.AppSyncResolvers {
+			resolvers, errGet := iface.getAppSyncResolvers(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: appsync: getAppSyncResolvers: %v", errGet)
+			}
+			resources = append(resources, resolvers...)
+		}
+	case "efs-ap":
+		// Access points have no metrics of their own, they are reported through their file system
+		var filteredResources []*tagsData
+		for _, r := range resources {
+			fileSystemID, errGet := iface.getAccessPointFileSystem(*r.ID)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: efs-ap: resource=%s could not find file system: %v", *r.ID, errGet)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "file_system_not_found").Inc()
+				continue // exclude resource to avoid crash later
+			}
+			r.Matcher = &fileSystemID
+			filteredResources = append(filteredResources, r)
+		}
+		resources = filteredResources
+	case "lambda":
+		if job.LambdaAliases {
+			aliases, errGet := iface.getLambdaAliases(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: lambda: getLambdaAliases: %v", errGet)
+			}
+			resources = append(resources, aliases...)
+		}
+	case "ec":
+		if job.EngineVersions {
+			versions, errGet := cachedEngineVersions(resources, iface.getCacheClusterEngineVersions)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: ec: getCacheClusterEngineVersions: %v", errGet)
+			}
+			addEngineVersionLabels(resources, versions)
+		}
+		if job.CacheNodes {
+			nodes, errGet := iface.getCacheNodes(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: ec: getCacheNodes: %v", errGet)
+			}
+			resources = append(resources, nodes...)
+		}
+	case "fsx-lustre", "fsx-ontap", "fsx-openzfs", "fsx-windows":
+		fileSystemTypes, errGet := iface.getFileSystemTypes()
+		if errGet != nil {
+			log.Errorf("tagsInterface.get: %s: getFileSystemTypes: %v", job.Type, errGet)
+			return resources, errGet
+		}
+		var filteredResources []*tagsData
+		for _, r := range resources {
+			if fileSystemTypes[*r.ID] == fsxFileSystemTypes[job.Type] {
+				filteredResources = append(filteredResources, r)
+			}
+		}
+		resources = filteredResources
+	case "firehose":
+		if job.FirehoseDestinations {
+			destinations, errGet := iface.getFirehoseDestinations(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: firehose: getFirehoseDestinations: %v", errGet)
+			}
+			for _, r := range resources {
+				destination, ok := destinations[*r.ID]
+				if !ok {
+					destination = "unknown"
+				}
+				r.Labels = map[string]string{"destination": destination}
+			}
+		}
+	case "alb":
+		if job.LoadBalancerLabels {
+			loadBalancers, errGet := iface.getTargetGroupLoadBalancers(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: alb: getTargetGroupLoadBalancers: %v", errGet)
+			}
+			for _, r := range resources {
+				if names, ok := loadBalancers[*r.ID]; ok {
+					r.Labels = map[string]string{"load_balancer": strings.Join(names, ",")}
+				}
+			}
+		}
+	case "cf":
+		if job.CloudFrontDomains {
+			domains, errGet := iface.getDistributionDomains(resources)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: cf: getDistributionDomains: %v", errGet)
+			}
+			for _, r := range resources {
+				if d, ok := domains[*r.ID]; ok {
+					r.Labels = map[string]string{"domain_name": d.domainName, "aliases": strings.Join(d.aliases, ",")}
+				}
+			}
+		}
+	case "rds":
+		if job.MaxAge > 0 {
+			createTimes, errGet := iface.getDBInstanceCreateTimes()
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: rds: getDBInstanceCreateTimes: %v", errGet)
+				return resources, errGet
+			}
+			var filteredResources []*tagsData
+			for _, r := range resources {
+				if job.exceedsMaxAge(createTimes[*r.ID]) {
+					resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+					continue
+				}
+				observeResourceAge(job.Type, createTimes[*r.ID])
+				filteredResources = append(filteredResources, r)
+			}
+			resources = filteredResources
+		}
+		if job.EngineVersions {
+			versions, errGet := cachedEngineVersions(resources, iface.getDBInstanceEngineVersions)
+			if errGet != nil {
+				log.Errorf("tagsInterface.get: rds: getDBInstanceEngineVersions: %v", errGet)
+			}
+			addEngineVersionLabels(resources, versions)
+		}
+	case "rds-proxy":
+		// The proxy ARN contains its ID, the metrics use its name
+		proxyNames, errGet := iface.getDBProxyNames()
 		if errGet != nil {
+			log.Errorf("tagsInterface.get: rds-proxy: getDBProxyNames: %v", errGet)
+			return resources, errGet
+		}
+		var filteredResources []*tagsData
+		for _, r := range resources {
+			proxyName, ok := proxyNames[*r.ID]
+			if !ok {
+				log.Errorf("tagsInterface.get: rds-proxy: resource=%s could not find proxy", *r.ID)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "proxy_not_found").Inc()
+				continue // exclude resource to avoid crash later
+			}
+			r.Matcher = aws.String(proxyName)
+			filteredResources = append(filteredResources, r)
+		}
+		resources = filteredResources
+	case "apigateway":
+		// Get all the api gateways from aws, a slow GetRestApis must not block the scrape
+		ctx, cancel := context.WithTimeout(discoveryCtx, *apiGatewayTimeout)
+		apiGateways, errGet := iface.getCachedApiGateway(ctx, region)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			log.Warningf("tagsInterface.get: apigateway: getTaggedApiGateway timed out after %s, using the IDs of the gateways not found yet as name: %v", *apiGatewayTimeout, errGet)
+		} else if errGet != nil {
 			log.Errorf("tagsInterface.get: apigateway: getTaggedApiGateway: %v", errGet)
 			return resources, errGet
 		}
@@ -166,124 +1041,2001 @@ func (iface tagsInterface) get(job job, region string) (resources []*tagsData, e
 		for _, r := range resources {
 			// For each tagged resource, find the associated restApi
 			// And swap out the ID with the name
-			if strings.Contains(*r.ID, "/restapis") {
-				restApiId := strings.Split(*r.ID, "/")[2]
-				for _, apiGateway := range apiGateways.Items {
-					if *apiGateway.Id == restApiId {
-						r.Matcher = apiGateway.Name
-					}
-				}
-				if r.Matcher == nil {
-					log.Errorf("tagsInterface.get: apigateway: resource=%s restApiId=%s could not find gateway", *r.ID, restApiId)
-					continue // exclude resource to avoid crash later
+			if !strings.Contains(*r.ID, "/restapis") {
+				resourcesDroppedCounter.WithLabelValues(job.Type, "not_rest_api").Inc()
+				continue
+			}
+			restApiId := strings.Split(*r.ID, "/")[2]
+			for _, apiGateway := range apiGateways.Items {
+				if *apiGateway.Id == restApiId {
+					r.Matcher = apiGateway.Name
 				}
-				filteredResources = append(filteredResources, r)
 			}
+			if r.Matcher == nil && timedOut {
+				r.Matcher = aws.String(restApiId)
+			}
+			if r.Matcher == nil {
+				log.Errorf("tagsInterface.get: apigateway: resource=%s restApiId=%s could not find gateway", *r.ID, restApiId)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "api_gateway_not_found").Inc()
+				continue // exclude resource to avoid crash later
+			}
+			filteredResources = append(filteredResources, r)
 		}
 		resources = filteredResources
 	}
 
-	return resources, resourcePages
+	return resources, err
 }
 
 // Once the resourcemappingapi supports ASGs then this workaround method can be deleted
 // https://docs.aws.amazon.com/sdk-for-go/api/service/resourcegroupstaggingapi/
 func (iface tagsInterface) getTaggedAutoscalingGroups(job job, region string) (resources []*tagsData, err error) {
-	ctx := context.Background()
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
 	pageNum := 0
-	return resources, iface.asgClient.DescribeAutoScalingGroupsPagesWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{},
+	pool := newDescribePagePool(*describeConcurrency)
+	err = iface.asgClient.DescribeAutoScalingGroupsPagesWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{},
 		func(page *autoscaling.DescribeAutoScalingGroupsOutput, more bool) bool {
 			pageNum++
 			autoScalingAPICounter.Inc()
 
-			for _, asg := range page.AutoScalingGroups {
-				resource := tagsData{}
+			groups := page.AutoScalingGroups
+			pool.process(func() (pageResources []*tagsData) {
+				for _, asg := range groups {
+					if job.IgnoreTerminated && isAutoscalingGroupDeleting(asg) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "terminated").Inc()
+						continue
+					}
+					if job.exceedsMaxAge(asg.CreatedTime) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+						continue
+					}
+					asgArn, parseErr := arn.Parse(*asg.AutoScalingGroupARN)
+					if parseErr != nil {
+						log.Warningf("Unable to parse ARN (%s) on %s due to %v", *asg.AutoScalingGroupARN, job.Type, parseErr)
+						resourcesDroppedCounter.WithLabelValues(job.Type, "malformed_arn").Inc()
+						continue
+					}
+					resource := tagsData{}
 
-				// Transform the ASG ARN into something which looks more like an ARN from the ResourceGroupTaggingAPI
-				parts := strings.Split(*asg.AutoScalingGroupARN, ":")
-				resource.ID = aws.String(fmt.Sprintf("arn:%s:autoscaling:%s:%s:%s", parts[1], parts[3], parts[4], parts[7]))
+					if job.OriginalAsgArns {
+						resource.ID = asg.AutoScalingGroupARN
+					} else {
+						// Transform the ASG ARN into something which looks more like an ARN from the ResourceGroupTaggingAPI,
+						// keeping its partition (aws, aws-cn, aws-us-gov): autoScalingGroup:uuid:autoScalingGroupName/name
+						groupName := asgArn.Resource[strings.LastIndex(asgArn.Resource, ":")+1:]
+						resource.ID = aws.String(fmt.Sprintf("arn:%s:autoscaling:%s:%s:%s", asgArn.Partition, asgArn.Region, asgArn.AccountID, groupName))
+					}
 
-				resource.Service = &job.Type
-				resource.Region = &region
+					resource.Service = &job.Type
+					resource.Region = &region
+					if job.InfoCreationTime {
+						resource.CreatedAt = asg.CreatedTime
+					}
 
+					for _, t := range asg.Tags {
+						resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+					}
+
+					if resource.filterThroughJobTags(job) {
+						observeResourceAge(job.Type, asg.CreatedTime)
+						pageResources = append(pageResources, &resource)
+					}
+				}
+				return pageResources
+			})
+			return pageNum < 100
+		}, withRateLimit("autoscaling"))
+	resources = pool.wait()
+	return resources, wrapPartialResults(err, pageNum, len(resources))
+}
+
+// Get the tags of every ASG by its name, fetched once per discovery and shared by all instances
+func (iface tagsInterface) getAutoScalingGroupTags(job job) (map[string][]*tag, error) {
+	groupTags := make(map[string][]*tag)
+	err := iface.asgClient.DescribeAutoScalingGroupsPagesWithContext(discoveryCtx, &autoscaling.DescribeAutoScalingGroupsInput{},
+		func(page *autoscaling.DescribeAutoScalingGroupsOutput, more bool) bool {
+			autoScalingAPICounter.Inc()
+			for _, asg := range page.AutoScalingGroups {
+				var tags []*tag
 				for _, t := range asg.Tags {
-					resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: *t.Value})
+					tags = append(tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+				}
+				groupTags[*asg.AutoScalingGroupName] = tags
+			}
+			return true
+		}, withRateLimit("autoscaling"))
+	return groupTags, err
+}
+
+// Add the tags of the ASG which launched the instance, the tags of the instance itself take precedence
+func (r *tagsData) mergeAutoScalingGroupTags(groupTags map[string][]*tag) {
+	var groupName string
+	keys := make(map[string]bool, len(r.Tags))
+	for _, t := range r.Tags {
+		keys[t.Key] = true
+		if t.Key == "aws:autoscaling:groupName" {
+			groupName = t.Value
+		}
+	}
+	for _, t := range groupTags[groupName] {
+		if !keys[t.Key] {
+			r.Tags = append(r.Tags, t)
+		}
+	}
+}
+
+// An ASG being deleted reports a status of "Delete in progress" while it scales in to zero
+func isAutoscalingGroupDeleting(asg *autoscaling.Group) bool {
+	return asg.Status != nil && *asg.Status == "Delete in progress"
+}
+
+// Get the IDs of all instances which are shutting down or already terminated
+func (iface tagsInterface) getTerminatedInstances() (map[string]bool, error) {
+	ctx := discoveryCtx
+	terminated := make(map[string]bool)
+	input := ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated}),
+		}},
+	}
+	pageNum := 0
+	err := iface.ec2Client.DescribeInstancesPagesWithContext(ctx, &input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		pageNum++
+		ec2APICounter.Inc()
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				terminated[*instance.InstanceId] = true
+			}
+		}
+		return pageNum < 100
+	}, withRateLimit("ec2"))
+	return terminated, err
+}
+
+// The launch time and the details of an instance don't change, the instances are only swept again once one of the
+// discovered instances isn't cached or expired, so the state of an instance is refreshed every few scrapes
+const instancesCacheTTL = 5 * time.Minute
+
+var instancesCache = struct {
+	sync.Mutex
+	instances map[string]cachedInstance
+}{instances: make(map[string]cachedInstance)}
+
+type cachedInstance struct {
+	// nil for an instance the sweep didn't return
+	instance *ec2.Instance
+	expires  time.Time
+}
+
+// Get the instances by their ID, the instances which weren't found are missing
+func (iface tagsInterface) getInstances(instanceIDs []string) (map[string]*ec2.Instance, error) {
+	now := time.Now()
+	instances := make(map[string]*ec2.Instance)
+	missing := false
+	instancesCache.Lock()
+	for _, instanceID := range instanceIDs {
+		cached, ok := instancesCache.instances[instanceID]
+		if !ok || !now.Before(cached.expires) {
+			missing = true
+			break
+		}
+		if cached.instance != nil {
+			instances[instanceID] = cached.instance
+		}
+	}
+	instancesCache.Unlock()
+	if !missing {
+		return instances, nil
+	}
+
+	ctx := discoveryCtx
+	described := make(map[string]*ec2.Instance)
+	pageNum := 0
+	err := iface.ec2Client.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		pageNum++
+		ec2APICounter.Inc()
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				described[*instance.InstanceId] = instance
+			}
+		}
+		return pageNum < 100
+	}, withRateLimit("ec2"))
+	if err != nil {
+		return described, err
+	}
+
+	expires := now.Add(instancesCacheTTL)
+	instancesCache.Lock()
+	// The instances terminated since aren't discovered anymore, their expired entries are pruned
+	for instanceID, cached := range instancesCache.instances {
+		if !now.Before(cached.expires) {
+			delete(instancesCache.instances, instanceID)
+		}
+	}
+	for instanceID, instance := range described {
+		instancesCache.instances[instanceID] = cachedInstance{instance: instance, expires: expires}
+	}
+	// The instances the sweep didn't return aren't swept again every scrape
+	for _, instanceID := range instanceIDs {
+		if _, ok := described[instanceID]; !ok {
+			instancesCache.instances[instanceID] = cachedInstance{expires: expires}
+		}
+	}
+	instancesCache.Unlock()
+	return described, nil
+}
+
+// The attributes of an instance which can be filtered on and exported like tags, none for an unknown instance
+func instanceDetails(instance *ec2.Instance) []*tag {
+	if instance == nil {
+		return nil
+	}
+	// The platform is only set for Windows instances
+	platform := "linux"
+	if instance.Platform != nil {
+		platform = strings.ToLower(*instance.Platform)
+	}
+	return []*tag{
+		{Key: "instance_type", Value: aws.StringValue(instance.InstanceType)},
+		{Key: "platform", Value: platform},
+	}
+}
+
+// Create a resource for every tunnel of the given VPN connections, identified by the tunnel outside IP address
+func (iface tagsInterface) getVpnTunnels(connections []*tagsData) (tunnels []*tagsData, err error) {
+	if len(connections) == 0 {
+		return nil, nil
+	}
+	byID := make(map[string]*tagsData)
+	var ids []*string
+	for _, connection := range connections {
+		id := resourceIDFromArn(*connection.ID)
+		byID[id] = connection
+		ids = append(ids, aws.String(id))
+	}
+	ctx := discoveryCtx
+	ec2APICounter.Inc()
+	output, err := iface.ec2Client.DescribeVpnConnectionsWithContext(ctx, &ec2.DescribeVpnConnectionsInput{VpnConnectionIds: ids}, withRateLimit("ec2"))
+	if err != nil {
+		return nil, err
+	}
+	for _, vpn := range output.VpnConnections {
+		connection, ok := byID[*vpn.VpnConnectionId]
+		if !ok {
+			continue
+		}
+		for _, telemetry := range vpn.VgwTelemetry {
+			if telemetry.OutsideIpAddress == nil {
+				continue
+			}
+			tunnel := *connection
+			tunnel.ID = aws.String(*connection.ID + "/" + *telemetry.OutsideIpAddress)
+			tunnel.Matcher = telemetry.OutsideIpAddress
+			tunnels = append(tunnels, &tunnel)
+		}
+	}
+	return tunnels, nil
+}
+
+func resourceIDFromArn(resourceArn string) string {
+	parts := strings.Split(resourceArn, "/")
+	return parts[len(parts)-1]
+}
+
+// A cancelled spot fleet request keeps being described while its instances are terminated
+func isSpotFleetCancelled(fleet *ec2.SpotFleetRequestConfig) bool {
+	if fleet.SpotFleetRequestState == nil {
+		return false
+	}
+	switch *fleet.SpotFleetRequestState {
+	case ec2.BatchStateCancelled, ec2.BatchStateCancelledRunning, ec2.BatchStateCancelledTerminating:
+		return true
+	}
+	return false
+}
+
+func isTransitGatewayRouteTableDeleting(routeTable *ec2.TransitGatewayRouteTable) bool {
+	if routeTable.State == nil {
+		return false
+	}
+	switch *routeTable.State {
+	case ec2.TransitGatewayRouteTableStateDeleting, ec2.TransitGatewayRouteTableStateDeleted:
+		return true
+	}
+	return false
+}
+
+func isTransitGatewayAttachmentDeleting(tgwa *ec2.TransitGatewayAttachment) bool {
+	if tgwa.State == nil {
+		return false
+	}
+	switch *tgwa.State {
+	case ec2.TransitGatewayAttachmentStateDeleting, ec2.TransitGatewayAttachmentStateDeleted:
+		return true
+	}
+	return false
+}
+
+// Create a resource for every resolver of the given GraphQL APIs, identified by its type and field name
+func (iface tagsInterface) getAppSyncResolvers(apis []*tagsData) (resolvers []*tagsData, err error) {
+	ctx := discoveryCtx
+	for _, api := range apis {
+		apiID := resourceIDFromArn(*api.ID)
+		var typeNames []*string
+		typesInput := appsync.ListTypesInput{ApiId: &apiID, Format: aws.String(appsync.TypeDefinitionFormatSdl)}
+		for {
+			appSyncAPICounter.Inc()
+			page, err := iface.appSyncClient.ListTypesWithContext(ctx, &typesInput, withRateLimit("appsync"))
+			if err != nil {
+				return resolvers, err
+			}
+			for _, t := range page.Types {
+				typeNames = append(typeNames, t.Name)
+			}
+			if page.NextToken == nil {
+				break
+			}
+			typesInput.NextToken = page.NextToken
+		}
+
+		for _, typeName := range typeNames {
+			resolversInput := appsync.ListResolversInput{ApiId: &apiID, TypeName: typeName}
+			for {
+				appSyncAPICounter.Inc()
+				page, err := iface.appSyncClient.ListResolversWithContext(ctx, &resolversInput, withRateLimit("appsync"))
+				if err != nil {
+					return resolvers, err
+				}
+				for _, r := range page.Resolvers {
+					resolver := *api
+					resolver.ID = r.ResolverArn
+					resolver.Matcher = aws.String(*r.TypeName + "." + *r.FieldName)
+					resolvers = append(resolvers, &resolver)
+				}
+				if page.NextToken == nil {
+					break
+				}
+				resolversInput.NextToken = page.NextToken
+			}
+		}
+	}
+	return resolvers, nil
+}
+
+// Get the nodes of the cache clusters, their metrics are dimensioned by the cluster and the node
+func (iface tagsInterface) getCacheNodes(clusters []*tagsData) (nodes []*tagsData, err error) {
+	if len(clusters) == 0 {
+		return nil, nil
+	}
+	byArn := make(map[string]*tagsData)
+	for _, cluster := range clusters {
+		byArn[*cluster.ID] = cluster
+	}
+	ctx := discoveryCtx
+	input := elasticache.DescribeCacheClustersInput{ShowCacheNodeInfo: aws.Bool(true)}
+	err = iface.ecClient.DescribeCacheClustersPagesWithContext(ctx, &input, func(page *elasticache.DescribeCacheClustersOutput, lastPage bool) bool {
+		elastiCacheAPICounter.Inc()
+		for _, cacheCluster := range page.CacheClusters {
+			if cacheCluster.ARN == nil {
+				continue
+			}
+			cluster, ok := byArn[*cacheCluster.ARN]
+			if !ok {
+				continue
+			}
+			for _, cacheNode := range cacheCluster.CacheNodes {
+				node := *cluster
+				node.ID = aws.String(*cluster.ID + "/" + *cacheNode.CacheNodeId)
+				node.Matcher = cacheNode.CacheNodeId
+				// The nodes keep the labels of their cluster, e.g. its engine version
+				node.Labels = map[string]string{"node_id": *cacheNode.CacheNodeId}
+				for name, value := range cluster.Labels {
+					node.Labels[name] = value
+				}
+				nodes = append(nodes, &node)
+			}
+		}
+		return true
+	}, withRateLimit("elasticache"))
+	return nodes, err
+}
+
+// Aliases can be created, deleted and pointed to other versions at any time, the aliases of a function are listed again
+// once they expire
+const lambdaAliasesCacheTTL = 5 * time.Minute
+
+var lambdaAliasesCache = struct {
+	sync.Mutex
+	aliases map[string]lambdaAliases
+}{aliases: make(map[string]lambdaAliases)}
+
+type lambdaAliases struct {
+	aliases []*lambda.AliasConfiguration
+	expires time.Time
+}
+
+// Get the aliases of the functions, e.g. their provisioned concurrency is reported per function:alias Resource
+func (iface tagsInterface) getLambdaAliases(functions []*tagsData) (aliases []*tagsData, err error) {
+	ctx := discoveryCtx
+	now := time.Now()
+	lambdaAliasesCache.Lock()
+	// The deleted functions aren't discovered anymore, their expired aliases are pruned
+	for functionArn, cached := range lambdaAliasesCache.aliases {
+		if !now.Before(cached.expires) {
+			delete(lambdaAliasesCache.aliases, functionArn)
+		}
+	}
+	lambdaAliasesCache.Unlock()
+	for _, function := range functions {
+		lambdaAliasesCache.Lock()
+		cached, ok := lambdaAliasesCache.aliases[*function.ID]
+		lambdaAliasesCache.Unlock()
+		if !ok || !now.Before(cached.expires) {
+			var configurations []*lambda.AliasConfiguration
+			input := lambda.ListAliasesInput{FunctionName: function.ID}
+			errList := iface.lambdaClient.ListAliasesPagesWithContext(ctx, &input, func(page *lambda.ListAliasesOutput, lastPage bool) bool {
+				lambdaAPICounter.Inc()
+				configurations = append(configurations, page.Aliases...)
+				return true
+			}, withRateLimit("lambda"))
+			if errList != nil {
+				// The function could have been deleted since its discovery, its aliases are skipped
+				err = errList
+				continue
+			}
+			cached = lambdaAliases{aliases: configurations, expires: now.Add(lambdaAliasesCacheTTL)}
+			lambdaAliasesCache.Lock()
+			lambdaAliasesCache.aliases[*function.ID] = cached
+			lambdaAliasesCache.Unlock()
+		}
+
+		// arn:aws:lambda:region:account-id:function:function-name
+		functionName := (*function.ID)[strings.LastIndex(*function.ID, ":")+1:]
+		for _, configuration := range cached.aliases {
+			if configuration.AliasArn == nil || configuration.Name == nil {
+				continue
+			}
+			alias := *function
+			alias.ID = configuration.AliasArn
+			alias.Matcher = aws.String(functionName + ":" + *configuration.Name)
+			// The aliases keep the labels of their function
+			alias.Labels = map[string]string{"alias": *configuration.Name}
+			for name, value := range function.Labels {
+				alias.Labels[name] = value
+			}
+			aliases = append(aliases, &alias)
+		}
+	}
+	return aliases, err
+}
+
+// An access point can't move to another file system, its file system is cached by access point ARN for an hour. The
+// entries expire so the access points deleted since can be pruned.
+const accessPointFileSystemCacheTTL = time.Hour
+
+var accessPointFileSystemCache = struct {
+	sync.Mutex
+	fileSystems map[string]accessPointFileSystem
+}{fileSystems: make(map[string]accessPointFileSystem)}
+
+type accessPointFileSystem struct {
+	fileSystemID string
+	expires      time.Time
+}
+
+// Get the file system an EFS access point belongs to
+func (iface tagsInterface) getAccessPointFileSystem(accessPointArn string) (string, error) {
+	now := time.Now()
+	accessPointFileSystemCache.Lock()
+	cached, ok := accessPointFileSystemCache.fileSystems[accessPointArn]
+	accessPointFileSystemCache.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.fileSystemID, nil
+	}
+
+	ctx := discoveryCtx
+	accessPointID := resourceIDFromArn(accessPointArn)
+	efsAPICounter.Inc()
+	output, err := iface.efsClient.DescribeAccessPointsWithContext(ctx, &efs.DescribeAccessPointsInput{AccessPointId: &accessPointID}, withRateLimit("efs"))
+	if err != nil {
+		return "", err
+	}
+	if len(output.AccessPoints) == 0 {
+		return "", fmt.Errorf("access point %s not found", accessPointID)
+	}
+	fileSystemID := *output.AccessPoints[0].FileSystemId
+	accessPointFileSystemCache.Lock()
+	for cachedArn, cached := range accessPointFileSystemCache.fileSystems {
+		if !now.Before(cached.expires) {
+			delete(accessPointFileSystemCache.fileSystems, cachedArn)
+		}
+	}
+	accessPointFileSystemCache.fileSystems[accessPointArn] = accessPointFileSystem{fileSystemID: fileSystemID, expires: now.Add(accessPointFileSystemCacheTTL)}
+	accessPointFileSystemCache.Unlock()
+	return fileSystemID, nil
+}
+
+// Get all ApiGateways REST
+// Returns the gateways of the pages received so far along with the error
+func (iface tagsInterface) getTaggedApiGateway(ctx context.Context) (*apigateway.GetRestApisOutput, error) {
+	apiGatewayAPICounter.Inc()
+	var limit int64 = 500 // max number of results per page. default=25, max=500
+	const maxPages = 10
+	input := apigateway.GetRestApisInput{Limit: &limit}
+	output := apigateway.GetRestApisOutput{}
+	var pageNum int
+	err := iface.apiGatewayClient.GetRestApisPagesWithContext(ctx, &input, func(page *apigateway.GetRestApisOutput, lastPage bool) bool {
+		pageNum++
+		output.Items = append(output.Items, page.Items...)
+		return pageNum <= maxPages
+	}, withRateLimit("apigateway"))
+	return &output, err
+}
+
+// The REST APIs of a region and role, shared by the apigateway jobs of a scrape for --apigateway-cache-ttl
+var restApisCache = struct {
+	sync.Mutex
+	entries map[string]restApisCacheEntry
+}{entries: make(map[string]restApisCacheEntry)}
+
+type restApisCacheEntry struct {
+	restApis *apigateway.GetRestApisOutput
+	expires  time.Time
+}
+
+// Get the REST APIs from the cache while they are fresh, only complete listings are cached
+func (iface tagsInterface) getCachedApiGateway(ctx context.Context, region string) (*apigateway.GetRestApisOutput, error) {
+	if *apiGatewayCacheTTL <= 0 {
+		return iface.getTaggedApiGateway(ctx)
+	}
+	key := region + "/" + iface.roleArn
+	restApisCache.Lock()
+	entry, ok := restApisCache.entries[key]
+	restApisCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		apiGatewayCacheHitsCounter.Inc()
+		return entry.restApis, nil
+	}
+
+	restApis, err := iface.getTaggedApiGateway(ctx)
+	if err == nil {
+		now := time.Now()
+		restApisCache.Lock()
+		// The roles and regions removed from the configuration aren't scraped anymore, their expired entries are evicted
+		for cachedKey, cached := range restApisCache.entries {
+			if !now.Before(cached.expires) {
+				delete(restApisCache.entries, cachedKey)
+			}
+		}
+		restApisCache.entries[key] = restApisCacheEntry{restApis: restApis, expires: now.Add(*apiGatewayCacheTTL)}
+		restApisCache.Unlock()
+	}
+	return restApis, err
+}
+
+// The destination of a delivery stream can be updated in place, the stream is described again once its destination
+// expires
+const firehoseDestinationCacheTTL = 5 * time.Minute
+
+var firehoseDestinationCache = struct {
+	sync.Mutex
+	destinations map[string]firehoseDestination
+}{destinations: make(map[string]firehoseDestination)}
+
+type firehoseDestination struct {
+	destination string
+	expires     time.Time
+}
+
+// The load balancers of a target group change when it is attached or detached, the target groups are swept again once
+// one of them expires. The target groups without any, or which weren't described, are cached too so they aren't swept
+// every scrape.
+const targetGroupLoadBalancersCacheTTL = 5 * time.Minute
+
+var targetGroupLoadBalancersCache = struct {
+	sync.Mutex
+	loadBalancers map[string]targetGroupLoadBalancers
+}{loadBalancers: make(map[string]targetGroupLoadBalancers)}
+
+type targetGroupLoadBalancers struct {
+	names []string
+	// Whether the target group was described, i.e. whether it has the label
+	described bool
+	expires   time.Time
+}
+
+// Get the load balancers of the target groups by target group ARN, named like the LoadBalancer dimension, e.g.
+// app/my-alb/50dc6c495c0c9188
+func (iface tagsInterface) getTargetGroupLoadBalancers(resources []*tagsData) (map[string][]string, error) {
+	now := time.Now()
+	loadBalancers := make(map[string][]string)
+	var missing []string
+	targetGroupLoadBalancersCache.Lock()
+	for _, r := range resources {
+		if !strings.Contains(*r.ID, ":targetgroup/") {
+			continue
+		}
+		if cached, ok := targetGroupLoadBalancersCache.loadBalancers[*r.ID]; ok && now.Before(cached.expires) {
+			if cached.described {
+				loadBalancers[*r.ID] = cached.names
+			}
+		} else {
+			missing = append(missing, *r.ID)
+		}
+	}
+	targetGroupLoadBalancersCache.Unlock()
+	if len(missing) == 0 {
+		return loadBalancers, nil
+	}
+
+	// All the target groups of the region are described at once rather than by batches of ARNs
+	described := make(map[string][]string)
+	err := iface.elbv2Client.DescribeTargetGroupsPagesWithContext(discoveryCtx, &elbv2.DescribeTargetGroupsInput{}, func(page *elbv2.DescribeTargetGroupsOutput, lastPage bool) bool {
+		elbv2APICounter.Inc()
+		for _, targetGroup := range page.TargetGroups {
+			var names []string
+			for _, loadBalancerArn := range targetGroup.LoadBalancerArns {
+				names = append(names, (*loadBalancerArn)[strings.Index(*loadBalancerArn, ":loadbalancer/")+len(":loadbalancer/"):])
+			}
+			sort.Strings(names)
+			described[*targetGroup.TargetGroupArn] = names
+		}
+		return true
+	}, withRateLimit("elasticloadbalancing"))
+	if err != nil {
+		return loadBalancers, err
+	}
+
+	expires := now.Add(targetGroupLoadBalancersCacheTTL)
+	targetGroupLoadBalancersCache.Lock()
+	// The deleted target groups aren't discovered anymore, their expired entries are pruned
+	for targetGroupArn, cached := range targetGroupLoadBalancersCache.loadBalancers {
+		if !now.Before(cached.expires) {
+			delete(targetGroupLoadBalancersCache.loadBalancers, targetGroupArn)
+		}
+	}
+	for targetGroupArn, names := range described {
+		loadBalancers[targetGroupArn] = names
+		targetGroupLoadBalancersCache.loadBalancers[targetGroupArn] = targetGroupLoadBalancers{names: names, described: true, expires: expires}
+	}
+	for _, targetGroupArn := range missing {
+		if _, ok := described[targetGroupArn]; !ok {
+			targetGroupLoadBalancersCache.loadBalancers[targetGroupArn] = targetGroupLoadBalancers{expires: expires}
+		}
+	}
+	targetGroupLoadBalancersCache.Unlock()
+	return loadBalancers, nil
+}
+
+type distributionDomains struct {
+	domainName string
+	aliases    []string
+	// Whether the distribution was listed, i.e. whether it has the labels
+	listed  bool
+	expires time.Time
+}
+
+// The aliases of a distribution can be updated in place, the distributions are listed again once one of them expires.
+// The distributions which weren't listed are cached too so they aren't swept every scrape.
+const distributionDomainsCacheTTL = 5 * time.Minute
+
+var distributionDomainsCache = struct {
+	sync.Mutex
+	domains map[string]distributionDomains
+}{domains: make(map[string]distributionDomains)}
+
+// Get the CloudFront domain name (d123.cloudfront.net) and the sorted CNAME aliases of the distributions by
+// distribution ARN
+func (iface tagsInterface) getDistributionDomains(resources []*tagsData) (map[string]distributionDomains, error) {
+	now := time.Now()
+	domains := make(map[string]distributionDomains)
+	var missing []string
+	distributionDomainsCache.Lock()
+	for _, r := range resources {
+		if cached, ok := distributionDomainsCache.domains[*r.ID]; ok && now.Before(cached.expires) {
+			if cached.listed {
+				domains[*r.ID] = cached
+			}
+		} else {
+			missing = append(missing, *r.ID)
+		}
+	}
+	distributionDomainsCache.Unlock()
+	if len(missing) == 0 {
+		return domains, nil
+	}
+
+	// All the distributions of the account are listed at once rather than got one by one
+	expires := now.Add(distributionDomainsCacheTTL)
+	listed := make(map[string]distributionDomains)
+	err := iface.cfClient.ListDistributionsPagesWithContext(discoveryCtx, &cloudfront.ListDistributionsInput{}, func(page *cloudfront.ListDistributionsOutput, lastPage bool) bool {
+		cloudFrontAPICounter.Inc()
+		if page.DistributionList == nil {
+			return true
+		}
+		for _, distribution := range page.DistributionList.Items {
+			d := distributionDomains{domainName: aws.StringValue(distribution.DomainName), listed: true, expires: expires}
+			if distribution.Aliases != nil {
+				d.aliases = aws.StringValueSlice(distribution.Aliases.Items)
+				sort.Strings(d.aliases)
+			}
+			listed[aws.StringValue(distribution.ARN)] = d
+		}
+		return true
+	}, withRateLimit("cloudfront"))
+	if err != nil {
+		return domains, err
+	}
+
+	distributionDomainsCache.Lock()
+	// The deleted distributions aren't discovered anymore, their expired domains are pruned
+	for distributionArn, cached := range distributionDomainsCache.domains {
+		if !now.Before(cached.expires) {
+			delete(distributionDomainsCache.domains, distributionArn)
+		}
+	}
+	for distributionArn, d := range listed {
+		domains[distributionArn] = d
+		distributionDomainsCache.domains[distributionArn] = d
+	}
+	for _, distributionArn := range missing {
+		if _, ok := listed[distributionArn]; !ok {
+			distributionDomainsCache.domains[distributionArn] = distributionDomains{expires: expires}
+		}
+	}
+	distributionDomainsCache.Unlock()
+	return domains, nil
+}
+
+type natGatewayPlacement struct {
+	subnetID         string
+	availabilityZone string
+	expires          time.Time
+}
+
+// Get the ARNs of the members of a resource group which have one of the resource types of the job, a group can
+// contain the resources of several services
+func (iface tagsInterface) getResourceGroupMembers(groupName string, resourceTypeFilters []string) ([]string, error) {
+	var members []string
+	input := resourcegroups.ListGroupResourcesInput{GroupName: aws.String(groupName)}
+	err := iface.resGroupsClient.ListGroupResourcesPagesWithContext(discoveryCtx, &input, func(page *resourcegroups.ListGroupResourcesOutput, lastPage bool) bool {
+		resourceGroupsAPICounter.Inc()
+		for _, queryErr := range page.QueryErrors {
+			log.Warningf("tagsInterface.get: resource group %s: %s: %s", groupName, aws.StringValue(queryErr.ErrorCode), aws.StringValue(queryErr.Message))
+		}
+		for _, identifier := range page.ResourceIdentifiers {
+			if identifier.ResourceArn != nil && arnMatchesResourceTypes(*identifier.ResourceArn, resourceTypeFilters) {
+				members = append(members, *identifier.ResourceArn)
+			}
+		}
+		return true
+	}, withRateLimit("resourcegroups"))
+	return members, err
+}
+
+// Whether the ARN has one of the resource types of the tagging API, e.g. ec2:instance or
+// elasticloadbalancing:loadbalancer/app
+func arnMatchesResourceTypes(resourceArn string, resourceTypeFilters []string) bool {
+	parsed, err := arn.Parse(resourceArn)
+	if err != nil {
+		return false
+	}
+	resource := strings.TrimPrefix(parsed.Resource, "/")
+	for _, filter := range resourceTypeFilters {
+		parts := strings.SplitN(filter, ":", 2)
+		if parts[0] != parsed.Service {
+			continue
+		}
+		if len(parts) == 1 || resource == parts[1] || strings.HasPrefix(resource, parts[1]+"/") || strings.HasPrefix(resource, parts[1]+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Readers of the tags of a resource through the API of its service, the tagging API can't be asked for given ARNs
+var arnTagListers = map[string]func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error){
+	"alb": func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error) {
+		return iface.listLoadBalancerTags(ctx, resourceArn)
+	},
+	"ec": func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error) {
+		elastiCacheAPICounter.Inc()
+		output, err := iface.ecClient.ListTagsForResourceWithContext(ctx, &elasticache.ListTagsForResourceInput{ResourceName: aws.String(resourceArn)}, withRateLimit("elasticache"))
+		if err != nil {
+			return nil, err
+		}
+		var tags []*tag
+		for _, t := range output.TagList {
+			tags = append(tags, &tag{Key: *t.Key, Value: aws.StringValue(t.Value)})
+		}
+		return tags, nil
+	},
+	"gwlb": func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error) {
+		return iface.listLoadBalancerTags(ctx, resourceArn)
+	},
+	"lambda": func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error) {
+		lambdaAPICounter.Inc()
+		output, err := iface.lambdaClient.ListTagsWithContext(ctx, &lambda.ListTagsInput{Resource: aws.String(resourceArn)}, withRateLimit("lambda"))
+		if err != nil {
+			return nil, err
+		}
+		var tags []*tag
+		for key, value := range output.Tags {
+			tags = append(tags, &tag{Key: key, Value: aws.StringValue(value)})
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+		return tags, nil
+	},
+	"nlb": func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error) {
+		return iface.listLoadBalancerTags(ctx, resourceArn)
+	},
+	"rds": func(iface tagsInterface, ctx context.Context, resourceArn string) ([]*tag, error) {
+		rdsAPICounter.Inc()
+		output, err := iface.rdsClient.ListTagsForResourceWithContext(ctx, &rds.ListTagsForResourceInput{ResourceName: aws.String(resourceArn)}, withRateLimit("rds"))
+		if err != nil {
+			return nil, err
+		}
+		var tags []*tag
+		for _, t := range output.TagList {
+			tags = append(tags, &tag{Key: *t.Key, Value: aws.StringValue(t.Value)})
+		}
+		return tags, nil
+	},
+}
+
+func (iface tagsInterface) listLoadBalancerTags(ctx context.Context, resourceArn string) ([]*tag, error) {
+	elbv2APICounter.Inc()
+	output, err := iface.elbv2Client.DescribeTagsWithContext(ctx, &elbv2.DescribeTagsInput{ResourceArns: []*string{aws.String(resourceArn)}}, withRateLimit("elasticloadbalancing"))
+	if err != nil {
+		return nil, err
+	}
+	var tags []*tag
+	for _, description := range output.TagDescriptions {
+		for _, t := range description.Tags {
+			tags = append(tags, &tag{Key: *t.Key, Value: aws.StringValue(t.Value)})
+		}
+	}
+	return tags, nil
+}
+
+// Keep the arns of the resources in the region, the ARNs are validated when the configuration is loaded. The ARNs of
+// the global resources have no region (e.g. s3 buckets and cloudfront distributions), they are scraped in the first
+// region of the job.
+func arnsInRegion(j job, region string) []string {
+	var inRegion []string
+	for _, resourceArn := range j.Arns {
+		parsed, err := arn.Parse(resourceArn)
+		if err != nil {
+			continue
+		}
+		if parsed.Region == region || parsed.Region == "" && region == j.Regions[0] {
+			inRegion = append(inRegion, resourceArn)
+		}
+	}
+	return inRegion
+}
+
+// Get the tags of the arns of the job by ARN through the API of the service. The resources whose tags can't be read,
+// e.g. as they were deleted, are kept without tags.
+func (iface tagsInterface) getArnTags(job job) (map[string][]*tag, error) {
+	ctx := discoveryCtx
+	listTags := arnTagListers[job.Type]
+	tags := make(map[string][]*tag, len(job.Arns))
+	var err error
+	for _, resourceArn := range job.Arns {
+		resourceTags, errList := listTags(iface, ctx, resourceArn)
+		if errList != nil {
+			err = errList
+			continue
+		}
+		for _, t := range resourceTags {
+			t.Value = job.NormalizeTagValues.apply(t.Value)
+		}
+		tags[resourceArn] = resourceTags
+	}
+	return tags, err
+}
+
+// A volume can be detached and attached to another instance, its attachments are described again once they expire
+const volumeAttachmentsCacheTTL = 5 * time.Minute
+
+var volumeAttachmentsCache = struct {
+	sync.Mutex
+	attachments map[string]volumeAttachments
+}{attachments: make(map[string]volumeAttachments)}
+
+type volumeAttachments struct {
+	instanceIDs []string
+	expires     time.Time
+}
+
+// Get the IDs of the instances the volumes are attached to by volume ID, sorted as a volume can be attached to several
+// instances (multi-attach). Detached volumes have no instances.
+func (iface tagsInterface) getVolumeAttachments(volumes []*tagsData) (map[string][]string, error) {
+	attachments := make(map[string][]string)
+	var missing []*string
+	now := time.Now()
+	volumeAttachmentsCache.Lock()
+	// The deleted volumes aren't discovered anymore, their expired attachments are pruned
+	for volumeID, cached := range volumeAttachmentsCache.attachments {
+		if !now.Before(cached.expires) {
+			delete(volumeAttachmentsCache.attachments, volumeID)
+		}
+	}
+	for _, volume := range volumes {
+		volumeID := resourceIDFromArn(*volume.ID)
+		if cached, ok := volumeAttachmentsCache.attachments[volumeID]; ok {
+			attachments[volumeID] = cached.instanceIDs
+		} else {
+			missing = append(missing, aws.String(volumeID))
+		}
+	}
+	volumeAttachmentsCache.Unlock()
+
+	// A filter ignores the volumes deleted since their discovery, unlike the VolumeIds of the input
+	const filterValuesPerCall = 200
+	for start := 0; start < len(missing); start += filterValuesPerCall {
+		end := start + filterValuesPerCall
+		if end > len(missing) {
+			end = len(missing)
+		}
+		input := ec2.DescribeVolumesInput{Filters: []*ec2.Filter{{Name: aws.String("volume-id"), Values: missing[start:end]}}}
+		found := make(map[string][]string)
+		err := iface.ec2Client.DescribeVolumesPagesWithContext(discoveryCtx, &input, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+			ec2APICounter.Inc()
+			for _, volume := range page.Volumes {
+				instanceIDs := []string{}
+				for _, attachment := range volume.Attachments {
+					if attachment.InstanceId != nil {
+						instanceIDs = append(instanceIDs, *attachment.InstanceId)
+					}
 				}
+				sort.Strings(instanceIDs)
+				found[*volume.VolumeId] = instanceIDs
+			}
+			return true
+		}, withRateLimit("ec2"))
+		if err != nil {
+			return attachments, err
+		}
+
+		volumeAttachmentsCache.Lock()
+		for volumeID, instanceIDs := range found {
+			volumeAttachmentsCache.attachments[volumeID] = volumeAttachments{instanceIDs: instanceIDs, expires: now.Add(volumeAttachmentsCacheTTL)}
+			attachments[volumeID] = instanceIDs
+		}
+		volumeAttachmentsCache.Unlock()
+	}
+	return attachments, nil
+}
+
+// A NAT gateway can't move to another subnet, its placement is cached for an hour, so the gateways deleted since can be
+// pruned. The gateways which weren't found (e.g. deleted since their discovery) are cached without subnet, so they
+// aren't described every scrape.
+const natGatewayPlacementCacheTTL = time.Hour
+
+var natGatewayPlacementCache = struct {
+	sync.Mutex
+	placements map[string]natGatewayPlacement
+}{placements: make(map[string]natGatewayPlacement)}
+
+// Get the subnet and availability zone of the NAT gateways by their ID
+func (iface tagsInterface) getNatGatewayPlacements(natGateways []*tagsData) (map[string]natGatewayPlacement, error) {
+	now := time.Now()
+	placements := make(map[string]natGatewayPlacement)
+	var missing []*string
+	natGatewayPlacementCache.Lock()
+	for _, natGateway := range natGateways {
+		natGatewayID := resourceIDFromArn(*natGateway.ID)
+		if placement, ok := natGatewayPlacementCache.placements[natGatewayID]; ok && now.Before(placement.expires) {
+			placements[natGatewayID] = placement
+		} else {
+			missing = append(missing, aws.String(natGatewayID))
+		}
+	}
+	natGatewayPlacementCache.Unlock()
+	if len(missing) == 0 {
+		return placements, nil
+	}
+
+	// A filter ignores the gateways deleted since their discovery, unlike the NatGatewayIds of the input which fail
+	ctx := discoveryCtx
+	const filterValuesPerCall = 200
+	subnetIDs := make(map[string]string)
+	availabilityZones := make(map[string]string)
+	var subnets []*string
+	for start := 0; start < len(missing); start += filterValuesPerCall {
+		end := start + filterValuesPerCall
+		if end > len(missing) {
+			end = len(missing)
+		}
+		input := ec2.DescribeNatGatewaysInput{Filter: []*ec2.Filter{{Name: aws.String("nat-gateway-id"), Values: missing[start:end]}}}
+		err := iface.ec2Client.DescribeNatGatewaysPagesWithContext(ctx, &input, func(page *ec2.DescribeNatGatewaysOutput, lastPage bool) bool {
+			ec2APICounter.Inc()
+			for _, natGateway := range page.NatGateways {
+				if natGateway.SubnetId == nil {
+					continue
+				}
+				if _, ok := availabilityZones[*natGateway.SubnetId]; !ok {
+					availabilityZones[*natGateway.SubnetId] = ""
+					subnets = append(subnets, natGateway.SubnetId)
+				}
+				subnetIDs[*natGateway.NatGatewayId] = *natGateway.SubnetId
+			}
+			return true
+		}, withRateLimit("ec2"))
+		if err != nil {
+			return placements, err
+		}
+	}
+
+	for start := 0; start < len(subnets); start += filterValuesPerCall {
+		end := start + filterValuesPerCall
+		if end > len(subnets) {
+			end = len(subnets)
+		}
+		ec2APICounter.Inc()
+		input := ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{{Name: aws.String("subnet-id"), Values: subnets[start:end]}}}
+		output, err := iface.ec2Client.DescribeSubnetsWithContext(ctx, &input, withRateLimit("ec2"))
+		if err != nil {
+			return placements, err
+		}
+		for _, subnet := range output.Subnets {
+			availabilityZones[*subnet.SubnetId] = aws.StringValue(subnet.AvailabilityZone)
+		}
+	}
+
+	natGatewayPlacementCache.Lock()
+	for natGatewayID, cached := range natGatewayPlacementCache.placements {
+		if !now.Before(cached.expires) {
+			delete(natGatewayPlacementCache.placements, natGatewayID)
+		}
+	}
+	for _, natGatewayID := range aws.StringValueSlice(missing) {
+		subnetID := subnetIDs[natGatewayID]
+		placement := natGatewayPlacement{subnetID: subnetID, availabilityZone: availabilityZones[subnetID], expires: now.Add(natGatewayPlacementCacheTTL)}
+		natGatewayPlacementCache.placements[natGatewayID] = placement
+		placements[natGatewayID] = placement
+	}
+	natGatewayPlacementCache.Unlock()
+	return placements, nil
+}
+
+// Get the destination types (s3, elasticsearch, opensearch, opensearchserverless, redshift, splunk, http) of the
+// delivery streams by stream ARN. Firehose only describes the streams one by one, so only the streams whose
+// destination isn't cached are described. The streams which couldn't be described are missing.
+func (iface tagsInterface) getFirehoseDestinations(resources []*tagsData) (map[string]string, error) {
+	now := time.Now()
+	destinations := make(map[string]string)
+	var missing []string
+	firehoseDestinationCache.Lock()
+	for _, r := range resources {
+		if cached, ok := firehoseDestinationCache.destinations[*r.ID]; ok && now.Before(cached.expires) {
+			destinations[*r.ID] = cached.destination
+		} else {
+			missing = append(missing, *r.ID)
+		}
+	}
+	firehoseDestinationCache.Unlock()
+
+	ctx := discoveryCtx
+	var err error
+	described := make(map[string]string)
+	for _, streamArn := range missing {
+		firehoseAPICounter.Inc()
+		output, errDescribe := iface.firehoseClient.DescribeDeliveryStreamWithContext(ctx, &firehose.DescribeDeliveryStreamInput{
+			DeliveryStreamName: aws.String(resourceIDFromArn(streamArn)),
+		}, withRateLimit("firehose"))
+		if errDescribe != nil {
+			err = fmt.Errorf("%s: %v", streamArn, errDescribe)
+			continue
+		}
+		described[streamArn] = firehoseDestinationType(output.DeliveryStreamDescription.Destinations)
+	}
+
+	expires := now.Add(firehoseDestinationCacheTTL)
+	firehoseDestinationCache.Lock()
+	// The deleted streams aren't discovered anymore, their expired destinations are pruned
+	for streamArn, cached := range firehoseDestinationCache.destinations {
+		if !now.Before(cached.expires) {
+			delete(firehoseDestinationCache.destinations, streamArn)
+		}
+	}
+	for streamArn, destination := range described {
+		destinations[streamArn] = destination
+		firehoseDestinationCache.destinations[streamArn] = firehoseDestination{destination: destination, expires: expires}
+	}
+	firehoseDestinationCache.Unlock()
+	return destinations, err
+}
+
+// The type of the first destination of a delivery stream, S3 is also described as the backup of the other destinations
+func firehoseDestinationType(destinations []*firehose.DestinationDescription) string {
+	if len(destinations) == 0 {
+		return "unknown"
+	}
+	switch d := destinations[0]; {
+	case d.ElasticsearchDestinationDescription != nil:
+		return "elasticsearch"
+	case d.AmazonopensearchserviceDestinationDescription != nil:
+		return "opensearch"
+	case d.AmazonOpenSearchServerlessDestinationDescription != nil:
+		return "opensearchserverless"
+	case d.RedshiftDestinationDescription != nil:
+		return "redshift"
+	case d.SplunkDestinationDescription != nil:
+		return "splunk"
+	case d.HttpEndpointDestinationDescription != nil:
+		return "http"
+	case d.ExtendedS3DestinationDescription != nil, d.S3DestinationDescription != nil:
+		return "s3"
+	}
+	return "unknown"
+}
+
+// Get the types of the FSx file systems by their ARN
+func (iface tagsInterface) getFileSystemTypes() (map[string]string, error) {
+	ctx := discoveryCtx
+	types := make(map[string]string)
+	err := iface.fsxClient.DescribeFileSystemsPagesWithContext(ctx, &fsx.DescribeFileSystemsInput{}, func(page *fsx.DescribeFileSystemsOutput, lastPage bool) bool {
+		fsxAPICounter.Inc()
+		for _, fileSystem := range page.FileSystems {
+			types[*fileSystem.ResourceARN] = *fileSystem.FileSystemType
+		}
+		return true
+	}, withRateLimit("fsx"))
+	return types, err
+}
+
+// Get the names of the RDS proxies by their ARN
+func (iface tagsInterface) getDBProxyNames() (map[string]string, error) {
+	ctx := discoveryCtx
+	names := make(map[string]string)
+	err := iface.rdsClient.DescribeDBProxiesPagesWithContext(ctx, &rds.DescribeDBProxiesInput{}, func(page *rds.DescribeDBProxiesOutput, lastPage bool) bool {
+		rdsAPICounter.Inc()
+		for _, proxy := range page.DBProxies {
+			names[*proxy.DBProxyArn] = *proxy.DBProxyName
+		}
+		return true
+	}, withRateLimit("rds"))
+	return names, err
+}
+
+// Get the creation time of the RDS instances by their ARN
+func (iface tagsInterface) getDBInstanceCreateTimes() (map[string]*time.Time, error) {
+	ctx := discoveryCtx
+	createTimes := make(map[string]*time.Time)
+	err := iface.rdsClient.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{}, func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+		rdsAPICounter.Inc()
+		for _, instance := range page.DBInstances {
+			createTimes[*instance.DBInstanceArn] = instance.InstanceCreateTime
+		}
+		return true
+	}, withRateLimit("rds"))
+	return createTimes, err
+}
+
+// An engine can be upgraded in place, an upgrade shows up once the cached version expires
+const engineVersionsCacheTTL = 5 * time.Minute
+
+var engineVersionsCache = struct {
+	sync.Mutex
+	versions map[string]engineVersion
+}{versions: make(map[string]engineVersion)}
+
+type engineVersion struct {
+	engine  string
+	version string
+	expires time.Time
+}
+
+// Get the engine versions of the resources by ARN from the cache, the describe sweep refreshes all of them when one of
+// the resources is missing or expired
+func cachedEngineVersions(resources []*tagsData, describe func() (map[string]engineVersion, error)) (map[string]engineVersion, error) {
+	versions := make(map[string]engineVersion)
+	now := time.Now()
+	complete := true
+	engineVersionsCache.Lock()
+	for _, r := range resources {
+		cached, ok := engineVersionsCache.versions[*r.ID]
+		if !ok || !now.Before(cached.expires) {
+			complete = false
+			break
+		}
+		versions[*r.ID] = cached
+	}
+	engineVersionsCache.Unlock()
+	if complete {
+		return versions, nil
+	}
+
+	described, err := describe()
+	if err != nil {
+		return versions, err
+	}
+	engineVersionsCache.Lock()
+	// The deleted instances and clusters aren't discovered anymore, their expired versions are pruned
+	for resourceArn, cached := range engineVersionsCache.versions {
+		if !now.Before(cached.expires) {
+			delete(engineVersionsCache.versions, resourceArn)
+		}
+	}
+	for resourceArn, version := range described {
+		version.expires = now.Add(engineVersionsCacheTTL)
+		engineVersionsCache.versions[resourceArn] = version
+	}
+	engineVersionsCache.Unlock()
+	return described, nil
+}
+
+func (iface tagsInterface) getDBInstanceEngineVersions() (map[string]engineVersion, error) {
+	ctx := discoveryCtx
+	versions := make(map[string]engineVersion)
+	err := iface.rdsClient.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{}, func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+		rdsAPICounter.Inc()
+		for _, instance := range page.DBInstances {
+			versions[*instance.DBInstanceArn] = engineVersion{engine: aws.StringValue(instance.Engine), version: aws.StringValue(instance.EngineVersion)}
+		}
+		return true
+	}, withRateLimit("rds"))
+	return versions, err
+}
+
+func (iface tagsInterface) getCacheClusterEngineVersions() (map[string]engineVersion, error) {
+	ctx := discoveryCtx
+	versions := make(map[string]engineVersion)
+	err := iface.ecClient.DescribeCacheClustersPagesWithContext(ctx, &elasticache.DescribeCacheClustersInput{}, func(page *elasticache.DescribeCacheClustersOutput, lastPage bool) bool {
+		elastiCacheAPICounter.Inc()
+		for _, cluster := range page.CacheClusters {
+			if cluster.ARN != nil {
+				versions[*cluster.ARN] = engineVersion{engine: aws.StringValue(cluster.Engine), version: aws.StringValue(cluster.EngineVersion)}
+			}
+		}
+		return true
+	}, withRateLimit("elasticache"))
+	return versions, err
+}
+
+// The resources missing from the describe API, e.g. deleted since their discovery, are left without labels
+func addEngineVersionLabels(resources []*tagsData, versions map[string]engineVersion) {
+	for _, r := range resources {
+		version, ok := versions[*r.ID]
+		if !ok {
+			continue
+		}
+		if r.Labels == nil {
+			r.Labels = make(map[string]string)
+		}
+		r.Labels["engine"] = version.engine
+		r.Labels["engine_version"] = version.version
+	}
+}
+
+func (iface tagsInterface) getTaggedTransitGatewayAttachments(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+	pool := newDescribePagePool(*describeConcurrency)
+	err = iface.ec2Client.DescribeTransitGatewayAttachmentsPagesWithContext(ctx, &ec2.DescribeTransitGatewayAttachmentsInput{},
+		func(page *ec2.DescribeTransitGatewayAttachmentsOutput, more bool) bool {
+			pageNum++
+			ec2APICounter.Inc()
+
+			attachments := page.TransitGatewayAttachments
+			pool.process(func() (pageResources []*tagsData) {
+				for _, tgwa := range attachments {
+					if job.IgnoreTerminated && isTransitGatewayAttachmentDeleting(tgwa) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "terminated").Inc()
+						continue
+					}
+					if job.exceedsMaxAge(tgwa.CreationTime) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+						continue
+					}
+					resource := tagsData{}
 
-				if resource.filterThroughTags(job.SearchTags) {
-					resources = append(resources, &resource)
+					resource.ID = aws.String(fmt.Sprintf("%s/%s", *tgwa.TransitGatewayId, *tgwa.TransitGatewayAttachmentId))
+
+					resource.Service = &job.Type
+					resource.Region = &region
+					if job.InfoCreationTime {
+						resource.CreatedAt = tgwa.CreationTime
+					}
+
+					for _, t := range tgwa.Tags {
+						resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+					}
+
+					if resource.filterThroughJobTags(job) {
+						observeResourceAge(job.Type, tgwa.CreationTime)
+						pageResources = append(pageResources, &resource)
+					}
 				}
-			}
+				return pageResources
+			})
 			return pageNum < 100
-		})
+		}, withRateLimit("ec2"))
+	resources = pool.wait()
+	return resources, wrapPartialResults(err, pageNum, len(resources))
 }
 
-// Get all ApiGateways REST
-func (iface tagsInterface) getTaggedApiGateway() (*apigateway.GetRestApisOutput, error) {
-	ctx := context.Background()
-	apiGatewayAPICounter.Inc()
-	var limit int64 = 500 // max number of results per page. default=25, max=500
-	const maxPages = 10
-	input := apigateway.GetRestApisInput{Limit: &limit}
-	output := apigateway.GetRestApisOutput{}
-	var pageNum int
-	err := iface.apiGatewayClient.GetRestApisPagesWithContext(ctx, &input, func(page *apigateway.GetRestApisOutput, lastPage bool) bool {
-		pageNum++
-		output.Items = append(output.Items, page.Items...)
-		return pageNum <= maxPages
-	})
-	return &output, err
+func (iface tagsInterface) getTaggedTransitGatewayRouteTables(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+	pool := newDescribePagePool(*describeConcurrency)
+	err = iface.ec2Client.DescribeTransitGatewayRouteTablesPagesWithContext(ctx, &ec2.DescribeTransitGatewayRouteTablesInput{},
+		func(page *ec2.DescribeTransitGatewayRouteTablesOutput, more bool) bool {
+			pageNum++
+			ec2APICounter.Inc()
+
+			routeTables := page.TransitGatewayRouteTables
+			pool.process(func() (pageResources []*tagsData) {
+				for _, routeTable := range routeTables {
+					if job.IgnoreTerminated && isTransitGatewayRouteTableDeleting(routeTable) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "terminated").Inc()
+						continue
+					}
+					if job.exceedsMaxAge(routeTable.CreationTime) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+						continue
+					}
+					resource := tagsData{}
+
+					resource.ID = aws.String(fmt.Sprintf("%s/%s", *routeTable.TransitGatewayId, *routeTable.TransitGatewayRouteTableId))
+
+					resource.Service = &job.Type
+					resource.Region = &region
+					if job.InfoCreationTime {
+						resource.CreatedAt = routeTable.CreationTime
+					}
+
+					for _, t := range routeTable.Tags {
+						resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+					}
+
+					if resource.filterThroughJobTags(job) {
+						observeResourceAge(job.Type, routeTable.CreationTime)
+						pageResources = append(pageResources, &resource)
+					}
+				}
+				return pageResources
+			})
+			return pageNum < 100
+		}, withRateLimit("ec2"))
+	resources = pool.wait()
+	return resources, wrapPartialResults(err, pageNum, len(resources))
 }
 
-func (iface tagsInterface) getTaggedTransitGatewayAttachments(job job, region string) (resources []*tagsData, err error) {
-	ctx := context.Background()
+// Spot fleet requests aren't listed by the Resource Groups Tagging API, they are identified by their request ID
+func (iface tagsInterface) getTaggedSpotFleet(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
 	pageNum := 0
-	return resources, iface.ec2Client.DescribeTransitGatewayAttachmentsPagesWithContext(ctx, &ec2.DescribeTransitGatewayAttachmentsInput{},
-		func(page *ec2.DescribeTransitGatewayAttachmentsOutput, more bool) bool {
+	pool := newDescribePagePool(*describeConcurrency)
+	err = iface.ec2Client.DescribeSpotFleetRequestsPagesWithContext(ctx, &ec2.DescribeSpotFleetRequestsInput{},
+		func(page *ec2.DescribeSpotFleetRequestsOutput, more bool) bool {
 			pageNum++
 			ec2APICounter.Inc()
 
-			for _, tgwa := range page.TransitGatewayAttachments {
-				resource := tagsData{}
+			fleets := page.SpotFleetRequestConfigs
+			pool.process(func() (pageResources []*tagsData) {
+				for _, fleet := range fleets {
+					if job.IgnoreTerminated && isSpotFleetCancelled(fleet) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "terminated").Inc()
+						continue
+					}
+					if job.exceedsMaxAge(fleet.CreateTime) {
+						resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+						continue
+					}
+					resource := tagsData{}
 
-				resource.ID = aws.String(fmt.Sprintf("%s/%s", *tgwa.TransitGatewayId, *tgwa.TransitGatewayAttachmentId))
+					resource.ID = fleet.SpotFleetRequestId
 
-				resource.Service = &job.Type
-				resource.Region = &region
+					resource.Service = &job.Type
+					resource.Region = &region
+					if job.InfoCreationTime {
+						resource.CreatedAt = fleet.CreateTime
+					}
 
-				for _, t := range tgwa.Tags {
-					resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: *t.Value})
+					for _, t := range fleet.Tags {
+						resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+					}
+
+					if resource.filterThroughJobTags(job) {
+						observeResourceAge(job.Type, fleet.CreateTime)
+						pageResources = append(pageResources, &resource)
+					}
 				}
+				return pageResources
+			})
+			return pageNum < 100
+		}, withRateLimit("ec2"))
+	resources = pool.wait()
+	return resources, wrapPartialResults(err, pageNum, len(resources))
+}
 
-				if resource.filterThroughTags(job.SearchTags) {
-					resources = append(resources, &resource)
+// IoT topic rules and things aren't listed by the Resource Groups Tagging API
+func (iface tagsInterface) getTaggedIoT(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+
+	rulesInput := iot.ListTopicRulesInput{}
+	for {
+		iotAPICounter.Inc()
+		page, err := iface.iotClient.ListTopicRulesWithContext(ctx, &rulesInput, withRateLimit("iot"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, rule := range page.Rules {
+			resource, err := iface.newIoTResource(ctx, job, region, *rule.RuleArn)
+			if err != nil {
+				if ctx.Err() != nil {
+					return resources, wrapPartialResults(err, pageNum, len(resources))
 				}
+				// The tags are listed per resource, one failure mustn't hide the other resources
+				log.Errorf("tagsInterface.get: iot: newIoTResource: %v", err)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "tags_not_listed").Inc()
+				continue
 			}
-			return pageNum < 100
-		})
+			if job.InfoCreationTime {
+				resource.CreatedAt = rule.CreatedAt
+			}
+			if resource.filterThroughJobTags(job) {
+				observeResourceAge(job.Type, rule.CreatedAt)
+				resources = append(resources, resource)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		rulesInput.NextToken = page.NextToken
+	}
+
+	thingsInput := iot.ListThingsInput{}
+	for {
+		iotAPICounter.Inc()
+		page, err := iface.iotClient.ListThingsWithContext(ctx, &thingsInput, withRateLimit("iot"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, thing := range page.Things {
+			resource, err := iface.newIoTResource(ctx, job, region, *thing.ThingArn)
+			if err != nil {
+				if ctx.Err() != nil {
+					return resources, wrapPartialResults(err, pageNum, len(resources))
+				}
+				log.Errorf("tagsInterface.get: iot: newIoTResource: %v", err)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "tags_not_listed").Inc()
+				continue
+			}
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, resource)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		thingsInput.NextToken = page.NextToken
+	}
+	return resources, nil
+}
+
+func (iface tagsInterface) newIoTResource(ctx context.Context, job job, region string, resourceArn string) (*tagsData, error) {
+	resource := tagsData{ID: aws.String(resourceArn), Service: &job.Type, Region: &region}
+
+	input := iot.ListTagsForResourceInput{ResourceArn: aws.String(resourceArn)}
+	for {
+		iotAPICounter.Inc()
+		page, err := iface.iotClient.ListTagsForResourceWithContext(ctx, &input, withRateLimit("iot"))
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page.Tags {
+			resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+		}
+		if page.NextToken == nil {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	return &resource, nil
+}
+
+// Comprehend endpoints aren't listed by the Resource Groups Tagging API
+func (iface tagsInterface) getTaggedComprehend(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+
+	input := comprehend.ListEndpointsInput{}
+	for {
+		comprehendAPICounter.Inc()
+		page, err := iface.comprehendClient.ListEndpointsWithContext(ctx, &input, withRateLimit("comprehend"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, endpoint := range page.EndpointPropertiesList {
+			if job.IgnoreTerminated && endpoint.Status != nil && *endpoint.Status == comprehend.EndpointStatusDeleting {
+				resourcesDroppedCounter.WithLabelValues(job.Type, "terminated").Inc()
+				continue
+			}
+			if job.exceedsMaxAge(endpoint.CreationTime) {
+				resourcesDroppedCounter.WithLabelValues(job.Type, "max_age").Inc()
+				continue
+			}
+			resource := tagsData{ID: endpoint.EndpointArn, Service: &job.Type, Region: &region}
+			if job.InfoCreationTime {
+				resource.CreatedAt = endpoint.CreationTime
+			}
+
+			comprehendAPICounter.Inc()
+			tags, err := iface.comprehendClient.ListTagsForResourceWithContext(ctx, &comprehend.ListTagsForResourceInput{ResourceArn: endpoint.EndpointArn}, withRateLimit("comprehend"))
+			if err != nil {
+				return resources, wrapPartialResults(err, pageNum, len(resources))
+			}
+			for _, t := range tags.Tags {
+				resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(aws.StringValue(t.Value))})
+			}
+
+			if resource.filterThroughJobTags(job) {
+				observeResourceAge(job.Type, endpoint.CreationTime)
+				resources = append(resources, &resource)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	return resources, nil
+}
+
+// Bedrock custom models and provisioned throughputs aren't listed by the Resource Groups Tagging API
+func (iface tagsInterface) getTaggedBedrock(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+
+	modelsInput := bedrock.ListCustomModelsInput{}
+	for {
+		bedrockAPICounter.Inc()
+		page, err := iface.bedrockClient.ListCustomModelsWithContext(ctx, &modelsInput, withRateLimit("bedrock"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, model := range page.ModelSummaries {
+			resource, err := iface.newBedrockResource(job, region, model.ModelArn)
+			if err != nil {
+				return resources, wrapPartialResults(err, pageNum, len(resources))
+			}
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, resource)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		modelsInput.NextToken = page.NextToken
+	}
+
+	throughputsInput := bedrock.ListProvisionedModelThroughputsInput{}
+	for {
+		bedrockAPICounter.Inc()
+		page, err := iface.bedrockClient.ListProvisionedModelThroughputsWithContext(ctx, &throughputsInput, withRateLimit("bedrock"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, throughput := range page.ProvisionedModelSummaries {
+			resource, err := iface.newBedrockResource(job, region, throughput.ProvisionedModelArn)
+			if err != nil {
+				return resources, wrapPartialResults(err, pageNum, len(resources))
+			}
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, resource)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		throughputsInput.NextToken = page.NextToken
+	}
+	return resources, nil
+}
+
+func (iface tagsInterface) newBedrockResource(job job, region string, resourceArn *string) (*tagsData, error) {
+	resource := tagsData{ID: resourceArn, Service: &job.Type, Region: &region}
+	bedrockAPICounter.Inc()
+	tags, err := iface.bedrockClient.ListTagsForResourceWithContext(discoveryCtx, &bedrock.ListTagsForResourceInput{ResourceARN: resourceArn}, withRateLimit("bedrock"))
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tags.Tags {
+		resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(aws.StringValue(t.Value))})
+	}
+	return &resource, nil
+}
+
+// Elastic Disaster Recovery source servers aren't listed by the Resource Groups Tagging API, their tags come with the
+// source server.
+func (iface tagsInterface) getTaggedDRS(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+	err = iface.drsClient.DescribeSourceServersPagesWithContext(ctx, &drs.DescribeSourceServersInput{}, func(page *drs.DescribeSourceServersOutput, lastPage bool) bool {
+		pageNum++
+		drsAPICounter.Inc()
+		for _, sourceServer := range page.Items {
+			resource := tagsData{ID: sourceServer.Arn, Service: &job.Type, Region: &region}
+
+			for key, value := range sourceServer.Tags {
+				resource.Tags = append(resource.Tags, &tag{Key: key, Value: job.NormalizeTagValues.apply(aws.StringValue(value))})
+			}
+			// The tags are a map, sort them so the info metrics keep the same labels
+			sort.Slice(resource.Tags, func(i, j int) bool { return resource.Tags[i].Key < resource.Tags[j].Key })
+
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, &resource)
+			}
+		}
+		return true
+	}, withRateLimit("drs"))
+	return resources, wrapPartialResults(err, pageNum, len(resources))
+}
+
+// Managed Grafana workspaces are discovered through the Managed Grafana API, their tags come with the workspace. Their
+// ARN isn't returned, it is built without account, which is then taken from the role of the job.
+func (iface tagsInterface) getTaggedGrafana(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+	partition := "aws"
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		partition = p.ID()
+	}
+	err = iface.grafanaClient.ListWorkspacesPagesWithContext(ctx, &managedgrafana.ListWorkspacesInput{}, func(page *managedgrafana.ListWorkspacesOutput, lastPage bool) bool {
+		pageNum++
+		grafanaAPICounter.Inc()
+		for _, workspace := range page.Workspaces {
+			workspaceArn := arn.ARN{
+				Partition: partition,
+				Service:   "grafana",
+				Region:    region,
+				Resource:  "/workspaces/" + aws.StringValue(workspace.Id),
+			}.String()
+			resource := tagsData{ID: &workspaceArn, Service: &job.Type, Region: &region}
+
+			for key, value := range workspace.Tags {
+				resource.Tags = append(resource.Tags, &tag{Key: key, Value: job.NormalizeTagValues.apply(aws.StringValue(value))})
+			}
+			// The tags are a map, sort them so the info metrics keep the same labels
+			sort.Slice(resource.Tags, func(i, j int) bool { return resource.Tags[i].Key < resource.Tags[j].Key })
+
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, &resource)
+			}
+		}
+		return true
+	}, withRateLimit("grafana"))
+	return resources, wrapPartialResults(err, pageNum, len(resources))
+}
+
+// GuardDuty detectors are discovered through the GuardDuty API. Their ARN isn't returned, it is built with the account
+// of their service role, and their tags come with the detector.
+func (iface tagsInterface) getTaggedGuardDuty(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+
+	input := guardduty.ListDetectorsInput{}
+	for {
+		guardDutyAPICounter.Inc()
+		page, err := iface.guardDutyClient.ListDetectorsWithContext(ctx, &input, withRateLimit("guardduty"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, detectorID := range page.DetectorIds {
+			guardDutyAPICounter.Inc()
+			detector, err := iface.guardDutyClient.GetDetectorWithContext(ctx, &guardduty.GetDetectorInput{DetectorId: detectorID}, withRateLimit("guardduty"))
+			if err != nil {
+				return resources, wrapPartialResults(err, pageNum, len(resources))
+			}
+			serviceRole, err := arn.Parse(aws.StringValue(detector.ServiceRole))
+			if err != nil {
+				return resources, wrapPartialResults(fmt.Errorf("service role of detector %s: %w", *detectorID, err), pageNum, len(resources))
+			}
+			detectorArn := arn.ARN{
+				Partition: serviceRole.Partition,
+				Service:   "guardduty",
+				Region:    region,
+				AccountID: serviceRole.AccountID,
+				Resource:  "detector/" + *detectorID,
+			}.String()
+			resource := tagsData{ID: &detectorArn, Service: &job.Type, Region: &region}
+
+			for key, value := range detector.Tags {
+				resource.Tags = append(resource.Tags, &tag{Key: key, Value: job.NormalizeTagValues.apply(aws.StringValue(value))})
+			}
+			// The tags are a map, sort them so the info metrics keep the same labels
+			sort.Slice(resource.Tags, func(i, j int) bool { return resource.Tags[i].Key < resource.Tags[j].Key })
+
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, &resource)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	return resources, nil
+}
+
+// Synthetics canaries are discovered through the Synthetics API. Their ARN isn't returned, it is built with the account
+// of their execution role, and their tags come with the canary.
+func (iface tagsInterface) getTaggedSynthetics(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+	err = iface.syntheticsClient.DescribeCanariesPagesWithContext(ctx, &synthetics.DescribeCanariesInput{}, func(page *synthetics.DescribeCanariesOutput, lastPage bool) bool {
+		pageNum++
+		syntheticsAPICounter.Inc()
+		for _, canary := range page.Canaries {
+			executionRole, errParse := arn.Parse(aws.StringValue(canary.ExecutionRoleArn))
+			if errParse != nil {
+				log.Errorf("tagsInterface.get: synthetics: canary=%s could not parse execution role: %v", aws.StringValue(canary.Name), errParse)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "malformed_arn").Inc()
+				continue
+			}
+			canaryArn := arn.ARN{
+				Partition: executionRole.Partition,
+				Service:   "synthetics",
+				Region:    region,
+				AccountID: executionRole.AccountID,
+				Resource:  "canary:" + *canary.Name,
+			}.String()
+			resource := tagsData{ID: &canaryArn, Service: &job.Type, Region: &region}
+
+			for key, value := range canary.Tags {
+				resource.Tags = append(resource.Tags, &tag{Key: key, Value: job.NormalizeTagValues.apply(aws.StringValue(value))})
+			}
+			// The tags are a map, sort them so the info metrics keep the same labels
+			sort.Slice(resource.Tags, func(i, j int) bool { return resource.Tags[i].Key < resource.Tags[j].Key })
+
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, &resource)
+			}
+		}
+		return true
+	}, withRateLimit("synthetics"))
+	return resources, wrapPartialResults(err, pageNum, len(resources))
+}
+
+// Shield Advanced protections are listed through the global Shield API, a job keeps the protected resources of its
+// region, and the global ones (e.g. CloudFront distributions) in us-east-1 where their metrics are. The resources are
+// identified by their ARN and carry the tags of their protection.
+func (iface tagsInterface) getTaggedShield(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	ctx := discoveryCtx
+	pageNum := 0
+	var tagsErr error
+	err = iface.shieldClient.ListProtectionsPagesWithContext(ctx, &shield.ListProtectionsInput{}, func(page *shield.ListProtectionsOutput, lastPage bool) bool {
+		pageNum++
+		shieldAPICounter.Inc()
+		for _, protection := range page.Protections {
+			resourceArn, errParse := arn.Parse(aws.StringValue(protection.ResourceArn))
+			if errParse != nil {
+				log.Errorf("tagsInterface.get: shield: protection=%s could not parse resource ARN: %v", aws.StringValue(protection.Id), errParse)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "malformed_arn").Inc()
+				continue
+			}
+			if resourceArn.Region != region && !(resourceArn.Region == "" && region == "us-east-1") {
+				continue
+			}
+			resource := tagsData{ID: protection.ResourceArn, Service: &job.Type, Region: &region, Labels: map[string]string{
+				"protection_id":   aws.StringValue(protection.Id),
+				"protection_name": aws.StringValue(protection.Name),
+			}}
+
+			shieldAPICounter.Inc()
+			tags, err := iface.shieldClient.ListTagsForResourceWithContext(ctx, &shield.ListTagsForResourceInput{ResourceARN: protection.ProtectionArn}, withRateLimit("shield"))
+			if err != nil {
+				if ctx.Err() != nil {
+					tagsErr = err
+					return false
+				}
+				// The tags are listed per protection, one failure mustn't hide the other protections
+				log.Errorf("tagsInterface.get: shield: protection=%s could not list tags: %v", aws.StringValue(protection.Id), err)
+				resourcesDroppedCounter.WithLabelValues(job.Type, "tags_not_listed").Inc()
+				continue
+			}
+			for _, t := range tags.Tags {
+				resource.Tags = append(resource.Tags, &tag{Key: aws.StringValue(t.Key), Value: job.NormalizeTagValues.apply(aws.StringValue(t.Value))})
+			}
+
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, &resource)
+			}
+		}
+		return true
+	}, withRateLimit("shield"))
+	if err == nil {
+		err = tagsErr
+	}
+	return resources, wrapPartialResults(err, pageNum, len(resources))
+}
+
+// The WAF Classic calls shared by the global and the regional API
+type wafClassicAPI interface {
+	ListWebACLsWithContext(aws.Context, *waf.ListWebACLsInput, ...request.Option) (*waf.ListWebACLsOutput, error)
+	GetWebACLWithContext(aws.Context, *waf.GetWebACLInput, ...request.Option) (*waf.GetWebACLOutput, error)
+	ListTagsForResourceWithContext(aws.Context, *waf.ListTagsForResourceInput, ...request.Option) (*waf.ListTagsForResourceOutput, error)
+}
+
+// Get the WAF Classic web ACLs of the region, plus the global ones of CloudFront whose metrics are in us-east-1
+func (iface tagsInterface) getTaggedWAFClassic(job job, region string) (resources []*tagsData, err error) {
+	defer func() { err = iface.wrapDiscoveryError(err, job.Type, region) }()
+	resources, err = iface.getWAFClassicWebACLs(iface.wafRegClient, job, region)
+	if err != nil || region != "us-east-1" {
+		return resources, err
+	}
+	global, err := iface.getWAFClassicWebACLs(iface.wafClient, job, region)
+	return append(resources, global...), err
+}
+
+func (iface tagsInterface) getWAFClassicWebACLs(client wafClassicAPI, job job, region string) (resources []*tagsData, err error) {
+	ctx := discoveryCtx
+	pageNum := 0
+	input := waf.ListWebACLsInput{}
+	for {
+		wafAPICounter.Inc()
+		page, err := client.ListWebACLsWithContext(ctx, &input, withRateLimit("waf"))
+		if err != nil {
+			return resources, wrapPartialResults(err, pageNum, len(resources))
+		}
+		pageNum++
+		for _, summary := range page.WebACLs {
+			resource, err := newWAFClassicResource(ctx, client, job, region, summary.WebACLId)
+			if err != nil {
+				return resources, wrapPartialResults(err, pageNum, len(resources))
+			}
+			if resource.filterThroughJobTags(job) {
+				resources = append(resources, resource)
+			}
+		}
+		if page.NextMarker == nil {
+			break
+		}
+		input.NextMarker = page.NextMarker
+	}
+	return resources, nil
+}
+
+// The summary of a web ACL has neither its ARN nor the metric name its metrics are reported under
+func newWAFClassicResource(ctx context.Context, client wafClassicAPI, job job, region string, webACLID *string) (*tagsData, error) {
+	wafAPICounter.Inc()
+	output, err := client.GetWebACLWithContext(ctx, &waf.GetWebACLInput{WebACLId: webACLID}, withRateLimit("waf"))
+	if err != nil {
+		return nil, err
+	}
+	resource := tagsData{ID: output.WebACL.WebACLArn, Matcher: output.WebACL.MetricName, Service: &job.Type, Region: &region}
+
+	input := waf.ListTagsForResourceInput{ResourceARN: output.WebACL.WebACLArn}
+	for {
+		wafAPICounter.Inc()
+		page, err := client.ListTagsForResourceWithContext(ctx, &input, withRateLimit("waf"))
+		if err != nil {
+			return nil, err
+		}
+		if page.TagInfoForResource != nil {
+			for _, t := range page.TagInfoForResource.TagList {
+				resource.Tags = append(resource.Tags, &tag{Key: *t.Key, Value: job.NormalizeTagValues.apply(*t.Value)})
+			}
+		}
+		if page.NextMarker == nil {
+			break
+		}
+		input.NextMarker = page.NextMarker
+	}
+	return &resource, nil
+}
+
+// Normalize a tag value before it is used for filtering and as a label value
+func (n tagNormalization) apply(value string) string {
+	if n.Trim {
+		value = strings.TrimSpace(value)
+	}
+	if n.Lowercase {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// The HELP of the info metric of a service, a metric has a single HELP so the first job of the service setting it wins
+func infoMetricHelp(service string) string {
+	for _, job := range config.Discovery.Jobs {
+		if job.Type == service && job.HelpText != "" {
+			return job.HelpText
+		}
+	}
+	namespace, err := getNamespace(service)
+	if err != nil {
+		return fmt.Sprintf("Tags of the discovered %s resources.", service)
+	}
+	return fmt.Sprintf("Tags of the discovered %s resources (%s), the name label joins them to their metrics.", service, namespace)
 }
 
+// Name of the info metric shared by the services with unifiedInfoMetric, before the info metric suffix
+const unifiedInfoMetricName = "aws_resource"
+
 func migrateTagsToPrometheus(tagData []*tagsData) []*PrometheusMetric {
 	output := make([]*PrometheusMetric, 0)
 
 	tagList := make(map[string][]string)
+	// The unified info metric has the tag keys and the additional labels of every service, so its label names are
+	// the same for all the resources
+	var allTagKeys []string
+	allLabels := make(map[string]struct{})
 
 	for _, d := range tagData {
 		for _, entry := range d.Tags {
 			if !stringInSlice(entry.Key, tagList[*d.Service]) {
 				tagList[*d.Service] = append(tagList[*d.Service], entry.Key)
 			}
+			if config.UnifiedInfoMetric && !stringInSlice(entry.Key, allTagKeys) {
+				allTagKeys = append(allTagKeys, entry.Key)
+			}
+		}
+		if config.UnifiedInfoMetric {
+			for name := range d.Labels {
+				allLabels[name] = struct{}{}
+			}
+			if d.AccountAlias != "" {
+				allLabels["account_alias"] = struct{}{}
+			}
+			if d.AccountID != "" {
+				allLabels["account_id"] = struct{}{}
+			}
 		}
 	}
+	// Only the services discovered in this scrape are reported
+	serviceTagKeysGauge.Reset()
+	for _, d := range tagData {
+		serviceTagKeysGauge.WithLabelValues(*d.Service).Set(float64(len(tagList[*d.Service])))
+	}
 
 	for _, d := range tagData {
-		name := "aws_" + promString(*d.Service) + "_info"
+		name := "aws_" + promString(*d.Service) + *infoMetricSuffix
+		help := infoMetricHelp(*d.Service)
+		tagKeys := tagList[*d.Service]
+		if config.UnifiedInfoMetric {
+			name = unifiedInfoMetricName + *infoMetricSuffix
+			help = "Tags of the discovered resources of every service."
+			tagKeys = allTagKeys
+		}
 		promLabels := make(map[string]string)
-		promLabels["name"] = *d.ID
+		config.NameLabel.apply(promLabels, *d.ID)
+		if d.Region != nil && hasRegionTag(*d.Service) {
+			promLabels["region"] = *d.Region
+		}
 
-		for _, entry := range tagList[*d.Service] {
+		for _, entry := range tagKeys {
 			labelKey := "tag_" + promStringTag(entry)
-			promLabels[labelKey] = ""
+			// Tag keys like cost-center and cost_center share a label, the value of one mustn't be reset by the other
+			if _, ok := promLabels[labelKey]; !ok {
+				promLabels[labelKey] = ""
+			}
 
 			for _, rTag := range d.Tags {
 				if entry == rTag.Key {
@@ -292,17 +3044,103 @@ func migrateTagsToPrometheus(tagData []*tagsData) []*PrometheusMetric {
 			}
 		}
 
+		for name, value := range d.Labels {
+			promLabels[name] = value
+		}
+		if d.AccountAlias != "" {
+			promLabels["account_alias"] = d.AccountAlias
+		}
+		if d.AccountID != "" {
+			promLabels["account_id"] = d.AccountID
+		}
+		if config.UnifiedInfoMetric {
+			for name := range allLabels {
+				if _, ok := promLabels[name]; !ok {
+					promLabels[name] = ""
+				}
+			}
+			// Set last, the resources of the services can't be told apart otherwise
+			promLabels["service"] = *d.Service
+		}
+		addStaticLabels(promLabels, config.StaticLabels)
+		recordLabelsForMetric(name, promLabels)
+
 		var i int
 		f := float64(i)
+		if d.CreatedAt != nil {
+			f = float64(d.CreatedAt.Unix())
+		}
 
 		p := PrometheusMetric{
 			name:   &name,
 			labels: promLabels,
 			value:  &f,
+			help:   help,
 		}
 
 		output = append(output, &p)
+		output = append(output, numericTagMetrics(d)...)
+	}
+
+	return output
+}
+
+// The info metric only has the region label when a job of the service overrides the region from a tag
+func hasRegionTag(service string) bool {
+	for _, job := range config.Discovery.Jobs {
+		if job.Type == service && job.RegionTag != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Tag keys whose values are exported as aws_<service>_tag_value by the jobs of the service
+func numericTagKeys(service string) []string {
+	var keys []string
+	for _, job := range config.Discovery.Jobs {
+		if job.Type != service {
+			continue
+		}
+		for _, key := range job.NumericTags {
+			if !stringInSlice(key, keys) {
+				keys = append(keys, key)
+			}
+		}
 	}
+	return keys
+}
 
+// Export the numeric values of the numericTags of the resource, e.g. replicas=3, the other values are skipped
+func numericTagMetrics(d *tagsData) []*PrometheusMetric {
+	keys := numericTagKeys(*d.Service)
+	if len(keys) == 0 {
+		return nil
+	}
+	name := "aws_" + promString(*d.Service) + "_tag_value"
+	var output []*PrometheusMetric
+	// A key can be repeated (e.g. returned by a describe API) or share its label with another one, like cost-center and
+	// cost_center, only the first value is exported so the series stay unique
+	exported := make(map[string]bool)
+	for _, t := range d.Tags {
+		if !stringInSlice(t.Key, keys) || exported[promStringTag(t.Key)] {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(t.Value), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		exported[promStringTag(t.Key)] = true
+		promLabels := map[string]string{"tag_key": t.Key}
+		config.NameLabel.apply(promLabels, *d.ID)
+		addStaticLabels(promLabels, config.StaticLabels)
+		recordLabelsForMetric(name, promLabels)
+		output = append(output, &PrometheusMetric{
+			name:   &name,
+			labels: promLabels,
+			value:  &value,
+			help:   fmt.Sprintf("Numeric values of the tags of the discovered %s resources, by tag key.", *d.Service),
+		})
+	}
 	return output
 }
@@ -1,9 +1,100 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+	"github.com/aws/aws-sdk-go/service/apigateway/apigatewayiface"
+	"github.com/aws/aws-sdk-go/service/appsync"
+	"github.com/aws/aws-sdk-go/service/appsync/appsynciface"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/bedrock"
+	"github.com/aws/aws-sdk-go/service/bedrock/bedrockiface"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/aws/aws-sdk-go/service/comprehend/comprehendiface"
+	"github.com/aws/aws-sdk-go/service/drs"
+	"github.com/aws/aws-sdk-go/service/drs/drsiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/fsx"
+	"github.com/aws/aws-sdk-go/service/fsx/fsxiface"
+	"github.com/aws/aws-sdk-go/service/guardduty"
+	"github.com/aws/aws-sdk-go/service/guardduty/guarddutyiface"
+	"github.com/aws/aws-sdk-go/service/iot"
+	"github.com/aws/aws-sdk-go/service/iot/iotiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/managedgrafana"
+	"github.com/aws/aws-sdk-go/service/managedgrafana/managedgrafanaiface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroups"
+	"github.com/aws/aws-sdk-go/service/resourcegroups/resourcegroupsiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/shield"
+	"github.com/aws/aws-sdk-go/service/shield/shieldiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/synthetics"
+	"github.com/aws/aws-sdk-go/service/synthetics/syntheticsiface"
+	"github.com/aws/aws-sdk-go/service/waf"
+	"github.com/aws/aws-sdk-go/service/waf/wafiface"
+	"github.com/aws/aws-sdk-go/service/wafregional/wafregionaliface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+func TestMigrateTagsToPrometheusCountsTagKeys(t *testing.T) {
+	// Setup Test
+	ec2, rds, stale := "ec2", "rds", "sqs"
+	serviceTagKeysGauge.WithLabelValues(stale).Set(5)
+	resources := []*tagsData{
+		{ID: aws.String("i-0123"), Service: &ec2, Tags: []*tag{{Key: "Name", Value: "web"}, {Key: "team", Value: "frontend"}}},
+		{ID: aws.String("i-4567"), Service: &ec2, Tags: []*tag{{Key: "Name", Value: "api"}, {Key: "env", Value: "prod"}}},
+		{ID: aws.String("db-0123"), Service: &rds},
+	}
+
+	// Act
+	migrateTagsToPrometheus(resources)
+
+	// Assert
+	for service, expected := range map[string]float64{ec2: 3, rds: 0} {
+		if actual := testutil.ToFloat64(serviceTagKeysGauge.WithLabelValues(service)); actual != expected {
+			t.Fatalf("%s\nexpected: %v tag keys\nactual:  %v", service, expected, actual)
+		}
+	}
+	if count := testutil.CollectAndCount(serviceTagKeysGauge); count != 2 {
+		t.Fatalf("\nexpected: only the 2 discovered services\nactual:  %d", count)
+	}
+}
+
 func TestMigrateTagsToPrometheus(t *testing.T) {
 	// Setup Test
 	id := "tag_Id"
@@ -37,3 +128,3635 @@ func TestMigrateTagsToPrometheus(t *testing.T) {
 	}
 
 }
+
+type mockAutoScalingClient struct {
+	autoscalingiface.AutoScalingAPI
+	groups []*autoscaling.Group
+	// pages returns the groups this many times, defaults to a single page
+	pages int
+}
+
+func (m mockAutoScalingClient) DescribeAutoScalingGroupsPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool, opts ...request.Option) error {
+	pages := m.pages
+	if pages == 0 {
+		pages = 1
+	}
+	for i := 1; i <= pages; i++ {
+		if !fn(&autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: m.groups}, i == pages) {
+			break
+		}
+	}
+	return nil
+}
+
+type mockEC2Client struct {
+	ec2iface.EC2API
+	instances                 []*ec2.Instance
+	vpnConnections            []*ec2.VpnConnection
+	transitGatewayAttachments []*ec2.TransitGatewayAttachment
+	transitGatewayRouteTables []*ec2.TransitGatewayRouteTable
+	spotFleetRequests         []*ec2.SpotFleetRequestConfig
+	natGateways               []*ec2.NatGateway
+	subnets                   []*ec2.Subnet
+	volumes                   []*ec2.Volume
+	calls                     *int
+}
+
+func (m mockEC2Client) DescribeVolumesPagesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool, opts ...request.Option) error {
+	if m.calls != nil {
+		*m.calls++
+	}
+	output := &ec2.DescribeVolumesOutput{}
+	for _, volume := range m.volumes {
+		if stringInSlice(*volume.VolumeId, ec2FilterValues(input.Filters, "volume-id")) {
+			output.Volumes = append(output.Volumes, volume)
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+// The values of the filter with the given name, like the EC2 API the mocks only return the resources matching them
+func ec2FilterValues(filters []*ec2.Filter, name string) []string {
+	for _, filter := range filters {
+		if *filter.Name == name {
+			return aws.StringValueSlice(filter.Values)
+		}
+	}
+	return nil
+}
+
+func (m mockEC2Client) DescribeNatGatewaysPagesWithContext(ctx aws.Context, input *ec2.DescribeNatGatewaysInput, fn func(*ec2.DescribeNatGatewaysOutput, bool) bool, opts ...request.Option) error {
+	if m.calls != nil {
+		*m.calls++
+	}
+	output := &ec2.DescribeNatGatewaysOutput{}
+	for _, natGateway := range m.natGateways {
+		if stringInSlice(*natGateway.NatGatewayId, ec2FilterValues(input.Filter, "nat-gateway-id")) {
+			output.NatGateways = append(output.NatGateways, natGateway)
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m mockEC2Client) DescribeSubnetsWithContext(ctx aws.Context, input *ec2.DescribeSubnetsInput, opts ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
+	output := &ec2.DescribeSubnetsOutput{}
+	for _, subnet := range m.subnets {
+		if stringInSlice(*subnet.SubnetId, ec2FilterValues(input.Filters, "subnet-id")) {
+			output.Subnets = append(output.Subnets, subnet)
+		}
+	}
+	return output, nil
+}
+
+func (m mockEC2Client) DescribeSpotFleetRequestsPagesWithContext(ctx aws.Context, input *ec2.DescribeSpotFleetRequestsInput, fn func(*ec2.DescribeSpotFleetRequestsOutput, bool) bool, opts ...request.Option) error {
+	fn(&ec2.DescribeSpotFleetRequestsOutput{SpotFleetRequestConfigs: m.spotFleetRequests}, true)
+	return nil
+}
+
+func (m mockEC2Client) DescribeTransitGatewayRouteTablesPagesWithContext(ctx aws.Context, input *ec2.DescribeTransitGatewayRouteTablesInput, fn func(*ec2.DescribeTransitGatewayRouteTablesOutput, bool) bool, opts ...request.Option) error {
+	fn(&ec2.DescribeTransitGatewayRouteTablesOutput{TransitGatewayRouteTables: m.transitGatewayRouteTables}, true)
+	return nil
+}
+
+func (m mockEC2Client) DescribeTransitGatewayAttachmentsPagesWithContext(ctx aws.Context, input *ec2.DescribeTransitGatewayAttachmentsInput, fn func(*ec2.DescribeTransitGatewayAttachmentsOutput, bool) bool, opts ...request.Option) error {
+	fn(&ec2.DescribeTransitGatewayAttachmentsOutput{TransitGatewayAttachments: m.transitGatewayAttachments}, true)
+	return nil
+}
+
+type mockAPIGatewayClient struct {
+	apigatewayiface.APIGatewayAPI
+	restApis []*apigateway.RestApi
+	// slowRestApis are only returned on a second page after the delay
+	slowRestApis []*apigateway.RestApi
+	delay        time.Duration
+}
+
+func (m mockAPIGatewayClient) GetRestApisPagesWithContext(ctx aws.Context, input *apigateway.GetRestApisInput, fn func(*apigateway.GetRestApisOutput, bool) bool, opts ...request.Option) error {
+	if !fn(&apigateway.GetRestApisOutput{Items: m.restApis}, m.delay == 0) || m.delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(m.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	fn(&apigateway.GetRestApisOutput{Items: m.slowRestApis}, true)
+	return nil
+}
+
+func (m mockEC2Client) DescribeVpnConnectionsWithContext(ctx aws.Context, input *ec2.DescribeVpnConnectionsInput, opts ...request.Option) (*ec2.DescribeVpnConnectionsOutput, error) {
+	return &ec2.DescribeVpnConnectionsOutput{VpnConnections: m.vpnConnections}, nil
+}
+
+func (m mockEC2Client) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: m.instances}}}, true)
+	return nil
+}
+
+type mockTaggingClient struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	pages []*resourcegroupstaggingapi.GetResourcesOutput
+	input *resourcegroupstaggingapi.GetResourcesInput
+	// failOnPage makes the paginator return err instead of the given (1-based) page, on the first failures calls or
+	// on every call when failures is 0
+	failOnPage int
+	failures   int
+	err        error
+	calls      int
+}
+
+// The pagination token is the index of the next page
+func (m *mockTaggingClient) GetResourcesPagesWithContext(ctx aws.Context, input *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool, opts ...request.Option) error {
+	m.input = input
+	m.calls++
+	start := 0
+	if input.PaginationToken != nil {
+		start, _ = strconv.Atoi(*input.PaginationToken)
+	}
+	for i := start; i < len(m.pages); i++ {
+		if i+1 == m.failOnPage && (m.failures == 0 || m.calls <= m.failures) {
+			return m.err
+		}
+		page := *m.pages[i]
+		if i < len(m.pages)-1 {
+			page.PaginationToken = aws.String(strconv.Itoa(i + 1))
+		}
+		if !fn(&page, i == len(m.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// Tagging client serving its resources by resource type filter, a page per resource
+type mockResourceTypeTaggingClient struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	resourceArns []string
+	calls        [][]string
+}
+
+func (m *mockResourceTypeTaggingClient) GetResourcesPagesWithContext(ctx aws.Context, input *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool, opts ...request.Option) error {
+	filters := aws.StringValueSlice(input.ResourceTypeFilters)
+	m.calls = append(m.calls, filters)
+	var pages []*resourcegroupstaggingapi.GetResourcesOutput
+	for _, resourceArn := range m.resourceArns {
+		parsedArn, _ := arn.Parse(resourceArn)
+		for _, filter := range filters {
+			// service:resource-type
+			parts := strings.SplitN(filter, ":", 2)
+			if parsedArn.Service == parts[0] && strings.HasPrefix(parsedArn.Resource, parts[1]) {
+				pages = append(pages, &resourcegroupstaggingapi.GetResourcesOutput{ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{ResourceARN: aws.String(resourceArn)}}})
+			}
+		}
+	}
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestGetSplitResourceTypes(t *testing.T) {
+	// Setup Test
+	resourceArns := []string{
+		"arn:aws:ecs:eu-west-1:123456789012:cluster/main",
+		"arn:aws:ecs:eu-west-1:123456789012:service/main/web",
+		"arn:aws:ecs:eu-west-1:123456789012:service/main/api",
+		"arn:aws:ecs:eu-west-1:123456789012:task-definition/web:1",
+	}
+	combinedClient := &mockResourceTypeTaggingClient{resourceArns: resourceArns}
+	splitClient := &mockResourceTypeTaggingClient{resourceArns: resourceArns}
+
+	// Act
+	combined, errCombined := tagsInterface{client: combinedClient}.get(job{Type: "ecs-svc"}, "eu-west-1")
+	split, errSplit := tagsInterface{client: splitClient}.get(job{Type: "ecs-svc", SplitResourceTypes: true}, "eu-west-1")
+
+	// Assert
+	if errCombined != nil || errSplit != nil {
+		t.Fatal(errCombined, errSplit)
+	}
+	if len(combinedClient.calls) != 1 || len(splitClient.calls) != 2 || splitClient.calls[0][0] != "ecs:cluster" || splitClient.calls[1][0] != "ecs:service" {
+		t.Fatalf("\nexpected: 1 combined call and a call per resource type\nactual:  %v and %v", combinedClient.calls, splitClient.calls)
+	}
+	ids := func(resources []*tagsData) (ids []string) {
+		for _, resource := range resources {
+			ids = append(ids, *resource.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	if len(combined) != 3 || strings.Join(ids(combined), ",") != strings.Join(ids(split), ",") {
+		t.Fatalf("\nexpected: the same 3 resources\nactual:  %v and %v", ids(combined), ids(split))
+	}
+}
+
+func TestIgnoreTerminatedAutoscalingGroups(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+			{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/active")},
+			{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/deleting"), Status: aws.String("Delete in progress")},
+		}},
+	}
+
+	for _, ignoreTerminated := range []bool{false, true} {
+		// Arrange
+		expected := 2
+		if ignoreTerminated {
+			expected = 1
+		}
+
+		// Act
+		resources, err := iface.get(job{Type: "asg", IgnoreTerminated: ignoreTerminated}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != expected {
+			t.Fatalf("ignoreTerminated=%t\nexpected: %d\nactual:  %d", ignoreTerminated, expected, len(resources))
+		}
+	}
+}
+
+func TestIgnoreTerminatedInstances(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-running")},
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-terminated")},
+			},
+		}}},
+		ec2Client: mockEC2Client{instances: []*ec2.Instance{
+			{InstanceId: aws.String("i-terminated")},
+		}},
+	}
+
+	// Act
+	resources, err := iface.get(job{Type: "ec2", IgnoreTerminated: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != "arn:aws:ec2:eu-west-1:123456789012:instance/i-running" {
+		t.Fatalf("\nexpected: only i-running\nactual:  %d resources", len(resources))
+	}
+}
+
+func TestGetOpenSearchIngestionPipelines(t *testing.T) {
+	// Setup Test
+	client := &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+			{
+				ResourceARN: aws.String("arn:aws:osis:eu-west-1:123456789012:pipeline/logs"),
+				Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("env"), Value: aws.String("prod")}},
+			},
+			{
+				ResourceARN: aws.String("arn:aws:osis:eu-west-1:123456789012:pipeline/traces"),
+				Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("env"), Value: aws.String("dev")}},
+			},
+		},
+	}}}
+	iface := tagsInterface{client: client}
+
+	// Act
+	j := job{Type: "osis", SearchTags: []tag{{Key: "env", Value: "^prod$"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := aws.StringValueSlice(client.input.ResourceTypeFilters)
+	if len(filters) != 1 || filters[0] != "osis:pipeline" {
+		t.Fatalf("\nexpected: [osis:pipeline]\nactual:  %v", filters)
+	}
+	if len(resources) != 1 || *resources[0].ID != "arn:aws:osis:eu-west-1:123456789012:pipeline/logs" {
+		t.Fatalf("\nexpected: only the logs pipeline\nactual:  %d resources", len(resources))
+	}
+}
+
+func TestTagNormalization(t *testing.T) {
+	for _, tc := range []struct {
+		normalization tagNormalization
+		expected      string
+	}{
+		{tagNormalization{}, " Production "},
+		{tagNormalization{Trim: true}, "Production"},
+		{tagNormalization{Lowercase: true}, " production "},
+		{tagNormalization{Trim: true, Lowercase: true}, "production"},
+	} {
+		actual := tc.normalization.apply(" Production ")
+		if actual != tc.expected {
+			t.Fatalf("%+v\nexpected: %q\nactual:  %q", tc.normalization, tc.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeTagValuesOnDiscovery(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{
+				ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:orders"),
+				Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("env"), Value: aws.String("Production ")}},
+			}},
+		}}},
+	}
+	j := job{
+		Type:               "sqs",
+		SearchTags:         []tag{{Key: "env", Value: "^production$"}},
+		NormalizeTagValues: tagNormalization{Trim: true, Lowercase: true},
+	}
+	j.compileRegexes()
+
+	// Act
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("\nexpected: 1 resource\nactual:  %d", len(resources))
+	}
+	metrics := migrateTagsToPrometheus(resources)
+	if value := metrics[0].labels["tag_env"]; value != "production" {
+		t.Fatalf("\nexpected: %q\nactual:  %q", "production", value)
+	}
+}
+
+func TestMemoryDBDoesNotOverlapElastiCache(t *testing.T) {
+	// Setup Test
+	filters := make(map[string][]string)
+	for _, jobType := range []string{"ec", "memorydb"} {
+		client := &mockTaggingClient{}
+		iface := tagsInterface{client: client}
+
+		// Act
+		if _, err := iface.get(job{Type: jobType}, "eu-west-1"); err != nil {
+			t.Fatal(err)
+		}
+		filters[jobType] = aws.StringValueSlice(client.input.ResourceTypeFilters)
+	}
+
+	// Assert
+	for _, filter := range filters["memorydb"] {
+		if stringInSlice(filter, filters["ec"]) {
+			t.Fatalf("memorydb filter %s is also used by ec", filter)
+		}
+	}
+	ecNamespace, _ := getNamespace("ec")
+	memorydbNamespace, _ := getNamespace("memorydb")
+	if ecNamespace == memorydbNamespace {
+		t.Fatalf("memorydb and ec share the namespace %s", ecNamespace)
+	}
+}
+
+func TestGetReturnsPartialResultsOnPaginationError(t *testing.T) {
+	// Setup Test
+	var pages []*resourcegroupstaggingapi.GetResourcesOutput
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		pages = append(pages, &resourcegroupstaggingapi.GetResourcesOutput{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:" + name)},
+			},
+		})
+	}
+	throttled := errors.New("Throttling: Rate exceeded")
+	iface := tagsInterface{client: &mockTaggingClient{pages: pages, failOnPage: 3, err: throttled}}
+
+	// Act
+	resources, err := iface.get(job{Type: "sqs"}, "eu-west-1")
+
+	// Assert
+	var partial *partialResultsError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected a partialResultsError, got %v", err)
+	}
+	if !errors.Is(err, throttled) {
+		t.Fatalf("expected the paginator error to be wrapped, got %v", err)
+	}
+	if partial.pages != 2 || len(resources) != 2 {
+		t.Fatalf("\nexpected: 2 pages and 2 resources\nactual:  %d pages and %d resources", partial.pages, len(resources))
+	}
+}
+
+func TestGetResumesPaginationAfterError(t *testing.T) {
+	// Setup Test
+	var pages []*resourcegroupstaggingapi.GetResourcesOutput
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		pages = append(pages, &resourcegroupstaggingapi.GetResourcesOutput{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:" + name)},
+			},
+		})
+	}
+	throttled := errors.New("Throttling: Rate exceeded")
+	client := &mockTaggingClient{pages: pages, failOnPage: 3, failures: 2, err: throttled}
+	iface := tagsInterface{client: client}
+
+	// Act
+	resources, err := iface.get(job{Type: "sqs"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The resumed calls start at the failed page, the first pages aren't read twice
+	if len(resources) != 5 || client.calls != 3 || aws.StringValue(client.input.PaginationToken) != "2" {
+		t.Fatalf("\nexpected: 5 resources after 3 calls resuming at page 3\nactual:  %d resources after %d calls resuming at %q", len(resources), client.calls, aws.StringValue(client.input.PaginationToken))
+	}
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		if *resources[i].ID != "arn:aws:sqs:eu-west-1:123456789012:"+name {
+			t.Fatalf("resource %d\nexpected: queue %s\nactual:  %s", i, name, *resources[i].ID)
+		}
+	}
+
+	// The pages keep failing, the call is given up after the resumes
+	client = &mockTaggingClient{pages: pages, failOnPage: 3, err: throttled}
+	iface = tagsInterface{client: client}
+	resources, err = iface.get(job{Type: "sqs"}, "eu-west-1")
+	if !errors.Is(err, throttled) || len(resources) != 2 || client.calls != 1+maxPageResumes {
+		t.Fatalf("\nexpected: the error with 2 resources after %d calls\nactual:  %v with %d resources after %d calls", 1+maxPageResumes, err, len(resources), client.calls)
+	}
+}
+
+func TestGetReturnsPlainErrorWithoutResources(t *testing.T) {
+	// Setup Test
+	denied := errors.New("AccessDenied")
+	iface := tagsInterface{client: &mockTaggingClient{
+		pages:      []*resourcegroupstaggingapi.GetResourcesOutput{{}},
+		failOnPage: 1,
+		err:        denied,
+	}}
+
+	// Act
+	resources, err := iface.get(job{Type: "sqs"}, "eu-west-1")
+
+	// Assert
+	var partial *partialResultsError
+	if !errors.Is(err, denied) || errors.As(err, &partial) || len(resources) != 0 {
+		t.Fatalf("expected the plain paginator error without resources, got %v and %d resources", err, len(resources))
+	}
+}
+
+func TestCreateTagsInterfaceUsesUsEast1ForCloudFront(t *testing.T) {
+	for _, tc := range []struct {
+		jobType  string
+		expected string
+	}{
+		{"cf", "us-east-1"},
+		{"ec2", "eu-west-1"},
+	} {
+		// Act
+		iface := createTagsInterface(job{Type: tc.jobType}, "eu-west-1", "")
+
+		// Assert
+		actual := *iface.client.(*resourcegroupstaggingapi.ResourceGroupsTaggingAPI).Client.Config.Region
+		if actual != tc.expected {
+			t.Fatalf("%s\nexpected: %s\nactual:  %s", tc.jobType, tc.expected, actual)
+		}
+	}
+}
+
+func TestCreateTagsInterfaceOnlyCreatesTheClientsOfTheJobType(t *testing.T) {
+	// Act
+	sqs := createTagsInterface(job{Type: "sqs"}, "eu-west-1", "")
+	ec2 := createTagsInterface(job{Type: "ec2"}, "eu-west-1", "")
+	grouped := createTagsInterface(job{Type: "sqs", ResourceGroup: "production"}, "eu-west-1", "")
+
+	// Assert
+	if sqs.client == nil || !reflect.DeepEqual(sqs, tagsInterface{client: sqs.client}) {
+		t.Fatalf("\nexpected: only the tagging client for sqs\nactual:  %+v", sqs)
+	}
+	if ec2.ec2Client == nil || ec2.asgClient == nil || ec2.lambdaClient != nil || ec2.resGroupsClient != nil {
+		t.Fatalf("\nexpected: the ec2 and autoscaling clients for ec2\nactual:  %+v", ec2)
+	}
+	if grouped.resGroupsClient == nil {
+		t.Fatalf("\nexpected: the resource groups client for a job with a resource group\nactual:  %+v", grouped)
+	}
+}
+
+func TestGetDispatchesToDescribeDiscoverer(t *testing.T) {
+	// Setup Test
+	id := "arn:aws:example:eu-west-1:123456789012:thing/a"
+	describeDiscoverers["example"] = func(iface tagsInterface, job job, region string) ([]*tagsData, error) {
+		return []*tagsData{{ID: &id, Service: &job.Type, Region: &region}}, nil
+	}
+	defer delete(describeDiscoverers, "example")
+	client := &mockTaggingClient{}
+	iface := tagsInterface{client: client}
+
+	// Act
+	resources, err := iface.get(job{Type: "example"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != id {
+		t.Fatalf("expected the registered discoverer to be used, got %d resources", len(resources))
+	}
+	if client.input != nil {
+		t.Fatalf("the tagging API should not be called for describe based services")
+	}
+}
+
+func TestEverySupportedServiceCanBeDiscovered(t *testing.T) {
+	for _, jobType := range supportedServices {
+		_, tagged := allResourceTypesFilters[jobType]
+		_, described := describeDiscoverers[jobType]
+		if !tagged && !described {
+			t.Errorf("jobType %s has neither resource type filters nor a describe discoverer", jobType)
+		}
+		if tagged && described {
+			t.Errorf("jobType %s has both resource type filters and a describe discoverer", jobType)
+		}
+	}
+}
+
+type mockEFSClient struct {
+	efsiface.EFSAPI
+	fileSystems map[string]string
+	calls       *int
+}
+
+func (m mockEFSClient) DescribeAccessPointsWithContext(ctx aws.Context, input *efs.DescribeAccessPointsInput, opts ...request.Option) (*efs.DescribeAccessPointsOutput, error) {
+	if m.calls != nil {
+		*m.calls++
+	}
+	output := &efs.DescribeAccessPointsOutput{}
+	if fileSystemID, ok := m.fileSystems[*input.AccessPointId]; ok {
+		output.AccessPoints = []*efs.AccessPointDescription{{AccessPointId: input.AccessPointId, FileSystemId: aws.String(fileSystemID)}}
+	}
+	return output, nil
+}
+
+func TestGetEFSAccessPoints(t *testing.T) {
+	// Setup Test
+	defer func() {
+		accessPointFileSystemCache.fileSystems = make(map[string]accessPointFileSystem)
+	}()
+	calls := 0
+	client := &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:elasticfilesystem:eu-west-1:123456789012:access-point/fsap-0123")},
+			{ResourceARN: aws.String("arn:aws:elasticfilesystem:eu-west-1:123456789012:access-point/fsap-gone")},
+		},
+	}}}
+	iface := tagsInterface{
+		client:    client,
+		efsClient: mockEFSClient{fileSystems: map[string]string{"fsap-0123": "fs-abcd"}, calls: &calls},
+	}
+
+	// Act
+	resources, err := iface.get(job{Type: "efs-ap"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filters := aws.StringValueSlice(client.input.ResourceTypeFilters); len(filters) != 1 || filters[0] != "elasticfilesystem:access-point" {
+		t.Fatalf("efs-ap should only discover access points, got filters %v", filters)
+	}
+	if len(resources) != 1 || *resources[0].Matcher != "fs-abcd" {
+		t.Fatalf("expected fsap-0123 to be matched to fs-abcd, got %d resources", len(resources))
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "FileSystemId" || *dimensions[0].Value != "fs-abcd" {
+		t.Fatalf("\nexpected: FileSystemId=fs-abcd\nactual:  %v", dimensions)
+	}
+
+	// The file system of the access point is cached, the unknown access point is described again
+	if _, err := iface.get(job{Type: "efs-ap"}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Fatalf("\nexpected: 3 DescribeAccessPoints calls\nactual:  %d", calls)
+	}
+
+	// The expired file systems are described again, the ones of the deleted access points are pruned
+	deletedArn := "arn:aws:elasticfilesystem:eu-west-1:123456789012:access-point/fsap-deleted"
+	for _, accessPointArn := range []string{"arn:aws:elasticfilesystem:eu-west-1:123456789012:access-point/fsap-0123", deletedArn} {
+		accessPointFileSystemCache.fileSystems[accessPointArn] = accessPointFileSystem{fileSystemID: "fs-abcd", expires: time.Now().Add(-time.Second)}
+	}
+	if _, err := iface.get(job{Type: "efs-ap"}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := accessPointFileSystemCache.fileSystems[deletedArn]; calls != 5 || ok {
+		t.Fatalf("\nexpected: 5 DescribeAccessPoints calls and the deleted access point pruned\nactual:  %d calls, %d cached", calls, len(accessPointFileSystemCache.fileSystems))
+	}
+}
+
+func TestDetectDimensionsByServiceWithoutMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		service string
+		arn     string
+	}{
+		// An ARN without the API ID mustn't panic either
+		{"appsync", "arn:aws:appsync:eu-west-1:123456789012:apis"},
+		{"efs-ap", "arn:aws:elasticfilesystem:eu-west-1:123456789012:access-point/fsap-0123"},
+		{"rds-proxy", "arn:aws:rds:eu-west-1:123456789012:db-proxy:prx-0123"},
+		{"waf", "arn:aws:waf::123456789012:webacl/0123"},
+	} {
+		// Act
+		dimensions := detectDimensionsByService(&tagsData{ID: aws.String(tc.arn), Service: aws.String(tc.service)}, nil)
+
+		// Assert
+		if len(dimensions) != 0 {
+			t.Errorf("%s\nexpected: no dimensions without a matcher\nactual:  %v", tc.service, dimensions)
+		}
+	}
+}
+
+func TestInfoCreationTime(t *testing.T) {
+	// Setup Test
+	created := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-0123")},
+			},
+		}}},
+		asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+			{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/web"), CreatedTime: &created},
+		}},
+		ec2Client: mockEC2Client{instances: []*ec2.Instance{
+			{InstanceId: aws.String("i-0123"), LaunchTime: &created},
+		}},
+	}
+
+	for _, jobType := range []string{"asg", "ec2"} {
+		for _, infoCreationTime := range []bool{false, true} {
+			// Arrange
+			var expected float64
+			if infoCreationTime {
+				expected = float64(created.Unix())
+			}
+
+			// Act
+			resources, err := iface.get(job{Type: jobType, InfoCreationTime: infoCreationTime}, "eu-west-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics := migrateTagsToPrometheus(resources)
+
+			// Assert
+			if *metrics[0].value != expected {
+				t.Fatalf("%s infoCreationTime=%t\nexpected: %f\nactual:  %f", jobType, infoCreationTime, expected, *metrics[0].value)
+			}
+		}
+	}
+}
+
+func TestGetServerSideTagFilters(t *testing.T) {
+	defer func() { config = conf{} }()
+	searchTags := []tag{{Key: "team", Value: "^(web|api)$"}, {Key: "env", Value: "prod"}}
+	for _, tc := range []struct {
+		name     string
+		job      job
+		enabled  map[string]bool
+		expected []string
+	}{
+		{"disabled by default", job{Type: "ec2", SearchTags: searchTags}, nil, nil},
+		{"opted in for ec2", job{Type: "ec2", SearchTags: searchTags}, map[string]bool{"ec2": true}, []string{"team", "env"}},
+		{"opted in for another service", job{Type: "ec2", SearchTags: searchTags}, map[string]bool{"s3": true}, nil},
+		{"opted out for ec2", job{Type: "ec2", SearchTags: searchTags}, map[string]bool{"ec2": false}, nil},
+		{"merged ASG tags", job{Type: "ec2", SearchTags: searchTags, AutoScalingGroupTags: true}, map[string]bool{"ec2": true}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Setup Test
+			config = conf{Discovery: discovery{ServerSideTagFilters: tc.enabled}}
+			client := &mockTaggingClient{}
+			iface := tagsInterface{client: client, asgClient: mockAutoScalingClient{}}
+
+			// Act
+			_, err := iface.get(tc.job, "eu-west-1")
+
+			// Assert
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual []string
+			for _, filter := range client.input.TagFilters {
+				actual = append(actual, *filter.Key)
+			}
+			if strings.Join(actual, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("\nexpected: %v\nactual:  %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSearchTagFilters(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		searchTags []tag
+		mode       string
+		normalize  tagNormalization
+		// key=value1|value2 per tag filter, key= when only the key is filtered
+		expected []string
+	}{
+		{"no search tags", nil, "", tagNormalization{}, nil},
+		{"anchored literal", []tag{{Key: "env", Value: "^prod$"}}, "", tagNormalization{}, []string{"env=prod"}},
+		{"escaped literal", []tag{{Key: "host", Value: `^api\.example\.com$`}}, "", tagNormalization{}, []string{"host=api.example.com"}},
+		{"alternation", []tag{{Key: "team", Value: "^(web|api)$"}}, "", tagNormalization{}, []string{"team=web|api"}},
+		{"non-capturing alternation", []tag{{Key: "team", Value: "^(?:web|api|batch)$"}}, "", tagNormalization{}, []string{"team=web|api|batch"}},
+		{"keys are ANDed", []tag{{Key: "env", Value: "^prod$"}, {Key: "team", Value: "^(web|api)$"}}, "", tagNormalization{}, []string{"env=prod", "team=web|api"}},
+		// "prod" also matches "production"
+		{"unanchored literal", []tag{{Key: "env", Value: "prod"}}, "", tagNormalization{}, []string{"env="}},
+		{"wildcard", []tag{{Key: "env", Value: "^prod-.*$"}}, "", tagNormalization{}, []string{"env="}},
+		{"case insensitive", []tag{{Key: "env", Value: "(?i)^prod$"}}, "", tagNormalization{}, []string{"env="}},
+		{"partially anchored", []tag{{Key: "env", Value: "^prod"}}, "", tagNormalization{}, []string{"env="}},
+		{"empty value", []tag{{Key: "env", Value: ""}}, "", tagNormalization{}, []string{"env="}},
+		{"same key twice", []tag{{Key: "env", Value: "^prod$"}, {Key: "env", Value: "^staging$"}}, "", tagNormalization{}, []string{"env="}},
+		{"normalized values", []tag{{Key: "env", Value: "^prod$"}}, "", tagNormalization{Lowercase: true}, []string{"env="}},
+		{"glob literal", []tag{{Key: "env", Value: "prod"}}, searchTagsModeGlob, tagNormalization{}, []string{"env=prod"}},
+		{"glob wildcard", []tag{{Key: "env", Value: "prod-*"}}, searchTagsModeGlob, tagNormalization{}, []string{"env="}},
+		{"glob character class", []tag{{Key: "env", Value: "prod-[ab]"}}, searchTagsModeGlob, tagNormalization{}, []string{"env="}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+			tagFilters := searchTagFilters(job{SearchTags: tc.searchTags, SearchTagsMode: tc.mode, NormalizeTagValues: tc.normalize})
+
+			// Assert
+			var actual []string
+			for _, tagFilter := range tagFilters {
+				actual = append(actual, *tagFilter.Key+"="+strings.Join(aws.StringValueSlice(tagFilter.Values), "|"))
+			}
+			if strings.Join(actual, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("\nexpected: %v\nactual:  %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestGetMergesAutoScalingGroupTags(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"),
+					Tags: []*resourcegroupstaggingapi.Tag{
+						{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String("web")},
+						{Key: aws.String("Name"), Value: aws.String("web-0123")},
+					},
+				},
+				{
+					ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-4567"),
+					Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("Name"), Value: aws.String("bastion")}},
+				},
+			},
+		}}},
+		asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{{
+			AutoScalingGroupName: aws.String("web"),
+			Tags: []*autoscaling.TagDescription{
+				{Key: aws.String("team"), Value: aws.String("frontend")},
+				{Key: aws.String("Name"), Value: aws.String("web")},
+			},
+		}}},
+	}
+
+	// Act
+	j := job{Type: "ec2", AutoScalingGroupTags: true, SearchTags: []tag{{Key: "team", Value: "frontend"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The instance outside of an ASG is filtered out by the search tags
+	if len(resources) != 1 || *resources[0].ID != "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123" {
+		t.Fatalf("\nexpected: the instance of the web ASG\nactual:  %d resources", len(resources))
+	}
+	tags := make(map[string]string)
+	for _, t := range resources[0].Tags {
+		tags[t.Key] = t.Value
+	}
+	if len(tags) != 3 || tags["team"] != "frontend" || tags["Name"] != "web-0123" {
+		t.Fatalf("\nexpected: the team tag of the ASG and the Name tag of the instance\nactual:  %v", tags)
+	}
+}
+
+func TestGetVpnTunnels(t *testing.T) {
+	// Setup Test
+	connectionArn := "arn:aws:ec2:eu-west-1:123456789012:vpn-connection/vpn-0123"
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{
+				ResourceARN: aws.String(connectionArn),
+				Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("Name"), Value: aws.String("office")}},
+			}},
+		}}},
+		ec2Client: mockEC2Client{vpnConnections: []*ec2.VpnConnection{{
+			VpnConnectionId: aws.String("vpn-0123"),
+			VgwTelemetry: []*ec2.VgwTelemetry{
+				{OutsideIpAddress: aws.String("203.0.113.10")},
+				{OutsideIpAddress: aws.String("203.0.113.20")},
+			},
+		}}},
+	}
+
+	// Without vpnTunnels only the connections are discovered
+	resources, err := iface.get(job{Type: "vpn"}, "eu-west-1")
+	if err != nil || len(resources) != 1 {
+		t.Fatalf("\nexpected: the connection\nactual:  %d resources, %v", len(resources), err)
+	}
+
+	// Act
+	resources, err = iface.get(job{Type: "vpn", VpnTunnels: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 3 {
+		t.Fatalf("\nexpected: the connection and its 2 tunnels\nactual:  %d resources", len(resources))
+	}
+	expected := []struct {
+		id        string
+		dimension string
+		value     string
+	}{
+		{connectionArn, "VpnId", "vpn-0123"},
+		{connectionArn + "/203.0.113.10", "TunnelIpAddress", "203.0.113.10"},
+		{connectionArn + "/203.0.113.20", "TunnelIpAddress", "203.0.113.20"},
+	}
+	for i, e := range expected {
+		if *resources[i].ID != e.id || len(resources[i].Tags) != 1 {
+			t.Fatalf("resource %d\nexpected: %s with the connection tags\nactual:  %s", i, e.id, *resources[i].ID)
+		}
+		dimensions := detectDimensionsByService(resources[i], nil)
+		if len(dimensions) != 1 || *dimensions[0].Name != e.dimension || *dimensions[0].Value != e.value {
+			t.Fatalf("resource %d\nexpected: %s=%s\nactual:  %v", i, e.dimension, e.value, dimensions)
+		}
+	}
+}
+
+func TestGetNatGatewayPlacement(t *testing.T) {
+	// Setup Test
+	natGatewayPlacementCache.placements = make(map[string]natGatewayPlacement)
+	gatewayArn := "arn:aws:ec2:eu-west-1:123456789012:natgateway/nat-0123"
+	calls := 0
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(gatewayArn)},
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:natgateway/nat-4567")},
+			},
+		}}},
+		ec2Client: mockEC2Client{
+			natGateways: []*ec2.NatGateway{
+				{NatGatewayId: aws.String("nat-0123"), SubnetId: aws.String("subnet-0123")},
+				{NatGatewayId: aws.String("nat-89ab"), SubnetId: aws.String("subnet-89ab")},
+			},
+			subnets: []*ec2.Subnet{
+				{SubnetId: aws.String("subnet-0123"), AvailabilityZone: aws.String("eu-west-1b")},
+				{SubnetId: aws.String("subnet-89ab"), AvailabilityZone: aws.String("eu-west-1c")},
+			},
+			calls: &calls,
+		},
+	}
+
+	// Without natGatewayPlacement the gateways aren't described
+	resources, err := iface.get(job{Type: "ngw"}, "eu-west-1")
+	if err != nil || calls != 0 || resources[0].Labels != nil {
+		t.Fatalf("\nexpected: no placement\nactual:  %v, %d calls, %v", err, calls, resources[0].Labels)
+	}
+
+	// Act
+	resources, err = iface.get(job{Type: "ngw", NatGatewayPlacement: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("\nexpected: 2 NAT gateways\nactual:  %d resources", len(resources))
+	}
+	if resources[0].Labels["subnet_id"] != "subnet-0123" || resources[0].Labels["availability_zone"] != "eu-west-1b" {
+		t.Fatalf("\nexpected: subnet-0123 in eu-west-1b\nactual:  %v", resources[0].Labels)
+	}
+	// The placement of an unknown gateway is left out rather than failing the discovery
+	if resources[1].Labels != nil {
+		t.Fatalf("\nexpected: no labels\nactual:  %v", resources[1].Labels)
+	}
+	// The placement is cached for the next scrapes, also the one of the unknown gateway
+	if _, err := iface.get(job{Type: "ngw", NatGatewayPlacement: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("\nexpected: 1 DescribeNatGateways call\nactual:  %d", calls)
+	}
+
+	// The expired placements are described again, the ones of the deleted gateways are pruned
+	for _, natGatewayID := range []string{"nat-0123", "nat-deleted"} {
+		natGatewayPlacementCache.placements[natGatewayID] = natGatewayPlacement{expires: time.Now().Add(-time.Second)}
+	}
+	resources, err = iface.get(job{Type: "ngw", NatGatewayPlacement: true}, "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources[0].Labels["subnet_id"] != "subnet-0123" || calls != 2 {
+		t.Fatalf("\nexpected: subnet-0123 described again\nactual:  %v after %d calls", resources[0].Labels, calls)
+	}
+	if _, ok := natGatewayPlacementCache.placements["nat-deleted"]; ok {
+		t.Fatalf("\nexpected: the expired placement pruned\nactual:  %d cached placements", len(natGatewayPlacementCache.placements))
+	}
+}
+
+func TestGetVolumeAttachments(t *testing.T) {
+	// Setup Test
+	calls := 0
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:volume/vol-attached")},
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:volume/vol-detached")},
+			},
+		}}},
+		ec2Client: mockEC2Client{
+			calls: &calls,
+			volumes: []*ec2.Volume{
+				{VolumeId: aws.String("vol-attached"), Attachments: []*ec2.VolumeAttachment{
+					{InstanceId: aws.String("i-4567")},
+					{InstanceId: aws.String("i-0123")},
+				}},
+				{VolumeId: aws.String("vol-detached")},
+				{VolumeId: aws.String("vol-untagged")},
+			},
+		},
+	}
+	defer func() {
+		volumeAttachmentsCache.Lock()
+		volumeAttachmentsCache.attachments = make(map[string]volumeAttachments)
+		volumeAttachmentsCache.Unlock()
+	}()
+
+	// Without volumeAttachments the volumes aren't described
+	resources, err := iface.get(job{Type: "ebs"}, "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 || resources[0].Labels != nil {
+		t.Fatalf("\nexpected: no DescribeVolumes call\nactual:  %d calls, %v", calls, resources[0].Labels)
+	}
+
+	// Act
+	resources, err = iface.get(job{Type: "ebs", VolumeAttachments: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("\nexpected: 2 volumes\nactual:  %d resources", len(resources))
+	}
+	// The instances of a multi-attach volume are sorted
+	if resources[0].Labels["instance_id"] != "i-0123,i-4567" {
+		t.Fatalf("\nexpected: i-0123,i-4567\nactual:  %v", resources[0].Labels)
+	}
+	if resources[1].Labels != nil {
+		t.Fatalf("\nexpected: no labels\nactual:  %v", resources[1].Labels)
+	}
+	if _, ok := volumeAttachmentsCache.attachments["vol-detached"]; !ok {
+		t.Fatal("expected the attachments of vol-detached to be cached")
+	}
+	// Only the discovered volumes are described
+	if _, ok := volumeAttachmentsCache.attachments["vol-untagged"]; ok {
+		t.Fatal("expected vol-untagged not to be described")
+	}
+
+	// The expired attachments of the volumes which aren't discovered anymore are pruned
+	volumeAttachmentsCache.attachments["vol-deleted"] = volumeAttachments{expires: time.Now().Add(-time.Second)}
+	if _, err := iface.get(job{Type: "ebs", VolumeAttachments: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := volumeAttachmentsCache.attachments["vol-deleted"]; ok {
+		t.Fatal("expected the expired attachments of vol-deleted to be pruned")
+	}
+	if calls != 1 {
+		t.Fatalf("\nexpected: 1 DescribeVolumes call\nactual:  %d", calls)
+	}
+}
+
+type mockAppSyncClient struct {
+	appsynciface.AppSyncAPI
+	// resolver field names per type name
+	resolvers map[string][]string
+}
+
+func (m mockAppSyncClient) ListTypesWithContext(ctx aws.Context, input *appsync.ListTypesInput, opts ...request.Option) (*appsync.ListTypesOutput, error) {
+	output := &appsync.ListTypesOutput{}
+	for typeName := range m.resolvers {
+		output.Types = append(output.Types, &appsync.Type{Name: aws.String(typeName)})
+	}
+	return output, nil
+}
+
+func (m mockAppSyncClient) ListResolversWithContext(ctx aws.Context, input *appsync.ListResolversInput, opts ...request.Option) (*appsync.ListResolversOutput, error) {
+	output := &appsync.ListResolversOutput{}
+	for _, fieldName := range m.resolvers[*input.TypeName] {
+		output.Resolvers = append(output.Resolvers, &appsync.Resolver{
+			ResolverArn: aws.String("arn:aws:appsync:eu-west-1:123456789012:apis/" + *input.ApiId + "/types/" + *input.TypeName + "/resolvers/" + fieldName),
+			TypeName:    input.TypeName,
+			FieldName:   aws.String(fieldName),
+		})
+	}
+	return output, nil
+}
+
+func TestGetAppSyncResolvers(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:appsync:eu-west-1:123456789012:apis/abcdefghij")},
+			},
+		}}},
+		appSyncClient: mockAppSyncClient{resolvers: map[string][]string{"Query": {"getOrder"}}},
+	}
+
+	for _, appSyncResolvers := range []bool{false, true} {
+		// Act
+		resources, err := iface.get(job{Type: "appsync", AppSyncResolvers: appSyncResolvers}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 1
+		if appSyncResolvers {
+			expected = 2
+		}
+		if len(resources) != expected {
+			t.Fatalf("appSyncResolvers=%t\nexpected: %d resources\nactual:  %d", appSyncResolvers, expected, len(resources))
+		}
+		dimensions := detectDimensionsByService(resources[0], nil)
+		if len(dimensions) != 1 || *dimensions[0].Name != "GraphQLAPIId" || *dimensions[0].Value != "abcdefghij" {
+			t.Fatalf("\nexpected: GraphQLAPIId=abcdefghij\nactual:  %v", dimensions)
+		}
+	}
+
+	resources, _ := iface.get(job{Type: "appsync", AppSyncResolvers: true}, "eu-west-1")
+	dimensions := detectDimensionsByService(resources[1], nil)
+	if len(dimensions) != 2 ||
+		*dimensions[0].Name != "GraphQLAPIId" || *dimensions[0].Value != "abcdefghij" ||
+		*dimensions[1].Name != "Resolver" || *dimensions[1].Value != "Query.getOrder" {
+		t.Fatalf("\nexpected: GraphQLAPIId=abcdefghij Resolver=Query.getOrder\nactual:  %v", dimensions)
+	}
+}
+
+func TestMigrateTagsToPrometheusInfoMetricSuffix(t *testing.T) {
+	defer func(suffix string) {
+		*infoMetricSuffix = suffix
+	}(*infoMetricSuffix)
+
+	for _, tc := range []struct {
+		suffix   string
+		expected string
+	}{
+		{"_info", "aws_ec2_info"},
+		{"_tags", "aws_ec2_tags"},
+		{"", "aws_ec2"},
+	} {
+		// Arrange
+		*infoMetricSuffix = tc.suffix
+		id := "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"
+		service := "ec2"
+
+		// Act
+		actual := migrateTagsToPrometheus([]*tagsData{{ID: &id, Service: &service}})
+
+		// Assert
+		if *actual[0].name != tc.expected {
+			t.Fatalf("\nexpected: %q\nactual:  %q", tc.expected, *actual[0].name)
+		}
+	}
+}
+
+type mockIoTClient struct {
+	iotiface.IoTAPI
+	rules  []string
+	things []string
+	tags   map[string][]*iot.Tag
+	err    error
+	// Errors of ListTagsForResource per resource ARN
+	tagErrs map[string]error
+}
+
+func (m mockIoTClient) ListTopicRulesWithContext(ctx aws.Context, input *iot.ListTopicRulesInput, opts ...request.Option) (*iot.ListTopicRulesOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	output := &iot.ListTopicRulesOutput{}
+	for _, name := range m.rules {
+		output.Rules = append(output.Rules, &iot.TopicRuleListItem{RuleArn: aws.String("arn:aws:iot:eu-west-1:123456789012:rule/" + name), RuleName: aws.String(name)})
+	}
+	return output, nil
+}
+
+func (m mockIoTClient) ListThingsWithContext(ctx aws.Context, input *iot.ListThingsInput, opts ...request.Option) (*iot.ListThingsOutput, error) {
+	output := &iot.ListThingsOutput{}
+	for _, name := range m.things {
+		output.Things = append(output.Things, &iot.ThingAttribute{ThingArn: aws.String("arn:aws:iot:eu-west-1:123456789012:thing/" + name), ThingName: aws.String(name)})
+	}
+	return output, nil
+}
+
+func (m mockIoTClient) ListTagsForResourceWithContext(ctx aws.Context, input *iot.ListTagsForResourceInput, opts ...request.Option) (*iot.ListTagsForResourceOutput, error) {
+	if err := m.tagErrs[*input.ResourceArn]; err != nil {
+		return nil, err
+	}
+	return &iot.ListTagsForResourceOutput{Tags: m.tags[*input.ResourceArn]}, nil
+}
+
+func TestGetTaggedIoT(t *testing.T) {
+	// Setup Test
+	production := []*iot.Tag{{Key: aws.String("env"), Value: aws.String("production")}}
+	iface := tagsInterface{
+		iotClient: mockIoTClient{
+			rules:  []string{"forward_telemetry", "debug"},
+			things: []string{"sensor-1"},
+			tags: map[string][]*iot.Tag{
+				"arn:aws:iot:eu-west-1:123456789012:rule/forward_telemetry": production,
+				"arn:aws:iot:eu-west-1:123456789012:thing/sensor-1":         production,
+			},
+		},
+	}
+
+	// Act
+	j := job{Type: "iot", SearchTags: []tag{{Key: "env", Value: "production"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("\nexpected: 2 resources\nactual:  %d", len(resources))
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "RuleName" || *dimensions[0].Value != "forward_telemetry" {
+		t.Fatalf("\nexpected: RuleName=forward_telemetry\nactual:  %v", dimensions)
+	}
+	if *resources[1].ID != "arn:aws:iot:eu-west-1:123456789012:thing/sensor-1" || resources[1].Tags[0].Value != "production" {
+		t.Fatalf("unexpected thing resource: %s %v", *resources[1].ID, resources[1].Tags)
+	}
+	if dimensions := detectDimensionsByService(resources[1], nil); len(dimensions) != 0 {
+		t.Fatalf("\nexpected: no dimensions for things\nactual:  %v", dimensions)
+	}
+}
+
+func TestGetTaggedIoTSkipsResourcesWithoutTags(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		iotClient: mockIoTClient{
+			rules:  []string{"forward_telemetry", "debug"},
+			things: []string{"sensor-1", "sensor-2"},
+			tagErrs: map[string]error{
+				"arn:aws:iot:eu-west-1:123456789012:rule/debug":     errors.New("ThrottlingException"),
+				"arn:aws:iot:eu-west-1:123456789012:thing/sensor-1": errors.New("ResourceNotFoundException"),
+			},
+		},
+	}
+	before := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("iot", "tags_not_listed"))
+
+	// Act
+	resources, err := iface.get(job{Type: "iot"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, resource := range resources {
+		actual = append(actual, *resource.ID)
+	}
+	expected := []string{"arn:aws:iot:eu-west-1:123456789012:rule/forward_telemetry", "arn:aws:iot:eu-west-1:123456789012:thing/sensor-2"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, actual)
+	}
+	if dropped := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("iot", "tags_not_listed")) - before; dropped != 2 {
+		t.Fatalf("\nexpected: 2 dropped resources\nactual:  %v", dropped)
+	}
+}
+
+func TestGetObservesDiscoveryDuration(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		asgClient: mockAutoScalingClient{},
+		client:    &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{}}},
+	}
+	before := testutil.CollectAndCount(discoveryDurationHistogram)
+
+	// Act
+	for _, service := range []string{"asg", "ec2"} {
+		if _, err := iface.get(job{Type: service}, "test-discovery-duration"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Assert
+	if actual := testutil.CollectAndCount(discoveryDurationHistogram); actual != before+2 {
+		t.Fatalf("\nexpected: %d series\nactual:  %d", before+2, actual)
+	}
+}
+
+func TestGetSetsLastSuccessTimestamp(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{}}}}
+	failing := tagsInterface{client: &mockTaggingClient{
+		pages:      []*resourcegroupstaggingapi.GetResourcesOutput{{}},
+		failOnPage: 1,
+		err:        errors.New("AccessDenied"),
+	}}
+	before := float64(time.Now().Unix())
+
+	// Act
+	_, err := iface.get(job{Type: "sqs"}, "test-last-success")
+	_, failingErr := failing.get(job{Type: "lambda"}, "test-last-success")
+
+	// Assert
+	if err != nil || failingErr == nil {
+		t.Fatalf("\nexpected: sqs to succeed and lambda to fail\nactual:  %v, %v", err, failingErr)
+	}
+	if actual := testutil.ToFloat64(serviceLastSuccessGauge.WithLabelValues("sqs", "test-last-success")); actual < before {
+		t.Fatalf("\nexpected: at least %f\nactual:  %f", before, actual)
+	}
+	if actual := testutil.ToFloat64(serviceLastSuccessGauge.WithLabelValues("lambda", "test-last-success")); actual != 0 {
+		t.Fatalf("\nexpected: no success of lambda\nactual:  %f", actual)
+	}
+}
+
+type mockFirehoseClient struct {
+	firehoseiface.FirehoseAPI
+	destinations map[string]*firehose.DestinationDescription
+	calls        *int
+}
+
+func (m mockFirehoseClient) DescribeDeliveryStreamWithContext(ctx aws.Context, input *firehose.DescribeDeliveryStreamInput, opts ...request.Option) (*firehose.DescribeDeliveryStreamOutput, error) {
+	*m.calls++
+	return &firehose.DescribeDeliveryStreamOutput{DeliveryStreamDescription: &firehose.DeliveryStreamDescription{
+		DeliveryStreamName: input.DeliveryStreamName,
+		Destinations:       []*firehose.DestinationDescription{m.destinations[*input.DeliveryStreamName]},
+	}}, nil
+}
+
+func TestGetFirehoseDestinations(t *testing.T) {
+	// Setup Test
+	firehoseDestinationCache.destinations = make(map[string]firehoseDestination)
+	s3Stream := "arn:aws:firehose:eu-west-1:123456789012:deliverystream/to-s3"
+	searchStream := "arn:aws:firehose:eu-west-1:123456789012:deliverystream/to-search"
+	openSearchStream := "arn:aws:firehose:eu-west-1:123456789012:deliverystream/to-opensearch"
+	calls := 0
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(s3Stream)},
+				{ResourceARN: aws.String(searchStream)},
+				{ResourceARN: aws.String(openSearchStream)},
+			},
+		}}},
+		firehoseClient: mockFirehoseClient{calls: &calls, destinations: map[string]*firehose.DestinationDescription{
+			"to-s3": {
+				S3DestinationDescription:         &firehose.S3DestinationDescription{},
+				ExtendedS3DestinationDescription: &firehose.ExtendedS3DestinationDescription{},
+			},
+			"to-search": {
+				ElasticsearchDestinationDescription: &firehose.ElasticsearchDestinationDescription{},
+				S3DestinationDescription:            &firehose.S3DestinationDescription{},
+			},
+			"to-opensearch": {
+				AmazonopensearchserviceDestinationDescription: &firehose.AmazonopensearchserviceDestinationDescription{},
+				S3DestinationDescription:                      &firehose.S3DestinationDescription{},
+			},
+		}},
+	}
+
+	for i := 0; i < 2; i++ {
+		// Act
+		resources, err := iface.get(job{Type: "firehose", FirehoseDestinations: true}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{s3Stream: "s3", searchStream: "elasticsearch", openSearchStream: "opensearch"}
+		for _, resource := range resources {
+			if destination := resource.Labels["destination"]; destination != expected[*resource.ID] {
+				t.Fatalf("%s\nexpected: %s\nactual:  %s", *resource.ID, expected[*resource.ID], destination)
+			}
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("\nexpected: 3 cached DescribeDeliveryStream calls\nactual:  %d", calls)
+	}
+
+	// Expired destinations are described again
+	cached := firehoseDestinationCache.destinations[s3Stream]
+	cached.expires = time.Now().Add(-time.Second)
+	firehoseDestinationCache.destinations[s3Stream] = cached
+	// A stream deleted since isn't discovered anymore
+	deletedStream := "arn:aws:firehose:eu-west-1:123456789012:deliverystream/deleted"
+	firehoseDestinationCache.destinations[deletedStream] = cached
+	if _, err := iface.get(job{Type: "firehose", FirehoseDestinations: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 {
+		t.Fatalf("\nexpected: the expired destination described again\nactual:  %d calls", calls)
+	}
+	if _, ok := firehoseDestinationCache.destinations[deletedStream]; ok {
+		t.Fatalf("\nexpected: the expired destination pruned\nactual:  %d cached destinations", len(firehoseDestinationCache.destinations))
+	}
+
+	resources, _ := iface.get(job{Type: "firehose", FirehoseDestinations: true}, "eu-west-1")
+	if labels := migrateTagsToPrometheus(resources)[0].labels; labels["destination"] != "s3" {
+		t.Fatalf("\nexpected: destination=s3\nactual:  %v", labels)
+	}
+}
+
+type mockELBv2Client struct {
+	elbv2iface.ELBV2API
+	targetGroups []*elbv2.TargetGroup
+	calls        *int
+}
+
+func (m mockELBv2Client) DescribeTargetGroupsPagesWithContext(ctx aws.Context, input *elbv2.DescribeTargetGroupsInput, fn func(*elbv2.DescribeTargetGroupsOutput, bool) bool, opts ...request.Option) error {
+	*m.calls++
+	fn(&elbv2.DescribeTargetGroupsOutput{TargetGroups: m.targetGroups}, true)
+	return nil
+}
+
+func TestGetTargetGroupLoadBalancers(t *testing.T) {
+	// Setup Test
+	sharedArn := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/shared/73e2d6bc24d8a067"
+	detachedArn := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/detached/83e2d6bc24d8a067"
+	loadBalancerArn := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/public/50dc6c495c0c9188"
+	deletedArn := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/deleted/93e2d6bc24d8a067"
+	defer func() {
+		for _, targetGroupArn := range []string{sharedArn, detachedArn, deletedArn} {
+			delete(targetGroupLoadBalancersCache.loadBalancers, targetGroupArn)
+		}
+	}()
+	calls := 0
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(loadBalancerArn)},
+				{ResourceARN: aws.String(sharedArn)},
+				{ResourceARN: aws.String(detachedArn)},
+				{ResourceARN: aws.String(deletedArn)},
+			},
+		}}},
+		elbv2Client: mockELBv2Client{calls: &calls, targetGroups: []*elbv2.TargetGroup{
+			{TargetGroupArn: aws.String(sharedArn), LoadBalancerArns: aws.StringSlice([]string{
+				"arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/public/50dc6c495c0c9188",
+				"arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/internal/60dc6c495c0c9188",
+			})},
+			{TargetGroupArn: aws.String(detachedArn)},
+		}},
+	}
+
+	for i := 0; i < 2; i++ {
+		// Act
+		resources, err := iface.get(job{Type: "alb", LoadBalancerLabels: true}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []map[string]string{
+			// Only the target groups get the label
+			nil,
+			{"load_balancer": "app/internal/60dc6c495c0c9188,app/public/50dc6c495c0c9188"},
+			{"load_balancer": ""},
+			// The target group deleted since it was listed isn't described
+			nil,
+		}
+		for n, resource := range resources {
+			if !reflect.DeepEqual(resource.Labels, expected[n]) {
+				t.Fatalf("%s\nexpected: %v\nactual:  %v", *resource.ID, expected[n], resource.Labels)
+			}
+		}
+	}
+	// The target groups without load balancer or description are cached too
+	if calls != 1 {
+		t.Fatalf("\nexpected: 1 DescribeTargetGroups sweep\nactual:  %d", calls)
+	}
+
+	// The detached target group may be attached later, it is described again once expired
+	cached := targetGroupLoadBalancersCache.loadBalancers[detachedArn]
+	cached.expires = time.Now().Add(-time.Second)
+	targetGroupLoadBalancersCache.loadBalancers[detachedArn] = cached
+	// A target group removed since isn't discovered anymore
+	removedArn := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/removed/a3e2d6bc24d8a067"
+	targetGroupLoadBalancersCache.loadBalancers[removedArn] = cached
+	if _, err := iface.get(job{Type: "alb", LoadBalancerLabels: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("\nexpected: the expired target group described again\nactual:  %d sweeps", calls)
+	}
+	if _, ok := targetGroupLoadBalancersCache.loadBalancers[removedArn]; ok {
+		t.Fatalf("\nexpected: the expired target group pruned\nactual:  %d cached target groups", len(targetGroupLoadBalancersCache.loadBalancers))
+	}
+}
+
+type mockCloudFrontClient struct {
+	cloudfrontiface.CloudFrontAPI
+	distributions map[string]*cloudfront.DistributionSummary
+	calls         *int
+}
+
+func (m mockCloudFrontClient) ListDistributionsPagesWithContext(ctx aws.Context, input *cloudfront.ListDistributionsInput, fn func(*cloudfront.ListDistributionsOutput, bool) bool, opts ...request.Option) error {
+	*m.calls++
+	var items []*cloudfront.DistributionSummary
+	for id, distribution := range m.distributions {
+		distribution.ARN = aws.String("arn:aws:cloudfront::123456789012:distribution/" + id)
+		items = append(items, distribution)
+	}
+	fn(&cloudfront.ListDistributionsOutput{DistributionList: &cloudfront.DistributionList{Items: items}}, true)
+	return nil
+}
+
+func TestGetDistributionDomains(t *testing.T) {
+	// Setup Test
+	aliasedArn := "arn:aws:cloudfront::123456789012:distribution/E1ALIASED"
+	plainArn := "arn:aws:cloudfront::123456789012:distribution/E2PLAIN"
+	calls := 0
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(aliasedArn)},
+				{ResourceARN: aws.String(plainArn)},
+				{ResourceARN: aws.String("arn:aws:cloudfront::123456789012:distribution/E3DELETED")},
+			},
+		}}},
+		cfClient: mockCloudFrontClient{calls: &calls, distributions: map[string]*cloudfront.DistributionSummary{
+			"E1ALIASED": {
+				DomainName: aws.String("d111.cloudfront.net"),
+				Aliases:    &cloudfront.Aliases{Items: aws.StringSlice([]string{"www.example.com", "cdn.example.com"})},
+			},
+			"E2PLAIN": {DomainName: aws.String("d222.cloudfront.net")},
+		}},
+	}
+
+	for i := 0; i < 2; i++ {
+		// Act
+		resources, err := iface.get(job{Type: "cf", CloudFrontDomains: true}, "us-east-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []map[string]string{
+			{"domain_name": "d111.cloudfront.net", "aliases": "cdn.example.com,www.example.com"},
+			{"domain_name": "d222.cloudfront.net", "aliases": ""},
+			// The distribution is kept without labels when it isn't listed
+			nil,
+		}
+		for n, resource := range resources {
+			if !reflect.DeepEqual(resource.Labels, expected[n]) {
+				t.Fatalf("%s\nexpected: %v\nactual:  %v", *resource.ID, expected[n], resource.Labels)
+			}
+		}
+	}
+	// The distribution which wasn't listed is cached too
+	if calls != 1 {
+		t.Fatalf("\nexpected: 1 ListDistributions sweep\nactual:  %d", calls)
+	}
+
+	// Expired domains are described again
+	cached := distributionDomainsCache.domains[aliasedArn]
+	cached.expires = time.Now().Add(-time.Second)
+	distributionDomainsCache.domains[aliasedArn] = cached
+	// A distribution removed since isn't discovered anymore
+	removedArn := "arn:aws:cloudfront::123456789012:distribution/E4REMOVED"
+	distributionDomainsCache.domains[removedArn] = cached
+	if _, err := iface.get(job{Type: "cf", CloudFrontDomains: true}, "us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("\nexpected: the expired distribution listed again\nactual:  %d sweeps", calls)
+	}
+	if _, ok := distributionDomainsCache.domains[removedArn]; ok {
+		t.Fatalf("\nexpected: the expired distribution pruned\nactual:  %d cached distributions", len(distributionDomainsCache.domains))
+	}
+}
+
+type mockFSxClient struct {
+	fsxiface.FSxAPI
+	fileSystems []*fsx.FileSystem
+}
+
+func (m mockFSxClient) DescribeFileSystemsPagesWithContext(ctx aws.Context, input *fsx.DescribeFileSystemsInput, fn func(*fsx.DescribeFileSystemsOutput, bool) bool, opts ...request.Option) error {
+	fn(&fsx.DescribeFileSystemsOutput{FileSystems: m.fileSystems}, true)
+	return nil
+}
+
+func TestGetFSxFileSystemsByType(t *testing.T) {
+	// Setup Test
+	lustre := "arn:aws:fsx:eu-west-1:123456789012:file-system/fs-0lustre"
+	ontap := "arn:aws:fsx:eu-west-1:123456789012:file-system/fs-0ontap"
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(lustre)},
+				{ResourceARN: aws.String(ontap)},
+			},
+		}}},
+		fsxClient: mockFSxClient{fileSystems: []*fsx.FileSystem{
+			{ResourceARN: aws.String(lustre), FileSystemType: aws.String("LUSTRE")},
+			{ResourceARN: aws.String(ontap), FileSystemType: aws.String("ONTAP")},
+		}},
+	}
+
+	for service, expected := range map[string]string{"fsx-lustre": lustre, "fsx-ontap": ontap} {
+		// Act
+		resources, err := iface.get(job{Type: service}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != 1 || *resources[0].ID != expected {
+			t.Fatalf("%s\nexpected: %s\nactual:  %d resources", service, expected, len(resources))
+		}
+		dimensions := detectDimensionsByService(resources[0], nil)
+		if len(dimensions) != 1 || *dimensions[0].Name != "FileSystemId" || *dimensions[0].Value != resourceIDFromArn(expected) {
+			t.Fatalf("%s\nexpected: FileSystemId=%s\nactual:  %v", service, resourceIDFromArn(expected), dimensions)
+		}
+	}
+
+	// The untyped job keeps every file system
+	if resources, _ := iface.get(job{Type: "fsx"}, "eu-west-1"); len(resources) != 2 {
+		t.Fatalf("fsx\nexpected: 2 resources\nactual:  %d", len(resources))
+	}
+}
+
+type mockRDSClient struct {
+	rdsiface.RDSAPI
+	proxies   []*rds.DBProxy
+	instances []*rds.DBInstance
+}
+
+func (m mockRDSClient) DescribeDBInstancesPagesWithContext(ctx aws.Context, input *rds.DescribeDBInstancesInput, fn func(*rds.DescribeDBInstancesOutput, bool) bool, opts ...request.Option) error {
+	fn(&rds.DescribeDBInstancesOutput{DBInstances: m.instances}, true)
+	return nil
+}
+
+func (m mockRDSClient) DescribeDBProxiesPagesWithContext(ctx aws.Context, input *rds.DescribeDBProxiesInput, fn func(*rds.DescribeDBProxiesOutput, bool) bool, opts ...request.Option) error {
+	fn(&rds.DescribeDBProxiesOutput{DBProxies: m.proxies}, true)
+	return nil
+}
+
+func TestGetRDSProxies(t *testing.T) {
+	// Setup Test
+	client := &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+		ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:rds:eu-west-1:123456789012:db-proxy:prx-0123456789abcdef0")},
+		},
+	}}}
+	iface := tagsInterface{
+		client: client,
+		rdsClient: mockRDSClient{proxies: []*rds.DBProxy{
+			{DBProxyArn: aws.String("arn:aws:rds:eu-west-1:123456789012:db-proxy:prx-0123456789abcdef0"), DBProxyName: aws.String("orders")},
+		}},
+	}
+
+	// Act
+	resources, err := iface.get(job{Type: "rds-proxy"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filters := aws.StringValueSlice(client.input.ResourceTypeFilters); !reflect.DeepEqual(filters, []string{"rds:db-proxy"}) {
+		t.Fatalf("\nexpected: [rds:db-proxy]\nactual:  %v", filters)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("\nexpected: 1 resource\nactual:  %d", len(resources))
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "ProxyName" || *dimensions[0].Value != "orders" {
+		t.Fatalf("\nexpected: ProxyName=orders\nactual:  %v", dimensions)
+	}
+
+	// Database instances keep their own filter and dimension
+	if _, err := iface.get(job{Type: "rds"}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if filters := aws.StringValueSlice(client.input.ResourceTypeFilters); !reflect.DeepEqual(filters, []string{"rds:db"}) {
+		t.Fatalf("\nexpected: [rds:db]\nactual:  %v", filters)
+	}
+	id := "arn:aws:rds:eu-west-1:123456789012:db:orders-primary"
+	service := "rds"
+	dimensions = detectDimensionsByService(&tagsData{ID: &id, Service: &service}, nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "DBInstanceIdentifier" || *dimensions[0].Value != "orders-primary" {
+		t.Fatalf("\nexpected: DBInstanceIdentifier=orders-primary\nactual:  %v", dimensions)
+	}
+}
+
+func TestGetCountsDroppedResources(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:apigateway:eu-west-1::/restapis/known/stages/prod")},
+				{ResourceARN: aws.String("arn:aws:apigateway:eu-west-1::/restapis/deleted/stages/prod")},
+				{ResourceARN: aws.String("arn:aws:apigateway:eu-west-1::/apis/http")},
+			},
+		}}},
+		apiGatewayClient: mockAPIGatewayClient{restApis: []*apigateway.RestApi{{Id: aws.String("known"), Name: aws.String("orders")}}},
+	}
+	notFound := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("apigateway", "api_gateway_not_found"))
+	notRestAPI := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("apigateway", "not_rest_api"))
+
+	// Act
+	resources, err := iface.get(job{Type: "apigateway"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("\nexpected: 1 resource\nactual:  %d", len(resources))
+	}
+	if actual := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("apigateway", "api_gateway_not_found")); actual != notFound+1 {
+		t.Fatalf("\nexpected: %f dropped api_gateway_not_found\nactual:  %f", notFound+1, actual)
+	}
+	if actual := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("apigateway", "not_rest_api")); actual != notRestAPI+1 {
+		t.Fatalf("\nexpected: %f dropped not_rest_api\nactual:  %f", notRestAPI+1, actual)
+	}
+}
+
+func TestGetMaxResources(t *testing.T) {
+	// Setup Test
+	queue := func(name string) *resourcegroupstaggingapi.ResourceTagMapping {
+		return &resourcegroupstaggingapi.ResourceTagMapping{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:" + name)}
+	}
+	pages := []*resourcegroupstaggingapi.GetResourcesOutput{
+		{ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{queue("a"), queue("b")}},
+		{ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{queue("c"), queue("d")}},
+	}
+
+	for _, tc := range []struct {
+		maxResources int
+		expected     int
+		exceeded     float64
+	}{
+		{0, 4, 0},
+		{4, 4, 0},
+		{3, 3, 1},
+		{1, 1, 1},
+	} {
+		// Arrange
+		iface := tagsInterface{client: &mockTaggingClient{pages: pages}}
+		exceeded := testutil.ToFloat64(resourceLimitExceededCounter.WithLabelValues("sqs"))
+
+		// Act
+		resources, err := iface.get(job{Type: "sqs", MaxResources: tc.maxResources}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != tc.expected {
+			t.Fatalf("maxResources %d\nexpected: %d resources\nactual:  %d", tc.maxResources, tc.expected, len(resources))
+		}
+		if actual := testutil.ToFloat64(resourceLimitExceededCounter.WithLabelValues("sqs")); actual != exceeded+tc.exceeded {
+			t.Fatalf("maxResources %d\nexpected: %f exceeded\nactual:  %f", tc.maxResources, exceeded+tc.exceeded, actual)
+		}
+	}
+}
+
+func TestGetMaxResourcesOfDescribeDiscovery(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{comprehendClient: mockComprehendClient{pages: [][]*comprehend.EndpointProperties{{
+		{EndpointArn: aws.String("arn:aws:comprehend:eu-west-1:123456789012:document-classifier-endpoint/a")},
+		{EndpointArn: aws.String("arn:aws:comprehend:eu-west-1:123456789012:document-classifier-endpoint/b")},
+	}}}}
+	exceeded := testutil.ToFloat64(resourceLimitExceededCounter.WithLabelValues("comprehend"))
+
+	// Act
+	resources, err := iface.get(job{Type: "comprehend", MaxResources: 1}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("\nexpected: 1 resource\nactual:  %d", len(resources))
+	}
+	if actual := testutil.ToFloat64(resourceLimitExceededCounter.WithLabelValues("comprehend")); actual != exceeded+1 {
+		t.Fatalf("\nexpected: %f exceeded\nactual:  %f", exceeded+1, actual)
+	}
+}
+
+func TestGetApiGatewayTimeout(t *testing.T) {
+	// Setup Test
+	timeout := *apiGatewayTimeout
+	*apiGatewayTimeout = 10 * time.Millisecond
+	defer func() { *apiGatewayTimeout = timeout }()
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:apigateway:eu-west-1::/restapis/fast/stages/prod")},
+				{ResourceARN: aws.String("arn:aws:apigateway:eu-west-1::/restapis/slow/stages/prod")},
+			},
+		}}},
+		apiGatewayClient: mockAPIGatewayClient{
+			restApis:     []*apigateway.RestApi{{Id: aws.String("fast"), Name: aws.String("orders")}},
+			slowRestApis: []*apigateway.RestApi{{Id: aws.String("slow"), Name: aws.String("payments")}},
+			delay:        time.Minute,
+		},
+	}
+
+	// Act
+	start := time.Now()
+	resources, err := iface.get(job{Type: "apigateway"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the slow GetRestApis to be abandoned, took %s", elapsed)
+	}
+	// The gateway of the pages received in time keeps its name, the other one falls back to its ID
+	if len(resources) != 2 || *resources[0].Matcher != "orders" || *resources[1].Matcher != "slow" {
+		t.Fatalf("\nexpected: orders and slow\nactual:  %d resources", len(resources))
+	}
+}
+
+func TestGetApiGatewayCache(t *testing.T) {
+	// Setup Test
+	ttl := *apiGatewayCacheTTL
+	*apiGatewayCacheTTL = time.Minute
+	defer func() { *apiGatewayCacheTTL = ttl }()
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:apigateway:eu-west-1::/restapis/abc123/stages/prod")},
+			},
+		}}},
+		apiGatewayClient: mockAPIGatewayClient{restApis: []*apigateway.RestApi{{Id: aws.String("abc123"), Name: aws.String("orders")}}},
+		roleArn:          "arn:aws:iam::123456789012:role/cache-test",
+	}
+	requests, hits := testutil.ToFloat64(apiGatewayAPICounter), testutil.ToFloat64(apiGatewayCacheHitsCounter)
+
+	for i := 0; i < 2; i++ {
+		// Act
+		resources, err := iface.get(job{Type: "apigateway"}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != 1 || *resources[0].Matcher != "orders" {
+			t.Fatalf("\nexpected: orders\nactual:  %v", resources)
+		}
+	}
+	if calls := testutil.ToFloat64(apiGatewayAPICounter) - requests; calls != 1 {
+		t.Fatalf("\nexpected: a single GetRestApis\nactual:  %v", calls)
+	}
+	if cached := testutil.ToFloat64(apiGatewayCacheHitsCounter) - hits; cached != 1 {
+		t.Fatalf("\nexpected: 1 cache hit\nactual:  %v", cached)
+	}
+
+	// The expired entries of the other roles and regions are evicted
+	restApisCache.Lock()
+	restApisCache.entries["eu-west-1/arn:aws:iam::123456789012:role/removed"] = restApisCacheEntry{expires: time.Now().Add(-time.Second)}
+	entry := restApisCache.entries["eu-west-1/"+iface.roleArn]
+	entry.expires = time.Now().Add(-time.Second)
+	restApisCache.entries["eu-west-1/"+iface.roleArn] = entry
+	restApisCache.Unlock()
+	if _, err := iface.get(job{Type: "apigateway"}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restApisCache.entries["eu-west-1/arn:aws:iam::123456789012:role/removed"]; ok {
+		t.Fatalf("\nexpected: the expired entry evicted\nactual:  %d entries", len(restApisCache.entries))
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	// Setup Test
+	*userAgentSuffix = "team-a"
+	defer func() { *userAgentSuffix = "" }()
+	region := "eu-west-1"
+	requests := map[string]*request.Request{}
+	requests["tagging"], _ = createTagSession(&region, "").GetResourcesRequest(&resourcegroupstaggingapi.GetResourcesInput{})
+	requests["apigateway"], _ = createAPIGatewaySession(&region, "").GetRestApisRequest(&apigateway.GetRestApisInput{})
+	requests["cloudwatch"], _ = createCloudwatchSession(&region, "").ListMetricsRequest(&cloudwatch.ListMetricsInput{})
+
+	for client, req := range requests {
+		// Act
+		if err := req.Build(); err != nil {
+			t.Fatalf("%s: %v", client, err)
+		}
+
+		// Assert
+		expected := "yace/" + version + " (team-a)"
+		if userAgent := req.HTTPRequest.Header.Get("User-Agent"); !strings.Contains(userAgent, expected) {
+			t.Fatalf("%s\nexpected: %s\nactual:  %s", client, expected, userAgent)
+		}
+	}
+}
+
+func TestSTSEndpoint(t *testing.T) {
+	// Setup Test
+	*stsEndpoint = "https://vpce-0123-abcd.sts.eu-west-1.vpce.amazonaws.com"
+	defer func() { *stsEndpoint = "" }()
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-west-1")}))
+
+	// Act
+	req, _ := newSTSClient(sess).AssumeRoleRequest(&sts.AssumeRoleInput{RoleArn: aws.String("arn:aws:iam::123456789012:role/prometheus"), RoleSessionName: aws.String("yace")})
+	err := req.Build()
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := req.HTTPRequest.URL.Scheme + "://" + req.HTTPRequest.URL.Host; actual != *stsEndpoint {
+		t.Fatalf("\nexpected: %s\nactual:  %s", *stsEndpoint, actual)
+	}
+}
+
+func TestRoleCredentialsAreShared(t *testing.T) {
+	// Setup Test
+	defer func() {
+		roleCredentials.credentials = make(map[string]*credentials.Credentials)
+	}()
+	roleArn := "arn:aws:iam::123456789012:role/prometheus"
+
+	// Act
+	ec2Config := &aws.Config{Region: aws.String("eu-west-1")}
+	createSession(roleArn, ec2Config)
+	rdsConfig := &aws.Config{Region: aws.String("us-east-1")}
+	createSession(roleArn, rdsConfig)
+	otherConfig := &aws.Config{Region: aws.String("eu-west-1")}
+	createSession("arn:aws:iam::210987654321:role/prometheus", otherConfig)
+
+	// Assert
+	// The clients of a role share the credentials whose expiry is tracked
+	if ec2Config.Credentials != rdsConfig.Credentials || ec2Config.Credentials != credentialsExpiry.credentials[roleArn] {
+		t.Fatal("expected the clients of a role to share its tracked credentials")
+	}
+	if ec2Config.Credentials == otherConfig.Credentials {
+		t.Fatal("expected every role to have its own credentials")
+	}
+}
+
+func TestResourceAgeHistogram(t *testing.T) {
+	// Setup Test
+	recent, old := time.Now().Add(-48*time.Hour), time.Now().Add(-400*24*time.Hour)
+	iface := tagsInterface{asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+		{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/recent"), CreatedTime: &recent},
+		{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/old"), CreatedTime: &old},
+	}}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(resourceAgeHistogram)
+
+	// Act
+	// Every scrape replaces the ages of the previous one
+	for i := 0; i < 2; i++ {
+		if _, err := iface.get(job{Type: "asg"}, "eu-west-1"); err != nil {
+			t.Fatal(err)
+		}
+		publishResourceAges()
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert
+	if len(families) != 1 || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("\nexpected: 1 histogram\nactual:  %v", families)
+	}
+	metric := families[0].GetMetric()[0]
+	if label := metric.GetLabel()[0]; label.GetName() != "service" || label.GetValue() != "asg" {
+		t.Fatalf("\nexpected: service=asg\nactual:  %v", label)
+	}
+	histogram := metric.GetHistogram()
+	if histogram.GetSampleCount() != 2 {
+		t.Fatalf("\nexpected: 2\nactual:  %d", histogram.GetSampleCount())
+	}
+	for _, bucket := range histogram.GetBucket() {
+		var expected uint64
+		switch {
+		case bucket.GetUpperBound() >= 63072000:
+			expected = 2
+		case bucket.GetUpperBound() >= 604800:
+			expected = 1
+		}
+		if bucket.GetCumulativeCount() != expected {
+			t.Fatalf("\nexpected: %d resources up to %vs\nactual:  %d", expected, bucket.GetUpperBound(), bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func TestInstanceDetails(t *testing.T) {
+	// Setup Test
+	launched := time.Now().Add(-time.Hour)
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-linux")},
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-windows")},
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-unknown")},
+			},
+		}}},
+		ec2Client: mockEC2Client{instances: []*ec2.Instance{
+			{InstanceId: aws.String("i-linux"), InstanceType: aws.String("m5.large"), LaunchTime: &launched},
+			{InstanceId: aws.String("i-windows"), InstanceType: aws.String("t3.micro"), Platform: aws.String("Windows"), LaunchTime: &launched},
+		}},
+	}
+
+	resetInstancesCache := func() {
+		instancesCache.Lock()
+		instancesCache.instances = make(map[string]cachedInstance)
+		instancesCache.Unlock()
+	}
+	resetInstancesCache()
+	defer resetInstancesCache()
+
+	for _, tc := range []struct {
+		name     string
+		job      job
+		expected map[string]map[string]string
+		sweeps   float64
+	}{
+		{
+			name: "labels",
+			job:  job{Type: "ec2", InstanceDetails: true, InfoCreationTime: true},
+			expected: map[string]map[string]string{
+				"i-linux":   {"instance_type": "m5.large", "platform": "linux"},
+				"i-windows": {"instance_type": "t3.micro", "platform": "windows"},
+				"i-unknown": nil,
+			},
+			sweeps: 1,
+		},
+		{
+			// The instances of the previous discovery are cached, the unknown one too
+			name:     "filters",
+			job:      job{Type: "ec2", InstanceFilters: []tag{{Key: "instance_type", Value: "^m5\\."}, {Key: "platform", Value: "linux"}}},
+			expected: map[string]map[string]string{"i-linux": nil},
+			sweeps:   0,
+		},
+	} {
+		// Arrange
+		requests := testutil.ToFloat64(ec2APICounter)
+		tc.job.compileRegexes()
+
+		// Act
+		resources, err := iface.get(tc.job, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := map[string]map[string]string{}
+		for _, r := range resources {
+			actual[resourceIDFromArn(*r.ID)] = r.Labels
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("%s\nexpected: %v\nactual:  %v", tc.name, tc.expected, actual)
+		}
+		if sweeps := testutil.ToFloat64(ec2APICounter) - requests; sweeps != tc.sweeps {
+			t.Fatalf("%s\nexpected: %v DescribeInstances sweeps\nactual:  %v", tc.name, tc.sweeps, sweeps)
+		}
+	}
+
+	// Expired instances are swept again
+	cached := instancesCache.instances["i-linux"]
+	cached.expires = time.Now().Add(-time.Second)
+	instancesCache.instances["i-linux"] = cached
+	// An instance terminated since isn't discovered anymore
+	instancesCache.instances["i-terminated"] = cached
+	requests := testutil.ToFloat64(ec2APICounter)
+	if _, err := iface.get(job{Type: "ec2", InstanceDetails: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if sweeps := testutil.ToFloat64(ec2APICounter) - requests; sweeps != 1 {
+		t.Fatalf("\nexpected: the expired instance swept again\nactual:  %v sweeps", sweeps)
+	}
+	if _, ok := instancesCache.instances["i-terminated"]; ok {
+		t.Fatalf("\nexpected: the expired instance pruned\nactual:  %d cached instances", len(instancesCache.instances))
+	}
+}
+
+func TestOriginalAsgArns(t *testing.T) {
+	// Setup Test
+	original := "arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:0c1e7a3b-uuid:autoScalingGroupName/web"
+	iface := tagsInterface{asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+		{AutoScalingGroupARN: aws.String(original)},
+	}}}
+
+	for _, tc := range []struct {
+		originalAsgArns bool
+		expectedID      string
+	}{
+		{false, "arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroupName/web"},
+		{true, original},
+	} {
+		// Act
+		resources, err := iface.get(job{Type: "asg", OriginalAsgArns: tc.originalAsgArns}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != 1 || *resources[0].ID != tc.expectedID {
+			t.Fatalf("\nexpected: %s\nactual:  %v", tc.expectedID, resources)
+		}
+		dimensions := detectDimensionsByService(resources[0], nil)
+		if len(dimensions) != 1 || *dimensions[0].Name != "AutoScalingGroupName" || *dimensions[0].Value != "web" {
+			t.Fatalf("\nexpected: AutoScalingGroupName=web\nactual:  %v", dimensions)
+		}
+	}
+}
+
+func TestPartitionAwareDiscovery(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		iface      tagsInterface
+		service    string
+		region     string
+		expectedID string
+		expected   map[string]string
+	}{
+		{
+			name: "asg in GovCloud",
+			iface: tagsInterface{asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+				{AutoScalingGroupARN: aws.String("arn:aws-us-gov:autoscaling:us-gov-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/web")},
+			}}},
+			service:    "asg",
+			region:     "us-gov-west-1",
+			expectedID: "arn:aws-us-gov:autoscaling:us-gov-west-1:123456789012:autoScalingGroupName/web",
+			expected:   map[string]string{"AutoScalingGroupName": "web"},
+		},
+		{
+			name: "apigateway in China",
+			iface: tagsInterface{
+				client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+					ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+						{ResourceARN: aws.String("arn:aws-cn:apigateway:cn-north-1::/restapis/abc123/stages/prod")},
+					},
+				}}},
+				apiGatewayClient: mockAPIGatewayClient{restApis: []*apigateway.RestApi{{Id: aws.String("abc123"), Name: aws.String("orders")}}},
+			},
+			service:    "apigateway",
+			region:     "cn-north-1",
+			expectedID: "arn:aws-cn:apigateway:cn-north-1::/restapis/abc123/stages/prod",
+			expected:   map[string]string{"ApiName": "orders", "Stage": "prod"},
+		},
+		{
+			name: "tgwa in China",
+			iface: tagsInterface{ec2Client: mockEC2Client{transitGatewayAttachments: []*ec2.TransitGatewayAttachment{
+				{TransitGatewayId: aws.String("tgw-0123"), TransitGatewayAttachmentId: aws.String("tgw-attach-4567")},
+			}}},
+			service:    "tgwa",
+			region:     "cn-northwest-1",
+			expectedID: "tgw-0123/tgw-attach-4567",
+			expected:   map[string]string{"TransitGateway": "tgw-0123", "TransitGatewayAttachment": "tgw-attach-4567"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Act
+			resources, err := tc.iface.get(job{Type: tc.service}, tc.region)
+
+			// Assert
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resources) != 1 {
+				t.Fatalf("\nexpected: 1 resource\nactual:  %d", len(resources))
+			}
+			if *resources[0].ID != tc.expectedID || *resources[0].Region != tc.region {
+				t.Fatalf("\nexpected: %s in %s\nactual:  %s in %s", tc.expectedID, tc.region, *resources[0].ID, *resources[0].Region)
+			}
+			actual := map[string]string{}
+			for _, dimension := range detectDimensionsByService(resources[0], nil) {
+				actual[*dimension.Name] = *dimension.Value
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("\nexpected: %v\nactual:  %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func BenchmarkGetTaggedAutoscalingGroups(b *testing.B) {
+	groups := make([]*autoscaling.Group, 0, 100)
+	for i := 0; i < 100; i++ {
+		groups = append(groups, &autoscaling.Group{
+			AutoScalingGroupARN: aws.String(fmt.Sprintf("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/asg-%d", i)),
+			Tags: []*autoscaling.TagDescription{
+				{Key: aws.String("env"), Value: aws.String("production")},
+				{Key: aws.String("team"), Value: aws.String("platform")},
+			},
+		})
+	}
+	iface := tagsInterface{asgClient: mockAutoScalingClient{groups: groups, pages: 50}}
+	j := job{Type: "asg", SearchTags: []tag{{Key: "env", Value: "^prod"}}}
+	j.compileRegexes()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resources, err := iface.get(j, "eu-west-1")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(resources) != 5000 {
+			b.Fatalf("expected 5000 resources, got %d", len(resources))
+		}
+	}
+}
+
+func TestMigrateTagsToPrometheusStaticLabels(t *testing.T) {
+	defer func(staticLabels map[string]string) {
+		config.StaticLabels = staticLabels
+	}(config.StaticLabels)
+	config.StaticLabels = map[string]string{"environment": "prod", "name": "static", "tag_team": "static"}
+	// The labels recorded by the other tests would be added
+	labelMap = make(map[string][]string)
+
+	// Arrange
+	id := "arn:aws:ec2:eu-west-1:123456789012:instance/i-someid"
+	service := "ec2"
+	resource := tagsData{ID: &id, Service: &service, Tags: []*tag{{Key: "team", Value: "platform"}}}
+	expected := map[string]string{"environment": "prod", "name": id, "tag_team": "platform"}
+
+	// Act
+	labels := ensureLabelConsistencyForMetrics(migrateTagsToPrometheus([]*tagsData{&resource}))[0].labels
+
+	// Assert
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, labels)
+	}
+}
+
+func TestMigrateTagsToPrometheusNumericTags(t *testing.T) {
+	defer func(jobs []job) {
+		config.Discovery.Jobs = jobs
+	}(config.Discovery.Jobs)
+	config.Discovery.Jobs = []job{{Type: "ec2", NumericTags: []string{"replicas", "cost_center", "owner", "ratio"}}}
+
+	// Arrange
+	id := "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"
+	resource := &tagsData{ID: aws.String(id), Service: aws.String("ec2"), Tags: []*tag{
+		{Key: "replicas", Value: "3"},
+		{Key: "cost_center", Value: " 4512"},
+		{Key: "ratio", Value: "NaN"},
+		{Key: "owner", Value: "alice"},
+		{Key: "Name", Value: "42"},
+	}}
+	expected := map[string]float64{"replicas": 3, "cost_center": 4512}
+
+	// Act
+	metrics := migrateTagsToPrometheus([]*tagsData{resource})
+
+	// Assert
+	actual := make(map[string]float64)
+	for _, metric := range metrics {
+		if *metric.name != "aws_ec2_tag_value" {
+			continue
+		}
+		if metric.labels["name"] != id {
+			t.Fatalf("\nexpected: name %s\nactual:  %v", id, metric.labels)
+		}
+		actual[metric.labels["tag_key"]] = *metric.value
+	}
+	// The non numeric values and the tags which aren't numericTags are only labels of the info metric
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, actual)
+	}
+	if len(metrics) != 3 || *metrics[0].name != "aws_ec2_info" || metrics[0].labels["tag_owner"] != "alice" {
+		t.Fatalf("\nexpected: the info metric and 2 tag values\nactual:  %d metrics", len(metrics))
+	}
+}
+
+func TestMigrateTagsToPrometheusNumericTagsCollidingKeys(t *testing.T) {
+	defer func(jobs []job) {
+		config.Discovery.Jobs = jobs
+	}(config.Discovery.Jobs)
+	config.Discovery.Jobs = []job{{Type: "ec2", NumericTags: []string{"replicas", "cost-center", "cost_center"}}}
+
+	// Arrange
+	resource := &tagsData{ID: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"), Service: aws.String("ec2"), Tags: []*tag{
+		{Key: "replicas", Value: "3"},
+		{Key: "replicas", Value: "5"},
+		{Key: "cost-center", Value: "4512"},
+		{Key: "cost_center", Value: "4513"},
+	}}
+
+	// Act
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusCollector(migrateTagsToPrometheus([]*tagsData{resource})))
+	families, err := registry.Gather()
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "aws_ec2_tag_value" {
+			continue
+		}
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				if label.GetName() == "tag_key" {
+					actual[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	// The first value of a key is exported
+	expected := map[string]float64{"replicas": 3, "cost-center": 4512}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("\nexpected: %v\nactual:  %v", expected, actual)
+	}
+}
+
+func TestMigrateTagsToPrometheusRegionTag(t *testing.T) {
+	defer func(jobs []job) {
+		config.Discovery.Jobs = jobs
+	}(config.Discovery.Jobs)
+	config.Discovery.Jobs = []job{{Type: "cf", RegionTag: "region"}}
+
+	// Arrange
+	distribution := &tagsData{
+		ID:      aws.String("arn:aws:cloudfront::123456789012:distribution/E1"),
+		Service: aws.String("cf"),
+		Region:  aws.String("eu-west-1"),
+	}
+	queue := &tagsData{
+		ID:      aws.String("arn:aws:sqs:eu-west-1:123456789012:queue"),
+		Service: aws.String("sqs"),
+		Region:  aws.String("eu-west-1"),
+	}
+
+	// Act
+	metrics := migrateTagsToPrometheus([]*tagsData{distribution, queue})
+
+	// Assert
+	// Only the services whose jobs override the region from a tag have the region label
+	if region, ok := metrics[0].labels["region"]; !ok || region != "eu-west-1" {
+		t.Fatalf("\nexpected: region=eu-west-1\nactual:  %v", metrics[0].labels)
+	}
+	if _, ok := metrics[1].labels["region"]; ok {
+		t.Fatalf("\nexpected: no region label\nactual:  %v", metrics[1].labels)
+	}
+}
+
+func TestMigrateTagsToPrometheusCollidingTagKeys(t *testing.T) {
+	// Arrange
+	// cost-center and cost_center are exported as the same label
+	web := &tagsData{
+		ID:      aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"),
+		Service: aws.String("ec2"),
+		Region:  aws.String("eu-west-1"),
+		Tags:    []*tag{{Key: "cost-center", Value: "42"}},
+	}
+	batch := &tagsData{
+		ID:      aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-4567"),
+		Service: aws.String("ec2"),
+		Region:  aws.String("eu-west-1"),
+		Tags:    []*tag{{Key: "cost_center", Value: "7"}},
+	}
+
+	// Act
+	metrics := migrateTagsToPrometheus([]*tagsData{web, batch})
+
+	// Assert
+	for i, expected := range []string{"42", "7"} {
+		if actual := metrics[i].labels["tag_cost_center"]; actual != expected {
+			t.Fatalf("%s\nexpected: tag_cost_center=%s\nactual:  %s", metrics[i].labels["name"], expected, actual)
+		}
+	}
+}
+
+func TestMigrateTagsToPrometheusUnifiedInfoMetric(t *testing.T) {
+	defer func(unified bool) {
+		config.UnifiedInfoMetric = unified
+	}(config.UnifiedInfoMetric)
+	config.UnifiedInfoMetric = true
+
+	// Arrange
+	instance := &tagsData{
+		ID:      aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"),
+		Service: aws.String("ec2"),
+		Region:  aws.String("eu-west-1"),
+		Tags:    []*tag{{Key: "cost-center", Value: "42"}, {Key: "Name", Value: "web"}},
+		Labels:  map[string]string{"instance_type": "t3.micro"},
+	}
+	// cost_center is exported as the same label as cost-center, and a service label of a describe API is replaced
+	bucket := &tagsData{
+		ID:      aws.String("arn:aws:s3:::bucket"),
+		Service: aws.String("s3"),
+		Region:  aws.String("eu-west-1"),
+		Tags:    []*tag{{Key: "cost_center", Value: "7"}},
+		Labels:  map[string]string{"service": "storage"},
+	}
+	expected := []map[string]string{
+		{"name": *instance.ID, "service": "ec2", "tag_cost_center": "42", "tag_Name": "web", "instance_type": "t3.micro"},
+		{"name": *bucket.ID, "service": "s3", "tag_cost_center": "7", "tag_Name": "", "instance_type": ""},
+	}
+
+	// Act
+	metrics := migrateTagsToPrometheus([]*tagsData{instance, bucket})
+
+	// Assert
+	if len(metrics) != 2 {
+		t.Fatalf("\nexpected: 2 info metrics\nactual:  %d", len(metrics))
+	}
+	for i, metric := range metrics {
+		if *metric.name != "aws_resource_info" {
+			t.Fatalf("\nexpected: aws_resource_info\nactual:  %s", *metric.name)
+		}
+		if !reflect.DeepEqual(metric.labels, expected[i]) {
+			t.Fatalf("\nexpected: %v\nactual:  %v", expected[i], metric.labels)
+		}
+	}
+}
+
+func TestSessionOptionsProfile(t *testing.T) {
+	// Setup Test
+	dir, err := ioutil.TempDir("", "yace-shared-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config")
+	credentialsFile := filepath.Join(dir, "credentials")
+	sharedConfig := "[profile source]\nregion = eu-west-1\n\n[profile monitoring]\nregion = eu-central-1\nrole_arn = arn:aws:iam::123456789012:role/prometheus\nsource_profile = source\n"
+	if err := ioutil.WriteFile(configFile, []byte(sharedConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(credentialsFile, []byte("[source]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"AWS_CONFIG_FILE": configFile, "AWS_SHARED_CREDENTIALS_FILE": credentialsFile} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+	defer func(profile string) {
+		*awsProfile = profile
+	}(*awsProfile)
+
+	// Act
+	*awsProfile = "monitoring"
+	sess, err := session.NewSessionWithOptions(sessionOptions())
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region := aws.StringValue(sess.Config.Region); region != "eu-central-1" {
+		t.Fatalf("\nexpected: region of the monitoring profile eu-central-1\nactual:  %s", region)
+	}
+
+	// The source profile uses its static credentials
+	*awsProfile = "source"
+	sess, err = session.NewSessionWithOptions(sessionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "AKID" || aws.StringValue(sess.Config.Region) != "eu-west-1" {
+		t.Fatalf("\nexpected: AKID in eu-west-1\nactual:  %s in %s", value.AccessKeyID, aws.StringValue(sess.Config.Region))
+	}
+}
+
+func TestSessionOptionsCredentialProcess(t *testing.T) {
+	// Setup Test
+	dir, err := ioutil.TempDir("", "yace-credential-process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Stub of an SSO helper printing the credentials it got from the identity provider
+	helper := filepath.Join(dir, "helper.sh")
+	output := `{"Version": 1, "AccessKeyId": "ASIASSO", "SecretAccessKey": "SECRET", "SessionToken": "TOKEN", "Expiration": "2100-01-01T00:00:00Z"}`
+	if err := ioutil.WriteFile(helper, []byte("#!/bin/sh\necho '"+output+"'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(configFile, []byte("[profile sso]\nregion = eu-west-1\ncredential_process = "+helper+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"AWS_CONFIG_FILE": configFile, "AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "credentials")} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+	defer func(profile string) {
+		*awsProfile = profile
+	}(*awsProfile)
+	*awsProfile = "sso"
+
+	// Act
+	sess, err := session.NewSessionWithOptions(sessionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := sess.Config.Credentials.Get()
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "ASIASSO" || value.SessionToken != "TOKEN" {
+		t.Fatalf("\nexpected: the credentials of the helper ASIASSO\nactual:  %s", value.AccessKeyID)
+	}
+}
+
+func TestGetEngineVersions(t *testing.T) {
+	// Setup Test
+	dbArn := "arn:aws:rds:eu-west-1:123456789012:db:orders"
+	clusterArn := "arn:aws:elasticache:eu-west-1:123456789012:cluster:sessions-001"
+	defer func() {
+		engineVersionsCache.Lock()
+		engineVersionsCache.versions = make(map[string]engineVersion)
+		engineVersionsCache.Unlock()
+	}()
+	tagging := func(resourceArn string) *mockTaggingClient {
+		return &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{ResourceARN: aws.String(resourceArn)}},
+		}}}
+	}
+	rdsClient := &mockRDSClient{instances: []*rds.DBInstance{
+		{DBInstanceArn: aws.String(dbArn), Engine: aws.String("postgres"), EngineVersion: aws.String("11.22")},
+	}}
+	ecClient := mockElastiCacheClient{clusters: []*elasticache.CacheCluster{{
+		ARN:           aws.String(clusterArn),
+		Engine:        aws.String("redis"),
+		EngineVersion: aws.String("6.2.6"),
+		CacheNodes:    []*elasticache.CacheNode{{CacheNodeId: aws.String("0001")}},
+	}}}
+
+	for _, tc := range []struct {
+		iface     tagsInterface
+		job       job
+		resources int
+		engine    string
+		version   string
+	}{
+		{tagsInterface{client: tagging(dbArn), rdsClient: rdsClient}, job{Type: "rds", EngineVersions: true}, 1, "postgres", "11.22"},
+		{tagsInterface{client: tagging(clusterArn), ecClient: ecClient}, job{Type: "ec", EngineVersions: true}, 1, "redis", "6.2.6"},
+		// The nodes keep the labels of their cluster
+		{tagsInterface{client: tagging(clusterArn), ecClient: ecClient}, job{Type: "ec", EngineVersions: true, CacheNodes: true}, 2, "redis", "6.2.6"},
+	} {
+		// Act
+		resources, err := tc.iface.get(tc.job, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != tc.resources {
+			t.Fatalf("\nexpected: %d resources\nactual:  %d", tc.resources, len(resources))
+		}
+		for _, resource := range resources {
+			if resource.Labels["engine"] != tc.engine || resource.Labels["engine_version"] != tc.version {
+				t.Fatalf("%s\nexpected: %s %s\nactual:  %v", *resource.ID, tc.engine, tc.version, resource.Labels)
+			}
+		}
+	}
+
+	// Arrange
+	rdsClient.instances[0].EngineVersion = aws.String("15.4")
+
+	// Act
+	resources, err := tagsInterface{client: tagging(dbArn), rdsClient: rdsClient}.get(job{Type: "rds", EngineVersions: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upgrade shows up once the cached version expires
+	if resources[0].Labels["engine_version"] != "11.22" {
+		t.Fatalf("\nexpected: the cached 11.22\nactual:  %v", resources[0].Labels)
+	}
+
+	// Arrange
+	deletedArn := "arn:aws:rds:eu-west-1:123456789012:db:deleted"
+	engineVersionsCache.Lock()
+	for _, resourceArn := range []string{dbArn, deletedArn} {
+		engineVersionsCache.versions[resourceArn] = engineVersion{expires: time.Now().Add(-time.Second)}
+	}
+	engineVersionsCache.Unlock()
+
+	// Act
+	resources, err = tagsInterface{client: tagging(dbArn), rdsClient: rdsClient}.get(job{Type: "rds", EngineVersions: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources[0].Labels["engine_version"] != "15.4" {
+		t.Fatalf("\nexpected: the upgraded 15.4\nactual:  %v", resources[0].Labels)
+	}
+	// The expired version of the deleted instance is pruned
+	if _, ok := engineVersionsCache.versions[deletedArn]; ok {
+		t.Fatalf("\nexpected: the expired version pruned\nactual:  %d cached versions", len(engineVersionsCache.versions))
+	}
+}
+
+type mockElastiCacheClient struct {
+	elasticacheiface.ElastiCacheAPI
+	clusters []*elasticache.CacheCluster
+}
+
+func (m mockElastiCacheClient) DescribeCacheClustersPagesWithContext(ctx aws.Context, input *elasticache.DescribeCacheClustersInput, fn func(*elasticache.DescribeCacheClustersOutput, bool) bool, opts ...request.Option) error {
+	// Like the API, the nodes are only returned when requested
+	if input.ShowCacheNodeInfo == nil || !*input.ShowCacheNodeInfo {
+		var clusters []*elasticache.CacheCluster
+		for _, cluster := range m.clusters {
+			withoutNodes := *cluster
+			withoutNodes.CacheNodes = nil
+			clusters = append(clusters, &withoutNodes)
+		}
+		fn(&elasticache.DescribeCacheClustersOutput{CacheClusters: clusters}, true)
+		return nil
+	}
+	fn(&elasticache.DescribeCacheClustersOutput{CacheClusters: m.clusters}, true)
+	return nil
+}
+
+func TestGetCacheNodes(t *testing.T) {
+	// Setup Test
+	clusterArn := "arn:aws:elasticache:eu-west-1:123456789012:cluster:sessions-001"
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{
+				ResourceARN: aws.String(clusterArn),
+				Tags:        []*resourcegroupstaggingapi.Tag{{Key: aws.String("Name"), Value: aws.String("sessions")}},
+			}},
+		}}},
+		ecClient: mockElastiCacheClient{clusters: []*elasticache.CacheCluster{
+			{
+				ARN: aws.String(clusterArn),
+				CacheNodes: []*elasticache.CacheNode{
+					{CacheNodeId: aws.String("0001")},
+					{CacheNodeId: aws.String("0002")},
+				},
+			},
+			{
+				ARN:        aws.String("arn:aws:elasticache:eu-west-1:123456789012:cluster:untagged-001"),
+				CacheNodes: []*elasticache.CacheNode{{CacheNodeId: aws.String("0001")}},
+			},
+		}},
+	}
+
+	// Act
+	resources, err := iface.get(job{Type: "ec", CacheNodes: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 3 {
+		t.Fatalf("\nexpected: the cluster and its 2 nodes\nactual:  %d resources", len(resources))
+	}
+	expected := []struct {
+		id         string
+		nodeID     string
+		dimensions int
+	}{
+		{clusterArn, "", 1},
+		{clusterArn + "/0001", "0001", 2},
+		{clusterArn + "/0002", "0002", 2},
+	}
+	for i, e := range expected {
+		if *resources[i].ID != e.id || len(resources[i].Tags) != 1 || resources[i].Labels["node_id"] != e.nodeID {
+			t.Fatalf("resource %d\nexpected: %s with node_id %q and the cluster tags\nactual:  %s with node_id %q", i, e.id, e.nodeID, *resources[i].ID, resources[i].Labels["node_id"])
+		}
+		dimensions := detectDimensionsByService(resources[i], nil)
+		if len(dimensions) != e.dimensions || *dimensions[0].Name != "CacheClusterId" || *dimensions[0].Value != "sessions-001" {
+			t.Fatalf("resource %d\nexpected: CacheClusterId=sessions-001 and %d dimensions\nactual:  %v", i, e.dimensions, dimensions)
+		}
+		if e.nodeID != "" && (*dimensions[1].Name != "CacheNodeId" || *dimensions[1].Value != e.nodeID) {
+			t.Fatalf("resource %d\nexpected: CacheNodeId=%s\nactual:  %v", i, e.nodeID, dimensions[1])
+		}
+	}
+}
+
+type mockLambdaClient struct {
+	lambdaiface.LambdaAPI
+	aliases map[string][]*lambda.AliasConfiguration
+	tags    map[string]map[string]*string
+	calls   int
+}
+
+func (m *mockLambdaClient) ListTagsWithContext(ctx aws.Context, input *lambda.ListTagsInput, opts ...request.Option) (*lambda.ListTagsOutput, error) {
+	m.calls++
+	tags, ok := m.tags[*input.Resource]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException: Function not found")
+	}
+	return &lambda.ListTagsOutput{Tags: tags}, nil
+}
+
+func (m *mockLambdaClient) ListAliasesPagesWithContext(ctx aws.Context, input *lambda.ListAliasesInput, fn func(*lambda.ListAliasesOutput, bool) bool, opts ...request.Option) error {
+	m.calls++
+	aliases, ok := m.aliases[*input.FunctionName]
+	if !ok {
+		return errors.New("ResourceNotFoundException: Function not found")
+	}
+	fn(&lambda.ListAliasesOutput{Aliases: aliases}, true)
+	return nil
+}
+
+func TestGetLambdaAliases(t *testing.T) {
+	// Setup Test
+	defer func() {
+		lambdaAliasesCache.aliases = make(map[string]lambdaAliases)
+	}()
+	functionArn := "arn:aws:lambda:eu-west-1:123456789012:function:checkout"
+	deletedArn := "arn:aws:lambda:eu-west-1:123456789012:function:deleted"
+	lambdaClient := &mockLambdaClient{aliases: map[string][]*lambda.AliasConfiguration{
+		functionArn: {
+			{AliasArn: aws.String(functionArn + ":live"), Name: aws.String("live")},
+			{AliasArn: aws.String(functionArn + ":canary"), Name: aws.String("canary")},
+		},
+	}}
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(functionArn), Tags: []*resourcegroupstaggingapi.Tag{{Key: aws.String("Name"), Value: aws.String("checkout")}}},
+				{ResourceARN: aws.String(deletedArn), Tags: []*resourcegroupstaggingapi.Tag{{Key: aws.String("Name"), Value: aws.String("deleted")}}},
+			},
+		}}},
+		lambdaClient: lambdaClient,
+	}
+
+	// Act
+	resources, err := iface.get(job{Type: "lambda", LambdaAliases: true}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		id           string
+		alias        string
+		functionName string
+		resource     string
+	}{
+		{functionArn, "", "checkout", ""},
+		{deletedArn, "", "deleted", ""},
+		{functionArn + ":live", "live", "checkout", "checkout:live"},
+		{functionArn + ":canary", "canary", "checkout", "checkout:canary"},
+	}
+	if len(resources) != len(expected) {
+		t.Fatalf("\nexpected: the 2 functions and 2 aliases\nactual:  %d resources", len(resources))
+	}
+	for i, e := range expected {
+		if *resources[i].ID != e.id || len(resources[i].Tags) != 1 || resources[i].Labels["alias"] != e.alias {
+			t.Fatalf("resource %d\nexpected: %s with alias %q and the function tags\nactual:  %s with alias %q", i, e.id, e.alias, *resources[i].ID, resources[i].Labels["alias"])
+		}
+		dimensions := detectDimensionsByService(resources[i], nil)
+		if *dimensions[0].Name != "FunctionName" || *dimensions[0].Value != e.functionName {
+			t.Fatalf("resource %d\nexpected: FunctionName=%s\nactual:  %v", i, e.functionName, dimensions)
+		}
+		if e.resource == "" && len(dimensions) != 1 || e.resource != "" && (len(dimensions) != 2 || *dimensions[1].Name != "Resource" || *dimensions[1].Value != e.resource) {
+			t.Fatalf("resource %d\nexpected: Resource=%q\nactual:  %v", i, e.resource, dimensions)
+		}
+	}
+
+	// The aliases are cached per function, the deleted function is asked again on the next discovery
+	if _, err := iface.get(job{Type: "lambda", LambdaAliases: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if lambdaClient.calls != 3 {
+		t.Fatalf("\nexpected: 3 ListAliases calls\nactual:  %d", lambdaClient.calls)
+	}
+
+	// The expired aliases of the functions which aren't discovered anymore are pruned
+	removedArn := "arn:aws:lambda:eu-west-1:123456789012:function:removed"
+	lambdaAliasesCache.aliases[removedArn] = lambdaAliases{expires: time.Now().Add(-time.Second)}
+	if _, err := iface.get(job{Type: "lambda", LambdaAliases: true}, "eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lambdaAliasesCache.aliases[removedArn]; ok {
+		t.Fatalf("\nexpected: the expired aliases pruned\nactual:  %d cached functions", len(lambdaAliasesCache.aliases))
+	}
+}
+
+func TestGetArns(t *testing.T) {
+	// Setup Test
+	checkoutArn := "arn:aws:lambda:eu-west-1:123456789012:function:checkout"
+	deletedArn := "arn:aws:lambda:eu-west-1:123456789012:function:deleted"
+	// Scraped with the clients of its own region
+	otherRegionArn := "arn:aws:lambda:us-east-1:123456789012:function:checkout"
+	lambdaClient := &mockLambdaClient{tags: map[string]map[string]*string{
+		checkoutArn: {"Team": aws.String("payments"), "Name": aws.String("checkout")},
+	}}
+	// Without a tagging client, the tagging API must not be called
+	iface := tagsInterface{lambdaClient: lambdaClient}
+
+	for _, tc := range []struct {
+		arnTags      bool
+		expectedTeam string
+		calls        int
+	}{
+		{false, "", 0},
+		{true, "payments", 2},
+	} {
+		lambdaClient.calls = 0
+
+		// Act
+		resources, err := iface.get(job{Type: "lambda", Arns: []string{checkoutArn, otherRegionArn, deletedArn}, ArnTags: tc.arnTags}, "eu-west-1")
+		metrics := migrateTagsToPrometheus(resources)
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lambdaClient.calls != tc.calls {
+			t.Fatalf("arnTags=%t\nexpected: %d ListTags calls\nactual:  %d", tc.arnTags, tc.calls, lambdaClient.calls)
+		}
+		// The resources whose tags can't be read are kept without tags
+		if len(resources) != 2 || *resources[0].ID != checkoutArn || *resources[1].ID != deletedArn || len(resources[1].Tags) != 0 {
+			t.Fatalf("arnTags=%t\nexpected: the 2 arns of the region\nactual:  %d resources", tc.arnTags, len(resources))
+		}
+		if len(metrics) != 2 || *metrics[0].name != "aws_lambda_info" || metrics[0].labels["name"] != checkoutArn || metrics[1].labels["name"] != deletedArn {
+			t.Fatalf("arnTags=%t\nexpected: an info metric per arn\nactual:  %d metrics", tc.arnTags, len(metrics))
+		}
+		if metrics[0].labels["tag_Team"] != tc.expectedTeam {
+			t.Fatalf("arnTags=%t\nexpected: tag_Team=%q\nactual:  %q", tc.arnTags, tc.expectedTeam, metrics[0].labels["tag_Team"])
+		}
+	}
+}
+
+func TestGetArnsGlobalResources(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{}
+
+	for _, tc := range []struct {
+		job      job
+		region   string
+		expected int
+	}{
+		// The ARNs without region are scraped in the first region of the job
+		{job{Type: "s3", Arns: []string{"arn:aws:s3:::logs"}, Regions: []string{"eu-west-1", "us-east-1"}}, "eu-west-1", 1},
+		{job{Type: "s3", Arns: []string{"arn:aws:s3:::logs"}, Regions: []string{"eu-west-1", "us-east-1"}}, "us-east-1", 0},
+		{job{Type: "cf", Arns: []string{"arn:aws:cloudfront::123456789012:distribution/EDFDVBD6EXAMPLE"}, Regions: []string{"us-east-1"}}, "us-east-1", 1},
+	} {
+		// Act
+		resources, err := iface.get(tc.job, tc.region)
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != tc.expected {
+			t.Fatalf("%s in %s\nexpected: %d resources\nactual:  %d", tc.job.Type, tc.region, tc.expected, len(resources))
+		}
+		if tc.expected > 0 && *resources[0].ID != tc.job.Arns[0] {
+			t.Fatalf("%s in %s\nexpected: %s\nactual:  %s", tc.job.Type, tc.region, tc.job.Arns[0], *resources[0].ID)
+		}
+	}
+}
+
+func TestGetReturnsDiscoveryError(t *testing.T) {
+	// Setup Test
+	roleArn := "arn:aws:iam::123456789012:role/yace"
+	denied := errors.New("AccessDenied")
+	for _, tc := range []struct {
+		service string
+		iface   tagsInterface
+	}{
+		{"sqs", tagsInterface{
+			client:  &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{}}, failOnPage: 1, err: denied},
+			roleArn: roleArn,
+		}},
+		{"iot", tagsInterface{iotClient: mockIoTClient{err: denied}, roleArn: roleArn}},
+	} {
+		// Act
+		_, err := tc.iface.get(job{Type: tc.service}, "eu-west-1")
+
+		// Assert
+		var discoveryErr *DiscoveryError
+		if !errors.As(err, &discoveryErr) || !errors.Is(err, denied) {
+			t.Fatalf("%s\nexpected: a DiscoveryError wrapping %v\nactual:  %v", tc.service, denied, err)
+		}
+		expected := DiscoveryError{Service: tc.service, Region: "eu-west-1", RoleArn: roleArn, Err: denied}
+		if *discoveryErr != expected {
+			t.Fatalf("%s\nexpected: %+v\nactual:  %+v", tc.service, expected, *discoveryErr)
+		}
+		if discoveryErr.Error() != "discovery of "+tc.service+" in eu-west-1 with role "+roleArn+" failed: AccessDenied" {
+			t.Errorf("%s\nunexpected message: %s", tc.service, discoveryErr.Error())
+		}
+	}
+}
+
+func TestDiscoveryErrorKeepsPartialResults(t *testing.T) {
+	// Setup Test
+	pages := []*resourcegroupstaggingapi.GetResourcesOutput{
+		{ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:a")}}},
+		{},
+	}
+	iface := tagsInterface{client: &mockTaggingClient{pages: pages, failOnPage: 2, err: errors.New("Throttling")}}
+
+	// Act
+	_, err := iface.get(job{Type: "sqs"}, "eu-west-1")
+
+	// Assert
+	var discoveryErr *DiscoveryError
+	var partial *partialResultsError
+	if !errors.As(err, &discoveryErr) || !errors.As(err, &partial) {
+		t.Fatalf("\nexpected: a DiscoveryError wrapping a partialResultsError\nactual:  %v", err)
+	}
+	if discoveryErr.RoleArn != "" || discoveryErr.Error() != "discovery of sqs in eu-west-1 failed: "+partial.Error() {
+		t.Errorf("\nunexpected message without role: %s", discoveryErr.Error())
+	}
+}
+
+func TestGetFiltersThroughArn(t *testing.T) {
+	// Setup Test
+	var mappings []*resourcegroupstaggingapi.ResourceTagMapping
+	for _, name := range []string{"payments-orders", "payments-orders-dlq", "search-index"} {
+		mappings = append(mappings, &resourcegroupstaggingapi.ResourceTagMapping{ResourceARN: aws.String("arn:aws:sqs:eu-west-1:123456789012:" + name)})
+	}
+	iface := tagsInterface{client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{ResourceTagMappingList: mappings}}}}
+
+	for _, tc := range []struct {
+		mode     string
+		expected []string
+	}{
+		{"", []string{"payments-orders", "payments-orders-dlq"}},
+		{"include", []string{"payments-orders", "payments-orders-dlq"}},
+		{"exclude", []string{"search-index"}},
+	} {
+		// Arrange
+		j := job{Type: "sqs", ArnFilter: ":payments-", ArnFilterMode: tc.mode}
+		j.compileRegexes()
+
+		// Act
+		resources, err := iface.get(j, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		for _, resource := range resources {
+			actual = append(actual, strings.TrimPrefix(*resource.ID, "arn:aws:sqs:eu-west-1:123456789012:"))
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("mode %q\nexpected: %v\nactual:  %v", tc.mode, tc.expected, actual)
+		}
+	}
+}
+
+func TestGetTaggedAutoscalingGroupsFiltersThroughArn(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+		{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:1234:autoScalingGroupName/web")},
+		{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:5678:autoScalingGroupName/web-canary")},
+	}}}
+
+	j := job{Type: "asg", ArnFilter: "-canary$", ArnFilterMode: "exclude"}
+	j.compileRegexes()
+
+	// Act
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != "arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroupName/web" {
+		t.Fatalf("\nexpected: only the web group\nactual:  %d resources", len(resources))
+	}
+}
+
+func TestGetMaxAge(t *testing.T) {
+	// Setup Test
+	recent := time.Now().Add(-time.Hour)
+	old := time.Now().Add(-90 * 24 * time.Hour)
+	ec2Arns := []string{"arn:aws:ec2:eu-west-1:123456789012:instance/i-new", "arn:aws:ec2:eu-west-1:123456789012:instance/i-old", "arn:aws:ec2:eu-west-1:123456789012:instance/i-unknown"}
+	rdsArns := []string{"arn:aws:rds:eu-west-1:123456789012:db:new", "arn:aws:rds:eu-west-1:123456789012:db:old"}
+	taggingPage := func(arns []string) []*resourcegroupstaggingapi.GetResourcesOutput {
+		page := &resourcegroupstaggingapi.GetResourcesOutput{}
+		for _, resourceArn := range arns {
+			page.ResourceTagMappingList = append(page.ResourceTagMappingList, &resourcegroupstaggingapi.ResourceTagMapping{ResourceARN: aws.String(resourceArn)})
+		}
+		return []*resourcegroupstaggingapi.GetResourcesOutput{page}
+	}
+	for _, tc := range []struct {
+		service  string
+		iface    tagsInterface
+		expected []string
+	}{
+		{"asg", tagsInterface{asgClient: mockAutoScalingClient{groups: []*autoscaling.Group{
+			{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/new"), CreatedTime: &recent},
+			{AutoScalingGroupARN: aws.String("arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/old"), CreatedTime: &old},
+		}}}, []string{"arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroupName/new"}},
+		{"ec2", tagsInterface{
+			client: &mockTaggingClient{pages: taggingPage(ec2Arns)},
+			ec2Client: mockEC2Client{instances: []*ec2.Instance{
+				{InstanceId: aws.String("i-new"), LaunchTime: &recent},
+				{InstanceId: aws.String("i-old"), LaunchTime: &old},
+			}},
+		}, []string{ec2Arns[0], ec2Arns[2]}},
+		{"rds", tagsInterface{
+			client: &mockTaggingClient{pages: taggingPage(rdsArns)},
+			rdsClient: mockRDSClient{instances: []*rds.DBInstance{
+				{DBInstanceArn: aws.String(rdsArns[0]), InstanceCreateTime: &recent},
+				{DBInstanceArn: aws.String(rdsArns[1]), InstanceCreateTime: &old},
+			}},
+		}, []string{rdsArns[0]}},
+	} {
+		// Act
+		resources, err := tc.iface.get(job{Type: tc.service, MaxAge: duration(30 * 24 * time.Hour)}, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		for _, resource := range resources {
+			actual = append(actual, *resource.ID)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("%s\nexpected: %v\nactual:  %v", tc.service, tc.expected, actual)
+		}
+		if dropped := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues(tc.service, "max_age")); dropped < 1 {
+			t.Fatalf("%s\nexpected: the old resource to be counted as dropped\nactual:  %f", tc.service, dropped)
+		}
+	}
+}
+
+func TestGetTaggedTransitGatewayRouteTables(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{ec2Client: mockEC2Client{transitGatewayRouteTables: []*ec2.TransitGatewayRouteTable{
+		{
+			TransitGatewayId:           aws.String("tgw-0123"),
+			TransitGatewayRouteTableId: aws.String("tgw-rtb-0123"),
+			State:                      aws.String(ec2.TransitGatewayRouteTableStateAvailable),
+			Tags:                       []*ec2.Tag{{Key: aws.String("env"), Value: aws.String("production")}},
+		},
+		{
+			TransitGatewayId:           aws.String("tgw-0123"),
+			TransitGatewayRouteTableId: aws.String("tgw-rtb-4567"),
+			State:                      aws.String(ec2.TransitGatewayRouteTableStateAvailable),
+			Tags:                       []*ec2.Tag{{Key: aws.String("env"), Value: aws.String("staging")}},
+		},
+		{
+			TransitGatewayId:           aws.String("tgw-0123"),
+			TransitGatewayRouteTableId: aws.String("tgw-rtb-89ab"),
+			State:                      aws.String(ec2.TransitGatewayRouteTableStateDeleting),
+			Tags:                       []*ec2.Tag{{Key: aws.String("env"), Value: aws.String("production")}},
+		},
+	}}}
+
+	// Act
+	j := job{Type: "tgw-rt", IgnoreTerminated: true, SearchTags: []tag{{Key: "env", Value: "production"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != "tgw-0123/tgw-rtb-0123" || *resources[0].Service != "tgw-rt" || *resources[0].Region != "eu-west-1" {
+		t.Fatalf("\nexpected: the production route table\nactual:  %d resources", len(resources))
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 2 || *dimensions[0].Name != "TransitGateway" || *dimensions[0].Value != "tgw-0123" ||
+		*dimensions[1].Name != "TransitGatewayRouteTable" || *dimensions[1].Value != "tgw-rtb-0123" {
+		t.Fatalf("\nexpected: TransitGateway=tgw-0123 TransitGatewayRouteTable=tgw-rtb-0123\nactual:  %v", dimensions)
+	}
+}
+
+func TestGetTaggedSpotFleet(t *testing.T) {
+	// Setup Test
+	created := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	iface := tagsInterface{ec2Client: mockEC2Client{spotFleetRequests: []*ec2.SpotFleetRequestConfig{
+		{
+			SpotFleetRequestId:    aws.String("sfr-0123"),
+			SpotFleetRequestState: aws.String(ec2.BatchStateActive),
+			CreateTime:            &created,
+			Tags:                  []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("batch")}},
+		},
+		{
+			SpotFleetRequestId:    aws.String("sfr-4567"),
+			SpotFleetRequestState: aws.String(ec2.BatchStateCancelledTerminating),
+			Tags:                  []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("batch")}},
+		},
+		{
+			SpotFleetRequestId:    aws.String("sfr-89ab"),
+			SpotFleetRequestState: aws.String(ec2.BatchStateActive),
+			Tags:                  []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("web")}},
+		},
+	}}}
+
+	// Act
+	j := job{Type: "spot-fleet", IgnoreTerminated: true, InfoCreationTime: true, SearchTags: []tag{{Key: "team", Value: "batch"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != "sfr-0123" || len(resources[0].Tags) != 1 || !resources[0].CreatedAt.Equal(created) {
+		t.Fatalf("\nexpected: the active batch fleet with its tags and creation time\nactual:  %d resources", len(resources))
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "FleetRequestId" || *dimensions[0].Value != "sfr-0123" {
+		t.Fatalf("\nexpected: FleetRequestId=sfr-0123\nactual:  %v", dimensions)
+	}
+}
+
+// Web ACLs and their tags served by a mocked WAF Classic API, either the global or the regional one
+type mockWebACLs struct {
+	webACLs []*waf.WebACL
+	tags    map[string][]*waf.Tag
+}
+
+func (m mockWebACLs) listWebACLs() *waf.ListWebACLsOutput {
+	output := &waf.ListWebACLsOutput{}
+	for _, webACL := range m.webACLs {
+		output.WebACLs = append(output.WebACLs, &waf.WebACLSummary{WebACLId: webACL.WebACLId, Name: webACL.Name})
+	}
+	return output
+}
+
+func (m mockWebACLs) getWebACL(input *waf.GetWebACLInput) *waf.GetWebACLOutput {
+	for _, webACL := range m.webACLs {
+		if *webACL.WebACLId == *input.WebACLId {
+			return &waf.GetWebACLOutput{WebACL: webACL}
+		}
+	}
+	return &waf.GetWebACLOutput{}
+}
+
+func (m mockWebACLs) listTags(input *waf.ListTagsForResourceInput) *waf.ListTagsForResourceOutput {
+	return &waf.ListTagsForResourceOutput{TagInfoForResource: &waf.TagInfoForResource{ResourceARN: input.ResourceARN, TagList: m.tags[*input.ResourceARN]}}
+}
+
+type mockWAFClient struct {
+	wafiface.WAFAPI
+	mockWebACLs
+}
+
+func (m mockWAFClient) ListWebACLsWithContext(ctx aws.Context, input *waf.ListWebACLsInput, opts ...request.Option) (*waf.ListWebACLsOutput, error) {
+	return m.listWebACLs(), nil
+}
+
+func (m mockWAFClient) GetWebACLWithContext(ctx aws.Context, input *waf.GetWebACLInput, opts ...request.Option) (*waf.GetWebACLOutput, error) {
+	return m.getWebACL(input), nil
+}
+
+func (m mockWAFClient) ListTagsForResourceWithContext(ctx aws.Context, input *waf.ListTagsForResourceInput, opts ...request.Option) (*waf.ListTagsForResourceOutput, error) {
+	return m.listTags(input), nil
+}
+
+type mockWAFRegionalClient struct {
+	wafregionaliface.WAFRegionalAPI
+	mockWebACLs
+}
+
+func (m mockWAFRegionalClient) ListWebACLsWithContext(ctx aws.Context, input *waf.ListWebACLsInput, opts ...request.Option) (*waf.ListWebACLsOutput, error) {
+	return m.listWebACLs(), nil
+}
+
+func (m mockWAFRegionalClient) GetWebACLWithContext(ctx aws.Context, input *waf.GetWebACLInput, opts ...request.Option) (*waf.GetWebACLOutput, error) {
+	return m.getWebACL(input), nil
+}
+
+func (m mockWAFRegionalClient) ListTagsForResourceWithContext(ctx aws.Context, input *waf.ListTagsForResourceInput, opts ...request.Option) (*waf.ListTagsForResourceOutput, error) {
+	return m.listTags(input), nil
+}
+
+type mockComprehendClient struct {
+	comprehendiface.ComprehendAPI
+	pages [][]*comprehend.EndpointProperties
+	tags  map[string][]*comprehend.Tag
+}
+
+func (m mockComprehendClient) ListEndpointsWithContext(ctx aws.Context, input *comprehend.ListEndpointsInput, opts ...request.Option) (*comprehend.ListEndpointsOutput, error) {
+	page := 0
+	if input.NextToken != nil {
+		fmt.Sscan(*input.NextToken, &page)
+	}
+	output := &comprehend.ListEndpointsOutput{EndpointPropertiesList: m.pages[page]}
+	if page+1 < len(m.pages) {
+		output.NextToken = aws.String(fmt.Sprint(page + 1))
+	}
+	return output, nil
+}
+
+func (m mockComprehendClient) ListTagsForResourceWithContext(ctx aws.Context, input *comprehend.ListTagsForResourceInput, opts ...request.Option) (*comprehend.ListTagsForResourceOutput, error) {
+	return &comprehend.ListTagsForResourceOutput{ResourceArn: input.ResourceArn, Tags: m.tags[*input.ResourceArn]}, nil
+}
+
+func TestGetTaggedComprehend(t *testing.T) {
+	// Setup Test
+	classifier := "arn:aws:comprehend:eu-west-1:123456789012:document-classifier-endpoint/classifier"
+	recognizer := "arn:aws:comprehend:eu-west-1:123456789012:entity-recognizer-endpoint/recognizer"
+	deleting := "arn:aws:comprehend:eu-west-1:123456789012:entity-recognizer-endpoint/deleting"
+	iface := tagsInterface{comprehendClient: mockComprehendClient{
+		pages: [][]*comprehend.EndpointProperties{
+			{{EndpointArn: aws.String(classifier), Status: aws.String(comprehend.EndpointStatusInService)}},
+			{
+				{EndpointArn: aws.String(recognizer), Status: aws.String(comprehend.EndpointStatusInService)},
+				{EndpointArn: aws.String(deleting), Status: aws.String(comprehend.EndpointStatusDeleting)},
+			},
+		},
+		tags: map[string][]*comprehend.Tag{
+			classifier: {{Key: aws.String("Team"), Value: aws.String("nlp")}},
+			recognizer: {{Key: aws.String("Team"), Value: aws.String("search")}},
+			deleting:   {{Key: aws.String("Team"), Value: aws.String("nlp")}},
+		},
+	}}
+
+	// Act
+	j := job{Type: "comprehend", IgnoreTerminated: true, SearchTags: []tag{{Key: "Team", Value: "nlp"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != classifier || *resources[0].Tags[0] != (tag{Key: "Team", Value: "nlp"}) {
+		t.Fatalf("\nexpected: %s\nactual:  %v", classifier, resources)
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "EndpointArn" || *dimensions[0].Value != classifier {
+		t.Fatalf("\nexpected: EndpointArn=%s\nactual:  %v", classifier, dimensions)
+	}
+
+	// Act
+	resources, err = iface.get(job{Type: "comprehend"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 3 {
+		t.Fatalf("\nexpected: the endpoints of both pages\nactual:  %v", resources)
+	}
+}
+
+type mockBedrockClient struct {
+	bedrockiface.BedrockAPI
+	models      []*bedrock.CustomModelSummary
+	throughputs []*bedrock.ProvisionedModelSummary
+	tags        map[string][]*bedrock.Tag
+}
+
+func (m mockBedrockClient) ListCustomModelsWithContext(ctx aws.Context, input *bedrock.ListCustomModelsInput, opts ...request.Option) (*bedrock.ListCustomModelsOutput, error) {
+	return &bedrock.ListCustomModelsOutput{ModelSummaries: m.models}, nil
+}
+
+func (m mockBedrockClient) ListProvisionedModelThroughputsWithContext(ctx aws.Context, input *bedrock.ListProvisionedModelThroughputsInput, opts ...request.Option) (*bedrock.ListProvisionedModelThroughputsOutput, error) {
+	return &bedrock.ListProvisionedModelThroughputsOutput{ProvisionedModelSummaries: m.throughputs}, nil
+}
+
+func (m mockBedrockClient) ListTagsForResourceWithContext(ctx aws.Context, input *bedrock.ListTagsForResourceInput, opts ...request.Option) (*bedrock.ListTagsForResourceOutput, error) {
+	return &bedrock.ListTagsForResourceOutput{Tags: m.tags[*input.ResourceARN]}, nil
+}
+
+func TestGetTaggedBedrock(t *testing.T) {
+	// Setup Test
+	model := "arn:aws:bedrock:us-east-1:123456789012:custom-model/amazon.titan-text-express-v1:0:8k/a1b2c3d4e5f6"
+	throughput := "arn:aws:bedrock:us-east-1:123456789012:provisioned-model/a1b2c3d4e5f6"
+	untagged := "arn:aws:bedrock:us-east-1:123456789012:provisioned-model/f6e5d4c3b2a1"
+	iface := tagsInterface{bedrockClient: mockBedrockClient{
+		models: []*bedrock.CustomModelSummary{{ModelArn: aws.String(model)}},
+		throughputs: []*bedrock.ProvisionedModelSummary{
+			{ProvisionedModelArn: aws.String(throughput)},
+			{ProvisionedModelArn: aws.String(untagged)},
+		},
+		tags: map[string][]*bedrock.Tag{
+			model:      {{Key: aws.String("Team"), Value: aws.String("ml")}},
+			throughput: {{Key: aws.String("Team"), Value: aws.String("ml")}},
+		},
+	}}
+
+	// Act
+	j := job{Type: "bedrock", SearchTags: []tag{{Key: "Team", Value: "ml"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "us-east-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 || *resources[0].ID != model || *resources[1].ID != throughput {
+		t.Fatalf("\nexpected: %s, %s\nactual:  %v", model, throughput, resources)
+	}
+	if *resources[1].Tags[0] != (tag{Key: "Team", Value: "ml"}) {
+		t.Fatalf("\nexpected: Team=ml\nactual:  %v", resources[1].Tags)
+	}
+}
+
+type mockDRSClient struct {
+	drsiface.DrsAPI
+	sourceServers []*drs.SourceServer
+}
+
+func (m mockDRSClient) DescribeSourceServersPagesWithContext(ctx aws.Context, input *drs.DescribeSourceServersInput, fn func(*drs.DescribeSourceServersOutput, bool) bool, opts ...request.Option) error {
+	fn(&drs.DescribeSourceServersOutput{Items: m.sourceServers}, true)
+	return nil
+}
+
+func TestGetTaggedDRS(t *testing.T) {
+	// Setup Test
+	replicated := "arn:aws:drs:eu-west-1:123456789012:source-server/s-0123456789abcdef0"
+	other := "arn:aws:drs:eu-west-1:123456789012:source-server/s-0fedcba9876543210"
+	iface := tagsInterface{drsClient: mockDRSClient{sourceServers: []*drs.SourceServer{
+		{Arn: aws.String(replicated), Tags: map[string]*string{"Team": aws.String("dr"), "App": aws.String("shop")}},
+		{Arn: aws.String(other), Tags: map[string]*string{"Team": aws.String("web")}},
+	}}}
+
+	// Act
+	j := job{Type: "drs", SearchTags: []tag{{Key: "Team", Value: "dr"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 1 || *resources[0].ID != replicated {
+		t.Fatalf("\nexpected: %s\nactual:  %v", replicated, resources)
+	}
+	if len(resources[0].Tags) != 2 || resources[0].Tags[0].Key != "App" || resources[0].Tags[1].Key != "Team" {
+		t.Fatalf("\nexpected: App and Team tags\nactual:  %v", resources[0].Tags)
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "SourceServerID" || *dimensions[0].Value != "s-0123456789abcdef0" {
+		t.Fatalf("\nexpected: SourceServerID=s-0123456789abcdef0\nactual:  %v", dimensions)
+	}
+}
+
+type mockGrafanaClient struct {
+	managedgrafanaiface.ManagedGrafanaAPI
+	workspaces []*managedgrafana.WorkspaceSummary
+}
+
+func (m mockGrafanaClient) ListWorkspacesPagesWithContext(ctx aws.Context, input *managedgrafana.ListWorkspacesInput, fn func(*managedgrafana.ListWorkspacesOutput, bool) bool, opts ...request.Option) error {
+	fn(&managedgrafana.ListWorkspacesOutput{Workspaces: m.workspaces}, true)
+	return nil
+}
+
+func TestGetTaggedGrafana(t *testing.T) {
+	// Setup Test
+	iface := tagsInterface{grafanaClient: mockGrafanaClient{workspaces: []*managedgrafana.WorkspaceSummary{
+		{Id: aws.String("g-0123456789"), Tags: map[string]*string{"Team": aws.String("obs")}},
+		{Id: aws.String("g-9876543210"), Tags: map[string]*string{"Team": aws.String("web")}},
+	}}}
+
+	// Act
+	j := job{Type: "grafana", SearchTags: []tag{{Key: "Team", Value: "obs"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "cn-north-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "arn:aws-cn:grafana:cn-north-1::/workspaces/g-0123456789"
+	if len(resources) != 1 || *resources[0].ID != expected {
+		t.Fatalf("\nexpected: %s\nactual:  %v", expected, resources)
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "WorkspaceId" || *dimensions[0].Value != "g-0123456789" {
+		t.Fatalf("\nexpected: WorkspaceId=g-0123456789\nactual:  %v", dimensions)
+	}
+}
+
+type mockResourceGroupsClient struct {
+	resourcegroupsiface.ResourceGroupsAPI
+	members []string
+}
+
+func (m mockResourceGroupsClient) ListGroupResourcesPagesWithContext(ctx aws.Context, input *resourcegroups.ListGroupResourcesInput, fn func(*resourcegroups.ListGroupResourcesOutput, bool) bool, opts ...request.Option) error {
+	output := &resourcegroups.ListGroupResourcesOutput{}
+	for _, member := range m.members {
+		output.ResourceIdentifiers = append(output.ResourceIdentifiers, &resourcegroups.ResourceIdentifier{ResourceArn: aws.String(member)})
+	}
+	fn(output, true)
+	return nil
+}
+
+func TestGetResourceGroupMembers(t *testing.T) {
+	// Setup Test
+	tagged := "arn:aws:ec2:eu-west-1:123456789012:instance/i-tagged"
+	untagged := "arn:aws:ec2:eu-west-1:123456789012:instance/i-untagged"
+	iface := tagsInterface{
+		client: &mockTaggingClient{pages: []*resourcegroupstaggingapi.GetResourcesOutput{{
+			ResourceTagMappingList: []*resourcegroupstaggingapi.ResourceTagMapping{
+				{ResourceARN: aws.String(tagged), Tags: []*resourcegroupstaggingapi.Tag{{Key: aws.String("Team"), Value: aws.String("payments")}}},
+				{ResourceARN: aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-outside"), Tags: []*resourcegroupstaggingapi.Tag{{Key: aws.String("Team"), Value: aws.String("payments")}}},
+			},
+		}}},
+		// The volume and the bucket of the group aren't instances
+		resGroupsClient: mockResourceGroupsClient{members: []string{
+			tagged,
+			untagged,
+			"arn:aws:ec2:eu-west-1:123456789012:volume/vol-0123",
+			"arn:aws:s3:::bucket",
+		}},
+	}
+
+	for _, tc := range []struct {
+		searchTags []tag
+		expected   []string
+	}{
+		{nil, []string{tagged, untagged}},
+		{[]tag{{Key: "Team", Value: "payments"}}, []string{tagged}},
+	} {
+		// Act
+		j := job{Type: "ec2", ResourceGroup: "payments", SearchTags: tc.searchTags}
+		j.compileRegexes()
+		resources, err := iface.get(j, "eu-west-1")
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		for _, resource := range resources {
+			actual = append(actual, *resource.ID)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Fatalf("\nexpected: %v\nactual:  %v", tc.expected, actual)
+		}
+		if len(resources[0].Tags) != 1 || *resources[0].Tags[0] != (tag{Key: "Team", Value: "payments"}) {
+			t.Fatalf("\nexpected: the tags of the tagging API\nactual:  %v", resources[0].Tags)
+		}
+	}
+}
+
+func TestArnMatchesResourceTypes(t *testing.T) {
+	for _, tc := range []struct {
+		arn      string
+		filters  []string
+		expected bool
+	}{
+		{"arn:aws:ec2:eu-west-1:123456789012:instance/i-0123", []string{"ec2:instance"}, true},
+		{"arn:aws:ec2:eu-west-1:123456789012:instance-connect-endpoint/eice-0123", []string{"ec2:instance"}, false},
+		{"arn:aws:ec2:eu-west-1:123456789012:volume/vol-0123", []string{"ec2:instance"}, false},
+		{"arn:aws:apigateway:eu-west-1::/restapis/0123", []string{"apigateway"}, true},
+		{"arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/web/0123", []string{"elasticloadbalancing:loadbalancer/app", "elasticloadbalancing:targetgroup"}, true},
+		{"arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/net/web/0123", []string{"elasticloadbalancing:loadbalancer/app"}, false},
+		{"arn:aws:grafana:eu-west-1:123456789012:/workspaces/g-0123", []string{"grafana:workspaces"}, true},
+		{"arn:aws:rds:eu-west-1:123456789012:db:database-1", []string{"rds:db"}, true},
+		{"not-an-arn", []string{"ec2:instance"}, false},
+	} {
+		if actual := arnMatchesResourceTypes(tc.arn, tc.filters); actual != tc.expected {
+			t.Errorf("%s %v\nexpected: %t\nactual:  %t", tc.arn, tc.filters, tc.expected, actual)
+		}
+	}
+}
+
+type mockSyntheticsClient struct {
+	syntheticsiface.SyntheticsAPI
+	canaries []*synthetics.Canary
+}
+
+func (m mockSyntheticsClient) DescribeCanariesPagesWithContext(ctx aws.Context, input *synthetics.DescribeCanariesInput, fn func(*synthetics.DescribeCanariesOutput, bool) bool, opts ...request.Option) error {
+	fn(&synthetics.DescribeCanariesOutput{Canaries: m.canaries}, true)
+	return nil
+}
+
+func TestGetTaggedSynthetics(t *testing.T) {
+	// Setup Test
+	executionRole := aws.String("arn:aws:iam::123456789012:role/service-role/CloudWatchSyntheticsRole-checkout")
+	iface := tagsInterface{syntheticsClient: mockSyntheticsClient{canaries: []*synthetics.Canary{
+		{Name: aws.String("checkout"), ExecutionRoleArn: executionRole, Tags: map[string]*string{"Team": aws.String("payments")}},
+		{Name: aws.String("search"), ExecutionRoleArn: executionRole, Tags: map[string]*string{"Team": aws.String("discovery")}},
+		{Name: aws.String("broken"), Tags: map[string]*string{"Team": aws.String("payments")}},
+	}}}
+
+	// Act
+	j := job{Type: "synthetics", SearchTags: []tag{{Key: "Team", Value: "payments"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The canary without execution role has no ARN
+	expected := "arn:aws:synthetics:eu-west-1:123456789012:canary:checkout"
+	if len(resources) != 1 || *resources[0].ID != expected || *resources[0].Tags[0] != (tag{Key: "Team", Value: "payments"}) {
+		t.Fatalf("\nexpected: %s\nactual:  %v", expected, resources)
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "CanaryName" || *dimensions[0].Value != "checkout" {
+		t.Fatalf("\nexpected: CanaryName=checkout\nactual:  %v", dimensions)
+	}
+	if namespace, _ := getNamespace("synthetics"); namespace != "CloudWatchSynthetics" {
+		t.Fatalf("\nexpected: CloudWatchSynthetics\nactual:  %s", namespace)
+	}
+}
+
+type mockShieldClient struct {
+	shieldiface.ShieldAPI
+	protections []*shield.Protection
+	tags        map[string][]*shield.Tag
+	tagsErr     map[string]error
+}
+
+func (m mockShieldClient) ListProtectionsPagesWithContext(ctx aws.Context, input *shield.ListProtectionsInput, fn func(*shield.ListProtectionsOutput, bool) bool, opts ...request.Option) error {
+	fn(&shield.ListProtectionsOutput{Protections: m.protections}, true)
+	return nil
+}
+
+func (m mockShieldClient) ListTagsForResourceWithContext(ctx aws.Context, input *shield.ListTagsForResourceInput, opts ...request.Option) (*shield.ListTagsForResourceOutput, error) {
+	if err, ok := m.tagsErr[*input.ResourceARN]; ok {
+		return nil, err
+	}
+	return &shield.ListTagsForResourceOutput{Tags: m.tags[*input.ResourceARN]}, nil
+}
+
+func TestGetTaggedShield(t *testing.T) {
+	// Setup Test
+	distributionArn := "arn:aws:cloudfront::123456789012:distribution/E1ABCDEF"
+	loadBalancerArn := "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/web/0123456789abcdef"
+	iface := tagsInterface{shieldClient: mockShieldClient{protections: []*shield.Protection{
+		{Id: aws.String("p-1"), Name: aws.String("cdn"), ResourceArn: aws.String(distributionArn), ProtectionArn: aws.String("arn:aws:shield::123456789012:protection/p-1")},
+		{Id: aws.String("p-2"), Name: aws.String("web"), ResourceArn: aws.String(loadBalancerArn), ProtectionArn: aws.String("arn:aws:shield::123456789012:protection/p-2")},
+		{Id: aws.String("p-3"), Name: aws.String("broken"), ResourceArn: aws.String("web"), ProtectionArn: aws.String("arn:aws:shield::123456789012:protection/p-3")},
+		// The protection whose tags can't be listed is skipped, the others are still discovered
+		{Id: aws.String("p-4"), Name: aws.String("denied"), ResourceArn: aws.String(loadBalancerArn + "0"), ProtectionArn: aws.String("arn:aws:shield::123456789012:protection/p-4")},
+	}, tags: map[string][]*shield.Tag{
+		"arn:aws:shield::123456789012:protection/p-1": {{Key: aws.String("Team"), Value: aws.String("edge")}},
+		"arn:aws:shield::123456789012:protection/p-2": {{Key: aws.String("Team"), Value: aws.String("web")}},
+	}, tagsErr: map[string]error{
+		"arn:aws:shield::123456789012:protection/p-4": errors.New("AccessDeniedException"),
+	}}}
+	dropped := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("shield", "tags_not_listed"))
+
+	for _, tc := range []struct {
+		region   string
+		expected string
+		name     string
+	}{
+		// The global resources have their metrics in us-east-1
+		{"us-east-1", distributionArn, "cdn"},
+		{"eu-west-1", loadBalancerArn, "web"},
+	} {
+		// Act
+		j := job{Type: "shield", SearchTags: []tag{{Key: "Team", Value: "edge|web"}}}
+		j.compileRegexes()
+		resources, err := iface.get(j, tc.region)
+
+		// Assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources) != 1 || *resources[0].ID != tc.expected || resources[0].Labels["protection_name"] != tc.name {
+			t.Fatalf("%s\nexpected: %s\nactual:  %v", tc.region, tc.expected, resources)
+		}
+		dimensions := detectDimensionsByService(resources[0], nil)
+		if len(dimensions) != 1 || *dimensions[0].Name != "ResourceArn" || *dimensions[0].Value != tc.expected {
+			t.Fatalf("%s\nexpected: ResourceArn=%s\nactual:  %v", tc.region, tc.expected, dimensions)
+		}
+	}
+	if actual := testutil.ToFloat64(resourcesDroppedCounter.WithLabelValues("shield", "tags_not_listed")) - dropped; actual != 1 {
+		t.Fatalf("\nexpected: 1 protection dropped\nactual:  %v", actual)
+	}
+	if namespace, _ := getNamespace("shield"); namespace != "AWS/DDoSProtection" {
+		t.Fatalf("\nexpected: AWS/DDoSProtection\nactual:  %s", namespace)
+	}
+}
+
+type mockGuardDutyClient struct {
+	guarddutyiface.GuardDutyAPI
+	detectors map[string]*guardduty.GetDetectorOutput
+}
+
+func (m mockGuardDutyClient) ListDetectorsWithContext(ctx aws.Context, input *guardduty.ListDetectorsInput, opts ...request.Option) (*guardduty.ListDetectorsOutput, error) {
+	output := &guardduty.ListDetectorsOutput{}
+	for id := range m.detectors {
+		output.DetectorIds = append(output.DetectorIds, aws.String(id))
+	}
+	sort.Slice(output.DetectorIds, func(i, j int) bool { return *output.DetectorIds[i] < *output.DetectorIds[j] })
+	return output, nil
+}
+
+func (m mockGuardDutyClient) GetDetectorWithContext(ctx aws.Context, input *guardduty.GetDetectorInput, opts ...request.Option) (*guardduty.GetDetectorOutput, error) {
+	return m.detectors[*input.DetectorId], nil
+}
+
+func TestGetTaggedGuardDuty(t *testing.T) {
+	// Setup Test
+	serviceRole := aws.String("arn:aws:iam::123456789012:role/aws-service-role/guardduty.amazonaws.com/AWSServiceRoleForAmazonGuardDuty")
+	iface := tagsInterface{guardDutyClient: mockGuardDutyClient{detectors: map[string]*guardduty.GetDetectorOutput{
+		"detector-matching": {ServiceRole: serviceRole, Tags: map[string]*string{"Team": aws.String("security"), "Env": aws.String("prod")}},
+		"detector-other":    {ServiceRole: serviceRole, Tags: map[string]*string{"Team": aws.String("platform")}},
+		"detector-untagged": {ServiceRole: serviceRole},
+	}}}
+
+	// Act
+	j := job{Type: "guardduty", SearchTags: []tag{{Key: "Team", Value: "security"}}}
+	j.compileRegexes()
+	resources, err := iface.get(j, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "arn:aws:guardduty:eu-west-1:123456789012:detector/detector-matching"
+	if len(resources) != 1 || *resources[0].ID != expected {
+		t.Fatalf("\nexpected: %s\nactual:  %v", expected, resources)
+	}
+	if len(resources[0].Tags) != 2 || *resources[0].Tags[0] != (tag{Key: "Env", Value: "prod"}) || *resources[0].Tags[1] != (tag{Key: "Team", Value: "security"}) {
+		t.Fatalf("\nexpected: the sorted tags Env and Team\nactual:  %v", resources[0].Tags)
+	}
+	dimensions := detectDimensionsByService(resources[0], nil)
+	if len(dimensions) != 1 || *dimensions[0].Name != "DetectorId" || *dimensions[0].Value != "detector-matching" {
+		t.Fatalf("\nexpected: DetectorId=detector-matching\nactual:  %v", dimensions)
+	}
+
+	// Act
+	resources, err = iface.get(job{Type: "guardduty"}, "eu-west-1")
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 3 {
+		t.Fatalf("\nexpected: every detector without search tags\nactual:  %v", resources)
+	}
+}
+
+func TestGetTaggedWAFClassic(t *testing.T) {
+	globalArn := "arn:aws:waf::123456789012:webacl/global-0123"
+	regionalArn := "arn:aws:waf-regional:us-east-1:123456789012:webacl/regional-4567"
+	iface := tagsInterface{
+		wafClient: mockWAFClient{mockWebACLs: mockWebACLs{
+			webACLs: []*waf.WebACL{{WebACLId: aws.String("global-0123"), WebACLArn: aws.String(globalArn), MetricName: aws.String("CloudFrontACL")}},
+			tags:    map[string][]*waf.Tag{globalArn: {{Key: aws.String("team"), Value: aws.String("edge")}}},
+		}},
+		wafRegClient: mockWAFRegionalClient{mockWebACLs: mockWebACLs{
+			webACLs: []*waf.WebACL{
+				{WebACLId: aws.String("regional-4567"), WebACLArn: aws.String(regionalArn), MetricName: aws.String("AlbACL")},
+				{WebACLId: aws.String("regional-89ab"), WebACLArn: aws.String("arn:aws:waf-regional:us-east-1:123456789012:webacl/regional-89ab"), MetricName: aws.String("LegacyACL")},
+			},
+			tags: map[string][]*waf.Tag{regionalArn: {{Key: aws.String("team"), Value: aws.String("edge")}}},
+		}},
+	}
+	for _, tc := range []struct {
+		region   string
+		expected map[string][]string
+	}{
+		// The global web ACLs are only discovered through us-east-1, where their metrics are
+		{"us-east-1", map[string][]string{
+			regionalArn: {"WebACL=AlbACL", "Rule=ALL", "Region=us-east-1"},
+			globalArn:   {"WebACL=CloudFrontACL", "Rule=ALL"},
+		}},
+		{"eu-west-1", map[string][]string{
+			regionalArn: {"WebACL=AlbACL", "Rule=ALL", "Region=us-east-1"},
+		}},
+	} {
+		t.Run(tc.region, func(t *testing.T) {
+			// Act
+			j := job{Type: "waf", SearchTags: []tag{{Key: "team", Value: "edge"}}}
+			j.compileRegexes()
+			resources, err := iface.get(j, tc.region)
+
+			// Assert
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resources) != len(tc.expected) {
+				t.Fatalf("\nexpected: %d web ACLs\nactual:  %d", len(tc.expected), len(resources))
+			}
+			for _, resource := range resources {
+				var actual []string
+				for _, dimension := range detectDimensionsByService(resource, nil) {
+					actual = append(actual, *dimension.Name+"="+*dimension.Value)
+				}
+				if expected := tc.expected[*resource.ID]; strings.Join(actual, ",") != strings.Join(expected, ",") {
+					t.Fatalf("%s\nexpected: %v\nactual:  %v", *resource.ID, expected, actual)
+				}
+			}
+		})
+	}
+}
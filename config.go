@@ -3,45 +3,191 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/arn"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 type conf struct {
-	Discovery discovery `yaml:"discovery"`
-	Static    []static  `yaml:"static"`
+	Discovery    discovery            `yaml:"discovery"`
+	Static       []static             `yaml:"static"`
+	StaticLabels map[string]string    `yaml:"staticLabels"`
+	RateLimits   map[string]rateLimit `yaml:"rateLimits"`
+	NameLabel    nameLabel            `yaml:"nameLabel"`
+	// Alias of the account per role ARN, takes precedence over the alias resolved through IAM
+	AccountAliases        map[string]string `yaml:"accountAliases"`
+	ResolveAccountAliases bool              `yaml:"resolveAccountAliases"`
+	RelabelConfigs        []relabelConfig   `yaml:"relabelConfigs"`
+	// Export the tags of every service as a single aws_resource_info metric with a service label
+	UnifiedInfoMetric bool `yaml:"unifiedInfoMetric"`
 }
 
+// Shortens the name label of the metrics, which is the ARN of the resource by default
+type nameLabel struct {
+	StripPrefix string `yaml:"stripPrefix"`
+	ResourceID  bool   `yaml:"resourceId"`
+	ArnLabel    bool   `yaml:"arnLabel"`
+}
+
+const (
+	searchTagsModeRegex = "regex"
+	searchTagsModeGlob  = "glob"
+
+	// How a search tag matched a tag of a resource, besides the modes
+	searchTagMatchExact = "exact"
+	searchTagMatchNone  = "none"
+
+	arnFilterModeInclude = "include"
+	arnFilterModeExclude = "exclude"
+)
+
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 type discovery struct {
 	ExportedTagsOnMetrics exportedTagsOnMetrics `yaml:"exportedTagsOnMetrics"`
+	Organization          organization          `yaml:"organization"`
 	Jobs                  []job                 `yaml:"jobs"`
+	ServerSideTagFilters  map[string]bool       `yaml:"serverSideTagFilters"`
+}
+
+// Whether the search tag keys of the service are filtered by the tagging API, which services opt in to
+func (d discovery) serverSideTagFilters(service string) bool {
+	return d.ServerSideTagFilters[service]
+}
+
+type organization struct {
+	RoleArn                    string   `yaml:"roleArn"`
+	MemberRoleName             string   `yaml:"memberRoleName"`
+	ExcludeOrganizationalUnits []string `yaml:"excludeOrganizationalUnits"`
+}
+
+func (o organization) isEmpty() bool {
+	return o.RoleArn == "" && o.MemberRoleName == "" && len(o.ExcludeOrganizationalUnits) == 0
 }
 
 type exportedTagsOnMetrics map[string][]string
 
 type job struct {
-	Regions                []string `yaml:"regions"`
-	Type                   string   `yaml:"type"`
-	RoleArns               []string `yaml:"roleArns"`
-	AwsDimensions          []string `yaml:"awsDimensions"`
-	SearchTags             []tag    `yaml:"searchTags"`
-	CustomTags             []tag    `yaml:"customTags"`
-	Metrics                []metric `yaml:"metrics"`
-	Length                 int      `yaml:"length"`
-	Delay                  int      `yaml:"delay"`
-	Period                 int      `yaml:"period"`
-	AddCloudwatchTimestamp bool     `yaml:"addCloudwatchTimestamp"`
+	Regions                []string            `yaml:"regions"`
+	ExcludeRegions         []string            `yaml:"excludeRegions"`
+	Type                   string              `yaml:"type"`
+	RoleArns               []string            `yaml:"roleArns"`
+	AwsDimensions          []string            `yaml:"awsDimensions"`
+	SearchTags             []tag               `yaml:"searchTags"`
+	CustomTags             []tag               `yaml:"customTags"`
+	Metrics                []metric            `yaml:"metrics"`
+	Length                 int                 `yaml:"length"`
+	Delay                  int                 `yaml:"delay"`
+	Period                 int                 `yaml:"period"`
+	AddCloudwatchTimestamp bool                `yaml:"addCloudwatchTimestamp"`
+	IgnoreTerminated       bool                `yaml:"ignoreTerminated"`
+	ResourcesPerPage       int64               `yaml:"resourcesPerPage"`
+	NormalizeTagValues     tagNormalization    `yaml:"normalizeTagValues"`
+	InfoCreationTime       bool                `yaml:"infoCreationTime"`
+	RegionTag              string              `yaml:"regionTag"`
+	AppSyncResolvers       bool                `yaml:"appSyncResolvers"`
+	DimensionOverrides     []dimensionOverride `yaml:"dimensionOverrides"`
+	FirehoseDestinations   bool                `yaml:"firehoseDestinations"`
+	SearchTagsMode         string              `yaml:"searchTagsMode"`
+	CacheNodes             bool                `yaml:"cacheNodes"`
+	ArnFilter              string              `yaml:"arnFilter"`
+	ArnFilterMode          string              `yaml:"arnFilterMode"`
+	MaxAge                 duration            `yaml:"maxAge"`
+	AutoScalingGroupTags   bool                `yaml:"autoScalingGroupTags"`
+	SplitResourceTypes     bool                `yaml:"splitResourceTypes"`
+	CloudFrontDomains      bool                `yaml:"cloudFrontDomains"`
+	HelpText               string              `yaml:"helpText"`
+	LoadBalancerLabels     bool                `yaml:"loadBalancerLabels"`
+	OriginalAsgArns        bool                `yaml:"originalAsgArns"`
+	InstanceDetails        bool                `yaml:"instanceDetails"`
+	InstanceFilters        []tag               `yaml:"instanceFilters"`
+	ResourceGroup          string              `yaml:"resourceGroup"`
+	MaxResources           int                 `yaml:"maxResources"`
+	EngineVersions         bool                `yaml:"engineVersions"`
+	NumericTags            []string            `yaml:"numericTags"`
+	LambdaAliases          bool                `yaml:"lambdaAliases"`
+	Arns                   []string            `yaml:"arns"`
+	ArnTags                bool                `yaml:"arnTags"`
+	NatGatewayPlacement    bool                `yaml:"natGatewayPlacement"`
+	VolumeAttachments      bool                `yaml:"volumeAttachments"`
+	VpnTunnels             bool                `yaml:"vpnTunnels"`
+	// Compiled once when the configuration is loaded instead of for every resource
+	arnFilterRegex *regexp.Regexp
+}
+
+// Extracts the value of a dimension from the resource ID instead of the per service default
+type dimensionOverride struct {
+	Name     string `yaml:"name"`
+	Regex    string `yaml:"regex"`
+	Template string `yaml:"template"`
+	// Compiled once when the configuration is loaded instead of for every resource
+	regex *regexp.Regexp
+}
+
+// Compile the regexes of the job, a validated job never fails to compile
+func (j *job) compileRegexes() {
+	if j.ArnFilter != "" {
+		j.arnFilterRegex = regexp.MustCompile(j.ArnFilter)
+	}
+	for i, override := range j.DimensionOverrides {
+		j.DimensionOverrides[i].regex = regexp.MustCompile(override.Regex)
+	}
+	if j.SearchTagsMode != searchTagsModeGlob {
+		compileTagRegexes(j.SearchTags)
+		compileTagRegexes(j.InstanceFilters)
+	}
+}
+
+// Compile the values of the search tags or instance filters of a job in regex mode
+func compileTagRegexes(tags []tag) {
+	for i, t := range tags {
+		tags[i].regex = regexp.MustCompile(t.Value)
+	}
+}
+
+// Whether the resource was created longer ago than the max age of the job, resources without a creation time are kept
+func (j job) exceedsMaxAge(createdAt *time.Time) bool {
+	return j.MaxAge > 0 && createdAt != nil && time.Since(*createdAt) > time.Duration(j.MaxAge)
+}
+
+// A duration with a unit like 720h, yaml.v2 would decode a bare number as nanoseconds
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+type tagNormalization struct {
+	Trim      bool `yaml:"trim"`
+	Lowercase bool `yaml:"lowercase"`
 }
 
 type static struct {
-	Name       string      `yaml:"name"`
-	Regions    []string    `yaml:"regions"`
-	RoleArns   []string    `yaml:"roleArns"`
-	Namespace  string      `yaml:"namespace"`
-	CustomTags []tag       `yaml:"customTags"`
-	Dimensions []dimension `yaml:"dimensions"`
-	Metrics    []metric    `yaml:"metrics"`
+	Name           string      `yaml:"name"`
+	Regions        []string    `yaml:"regions"`
+	ExcludeRegions []string    `yaml:"excludeRegions"`
+	RoleArns       []string    `yaml:"roleArns"`
+	Namespace      string      `yaml:"namespace"`
+	CustomTags     []tag       `yaml:"customTags"`
+	Dimensions     []dimension `yaml:"dimensions"`
+	Metrics        []metric    `yaml:"metrics"`
 }
 
 type metric struct {
@@ -63,20 +209,78 @@ type dimension struct {
 type tag struct {
 	Key   string `yaml:"Key"`
 	Value string `yaml:"Value"`
+	// The value of a search tag or instance filter in regex mode, compiled once when the configuration is loaded
+	regex *regexp.Regexp
 }
 
-func (c *conf) load(file *string) error {
-	yamlFile, err := ioutil.ReadFile(*file)
+// Every problem found in the configuration files, so they can be fixed at once
+type configErrors []error
+
+func (e configErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// The configuration is either a single file or a directory of *.yml/*.yaml fragments, loaded in name order
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = yaml.Unmarshal(yamlFile, c)
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (extension == ".yml" || extension == ".yaml") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No configuration files (*.yml, *.yaml) found in %s", path)
+	}
+	return files, nil
+}
+
+func (c *conf) load(file *string) error {
+	files, err := configFiles(*file)
 	if err != nil {
 		return err
 	}
 
+	var errs configErrors
+	for _, f := range files {
+		yamlFile, err := ioutil.ReadFile(f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fragment := conf{}
+		if err = yaml.Unmarshal(yamlFile, &fragment); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+			continue
+		}
+		for _, err := range fragment.validateJobs() {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+		}
+		c.merge(fragment)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
 	for n, job := range c.Discovery.Jobs {
-		if len(job.RoleArns) == 0 {
+		// Jobs without roles are assigned the organization member roles on startup
+		if len(job.RoleArns) == 0 && c.Discovery.Organization.MemberRoleName == "" {
 			c.Discovery.Jobs[n].RoleArns = []string{""} // use current IAM role
 		}
 	}
@@ -86,39 +290,155 @@ func (c *conf) load(file *string) error {
 		}
 	}
 
-	err = c.validate()
-	if err != nil {
+	if err := c.validate(); err != nil {
 		return err
 	}
+	for n := range c.Discovery.Jobs {
+		c.Discovery.Jobs[n].compileRegexes()
+	}
+	return nil
+}
+
+// Held for reading during a scrape, so a reload never swaps the configuration in the middle of one
+var configLock sync.RWMutex
+
+// Load the configuration into a fresh one and only replace the active configuration when it is valid
+func reloadConfig(file string) error {
+	newConfig := conf{}
+	if err := newConfig.load(&file); err != nil {
+		return err
+	}
+	if newConfig.Discovery.Organization.MemberRoleName != "" {
+		log.Println("Discover organization accounts..")
+		if err := newConfig.bootstrapOrganization(createOrganizationsSession(newConfig.Discovery.Organization.RoleArn)); err != nil {
+			return fmt.Errorf("Couldn't list organization accounts: %w", err)
+		}
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	config = newConfig
+	setupRateLimiters(config.RateLimits)
 	return nil
 }
 
+// Add the jobs and relabel configs of a configuration fragment, a later organization or static label replaces an earlier one
+func (c *conf) merge(fragment conf) {
+	c.Discovery.Jobs = append(c.Discovery.Jobs, fragment.Discovery.Jobs...)
+	c.Static = append(c.Static, fragment.Static...)
+	if !fragment.Discovery.Organization.isEmpty() {
+		c.Discovery.Organization = fragment.Discovery.Organization
+	}
+	if fragment.NameLabel != (nameLabel{}) {
+		c.NameLabel = fragment.NameLabel
+	}
+	for name, value := range fragment.StaticLabels {
+		if c.StaticLabels == nil {
+			c.StaticLabels = make(map[string]string)
+		}
+		c.StaticLabels[name] = value
+	}
+	for service, enabled := range fragment.Discovery.ServerSideTagFilters {
+		if c.Discovery.ServerSideTagFilters == nil {
+			c.Discovery.ServerSideTagFilters = make(map[string]bool)
+		}
+		c.Discovery.ServerSideTagFilters[service] = enabled
+	}
+	for roleArn, alias := range fragment.AccountAliases {
+		if c.AccountAliases == nil {
+			c.AccountAliases = make(map[string]string)
+		}
+		c.AccountAliases[roleArn] = alias
+	}
+	c.ResolveAccountAliases = c.ResolveAccountAliases || fragment.ResolveAccountAliases
+	c.UnifiedInfoMetric = c.UnifiedInfoMetric || fragment.UnifiedInfoMetric
+	c.RelabelConfigs = append(c.RelabelConfigs, fragment.RelabelConfigs...)
+	for api, limit := range fragment.RateLimits {
+		if c.RateLimits == nil {
+			c.RateLimits = make(map[string]rateLimit)
+		}
+		c.RateLimits[api] = limit
+	}
+	for service, tags := range fragment.Discovery.ExportedTagsOnMetrics {
+		if c.Discovery.ExportedTagsOnMetrics == nil {
+			c.Discovery.ExportedTagsOnMetrics = exportedTagsOnMetrics{}
+		}
+		for _, tag := range tags {
+			if !stringInSlice(tag, c.Discovery.ExportedTagsOnMetrics[service]) {
+				c.Discovery.ExportedTagsOnMetrics[service] = append(c.Discovery.ExportedTagsOnMetrics[service], tag)
+			}
+		}
+	}
+}
+
+// Validate the merged configuration, the jobs are validated per file
 func (c *conf) validate() error {
 	if c.Discovery.Jobs == nil && c.Static == nil {
 		return fmt.Errorf("At least 1 Discovery job or 1 Static must be defined")
 	}
 
-	if c.Discovery.Jobs != nil {
-		for idx, job := range c.Discovery.Jobs {
-			err := c.validateDiscoveryJob(job, idx)
-			if err != nil {
-				return err
-			}
+	if c.Discovery.Organization.RoleArn != "" && c.Discovery.Organization.MemberRoleName == "" {
+		return fmt.Errorf("Discovery organization: MemberRoleName should not be empty")
+	}
+	for _, unitID := range c.Discovery.Organization.ExcludeOrganizationalUnits {
+		if c.Discovery.Organization.MemberRoleName == "" {
+			return fmt.Errorf("Discovery organization: ExcludeOrganizationalUnits needs a MemberRoleName")
+		}
+		if !strings.HasPrefix(unitID, "ou-") {
+			return fmt.Errorf("Discovery organization: ExcludeOrganizationalUnits: %s is not an organizational unit ID", unitID)
 		}
 	}
 
-	if c.Static != nil {
-		for idx, job := range c.Static {
-			err := c.validateStaticJob(job, idx)
-			if err != nil {
-				return err
-			}
+	for service := range c.Discovery.ServerSideTagFilters {
+		if _, ok := allResourceTypesFilters[service]; !ok {
+			return fmt.Errorf("Discovery ServerSideTagFilters: %s is not discovered through the tagging API", service)
+		}
+	}
+
+	for name := range c.StaticLabels {
+		if !labelNameRegex.MatchString(name) {
+			return fmt.Errorf("StaticLabels: %s is not a valid label name", name)
+		}
+	}
+
+	for idx, relabel := range c.RelabelConfigs {
+		if err := relabel.validate(); err != nil {
+			return fmt.Errorf("RelabelConfigs [%d]: %w", idx, err)
+		}
+	}
+
+	for api, limit := range c.RateLimits {
+		if !stringInSlice(api, rateLimitedAPIs) {
+			return fmt.Errorf("RateLimits: %s is not in the list of rate limited APIs: %s", api, strings.Join(rateLimitedAPIs, ", "))
+		}
+		if limit.RequestsPerSecond <= 0 {
+			return fmt.Errorf("RateLimits [%s]: RequestsPerSecond should be greater than 0", api)
+		}
+		if limit.Burst < 0 {
+			return fmt.Errorf("RateLimits [%s]: Burst should not be negative", api)
 		}
 	}
 
 	return nil
 }
 
+func (c *conf) validateJobs() (errs configErrors) {
+	for idx, job := range c.Discovery.Jobs {
+		if err := c.validateDiscoveryJob(job, idx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for idx, job := range c.Static {
+		if err := c.validateStaticJob(job, idx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Services without metrics of their own, whose jobs may only export the info metric
+var infoOnlyServices = []string{"subnet"}
+
 func (c *conf) validateDiscoveryJob(j job, jobIdx int) error {
 	if j.Type != "" {
 		if !stringInSlice(j.Type, supportedServices) {
@@ -130,9 +450,95 @@ func (c *conf) validateDiscoveryJob(j job, jobIdx int) error {
 	if len(j.Regions) == 0 {
 		return fmt.Errorf("Discovery job [%s/%d]: Regions should not be empty", j.Type, jobIdx)
 	}
-	if len(j.Metrics) == 0 {
+	// The distributions are global, every other region would discover them again without metrics
+	if j.Type == "cf" && (len(j.Regions) != 1 || j.Regions[0] != "us-east-1") {
+		return fmt.Errorf("Discovery job [%s/%d]: Regions should only be us-east-1, where the CloudFront metrics are", j.Type, jobIdx)
+	}
+	if len(j.Metrics) == 0 && !stringInSlice(j.Type, infoOnlyServices) {
 		return fmt.Errorf("Discovery job [%s/%d]: Metrics should not be empty", j.Type, jobIdx)
 	}
+	if j.ResourcesPerPage < 0 || j.ResourcesPerPage > 100 {
+		return fmt.Errorf("Discovery job [%s/%d]: ResourcesPerPage should be between 1 and 100", j.Type, jobIdx)
+	}
+	switch j.SearchTagsMode {
+	case "", searchTagsModeRegex:
+		for _, searchTag := range j.SearchTags {
+			if _, err := regexp.Compile(searchTag.Value); err != nil {
+				return fmt.Errorf("Discovery job [%s/%d]: SearchTag %s: Invalid regex: %v", j.Type, jobIdx, searchTag.Key, err)
+			}
+		}
+	case searchTagsModeGlob:
+		for _, searchTag := range j.SearchTags {
+			if _, err := path.Match(searchTag.Value, ""); err != nil {
+				return fmt.Errorf("Discovery job [%s/%d]: SearchTag %s: Invalid glob pattern %s", j.Type, jobIdx, searchTag.Key, searchTag.Value)
+			}
+		}
+	default:
+		return fmt.Errorf("Discovery job [%s/%d]: SearchTagsMode should be regex or glob", j.Type, jobIdx)
+	}
+	if j.MaxResources < 0 {
+		return fmt.Errorf("Discovery job [%s/%d]: MaxResources should not be negative", j.Type, jobIdx)
+	}
+	if j.MaxAge < 0 {
+		return fmt.Errorf("Discovery job [%s/%d]: MaxAge should not be negative", j.Type, jobIdx)
+	}
+	if _, err := regexp.Compile(j.ArnFilter); err != nil {
+		return fmt.Errorf("Discovery job [%s/%d]: ArnFilter: Invalid regex: %v", j.Type, jobIdx, err)
+	}
+	switch j.ArnFilterMode {
+	case "", arnFilterModeInclude, arnFilterModeExclude:
+	default:
+		return fmt.Errorf("Discovery job [%s/%d]: ArnFilterMode should be include or exclude", j.Type, jobIdx)
+	}
+	if len(j.InstanceFilters) > 0 && j.Type != "ec2" {
+		return fmt.Errorf("Discovery job [%s/%d]: InstanceFilters are only supported by ec2", j.Type, jobIdx)
+	}
+	for _, filter := range j.InstanceFilters {
+		if filter.Key != "instance_type" && filter.Key != "platform" {
+			return fmt.Errorf("Discovery job [%s/%d]: InstanceFilter %s should be instance_type or platform", j.Type, jobIdx, filter.Key)
+		}
+		if j.SearchTagsMode == searchTagsModeGlob {
+			continue
+		}
+		if _, err := regexp.Compile(filter.Value); err != nil {
+			return fmt.Errorf("Discovery job [%s/%d]: InstanceFilter %s: Invalid regex: %v", j.Type, jobIdx, filter.Key, err)
+		}
+	}
+	if _, ok := allResourceTypesFilters[j.Type]; j.ResourceGroup != "" && !ok {
+		return fmt.Errorf("Discovery job [%s/%d]: ResourceGroup is only supported by the services discovered through the tagging API", j.Type, jobIdx)
+	}
+	if len(j.Arns) > 0 {
+		if _, ok := allResourceTypesFilters[j.Type]; !ok {
+			return fmt.Errorf("Discovery job [%s/%d]: Arns are only supported by the services discovered through the tagging API", j.Type, jobIdx)
+		}
+		if j.ResourceGroup != "" {
+			return fmt.Errorf("Discovery job [%s/%d]: Arns and ResourceGroup are mutually exclusive", j.Type, jobIdx)
+		}
+	}
+	for _, resourceArn := range j.Arns {
+		parsed, err := arn.Parse(resourceArn)
+		if err != nil {
+			return fmt.Errorf("Discovery job [%s/%d]: Arns: %s: %v", j.Type, jobIdx, resourceArn, err)
+		}
+		// Every region is scraped with its own clients, the resources of the other regions wouldn't be found
+		if parsed.Region != "" && !stringInSlice(parsed.Region, j.Regions) {
+			return fmt.Errorf("Discovery job [%s/%d]: Arns: %s is not in the Regions of the job", j.Type, jobIdx, resourceArn)
+		}
+	}
+	if j.ArnTags && len(j.Arns) == 0 {
+		return fmt.Errorf("Discovery job [%s/%d]: ArnTags needs Arns", j.Type, jobIdx)
+	}
+	if _, ok := arnTagListers[j.Type]; j.ArnTags && !ok {
+		return fmt.Errorf("Discovery job [%s/%d]: ArnTags is not supported by %s", j.Type, jobIdx, j.Type)
+	}
+	for overrideIdx, override := range j.DimensionOverrides {
+		if override.Name == "" {
+			return fmt.Errorf("Discovery job [%s/%d]: DimensionOverride [%d]: Name should not be empty", j.Type, jobIdx, overrideIdx)
+		}
+		if _, err := regexp.Compile(override.Regex); err != nil {
+			return fmt.Errorf("Discovery job [%s/%d]: DimensionOverride [%s/%d]: Invalid regex: %v", j.Type, jobIdx, override.Name, overrideIdx, err)
+		}
+	}
 	for metricIdx, metric := range j.Metrics {
 		parent := fmt.Sprintf("Discovery job [%s/%d]", j.Type, jobIdx)
 		err := c.validateMetric(metric, metricIdx, parent, &j)
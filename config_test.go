@@ -1,7 +1,13 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 func TestConfLoad(t *testing.T) {
@@ -11,3 +17,386 @@ func TestConfLoad(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func writeConfigFragments(t *testing.T, fragments map[string]string) string {
+	dir, err := ioutil.TempDir("", "yace-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range fragments {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestConfLoadDirectory(t *testing.T) {
+	// Setup Test
+	dir := writeConfigFragments(t, map[string]string{
+		"00-common.yml": "discovery:\n  exportedTagsOnMetrics:\n    ec2: [Name]\n",
+		"10-ec2.yml":    "discovery:\n  exportedTagsOnMetrics:\n    ec2: [Name, team]\n  jobs:\n  - type: ec2\n    regions: [eu-west-1]\n    metrics:\n    - name: CPUUtilization\n      statistics: [Average]\n      period: 300\n      length: 300\n",
+		"20-rds.yaml":   "discovery:\n  jobs:\n  - type: rds\n    regions: [eu-west-1]\n    metrics:\n    - name: FreeStorageSpace\n      statistics: [Minimum]\n      period: 300\n      length: 300\n",
+		"README.md":     "not a configuration file",
+	})
+	defer os.RemoveAll(dir)
+
+	// Act
+	c := conf{}
+	err := c.load(&dir)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Discovery.Jobs) != 2 || c.Discovery.Jobs[0].Type != "ec2" || c.Discovery.Jobs[1].Type != "rds" {
+		t.Fatalf("\nexpected: ec2 and rds jobs\nactual:  %+v", c.Discovery.Jobs)
+	}
+	if tags := c.Discovery.ExportedTagsOnMetrics["ec2"]; len(tags) != 2 || tags[0] != "Name" || tags[1] != "team" {
+		t.Fatalf("\nexpected: [Name team]\nactual:  %v", tags)
+	}
+}
+
+func TestConfLoadCompilesRegexes(t *testing.T) {
+	// Setup Test
+	dir := writeConfigFragments(t, map[string]string{
+		"10-asg.yml": "discovery:\n  jobs:\n  - type: asg\n    regions: [eu-west-1]\n    dimensionOverrides:\n    - name: AutoScalingGroupName\n      regex: 'autoScalingGroupName/(.+)$'\n    arnFilter: '-canary$'\n    metrics:\n    - name: GroupInServiceInstances\n      statistics: [Minimum]\n      period: 300\n      length: 300\n",
+	})
+	defer os.RemoveAll(dir)
+
+	// Act
+	c := conf{}
+	err := c.load(&dir)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if override := c.Discovery.Jobs[0].DimensionOverrides[0]; override.regex == nil || override.regex.String() != override.Regex {
+		t.Fatalf("\nexpected: compiled %s\nactual:  %v", override.Regex, override.regex)
+	}
+	if j := c.Discovery.Jobs[0]; j.arnFilterRegex == nil || j.arnFilterRegex.String() != j.ArnFilter {
+		t.Fatalf("\nexpected: compiled %s\nactual:  %v", j.ArnFilter, j.arnFilterRegex)
+	}
+}
+
+func TestConfLoadDirectoryReportsAllErrors(t *testing.T) {
+	// Setup Test
+	dir := writeConfigFragments(t, map[string]string{
+		"10-ec2.yml": "discovery:\n  jobs:\n  - type: ec2\n    metrics:\n    - name: CPUUtilization\n      statistics: [Average]\n      period: 300\n  - type: foobar\n",
+		"20-rds.yml": "discovery: [",
+	})
+	defer os.RemoveAll(dir)
+
+	// Act
+	err := (&conf{}).load(&dir)
+
+	// Assert
+	errs, ok := err.(configErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("\nexpected: 3 errors\nactual:  %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	// Setup Test
+	defer func() { config = conf{} }()
+	dir := writeConfigFragments(t, map[string]string{
+		"10-ec2.yml": "discovery:\n  jobs:\n  - type: ec2\n    regions: [eu-west-1]\n    metrics:\n    - name: CPUUtilization\n      statistics: [Average]\n      period: 300\n      length: 300\n",
+	})
+	defer os.RemoveAll(dir)
+	if err := reloadConfig(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "20-rds.yml"), []byte("discovery:\n  jobs:\n  - type: rds\n    regions: [eu-west-1]\n    metrics:\n    - name: FreeStorageSpace\n      statistics: [Minimum]\n      period: 300\n      length: 300\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	err := reloadConfig(dir)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Discovery.Jobs) != 2 || config.Discovery.Jobs[1].Type != "rds" {
+		t.Fatalf("\nexpected: ec2 and rds jobs\nactual:  %+v", config.Discovery.Jobs)
+	}
+}
+
+func TestReloadConfigKeepsCurrentWhenInvalid(t *testing.T) {
+	// Setup Test
+	defer func() { config = conf{} }()
+	dir := writeConfigFragments(t, map[string]string{
+		"10-ec2.yml": "discovery:\n  jobs:\n  - type: ec2\n    regions: [eu-west-1]\n    metrics:\n    - name: CPUUtilization\n      statistics: [Average]\n      period: 300\n      length: 300\n",
+	})
+	defer os.RemoveAll(dir)
+	if err := reloadConfig(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "20-rds.yml"), []byte("discovery:\n  jobs:\n  - type: rds\n  - type: foobar\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Act
+	err := reloadConfig(dir)
+
+	// Assert
+	if errs, ok := err.(configErrors); !ok || len(errs) != 2 {
+		t.Fatalf("\nexpected: the 2 errors of the new file\nactual:  %v", err)
+	}
+	if len(config.Discovery.Jobs) != 1 || config.Discovery.Jobs[0].Type != "ec2" {
+		t.Fatalf("\nexpected: the ec2 job of the current config\nactual:  %+v", config.Discovery.Jobs)
+	}
+}
+
+func TestValidateResourcesPerPage(t *testing.T) {
+	metrics := []metric{{Name: "CPUUtilization", Statistics: []string{"Average"}, Period: 300}}
+	for _, tc := range []struct {
+		resourcesPerPage int64
+		valid            bool
+	}{
+		{0, true},
+		{100, true},
+		{101, false},
+		{-1, false},
+	} {
+		j := job{Type: "ec2", Regions: []string{"eu-west-1"}, Metrics: metrics, ResourcesPerPage: tc.resourcesPerPage}
+		err := (&conf{}).validateDiscoveryJob(j, 0)
+		if (err == nil) != tc.valid {
+			t.Errorf("resourcesPerPage=%d: expected valid=%t, got error %v", tc.resourcesPerPage, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateDimensionOverrides(t *testing.T) {
+	metrics := []metric{{Name: "GroupInServiceInstances", Statistics: []string{"Minimum"}, Period: 300}}
+	for _, tc := range []struct {
+		override dimensionOverride
+		valid    bool
+	}{
+		{dimensionOverride{Name: "AutoScalingGroupName", Regex: `autoScalingGroupName/(.+)$`}, true},
+		{dimensionOverride{Regex: `autoScalingGroupName/(.+)$`}, false},
+		{dimensionOverride{Name: "AutoScalingGroupName", Regex: `(`}, false},
+	} {
+		j := job{Type: "asg", Regions: []string{"eu-west-1"}, Metrics: metrics, DimensionOverrides: []dimensionOverride{tc.override}}
+		err := (&conf{}).validateDiscoveryJob(j, 0)
+		if (err == nil) != tc.valid {
+			t.Errorf("override %+v: expected valid=%t, got error %v", tc.override, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateStaticLabels(t *testing.T) {
+	for name, valid := range map[string]bool{"environment": true, "cost_center": true, "cost-center": false, "1st": false} {
+		c := conf{Static: []static{{}}, StaticLabels: map[string]string{name: "value"}}
+		if err := c.validate(); (err == nil) != valid {
+			t.Errorf("static label %s: expected valid=%t, got error %v", name, valid, err)
+		}
+	}
+}
+
+func TestValidateSearchTagsMode(t *testing.T) {
+	metrics := []metric{{Name: "CPUUtilization", Statistics: []string{"Average"}, Period: 300}}
+	for _, tc := range []struct {
+		mode    string
+		pattern string
+		valid   bool
+	}{
+		{"", "^payments-.*$", true},
+		{"regex", "^payments-.*$", true},
+		{"", "payments-(", false},
+		{"regex", "payments-(", false},
+		{"glob", "payments-*", true},
+		// Only compiled as a regex in regex mode
+		{"glob", "payments-(", true},
+		{"glob", "payments-[", false},
+		{"wildcard", "payments-*", false},
+	} {
+		j := job{Type: "ec2", Regions: []string{"eu-west-1"}, Metrics: metrics, SearchTagsMode: tc.mode, SearchTags: []tag{{Key: "team", Value: tc.pattern}}}
+		err := (&conf{}).validateDiscoveryJob(j, 0)
+		if (err == nil) != tc.valid {
+			t.Errorf("mode %q pattern %q: expected valid=%t, got error %v", tc.mode, tc.pattern, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateArnFilter(t *testing.T) {
+	metrics := []metric{{Name: "NumberOfMessagesSent", Statistics: []string{"Sum"}, Period: 300}}
+	for _, tc := range []struct {
+		filter string
+		mode   string
+		valid  bool
+	}{
+		{"", "", true},
+		{":payments-", "", true},
+		{":payments-", "include", true},
+		{"-dlq$", "exclude", true},
+		{"(", "", false},
+		{":payments-", "ignore", false},
+	} {
+		j := job{Type: "sqs", Regions: []string{"eu-west-1"}, Metrics: metrics, ArnFilter: tc.filter, ArnFilterMode: tc.mode}
+		err := (&conf{}).validateDiscoveryJob(j, 0)
+		if (err == nil) != tc.valid {
+			t.Errorf("filter %q mode %q: expected valid=%t, got error %v", tc.filter, tc.mode, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	for _, tc := range []struct {
+		api   string
+		limit rateLimit
+		valid bool
+	}{
+		{"resourcegroupstaggingapi", rateLimit{RequestsPerSecond: 5, Burst: 10}, true},
+		{"ec2", rateLimit{RequestsPerSecond: 0.5}, true},
+		{"cloudwatch", rateLimit{RequestsPerSecond: 5}, false},
+		{"ec2", rateLimit{}, false},
+		{"ec2", rateLimit{RequestsPerSecond: 5, Burst: -1}, false},
+	} {
+		c := conf{Static: []static{{}}, RateLimits: map[string]rateLimit{tc.api: tc.limit}}
+		if err := c.validate(); (err == nil) != tc.valid {
+			t.Errorf("%s %+v: expected valid=%t, got error %v", tc.api, tc.limit, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateServerSideTagFilters(t *testing.T) {
+	for _, tc := range []struct {
+		service string
+		valid   bool
+	}{
+		{"s3", true},
+		{"ec2", true},
+		// Discovered through the describe API of the service
+		{"asg", false},
+		{"foobar", false},
+	} {
+		c := conf{Static: []static{{}}, Discovery: discovery{ServerSideTagFilters: map[string]bool{tc.service: true}}}
+		if err := c.validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%t, got error %v", tc.service, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateCloudFrontRegions(t *testing.T) {
+	for _, tc := range []struct {
+		regions []string
+		valid   bool
+	}{
+		{[]string{"us-east-1"}, true},
+		// The distributions would be discovered once per region
+		{[]string{"us-east-1", "eu-west-1"}, false},
+		{[]string{"eu-west-1"}, false},
+	} {
+		j := job{Type: "cf", Regions: tc.regions, Metrics: []metric{{Name: "Requests", Statistics: []string{"Sum"}, Period: 300}}}
+		if err := (&conf{}).validateDiscoveryJob(j, 0); (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid=%t, got error %v", tc.regions, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateEmptyMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		service string
+		valid   bool
+	}{
+		// AWS publishes no per subnet metrics, the job only exports the info metric
+		{"subnet", true},
+		{"ec2", false},
+	} {
+		j := job{Type: tc.service, Regions: []string{"eu-west-1"}}
+		if err := (&conf{}).validateDiscoveryJob(j, 0); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%t, got error %v", tc.service, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateArns(t *testing.T) {
+	for _, tc := range []struct {
+		job   job
+		valid bool
+	}{
+		{job{Type: "lambda", Arns: []string{"arn:aws:lambda:eu-west-1:123456789012:function:checkout"}, ArnTags: true}, true},
+		{job{Type: "sqs", Arns: []string{"arn:aws:sqs:eu-west-1:123456789012:orders"}}, true},
+		// The tags of sqs can't be read by ARN
+		{job{Type: "sqs", Arns: []string{"arn:aws:sqs:eu-west-1:123456789012:orders"}, ArnTags: true}, false},
+		{job{Type: "sqs", Arns: []string{"orders"}}, false},
+		{job{Type: "asg", Arns: []string{"arn:aws:autoscaling:eu-west-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/web"}}, false},
+		{job{Type: "lambda", ArnTags: true}, false},
+		// Not scraped in another region
+		{job{Type: "sqs", Arns: []string{"arn:aws:sqs:us-east-1:123456789012:orders"}}, false},
+		// Global resources have no region
+		{job{Type: "s3", Arns: []string{"arn:aws:s3:::logs"}}, true},
+	} {
+		tc.job.Regions = []string{"eu-west-1"}
+		tc.job.Metrics = []metric{{Name: "Invocations", Statistics: []string{"Sum"}, Period: 300}}
+		if err := (&conf{}).validateDiscoveryJob(tc.job, 0); (err == nil) != tc.valid {
+			t.Errorf("%s %v arnTags=%t: expected valid=%t, got error %v", tc.job.Type, tc.job.Arns, tc.job.ArnTags, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateExcludeOrganizationalUnits(t *testing.T) {
+	for _, tc := range []struct {
+		org   organization
+		valid bool
+	}{
+		{organization{MemberRoleName: "prometheus", ExcludeOrganizationalUnits: []string{"ou-abcd-sandbox1"}}, true},
+		{organization{MemberRoleName: "prometheus", ExcludeOrganizationalUnits: []string{"111111111111"}}, false},
+		{organization{ExcludeOrganizationalUnits: []string{"ou-abcd-sandbox1"}}, false},
+	} {
+		c := conf{Static: []static{{}}, Discovery: discovery{Organization: tc.org}}
+		if err := c.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: expected valid=%t, got error %v", tc.org, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateInstanceFilters(t *testing.T) {
+	for _, tc := range []struct {
+		service string
+		key     string
+		value   string
+		valid   bool
+	}{
+		{"ec2", "instance_type", "x", true},
+		{"ec2", "platform", "x", true},
+		{"ec2", "Name", "x", false},
+		{"ec2", "instance_type", "^m5\\.(", false},
+		// Only the ec2 jobs sweep the instances
+		{"ebs", "instance_type", "x", false},
+	} {
+		j := job{Type: tc.service, Regions: []string{"eu-west-1"}, Metrics: []metric{{Name: "CPUUtilization", Statistics: []string{"Average"}, Period: 300, Length: 300}}, InstanceFilters: []tag{{Key: tc.key, Value: tc.value}}}
+		if err := (&conf{}).validateDiscoveryJob(j, 0); (err == nil) != tc.valid {
+			t.Errorf("%s %s=%s: expected valid=%t, got error %v", tc.service, tc.key, tc.value, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateMaxAge(t *testing.T) {
+	// Arrange
+	var j job
+	if err := yaml.Unmarshal([]byte("type: ec2\nmaxAge: 720h\n"), &j); err != nil {
+		t.Fatal(err)
+	}
+	j.Regions = []string{"eu-west-1"}
+	j.Metrics = []metric{{Name: "CPUUtilization", Statistics: []string{"Average"}, Period: 300}}
+
+	// Act
+	err := (&conf{}).validateDiscoveryJob(j, 0)
+
+	// Assert
+	if err != nil || j.MaxAge != duration(30*24*time.Hour) {
+		t.Fatalf("\nexpected: a valid max age of 720h\nactual:  %s %v", time.Duration(j.MaxAge), err)
+	}
+	j.MaxAge = duration(-time.Hour)
+	if err := (&conf{}).validateDiscoveryJob(j, 0); err == nil {
+		t.Fatal("expected a negative max age to be rejected")
+	}
+	// A bare number would be nanoseconds, it needs a unit
+	if err := yaml.Unmarshal([]byte("type: ec2\nmaxAge: 720\n"), &job{}); err == nil {
+		t.Fatal("expected a max age without unit to be rejected")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dumpFormatJSON = "json"
+	dumpFormatCSV  = "csv"
+)
+
+// A discovered resource as written by the dump mode
+type dumpedResource struct {
+	Arn          string            `json:"arn"`
+	Service      string            `json:"service"`
+	Region       string            `json:"region"`
+	AccountID    string            `json:"account_id,omitempty"`
+	AccountAlias string            `json:"account_alias,omitempty"`
+	CreatedAt    *time.Time        `json:"created_at,omitempty"`
+	Tags         map[string]string `json:"tags"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+func newDumpedResource(r *tagsData) dumpedResource {
+	resource := dumpedResource{
+		Arn:          aws.StringValue(r.ID),
+		Service:      aws.StringValue(r.Service),
+		Region:       aws.StringValue(r.Region),
+		AccountID:    r.AccountID,
+		AccountAlias: r.AccountAlias,
+		CreatedAt:    r.CreatedAt,
+		Tags:         make(map[string]string, len(r.Tags)),
+		Labels:       r.Labels,
+	}
+	for _, t := range r.Tags {
+		resource.Tags[t.Key] = t.Value
+	}
+	return resource
+}
+
+// Runs the discovery of every job once, without getting the metrics. The resources found before an error are
+// returned with it.
+func discoverResources(config conf) ([]*tagsData, error) {
+	mux := &sync.Mutex{}
+	var wg sync.WaitGroup
+	var jobErrors []error
+	resources := make([]*tagsData, 0)
+
+	forEachDiscoveryRun(&wg, config.Discovery.Jobs, func(discoveryJob job, roleArn string, region string) {
+		clientTag := createTagsInterface(discoveryJob, region, roleArn)
+		found, err := discoverJobResources(discoveryJob, region, clientTag)
+		config.setAccounts(discoveryJob, roleArn, found, nil)
+		mux.Lock()
+		if err != nil {
+			jobErrors = append(jobErrors, err)
+		}
+		resources = append(resources, found...)
+		mux.Unlock()
+	})
+	wg.Wait()
+
+	if len(jobErrors) > 0 {
+		return resources, fmt.Errorf("%d discovery job runs failed, first: %w", len(jobErrors), jobErrors[0])
+	}
+	return resources, nil
+}
+
+// Writes the resources as a JSON array, or as CSV with a tag_<key> column per tag key found on any resource
+func writeResources(w io.Writer, format string, resources []*tagsData) error {
+	dumped := make([]dumpedResource, 0, len(resources))
+	for _, r := range resources {
+		dumped = append(dumped, newDumpedResource(r))
+	}
+
+	switch format {
+	case dumpFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(dumped)
+	case dumpFormatCSV:
+		keySet := make(map[string]struct{})
+		for _, r := range dumped {
+			for key := range r.Tags {
+				keySet[key] = struct{}{}
+			}
+		}
+		keys := make([]string, 0, len(keySet))
+		for key := range keySet {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writer := csv.NewWriter(w)
+		header := []string{"arn", "service", "region", "account_id", "account_alias", "created_at"}
+		for _, key := range keys {
+			header = append(header, "tag_"+key)
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		for _, r := range dumped {
+			createdAt := ""
+			if r.CreatedAt != nil {
+				createdAt = r.CreatedAt.UTC().Format(time.RFC3339)
+			}
+			record := []string{r.Arn, r.Service, r.Region, r.AccountID, r.AccountAlias, createdAt}
+			for _, key := range keys {
+				record = append(record, r.Tags[key])
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("unknown dump format %s, should be %s or %s", format, dumpFormatJSON, dumpFormatCSV)
+	}
+}
+
+// Discovers the resources of the config once and writes them to path
+func dumpResources(config conf, path string, format string) error {
+	if format != dumpFormatJSON && format != dumpFormatCSV {
+		return fmt.Errorf("unknown dump format %s, should be %s or %s", format, dumpFormatJSON, dumpFormatCSV)
+	}
+	resources, discoveryErr := discoverResources(config)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := writeResources(file, format, resources); err != nil {
+		return err
+	}
+	log.Printf("Dumped %d resources to %s", len(resources), path)
+	// The partial results are still written, so the resources of the successful jobs can be analyzed
+	return discoveryErr
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestWriteResourcesJSON(t *testing.T) {
+	// Setup Test
+	createdAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	resources := []*tagsData{
+		{
+			ID:           aws.String("arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"),
+			Service:      aws.String("ec2"),
+			Region:       aws.String("eu-west-1"),
+			Tags:         []*tag{{Key: "Name", Value: "web"}, {Key: "Team", Value: "payments"}},
+			CreatedAt:    &createdAt,
+			AccountAlias: "production",
+			Labels:       map[string]string{"instance_type": "t3.micro"},
+		},
+		// A resource without tags is dumped with empty tags rather than null
+		{
+			ID:      aws.String("arn:aws:sqs:eu-west-1:123456789012:queue"),
+			Service: aws.String("sqs"),
+			Region:  aws.String("eu-west-1"),
+		},
+	}
+	var buf bytes.Buffer
+
+	// Act
+	err := writeResources(&buf, dumpFormatJSON, resources)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &actual); err != nil {
+		t.Fatalf("invalid JSON %s: %v", buf.String(), err)
+	}
+	expected := []map[string]interface{}{
+		{
+			"arn":           "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123",
+			"service":       "ec2",
+			"region":        "eu-west-1",
+			"account_alias": "production",
+			"created_at":    "2020-06-01T12:00:00Z",
+			"tags":          map[string]interface{}{"Name": "web", "Team": "payments"},
+			"labels":        map[string]interface{}{"instance_type": "t3.micro"},
+		},
+		{
+			"arn":     "arn:aws:sqs:eu-west-1:123456789012:queue",
+			"service": "sqs",
+			"region":  "eu-west-1",
+			"tags":    map[string]interface{}{},
+		},
+	}
+	expectedJSON, _ := json.Marshal(expected)
+	actualJSON, _ := json.Marshal(actual)
+	if !bytes.Equal(expectedJSON, actualJSON) {
+		t.Fatalf("\nexpected: %s\nactual:  %s", expectedJSON, actualJSON)
+	}
+}
+
+func TestWriteResourcesCSV(t *testing.T) {
+	// Setup Test
+	resources := []*tagsData{
+		{ID: aws.String("arn:aws:sqs:eu-west-1:123456789012:a"), Service: aws.String("sqs"), Region: aws.String("eu-west-1"), Tags: []*tag{{Key: "Team", Value: "payments"}}},
+		{ID: aws.String("arn:aws:sqs:eu-west-1:123456789012:b"), Service: aws.String("sqs"), Region: aws.String("eu-west-1"), Tags: []*tag{{Key: "Name", Value: "b, c"}}},
+	}
+	var buf bytes.Buffer
+
+	// Act
+	err := writeResources(&buf, dumpFormatCSV, resources)
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "arn,service,region,account_id,account_alias,created_at,tag_Name,tag_Team\n" +
+		"arn:aws:sqs:eu-west-1:123456789012:a,sqs,eu-west-1,,,,,payments\n" +
+		"arn:aws:sqs:eu-west-1:123456789012:b,sqs,eu-west-1,,,,\"b, c\",\n"
+	if buf.String() != expected {
+		t.Fatalf("\nexpected: %s\nactual:  %s", expected, buf.String())
+	}
+}
+
+func TestWriteResourcesUnknownFormat(t *testing.T) {
+	if err := writeResources(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Fatal("expected an error for the xml format")
+	}
+}
@@ -3,9 +3,11 @@ module github.com/ivx/yet-another-cloudwatch-exporter
 go 1.14
 
 require (
-	github.com/aws/aws-sdk-go v1.32.6
+	github.com/aws/aws-sdk-go v1.46.7
 	github.com/fatih/structs v1.1.0
 	github.com/prometheus/client_golang v1.7.0
+	github.com/prometheus/common v0.10.0
 	github.com/sirupsen/logrus v1.4.2
-	gopkg.in/yaml.v2 v2.2.5
+	github.com/stretchr/testify v1.5.1 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,49 +20,93 @@ var version = "custom-build"
 
 var (
 	addr                  = flag.String("listen-address", ":5000", "The address to listen on.")
-	configFile            = flag.String("config.file", "config.yml", "Path to configuration file.")
+	configFile            = flag.String("config.file", "config.yml", "Path to configuration file, or to a directory of configuration files which are merged.")
 	debug                 = flag.Bool("debug", false, "Add verbose logging.")
 	showVersion           = flag.Bool("v", false, "prints current yace version.")
 	cloudwatchConcurrency = flag.Int("cloudwatch-concurrency", 5, "Maximum number of concurrent requests to CloudWatch API.")
 	tagConcurrency        = flag.Int("tag-concurrency", 5, "Maximum number of concurrent requests to Resource Tagging API.")
+	strictScrape          = flag.Bool("strict", false, "Fail the scrape with HTTP 500 when a discovery or static job errors, including its CloudWatch requests, instead of serving the partial data.")
+	awsProfile            = flag.String("profile", "", "Named profile of the shared AWS config to use, e.g. for source_profile role chaining or a credential_process SSO helper on local runs.")
+	describeConcurrency   = flag.Int("describe-concurrency", 5, "Maximum number of pages of describe based discovery (e.g. asg, tgwa) processed concurrently per job.")
+	apiGatewayTimeout     = flag.Duration("apigateway-timeout", 30*time.Second, "Maximum time to get the names of the API Gateway REST APIs, past it their IDs are used as ApiName.")
+	apiGatewayCacheTTL    = flag.Duration("apigateway-cache-ttl", 0, "Time the REST APIs listed by an apigateway job are reused by the other apigateway jobs of the same region and role (0 disables the cache).")
+	maxConcurrentRegions  = flag.Int("max-concurrent-regions", 0, "Maximum number of regions scraped at the same time (0 means unlimited).")
 	scrapingInterval      = flag.Int("scraping-interval", 300, "Seconds to wait between scraping the AWS metrics if decoupled scraping.")
 	decoupledScraping     = flag.Bool("decoupled-scraping", true, "Decouples scraping and serving of metrics.")
 	metricsPerQuery       = flag.Int("metrics-per-query", 500, "Number of metrics made in a single GetMetricsData request")
 	labelsSnakeCase       = flag.Bool("labels-snake-case", false, "If labels should be output in snake case instead of camel case")
+	infoMetricSuffix      = flag.String("info-metric-suffix", "_info", "Suffix of the metric names exposing the tags of the discovered resources")
+	shutdownGracePeriod   = flag.Duration("shutdown-grace-period", 20*time.Second, "Maximum time to wait for the scrapes in progress to finish on SIGTERM or SIGINT.")
+	dumpResourcesPath     = flag.String("dump-resources", "", "Run the discovery once, write the discovered resources to this file and exit, instead of serving the metrics.")
+	dumpFormat            = flag.String("dump-format", dumpFormatJSON, "Format of the file written by -dump-resources, json or csv.")
+	stsEndpoint           = flag.String("sts-endpoint", "", "Endpoint of the STS API used to assume the roles, e.g. the private DNS name of an interface VPC endpoint (the endpoint of the region by default).")
+	userAgentSuffix       = flag.String("user-agent-suffix", "", "Extra comment appended to the yace/<version> user agent of the AWS requests, e.g. a team name.")
+	debugMatchRules       = flag.Bool("debug-match-rules", false, "Count how every search tag matched the discovered resources in yace_match_rule_total, to debug the search tags (one series per search tag).")
 
 	supportedServices = []string{
 		"alb",
 		"apigateway",
+		"apprunner",
 		"appsync",
 		"asg",
+		"athena",
+		"bedrock",
 		"cf",
+		"comprehend",
+		"dax",
+		"drs",
 		"dynamodb",
 		"ebs",
 		"ec",
 		"ec2",
+		"ecr",
 		"ecs-svc",
 		"ecs-containerinsights",
 		"efs",
+		"efs-ap",
 		"elb",
 		"emr",
 		"es",
 		"firehose",
 		"fsx",
+		"fsx-lustre",
+		"fsx-ontap",
+		"fsx-openzfs",
+		"fsx-windows",
+		"grafana",
+		"guardduty",
+		"gwlb",
+		"iot",
 		"kafka",
 		"kinesis",
 		"lambda",
+		"memorydb",
 		"ngw",
 		"nlb",
+		"osis",
 		"rds",
+		"rds-proxy",
 		"redshift",
 		"r53r",
+		"r53r-endpoint",
+		"r53r-rule",
 		"s3",
+		"secretsmanager",
 		"sfn",
+		"sfn-activity",
+		"sfn-statemachine",
+		"shield",
 		"sns",
+		"spot-fleet",
 		"sqs",
+		"subnet",
+		"synthetics",
 		"tgw",
 		"tgwa",
+		"tgw-rt",
+		"vpce-service",
 		"vpn",
+		"waf",
 	}
 
 	config = conf{}
@@ -77,22 +125,66 @@ func init() {
 
 }
 
-func updateMetrics(registry *prometheus.Registry) {
-	tagsData, cloudwatchData := scrapeAwsData(config)
+var errShuttingDown = errors.New("the exporter is shutting down")
 
+// The registry and error of the last scrape, replaced by the background scrapes while the requests read it
+type lastScrape struct {
+	mux      sync.Mutex
+	registry *prometheus.Registry
+	err      error
+}
+
+func (s *lastScrape) set(registry *prometheus.Registry, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.registry, s.err = registry, err
+}
+
+func (s *lastScrape) get() (*prometheus.Registry, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.registry, s.err
+}
+
+// Migrate the scraped data to the exported metrics, the relabel configs see the labels the metrics are exported with
+func prometheusMetrics(tagsData []*tagsData, cloudwatchData []*cloudwatchData) []*PrometheusMetric {
 	var metrics []*PrometheusMetric
 
+	// The labels of the metrics are recorded again, the labels of the resources gone since the last scrape aren't kept
+	labelMap = make(map[string][]string)
 	metrics = append(metrics, migrateCloudwatchToPrometheus(cloudwatchData)...)
 	metrics = append(metrics, migrateTagsToPrometheus(tagsData)...)
 
 	metrics = ensureLabelConsistencyForMetrics(metrics)
+	return relabelMetrics(metrics, config.RelabelConfigs)
+}
 
-	registry.MustRegister(NewPrometheusCollector(metrics))
-	for _, counter := range []prometheus.Counter{cloudwatchAPICounter, cloudwatchGetMetricDataAPICounter, cloudwatchGetMetricStatisticsAPICounter, resourceGroupTaggingAPICounter, autoScalingAPICounter, apiGatewayAPICounter} {
+// Returns the error of the scrape, the registry still gets the metrics which could be scraped
+func updateMetrics(registry *prometheus.Registry) error {
+	if !scrapes.start() {
+		return errShuttingDown
+	}
+	defer scrapes.done()
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	tagsData, cloudwatchData, err := scrapeAwsData(config)
+
+	registry.MustRegister(NewPrometheusCollector(prometheusMetrics(tagsData, cloudwatchData)))
+	for _, counter := range []prometheus.Counter{cloudwatchAPICounter, cloudwatchGetMetricDataAPICounter, cloudwatchGetMetricStatisticsAPICounter, resourceGroupTaggingAPICounter, autoScalingAPICounter, apiGatewayAPICounter, appSyncAPICounter, efsAPICounter, iotAPICounter, rdsAPICounter, fsxAPICounter, firehoseAPICounter, elastiCacheAPICounter, organizationsAPICounter, iamAPICounter, wafAPICounter, cloudFrontAPICounter, elbv2APICounter, comprehendAPICounter, guardDutyAPICounter, resourceGroupsAPICounter, syntheticsAPICounter, lambdaAPICounter, shieldAPICounter, bedrockAPICounter, drsAPICounter, grafanaAPICounter} {
 		if err := registry.Register(counter); err != nil {
 			log.Warning("Could not publish cloudwatch api metric")
 		}
 	}
+	for _, collector := range []prometheus.Collector{jobsConfiguredGauge, jobsSucceededGauge, discoveryDurationHistogram, serviceLastSuccessGauge, resourcesScannedCounter, resourcesMatchedCounter, resourcesDroppedCounter, resourceLimitExceededCounter, matchRuleCounter, regionSkippedCounter, rateLimitGauge, serviceTagKeysGauge, resourceAgeHistogram, apiGatewayCacheHitsCounter} {
+		if err := registry.Register(collector); err != nil {
+			log.Warning("Could not publish job metric")
+		}
+	}
+	if err := registry.Register(credentialsExpiry); err != nil {
+		log.Warning("Could not publish credentials expiry metric")
+	}
+	return err
 }
 
 func main() {
@@ -108,14 +200,38 @@ func main() {
 	}
 
 	log.Println("Parse config..")
-	if err := config.load(configFile); err != nil {
+	if err := reloadConfig(*configFile); err != nil {
 		log.Fatal("Couldn't read ", *configFile, ": ", err)
 	}
 
+	// Pick up new jobs without restarting, an invalid configuration keeps the current one
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Reload config..")
+			if err := reloadConfig(*configFile); err != nil {
+				log.Error("Couldn't reload ", *configFile, ", keeping the current config: ", err)
+				continue
+			}
+			log.Println("Config reloaded")
+		}
+	}()
+
 	cloudwatchSemaphore = make(chan struct{}, *cloudwatchConcurrency)
 	tagSemaphore = make(chan struct{}, *tagConcurrency)
+	if *maxConcurrentRegions > 0 {
+		regionSemaphore = make(chan struct{}, *maxConcurrentRegions)
+	}
 
-	registry := prometheus.NewRegistry()
+	if *dumpResourcesPath != "" {
+		if err := dumpResources(config, *dumpResourcesPath, *dumpFormat); err != nil {
+			log.Fatal("Couldn't dump the resources to ", *dumpResourcesPath, ": ", err)
+		}
+		os.Exit(0)
+	}
+
+	scrape := &lastScrape{registry: prometheus.NewRegistry()}
 
 	log.Println("Startup completed")
 
@@ -123,9 +239,13 @@ func main() {
 		go func() {
 			for {
 				newRegistry := prometheus.NewRegistry()
-				updateMetrics(newRegistry)
+				err := updateMetrics(newRegistry)
+				if discoveryCtx.Err() != nil {
+					// Keep serving the last complete scrape until the exporter exits
+					return
+				}
 				log.Debug("Metrics scraped.")
-				registry = newRegistry
+				scrape.set(newRegistry, err)
 				time.Sleep(time.Duration(*scrapingInterval) * time.Second)
 			}
 		}()
@@ -142,17 +262,38 @@ func main() {
 	})
 
 	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		registry, scrapeErr := scrape.get()
 		if !(*decoupledScraping) {
-			newRegistry := prometheus.NewRegistry()
-			updateMetrics(newRegistry)
+			// Every request scrapes on its own, the registry isn't shared
+			registry = prometheus.NewRegistry()
+			scrapeErr = updateMetrics(registry)
 			log.Debug("Metrics scraped.")
-			registry = newRegistry
 		}
-		handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
-			DisableCompression: false,
-		})
-		handler.ServeHTTP(w, r)
+		if *strictScrape && scrapeErr != nil {
+			http.Error(w, "Scrape failed: "+scrapeErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		metricsHandler(registry).ServeHTTP(w, r)
 	})
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	server := &http.Server{Addr: *addr}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Let the scrapes in progress finish their pages instead of cutting them off
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	<-term
+	log.Println("Shutting down..")
+	if !scrapes.drain(cancelDiscovery, *shutdownGracePeriod) {
+		log.Warning("Scrapes still in progress after the grace period of ", *shutdownGracePeriod)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warning("Could not close the open connections: ", err)
+	}
 }
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"net/http"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -37,14 +42,245 @@ var (
 		Name: "yace_cloudwatch_ec2api_requests_total",
 		Help: "Help is not implemented yet.",
 	})
+	appSyncAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_appsyncapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	efsAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_efsapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	iotAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_iotapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	rdsAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_rdsapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	fsxAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_fsxapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	firehoseAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_firehoseapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	elastiCacheAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_elasticacheapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	organizationsAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_organizationsapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	elbv2APICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_elbv2api_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	cloudFrontAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_cloudfrontapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	wafAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_wafapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	iamAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_iamapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	comprehendAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_comprehendapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	resourceGroupsAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_resourcegroupsapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	syntheticsAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_syntheticsapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	guardDutyAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_guarddutyapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	shieldAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_shieldapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	bedrockAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_bedrockapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	drsAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_drsapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	grafanaAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_grafanaapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	lambdaAPICounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_cloudwatch_lambdaapi_requests_total",
+		Help: "Help is not implemented yet.",
+	})
+	apiGatewayCacheHitsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "yace_apigateway_cache_hits_total",
+		Help: "Number of apigateway discoveries which reused the cached REST APIs instead of listing them.",
+	})
+	jobsConfiguredGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "yace_jobs_configured",
+		Help: "Number of discovery jobs in the configuration.",
+	})
+	jobsSucceededGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yace_jobs_succeeded",
+		Help: "Number of discovery job runs (per role and region) which discovered at least one resource.",
+	}, []string{"service"})
+	resourcesScannedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yace_resources_scanned_total",
+		Help: "Number of discovered resources checked against the search tags of their job.",
+	}, []string{"service"})
+	resourcesMatchedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yace_resources_matched_total",
+		Help: "Number of discovered resources matching the search tags of their job.",
+	}, []string{"service"})
+	resourcesDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yace_resources_dropped_total",
+		Help: "Number of discovered resources dropped before their metrics were requested, by reason.",
+	}, []string{"service", "reason"})
+	matchRuleCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yace_match_rule_total",
+		Help: "Number of discovered resources checked against each search tag of their job, by how the tag matched (exact, regex, glob or none). Only counted with -debug-match-rules.",
+	}, []string{"service", "rule", "match"})
+	resourceLimitExceededCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yace_job_resource_limit_exceeded_total",
+		Help: "Number of discovery job runs which found more resources than their maxResources, the others were left out.",
+	}, []string{"service"})
+	regionSkippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yace_region_skipped_total",
+		Help: "Number of discovery job runs skipped because the region is not enabled for the account, by reason.",
+	}, []string{"region", "reason"})
+	rateLimitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yace_rate_limit_requests_per_second",
+		Help: "Requests per second the discovery requests to the API are limited to.",
+	}, []string{"api"})
+	serviceTagKeysGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yace_service_tag_keys",
+		Help: "Number of distinct tag keys of the discovered resources, each one is a label of the info metric of the service.",
+	}, []string{"service"})
+	discoveryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "yace_discovery_duration_seconds",
+		Help:    "Time spent discovering the resources of a service in a region, including describe based workarounds.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"service", "region"})
+	serviceLastSuccessGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yace_service_last_success_timestamp_seconds",
+		Help: "Unix time of the last discovery of a service in a region which succeeded, including its describe based workarounds.",
+	}, []string{"service", "region"})
+	resourceAgeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "yace_resource_age_seconds",
+		Help: "Age of the discovered resources whose creation time is read during the discovery.",
+		// 1 hour, 1 day, 1 week, 30 days, 90 days, 180 days, 1 year and 2 years
+		Buckets: []float64{3600, 86400, 604800, 2592000, 7776000, 15552000, 31536000, 63072000},
+	}, []string{"service"})
 )
 
+// The ages of the resources discovered by the running scrape, published at its end so the histogram describes the
+// resources of the last scrape instead of accumulating every scrape
+var resourceAges = struct {
+	sync.Mutex
+	ages map[string][]float64
+}{ages: make(map[string][]float64)}
+
+// Observe the age of a discovered resource, resources without a creation time are skipped
+func observeResourceAge(service string, createdAt *time.Time) {
+	if createdAt != nil {
+		resourceAges.Lock()
+		resourceAges.ages[service] = append(resourceAges.ages[service], time.Since(*createdAt).Seconds())
+		resourceAges.Unlock()
+	}
+}
+
+// Replace the histogram with the ages observed since the last scrape
+func publishResourceAges() {
+	resourceAges.Lock()
+	defer resourceAges.Unlock()
+	resourceAgeHistogram.Reset()
+	for service, ages := range resourceAges.ages {
+		for _, age := range ages {
+			resourceAgeHistogram.WithLabelValues(service).Observe(age)
+		}
+	}
+	resourceAges.ages = make(map[string][]float64)
+}
+
+var credentialsExpiry = newCredentialsExpiryCollector()
+
+// Exposes the seconds until the assumed role credentials expire, negative once they lapsed without being refreshed
+type credentialsExpiryCollector struct {
+	mux         sync.Mutex
+	desc        *prometheus.Desc
+	credentials map[string]*credentials.Credentials
+	expiry      map[string]time.Time
+}
+
+func newCredentialsExpiryCollector() *credentialsExpiryCollector {
+	return &credentialsExpiryCollector{
+		desc: prometheus.NewDesc(
+			"yace_credentials_expiry_seconds",
+			"Seconds until the credentials of the assumed role expire.",
+			[]string{"role_arn"},
+			nil,
+		),
+		credentials: make(map[string]*credentials.Credentials),
+		expiry:      make(map[string]time.Time),
+	}
+}
+
+// Remember the credentials shared by the clients of a role
+func (c *credentialsExpiryCollector) track(roleArn string, creds *credentials.Credentials) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.credentials[roleArn] = creds
+}
+
+func (c *credentialsExpiryCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- c.desc
+}
+
+func (c *credentialsExpiryCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for roleArn, creds := range c.credentials {
+		// Credentials which were never retrieved have no expiry, keep the last known one instead
+		if expiresAt, err := creds.ExpiresAt(); err == nil && !expiresAt.IsZero() {
+			c.expiry[roleArn] = expiresAt
+		}
+	}
+	for roleArn, expiresAt := range c.expiry {
+		metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Until(expiresAt).Seconds(), roleArn)
+	}
+}
+
 type PrometheusMetric struct {
 	name             *string
 	labels           map[string]string
 	value            *float64
 	includeTimestamp bool
 	timestamp        time.Time
+	// Must be the same for every metric with the same name, defaults to defaultHelp
+	help string
+}
+
+const defaultHelp = "Help is not implemented yet."
+
+func (metric *PrometheusMetric) helpText() string {
+	if metric.help == "" {
+		return defaultHelp
+	}
+	return metric.help
 }
 
 type PrometheusCollector struct {
@@ -72,7 +308,7 @@ func (p *PrometheusCollector) Collect(metrics chan<- prometheus.Metric) {
 func createDesc(metric *PrometheusMetric) *prometheus.Desc {
 	return prometheus.NewDesc(
 		*metric.name,
-		"Help is not implemented yet.",
+		metric.helpText(),
 		nil,
 		metric.labels,
 	)
@@ -81,7 +317,7 @@ func createDesc(metric *PrometheusMetric) *prometheus.Desc {
 func createMetric(metric *PrometheusMetric) prometheus.Metric {
 	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name:        *metric.name,
-		Help:        "Help is not implemented yet.",
+		Help:        metric.helpText(),
 		ConstLabels: metric.labels,
 	})
 
@@ -94,6 +330,34 @@ func createMetric(metric *PrometheusMetric) prometheus.Metric {
 	return prometheus.NewMetricWithTimestamp(metric.timestamp, gauge)
 }
 
+// Set the name label from the ID of the resource, keeping the full ID as arn label when it is shortened
+func (n nameLabel) apply(labels map[string]string, id string) {
+	name := id
+	if n.ResourceID {
+		// Last segment of the resource part, e.g. i-0123 of arn:aws:ec2:eu-west-1:123456789012:instance/i-0123
+		resource := id
+		if arnParsed, err := arn.Parse(id); err == nil {
+			resource = arnParsed.Resource
+		}
+		name = resource[strings.LastIndexAny(resource, ":/")+1:]
+	} else if n.StripPrefix != "" {
+		name = strings.TrimPrefix(id, n.StripPrefix)
+	}
+	labels["name"] = name
+	if n.ArnLabel {
+		labels["arn"] = id
+	}
+}
+
+// Add the static labels of the configuration, the labels of the resource (name, region, tag_*, ...) take precedence
+func addStaticLabels(labels map[string]string, staticLabels map[string]string) {
+	for name, value := range staticLabels {
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+}
+
 func removeDuplicatedMetrics(metrics []*PrometheusMetric) []*PrometheusMetric {
 	keys := make(map[string]bool)
 	filteredMetrics := []*PrometheusMetric{}
@@ -155,3 +419,11 @@ func splitString(text string) string {
 	splitRegexp := regexp.MustCompile(`([a-z0-9])([A-Z])`)
 	return splitRegexp.ReplaceAllString(text, `$1.$2`)
 }
+
+// Serve the metrics in the OpenMetrics format when the scraper accepts it, in the Prometheus text format otherwise.
+// Both are gzip compressed when the scraper accepts it, the large info metrics compress well
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type expiringProvider struct {
+	credentials.Expiry
+	err error
+}
+
+func (p *expiringProvider) Retrieve() (credentials.Value, error) {
+	if p.err != nil {
+		return credentials.Value{}, p.err
+	}
+	p.SetExpiration(time.Now().Add(time.Hour), 0)
+	return credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "SECRET", ProviderName: "test"}, nil
+}
+
+func TestCredentialsExpiryCollector(t *testing.T) {
+	// Setup Test
+	collector := newCredentialsExpiryCollector()
+	roleArn := "arn:aws:iam::123456789012:role/prometheus"
+
+	// Credentials which were never retrieved are not exported
+	collector.track(roleArn, credentials.NewCredentials(&expiringProvider{}))
+	if count := testutil.CollectAndCount(collector); count != 0 {
+		t.Fatalf("\nexpected: 0 metrics\nactual:  %d", count)
+	}
+
+	// Retrieved credentials export the seconds until they expire
+	creds := credentials.NewCredentials(&expiringProvider{})
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	collector.track(roleArn, creds)
+	expiry := testutil.ToFloat64(collector)
+	if expiry <= 3500 || expiry > 3600 {
+		t.Fatalf("\nexpected: about 3600 seconds\nactual:  %f", expiry)
+	}
+
+	// Newer credentials which fail to refresh keep the last known expiry
+	collector.track(roleArn, credentials.NewCredentials(&expiringProvider{err: credentials.ErrNoValidProvidersFoundInChain}))
+	if actual := testutil.ToFloat64(collector); actual > expiry || actual <= 3500 {
+		t.Fatalf("\nexpected: the last known expiry\nactual:  %f", actual)
+	}
+}
+
+func TestInfoMetricMetadata(t *testing.T) {
+	// Setup Test
+	id := "arn:aws:ec2:eu-west-1:123456789012:instance/i-someid"
+	service := "ec2"
+	metrics := migrateTagsToPrometheus([]*tagsData{{ID: &id, Service: &service}})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusCollector(metrics))
+
+	// Act
+	families, err := registry.Gather()
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("\nexpected: 1 metric family\nactual:  %d", len(families))
+	}
+	if help := families[0].GetHelp(); help != "Tags of the discovered ec2 resources (AWS/EC2), the name label joins them to their metrics." {
+		t.Fatalf("unexpected help: %q", help)
+	}
+	if metricType := families[0].GetType().String(); metricType != "GAUGE" {
+		t.Fatalf("\nexpected: GAUGE\nactual:  %s", metricType)
+	}
+}
+
+func TestInfoMetricHelpText(t *testing.T) {
+	// Setup Test
+	config = conf{Discovery: discovery{Jobs: []job{
+		{Type: "ec2"},
+		{Type: "ec2", HelpText: "Instances of the platform team, tag_team is the owning squad."},
+		{Type: "ec2", HelpText: "Ignored, the first help text of the service wins."},
+	}}}
+	defer func() { config = conf{} }()
+	ec2ID, rdsID := "arn:aws:ec2:eu-west-1:123456789012:instance/i-someid", "arn:aws:rds:eu-west-1:123456789012:db:main"
+	ec2, rds := "ec2", "rds"
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusCollector(migrateTagsToPrometheus([]*tagsData{{ID: &ec2ID, Service: &ec2}, {ID: &rdsID, Service: &rds}})))
+	recorder := httptest.NewRecorder()
+
+	// Act
+	metricsHandler(registry).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	// Assert
+	for _, expected := range []string{
+		"# HELP aws_ec2_info Instances of the platform team, tag_team is the owning squad.\n",
+		// Jobs without help text keep the default
+		"# HELP aws_rds_info Tags of the discovered rds resources (AWS/RDS), the name label joins them to their metrics.\n",
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Fatalf("\nexpected: %s\nactual:  %s", expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	// Setup Test
+	registry := prometheus.NewRegistry()
+	infoName, metricName := "aws_ec2_info", "aws_ec2_cpuutilization_average"
+	info, value := 0.0, 12.5
+	registry.MustRegister(NewPrometheusCollector([]*PrometheusMetric{
+		{name: &infoName, labels: map[string]string{"name": "arn:aws:ec2:eu-west-1:123456789012:instance/i-1", "tag_Name": `web "a"`}, value: &info, help: "Info of the ec2 resources"},
+		{name: &metricName, labels: map[string]string{"name": "arn:aws:ec2:eu-west-1:123456789012:instance/i-1"}, value: &value},
+	}))
+
+	for _, tc := range []struct {
+		accept      string
+		contentType string
+		expected    []string
+	}{
+		{
+			accept:      "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5",
+			contentType: "application/openmetrics-text",
+			expected: []string{
+				"# HELP aws_ec2_info Info of the ec2 resources\n# TYPE aws_ec2_info gauge\n",
+				`aws_ec2_info{name="arn:aws:ec2:eu-west-1:123456789012:instance/i-1",tag_Name="web \"a\""} 0.0` + "\n",
+				"# TYPE aws_ec2_cpuutilization_average gauge\n",
+				`aws_ec2_cpuutilization_average{name="arn:aws:ec2:eu-west-1:123456789012:instance/i-1"} 12.5` + "\n",
+				"# EOF\n",
+			},
+		},
+		{
+			accept:      "",
+			contentType: "text/plain",
+			expected: []string{
+				"# TYPE aws_ec2_info gauge\n",
+				`aws_ec2_info{name="arn:aws:ec2:eu-west-1:123456789012:instance/i-1",tag_Name="web \"a\""} 0` + "\n",
+			},
+		},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.accept != "" {
+			request.Header.Set("Accept", tc.accept)
+		}
+		recorder := httptest.NewRecorder()
+
+		// Act
+		metricsHandler(registry).ServeHTTP(recorder, request)
+
+		// Assert
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, tc.contentType) {
+			t.Fatalf("\nexpected: %s\nactual:  %s", tc.contentType, contentType)
+		}
+		for _, expected := range tc.expected {
+			if !strings.Contains(recorder.Body.String(), expected) {
+				t.Fatalf("\nexpected: %s\nactual:  %s", expected, recorder.Body.String())
+			}
+		}
+	}
+}
+
+func TestMetricsHandlerGzip(t *testing.T) {
+	// Setup Test
+	registry := prometheus.NewRegistry()
+	infoName := "aws_ec2_info"
+	info := 0.0
+	registry.MustRegister(NewPrometheusCollector([]*PrometheusMetric{
+		{name: &infoName, labels: map[string]string{"name": "arn:aws:ec2:eu-west-1:123456789012:instance/i-1"}, value: &info},
+	}))
+	expected := `aws_ec2_info{name="arn:aws:ec2:eu-west-1:123456789012:instance/i-1"}`
+
+	for _, accept := range []string{"", "application/openmetrics-text; version=0.0.1"} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept-Encoding", "gzip, deflate")
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+
+		// Act
+		metricsHandler(registry).ServeHTTP(recorder, request)
+
+		// Assert
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("\nexpected: gzip\nactual:  %s", encoding)
+		}
+		reader, err := gzip.NewReader(recorder.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("\nexpected: %s\nactual:  %s", expected, body)
+		}
+	}
+}
+
+func TestNameLabel(t *testing.T) {
+	for _, tc := range []struct {
+		nameLabel nameLabel
+		id        string
+		expected  map[string]string
+	}{
+		{nameLabel{}, "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123", map[string]string{"name": "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123"}},
+		{nameLabel{ResourceID: true}, "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123", map[string]string{"name": "i-0123"}},
+		{nameLabel{ResourceID: true}, "arn:aws:sqs:eu-west-1:123456789012:orders", map[string]string{"name": "orders"}},
+		{nameLabel{ResourceID: true}, "arn:aws:rds:eu-west-1:123456789012:db:orders-primary", map[string]string{"name": "orders-primary"}},
+		{nameLabel{ResourceID: true}, "arn:aws:s3:::assets", map[string]string{"name": "assets"}},
+		{nameLabel{ResourceID: true}, "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/web/0123456789abcdef", map[string]string{"name": "0123456789abcdef"}},
+		{nameLabel{ResourceID: true}, "tgw-0123/tgw-attach-4567", map[string]string{"name": "tgw-attach-4567"}},
+		{nameLabel{StripPrefix: "arn:aws:ec2:eu-west-1:123456789012:"}, "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123", map[string]string{"name": "instance/i-0123"}},
+		{nameLabel{StripPrefix: "arn:aws:ec2:eu-west-1:123456789012:"}, "arn:aws-cn:ec2:cn-north-1:123456789012:instance/i-0123", map[string]string{"name": "arn:aws-cn:ec2:cn-north-1:123456789012:instance/i-0123"}},
+		{nameLabel{ResourceID: true, ArnLabel: true}, "arn:aws:lambda:eu-west-1:123456789012:function:checkout", map[string]string{"name": "checkout", "arn": "arn:aws:lambda:eu-west-1:123456789012:function:checkout"}},
+	} {
+		// Arrange
+		labels := make(map[string]string)
+
+		// Act
+		tc.nameLabel.apply(labels, tc.id)
+
+		// Assert
+		if len(labels) != len(tc.expected) || labels["name"] != tc.expected["name"] || labels["arn"] != tc.expected["arn"] {
+			t.Errorf("%+v %s\nexpected: %v\nactual:  %v", tc.nameLabel, tc.id, tc.expected, labels)
+		}
+	}
+}
+
+func TestNameLabelOnInfoAndCloudWatchMetrics(t *testing.T) {
+	// Arrange
+	config.NameLabel = nameLabel{ResourceID: true, ArnLabel: true}
+	defer func() { config.NameLabel = nameLabel{} }()
+	id, service, region := "arn:aws:sqs:eu-west-1:123456789012:orders", "sqs", "eu-west-1"
+
+	// Act
+	infoLabels := migrateTagsToPrometheus([]*tagsData{{ID: &id, Service: &service, Region: &region}})[0].labels
+	metricLabels := createPrometheusLabels(&cloudwatchData{ID: &id, Service: &service, Region: &region})
+
+	// Assert
+	for _, labels := range []map[string]string{infoLabels, metricLabels} {
+		if labels["name"] != "orders" || labels["arn"] != id {
+			t.Fatalf("\nexpected: name=orders arn=%s\nactual:  %v", id, labels)
+		}
+	}
+}
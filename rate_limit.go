@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// APIs of the discovery which can be rate limited, keyed like their request counters
+var rateLimitedAPIs = []string{
+	"apigateway",
+	"appsync",
+	"autoscaling",
+	"bedrock",
+	"cloudfront",
+	"comprehend",
+	"drs",
+	"ec2",
+	"efs",
+	"elasticache",
+	"elasticloadbalancing",
+	"firehose",
+	"fsx",
+	"grafana",
+	"guardduty",
+	"iot",
+	"lambda",
+	"rds",
+	"resourcegroups",
+	"resourcegroupstaggingapi",
+	"shield",
+	"synthetics",
+	"waf",
+}
+
+type rateLimit struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst"`
+}
+
+// Token bucket shared by every client of an API, independent of the role and region of the client
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(context.Context, time.Duration) error
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: limit.RequestsPerSecond, burst: burst, tokens: burst, now: time.Now, sleep: sleepContext}
+}
+
+// Sleep for the duration, or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Block until a request may be sent or the context is done, a nil limiter never blocks
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	// The token is taken right away, concurrent callers queue up behind the debt
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	if err := l.sleep(ctx, delay); err != nil {
+		// Give the token back so the callers queued behind it don't wait for a request that is never sent
+		l.Lock()
+		l.tokens++
+		l.Unlock()
+		return err
+	}
+	return nil
+}
+
+var rateLimiters = make(map[string]*rateLimiter)
+
+// Replace the rate limiters of the APIs with the configured ones
+func setupRateLimiters(limits map[string]rateLimit) {
+	rateLimiters = make(map[string]*rateLimiter)
+	rateLimitGauge.Reset()
+	for api, limit := range limits {
+		rateLimiters[api] = newRateLimiter(limit)
+		rateLimitGauge.WithLabelValues(api).Set(limit.RequestsPerSecond)
+	}
+}
+
+// Request option pacing every request to the API, including the pages and the retries of a paginator
+func withRateLimit(api string) request.Option {
+	return func(r *request.Request) {
+		limiter := rateLimiters[api]
+		if limiter == nil {
+			return
+		}
+		r.Handlers.Send.PushFront(func(r *request.Request) {
+			// A cancelled discovery stops waiting, the send then fails on the same context
+			limiter.wait(r.Context())
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Rate limiter with a fake clock which only advances while sleeping
+func newTestRateLimiter(limit rateLimit) (*rateLimiter, *time.Duration) {
+	var slept time.Duration
+	start := time.Unix(0, 0)
+	limiter := newRateLimiter(limit)
+	limiter.now = func() time.Time { return start.Add(slept) }
+	limiter.sleep = func(_ context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}
+	return limiter, &slept
+}
+
+func TestRateLimiterPacesCalls(t *testing.T) {
+	// Arrange
+	limiter, slept := newTestRateLimiter(rateLimit{RequestsPerSecond: 2, Burst: 3})
+
+	// Act
+	for i := 0; i < 7; i++ {
+		limiter.wait(context.Background())
+	}
+
+	// Assert
+	// The burst passes right away, the other 4 calls are spaced by half a second
+	if *slept != 2*time.Second {
+		t.Fatalf("\nexpected: %s\nactual:  %s", 2*time.Second, *slept)
+	}
+}
+
+func TestRateLimiterRefillsUpToBurst(t *testing.T) {
+	// Arrange
+	limiter, slept := newTestRateLimiter(rateLimit{RequestsPerSecond: 1, Burst: 2})
+	limiter.wait(context.Background())
+	limiter.wait(context.Background())
+	// Idle for longer than needed to refill the burst
+	limiter.sleep(context.Background(), 10*time.Second)
+
+	// Act
+	for i := 0; i < 3; i++ {
+		limiter.wait(context.Background())
+	}
+
+	// Assert
+	if *slept != 11*time.Second {
+		t.Fatalf("\nexpected: %s\nactual:  %s", 11*time.Second, *slept)
+	}
+}
+
+func TestRateLimiterStopsWaitingWhenCancelled(t *testing.T) {
+	// Arrange
+	limiter := newRateLimiter(rateLimit{RequestsPerSecond: 0.001})
+	limiter.wait(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Act
+	start := time.Now()
+	err := limiter.wait(ctx)
+
+	// Assert
+	if err != context.Canceled {
+		t.Fatalf("\nexpected: %v\nactual:  %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("\nexpected: the wait to return right away\nactual:  waited %s", elapsed)
+	}
+	// The token of the cancelled wait is given back
+	if limiter.tokens < -0.01 {
+		t.Fatalf("\nexpected: 0 tokens\nactual:  %f", limiter.tokens)
+	}
+}
+
+func TestWithRateLimitPacesRequests(t *testing.T) {
+	// Arrange
+	setupRateLimiters(map[string]rateLimit{"resourcegroupstaggingapi": {RequestsPerSecond: 5}})
+	defer setupRateLimiters(nil)
+	limiter, slept := newTestRateLimiter(rateLimit{RequestsPerSecond: 5})
+	rateLimiters["resourcegroupstaggingapi"] = limiter
+
+	// Act
+	for i := 0; i < 3; i++ {
+		r := &request.Request{}
+		r.ApplyOptions(withRateLimit("resourcegroupstaggingapi"), withRateLimit("ec2"))
+		r.Handlers.Send.Run(r)
+	}
+
+	// Assert
+	if *slept != 400*time.Millisecond {
+		t.Fatalf("\nexpected: %s\nactual:  %s", 400*time.Millisecond, *slept)
+	}
+	if rps := testutil.ToFloat64(rateLimitGauge.WithLabelValues("resourcegroupstaggingapi")); rps != 5 {
+		t.Fatalf("\nexpected: 5 requests per second\nactual:  %f", rps)
+	}
+}
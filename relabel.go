@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+
+	// The name of the metric can be used as source label like in Prometheus, but is never changed
+	relabelMetricName = "__name__"
+)
+
+// Subset of the relabel_config of Prometheus, applied to every exported metric
+type relabelConfig struct {
+	SourceLabels []string `yaml:"sourceLabels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	TargetLabel  string   `yaml:"targetLabel"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+func (r relabelConfig) validate() error {
+	if _, err := regexp.Compile(r.Regex); err != nil {
+		return fmt.Errorf("Invalid regex: %v", err)
+	}
+	switch r.action() {
+	case relabelReplace:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("TargetLabel should not be empty for action %s", relabelReplace)
+		}
+		if !strings.Contains(r.TargetLabel, "$") && !labelNameRegex.MatchString(r.TargetLabel) {
+			return fmt.Errorf("TargetLabel: %s is not a valid label name", r.TargetLabel)
+		}
+	case relabelKeep, relabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("SourceLabels should not be empty for action %s", r.Action)
+		}
+	case relabelLabelDrop:
+	default:
+		return fmt.Errorf("Action should be %s, %s, %s or %s", relabelReplace, relabelKeep, relabelDrop, relabelLabelDrop)
+	}
+	return nil
+}
+
+func (r relabelConfig) action() string {
+	if r.Action == "" {
+		return relabelReplace
+	}
+	return r.Action
+}
+
+// Like Prometheus the regex has to match the whole value, a validated config never fails to compile
+func (r relabelConfig) regex() *regexp.Regexp {
+	regex := r.Regex
+	if regex == "" {
+		regex = "(.*)"
+	}
+	return regexp.MustCompile("^(?:" + regex + ")$")
+}
+
+// Apply the rules in order to the labels of every metric, dropping the metrics which are not kept
+func relabelMetrics(metrics []*PrometheusMetric, configs []relabelConfig) []*PrometheusMetric {
+	if len(configs) == 0 {
+		return metrics
+	}
+	regexes := make([]*regexp.Regexp, len(configs))
+	for i, c := range configs {
+		regexes[i] = c.regex()
+	}
+
+	var output []*PrometheusMetric
+	for _, metric := range metrics {
+		keep := true
+		for i, c := range configs {
+			if keep = c.apply(metric, regexes[i]); !keep {
+				break
+			}
+		}
+		if keep {
+			output = append(output, metric)
+		}
+	}
+
+	// The rules may change the labels of some metrics of a name only, they all get the labels of any of them
+	labelNames := make(map[string]map[string]string)
+	for _, metric := range output {
+		if labelNames[*metric.name] == nil {
+			labelNames[*metric.name] = make(map[string]string)
+		}
+		for name := range metric.labels {
+			labelNames[*metric.name][name] = ""
+		}
+	}
+	for _, metric := range output {
+		if metric.labels == nil {
+			metric.labels = make(map[string]string)
+		}
+		for name := range labelNames[*metric.name] {
+			if _, ok := metric.labels[name]; !ok {
+				metric.labels[name] = ""
+			}
+		}
+	}
+	for metricName, names := range labelNames {
+		if len(names) > 0 {
+			recordLabelsForMetric(metricName, names)
+		}
+	}
+	return output
+}
+
+// Returns whether the metric is kept
+func (r relabelConfig) apply(metric *PrometheusMetric, regex *regexp.Regexp) bool {
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, name := range r.SourceLabels {
+		if name == relabelMetricName {
+			values = append(values, *metric.name)
+		} else {
+			values = append(values, metric.labels[name])
+		}
+	}
+	separator := r.Separator
+	if separator == "" {
+		separator = ";"
+	}
+	value := strings.Join(values, separator)
+
+	switch r.action() {
+	case relabelKeep:
+		return regex.MatchString(value)
+	case relabelDrop:
+		return !regex.MatchString(value)
+	case relabelLabelDrop:
+		for name := range metric.labels {
+			if regex.MatchString(name) {
+				delete(metric.labels, name)
+			}
+		}
+	case relabelReplace:
+		match := regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return true
+		}
+		replacement := r.Replacement
+		if replacement == "" {
+			replacement = "$1"
+		}
+		target := string(regex.ExpandString(nil, r.TargetLabel, value, match))
+		if !labelNameRegex.MatchString(target) || target == relabelMetricName {
+			return true
+		}
+		result := string(regex.ExpandString(nil, replacement, value, match))
+		if result == "" {
+			delete(metric.labels, target)
+		} else {
+			if metric.labels == nil {
+				metric.labels = make(map[string]string)
+			}
+			metric.labels[target] = result
+		}
+	}
+	return true
+}
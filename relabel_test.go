@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRelabelMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		configs  []relabelConfig
+		labels   map[string]string
+		expected map[string]string // nil when the metric is dropped
+	}{
+		{
+			name:     "replace extracts a label from the ARN",
+			configs:  []relabelConfig{{SourceLabels: []string{"name"}, Regex: `arn:aws:ec2:[^:]+:(\d+):.*`, TargetLabel: "account"}},
+			labels:   map[string]string{"name": "arn:aws:ec2:eu-west-1:123456789012:instance/i-1"},
+			expected: map[string]string{"name": "arn:aws:ec2:eu-west-1:123456789012:instance/i-1", "account": "123456789012"},
+		},
+		{
+			name:     "replace joins the source labels with the separator",
+			configs:  []relabelConfig{{SourceLabels: []string{"tag_Team", "tag_Env"}, Separator: "-", TargetLabel: "team", Replacement: "team-$1"}},
+			labels:   map[string]string{"tag_Team": "core", "tag_Env": "prod"},
+			expected: map[string]string{"tag_Team": "core", "tag_Env": "prod", "team": "team-core-prod"},
+		},
+		{
+			name:     "replace has to match the whole value",
+			configs:  []relabelConfig{{SourceLabels: []string{"tag_Team"}, Regex: "cor", TargetLabel: "team"}},
+			labels:   map[string]string{"tag_Team": "core"},
+			expected: map[string]string{"tag_Team": "core"},
+		},
+		{
+			name:     "replace with an empty result removes the target label",
+			configs:  []relabelConfig{{SourceLabels: []string{"tag_Team"}, TargetLabel: "team"}},
+			labels:   map[string]string{"team": "old"},
+			expected: map[string]string{},
+		},
+		{
+			name:     "replace expands the target label",
+			configs:  []relabelConfig{{SourceLabels: []string{"tag_Key"}, Regex: "(.+)=(.+)", TargetLabel: "x_$1", Replacement: "$2"}},
+			labels:   map[string]string{"tag_Key": "team=core"},
+			expected: map[string]string{"tag_Key": "team=core", "x_team": "core"},
+		},
+		{
+			name:     "keep drops the metrics which don't match",
+			configs:  []relabelConfig{{SourceLabels: []string{"tag_Env"}, Regex: "prod|staging", Action: "keep"}},
+			labels:   map[string]string{"tag_Env": "dev"},
+			expected: nil,
+		},
+		{
+			name:     "keep matches the metric name",
+			configs:  []relabelConfig{{SourceLabels: []string{"__name__"}, Regex: "aws_ec2_.*", Action: "keep"}},
+			labels:   map[string]string{"tag_Env": "dev"},
+			expected: map[string]string{"tag_Env": "dev"},
+		},
+		{
+			name:     "drop drops the metrics which match",
+			configs:  []relabelConfig{{SourceLabels: []string{"tag_Env"}, Regex: "dev", Action: "drop"}},
+			labels:   map[string]string{"tag_Env": "dev"},
+			expected: nil,
+		},
+		{
+			name:     "labeldrop removes the labels whose name matches",
+			configs:  []relabelConfig{{Regex: "tag_.*", Action: "labeldrop"}},
+			labels:   map[string]string{"name": "i-1", "tag_Env": "dev", "tag_Team": "core"},
+			expected: map[string]string{"name": "i-1"},
+		},
+		{
+			name: "rules are applied in order",
+			configs: []relabelConfig{
+				{SourceLabels: []string{"tag_Team"}, TargetLabel: "team"},
+				{Regex: "tag_Team", Action: "labeldrop"},
+				{SourceLabels: []string{"team"}, Regex: "core", Action: "drop"},
+			},
+			labels:   map[string]string{"tag_Team": "core"},
+			expected: nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Setup Test
+			name := "aws_ec2_cpuutilization_average"
+			value := 1.0
+			metrics := []*PrometheusMetric{{name: &name, labels: tc.labels, value: &value}}
+
+			// Act
+			output := relabelMetrics(metrics, tc.configs)
+
+			// Assert
+			if tc.expected == nil {
+				if len(output) != 0 {
+					t.Fatalf("\nexpected: the metric to be dropped\nactual:  %v", output[0].labels)
+				}
+				return
+			}
+			if len(output) != 1 || !reflect.DeepEqual(output[0].labels, tc.expected) {
+				t.Fatalf("\nexpected: %v\nactual:  %v", tc.expected, output)
+			}
+		})
+	}
+}
+
+func TestRelabelExportedMetrics(t *testing.T) {
+	// Setup Test
+	defer func() { config = conf{} }()
+	config = conf{RelabelConfigs: []relabelConfig{
+		{SourceLabels: []string{"tag_Team"}, Regex: "core", TargetLabel: "owner", Replacement: "platform"},
+		{Regex: "tag_Env", Action: "labeldrop"},
+	}}
+	service := "ec2"
+	core, web := "arn:aws:ec2:eu-west-1:123456789012:instance/i-1", "arn:aws:ec2:eu-west-1:123456789012:instance/i-2"
+	tagsData := []*tagsData{
+		{ID: &core, Service: &service, Tags: []*tag{{Key: "Team", Value: "core"}, {Key: "Env", Value: "prod"}}},
+		{ID: &web, Service: &service, Tags: []*tag{{Key: "Team", Value: "web"}, {Key: "Env", Value: "prod"}}},
+	}
+
+	// Act
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPrometheusCollector(prometheusMetrics(tagsData, nil)))
+	families, err := registry.Gather()
+
+	// Assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("\nexpected: 2 aws_ec2_info metrics\nactual:  %v", families)
+	}
+	for _, metric := range families[0].Metric {
+		labels := make(map[string]string)
+		for _, label := range metric.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		// The label added by the rule is kept, the dropped one isn't added back
+		expected := map[string]string{"name": labels["name"], "tag_Team": labels["tag_Team"], "owner": ""}
+		if labels["tag_Team"] == "core" {
+			expected["owner"] = "platform"
+		}
+		if !reflect.DeepEqual(labels, expected) {
+			t.Fatalf("\nexpected: %v\nactual:  %v", expected, labels)
+		}
+	}
+}
+
+func TestValidateRelabelConfigs(t *testing.T) {
+	for _, tc := range []struct {
+		relabel relabelConfig
+		valid   bool
+	}{
+		{relabelConfig{SourceLabels: []string{"name"}, TargetLabel: "team"}, true},
+		{relabelConfig{SourceLabels: []string{"name"}, TargetLabel: "x_$1"}, true},
+		{relabelConfig{SourceLabels: []string{"name"}, Action: "keep"}, true},
+		{relabelConfig{Regex: "tag_.*", Action: "labeldrop"}, true},
+		{relabelConfig{SourceLabels: []string{"name"}}, false},
+		{relabelConfig{SourceLabels: []string{"name"}, TargetLabel: "team-name"}, false},
+		{relabelConfig{SourceLabels: []string{"name"}, TargetLabel: "team", Regex: "("}, false},
+		{relabelConfig{Action: "drop"}, false},
+		{relabelConfig{Action: "hashmod"}, false},
+	} {
+		c := conf{Static: []static{{}}, RelabelConfigs: []relabelConfig{tc.relabel}}
+		if err := c.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: expected valid=%t, got error %v", tc.relabel, tc.valid, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cancelled on shutdown, so the discovery stops requesting further pages instead of being cut off mid-scrape
+var discoveryCtx, cancelDiscovery = context.WithCancel(context.Background())
+
+var scrapes = &scrapeTracker{}
+
+// Tracks the scrapes in progress, so a shutdown can wait for them to finish
+type scrapeTracker struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+// Register a scrape, returns false once the tracker is draining and no scrape may start
+func (t *scrapeTracker) start() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.draining {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *scrapeTracker) done() {
+	t.wg.Done()
+}
+
+// Cancel the discovery and wait for the scrapes in progress up to the grace period, returns whether they finished
+func (t *scrapeTracker) drain(cancel context.CancelFunc, grace time.Duration) bool {
+	t.Lock()
+	t.draining = true
+	t.Unlock()
+	cancel()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScrapeTrackerDrain(t *testing.T) {
+	// Setup Test
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker := &scrapeTracker{}
+	var finished int32
+	for i := 0; i < 3; i++ {
+		if !tracker.start() {
+			t.Fatal("expected the scrape to start")
+		}
+		go func() {
+			defer tracker.done()
+			// A paginator stops after the page in progress when its context is cancelled
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&finished, 1)
+		}()
+	}
+
+	// Act
+	drained := tracker.drain(cancel, time.Second)
+
+	// Assert
+	if !drained || atomic.LoadInt32(&finished) != 3 {
+		t.Fatalf("\nexpected: 3 scrapes drained\nactual:  %t %d", drained, atomic.LoadInt32(&finished))
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("\nexpected: %v\nactual:  %v", context.Canceled, ctx.Err())
+	}
+	if tracker.start() {
+		t.Fatal("expected no scrape to start while draining")
+	}
+}
+
+func TestScrapeTrackerDrainGracePeriod(t *testing.T) {
+	// Setup Test
+	_, cancel := context.WithCancel(context.Background())
+	tracker := &scrapeTracker{}
+	tracker.start()
+	defer tracker.done()
+
+	// Act
+	drained := tracker.drain(cancel, 10*time.Millisecond)
+
+	// Assert
+	if drained {
+		t.Fatal("expected a scrape ignoring the cancellation to outlast the grace period")
+	}
+}